@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/noperator/membrane/pkg/membrane"
+)
+
+// command is a membrane subcommand. Anything on the command line that
+// isn't a subcommand starts a new session.
+type command struct {
+	name  string
+	args  string // usage synopsis after the command name
+	short string
+	run   func(cmd *command, args []string) error
+}
+
+var commands = []command{
+	{"run", "[options] [-- command...]", "start a session (the default)", nil},
+	{"attach", "<session>", "reattach to a running session", runAttach},
+	{"exec", "<session> [-- command...]", "run a command (default: bash) in a running session", runExec},
+	{"ls", "[-a]", "list running sessions", runLs},
+	{"inspect", "<session>", "show a session's record", runInspect},
+	{"stop", "<session>", "stop a running session", runStop},
+	{"review", "<session>", "apply or discard the workspace changes of an ended --cow session", runReview},
+	{"import", "<session> [branch]", "import the commits of an ended mediate_git session onto a branch", runImport},
+	{"checkpoint", "[--rm] <session>", "save a running session to resume later", runCheckpoint},
+	{"resume", "[-d] <session>", "start a checkpointed session again", runResume},
+	{"allow", "--session <session> <rule>...", "add allow rules to a running session", runAllow},
+	{"revoke", "--session <session> <rule>...", "remove allow rules from a running session", runRevoke},
+	{"images", "export|import <file>", "move membrane's images between machines, e.g. to run --offline", runImages},
+	{"update", "[--check|--apply]", "show, or apply, the changes to membrane on its update channel", runUpdate},
+	{"gc", "", "remove what ended sessions left behind", runGC},
+	{"learn", "[options] [-- command...]", "run permissively and propose allow rules from observed traffic", runLearn},
+}
+
+// internalCommands are run by membrane itself and left out of the help.
+var internalCommands = []command{
+	{"__supervise", "<spec-file>", "own a session in the background", runSupervise},
+}
+
+func lookupCommand(name string) *command {
+	for _, list := range [][]command{commands, internalCommands} {
+		for i := range list {
+			if list[i].name == name {
+				return &list[i]
+			}
+		}
+	}
+	return nil
+}
+
+// newCommandFlags returns a flag set for cmd with usage output matching
+// the top-level help.
+func newCommandFlags(cmd *command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "membrane %s: %s.\n\n", cmd.name, cmd.short)
+		fmt.Fprintf(os.Stderr, "Usage: membrane %s %s\n", cmd.name, cmd.args)
+		if fs.HasFlags() {
+			fmt.Fprintf(os.Stderr, "\nOptions:\n")
+			fmt.Fprint(os.Stderr, fs.FlagUsages())
+		}
+	}
+	return fs
+}
+
+func runAllow(cmd *command, args []string) error {
+	fs := newCommandFlags(cmd)
+	session := fs.StringP("session", "s", "", "session ID or name")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *session == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("--session and at least one rule are required")
+	}
+	return membrane.AllowRules(*session, fs.Args())
+}
+
+func runRevoke(cmd *command, args []string) error {
+	fs := newCommandFlags(cmd)
+	session := fs.StringP("session", "s", "", "session ID or name")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *session == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("--session and at least one rule are required")
+	}
+	return membrane.RevokeRules(*session, fs.Args())
+}
+
+func runLearn(cmd *command, args []string) error {
+	fs := newCommandFlags(cmd)
+	apply := fs.Bool("apply", false, "write the proposed rules to the workspace .membrane.yaml")
+	noGlobalConfig := fs.Bool("no-global-config", false, "skip reading ~/.membrane/config.yaml")
+	noTrace := fs.Bool("no-trace", false, "disable Tracee eBPF sidecar")
+	noUpdate := fs.Bool("no-update", false, "skip checking for updates")
+	ignore := fs.StringArrayP("ignore", "i", []string{}, "ignore pattern (repeatable)")
+	readonly := fs.StringArrayP("readonly", "r", []string{}, "readonly pattern (repeatable)")
+	allow := fs.StringArrayP("allow", "a", []string{}, "allow rule the proposal starts from: hostname, IP, CIDR, or URL (repeatable)")
+	arg := fs.StringArray("arg", []string{}, "extra docker run argument (repeatable)")
+	host := fs.StringArray("host", []string{}, "static host override served by dns-proxy: name=IP[,IP...] (repeatable)")
+	dnsResolver := fs.String("dns-resolver", "", "default DNS resolver, comma-separated for failover (overrides config file)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cli := membrane.CLIOverrides{
+		Ignore:      *ignore,
+		Readonly:    *readonly,
+		Allow:       *allow,
+		Args:        *arg,
+		Hosts:       *host,
+		DNSResolver: *dnsResolver,
+	}
+	opts := membrane.Options{
+		NoUpdate:       *noUpdate,
+		Trace:          !*noTrace,
+		NoGlobalConfig: *noGlobalConfig,
+	}
+	return membrane.Learn(opts, *apply, fs.Args(), cli)
+}
+
+func runAttach(cmd *command, args []string) error {
+	session, err := parseSessionArg(cmd, args)
+	if err != nil {
+		return err
+	}
+	return membrane.Attach(session)
+}
+
+func runExec(cmd *command, args []string) error {
+	fs := newCommandFlags(cmd)
+	fs.SetInterspersed(false)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("a session ID or name is required")
+	}
+	command := fs.Args()[1:]
+	if len(command) > 0 && command[0] == "--" {
+		command = command[1:]
+	}
+	return membrane.Exec(fs.Arg(0), command)
+}
+
+func runLs(cmd *command, args []string) error {
+	fs := newCommandFlags(cmd)
+	all := fs.BoolP("all", "a", false, "include sessions that have ended")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	return membrane.ListSessions(*all)
+}
+
+func runInspect(cmd *command, args []string) error {
+	session, err := parseSessionArg(cmd, args)
+	if err != nil {
+		return err
+	}
+	return membrane.InspectSession(session)
+}
+
+func runStop(cmd *command, args []string) error {
+	session, err := parseSessionArg(cmd, args)
+	if err != nil {
+		return err
+	}
+	return membrane.StopSession(session)
+}
+
+func runReview(cmd *command, args []string) error {
+	session, err := parseSessionArg(cmd, args)
+	if err != nil {
+		return err
+	}
+	return membrane.ReviewSession(session)
+}
+
+func runImport(cmd *command, args []string) error {
+	fs := newCommandFlags(cmd)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return fmt.Errorf("a session ID or name is required")
+	}
+	return membrane.ImportCommits(fs.Arg(0), fs.Arg(1))
+}
+
+func runCheckpoint(cmd *command, args []string) error {
+	fs := newCommandFlags(cmd)
+	remove := fs.Bool("rm", false, "delete the session's checkpoint instead")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("a session ID or name is required")
+	}
+	if *remove {
+		return membrane.RemoveCheckpoint(fs.Arg(0))
+	}
+	return membrane.Checkpoint(fs.Arg(0))
+}
+
+func runResume(cmd *command, args []string) error {
+	fs := newCommandFlags(cmd)
+	detach := fs.BoolP("detach", "d", false, "resume in the background")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("a session ID or name is required")
+	}
+	return membrane.Resume(fs.Arg(0), *detach)
+}
+
+// parseSessionArg parses the arguments of a command that takes a single
+// session ID or name.
+func parseSessionArg(cmd *command, args []string) (string, error) {
+	fs := newCommandFlags(cmd)
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return "", fmt.Errorf("a session ID or name is required")
+	}
+	return fs.Arg(0), nil
+}
+
+func runSupervise(cmd *command, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: membrane %s %s", cmd.name, cmd.args)
+	}
+	return membrane.Supervise(args[0])
+}
+
+func runImages(cmd *command, args []string) error {
+	fs := newCommandFlags(cmd)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("export or import, and a file, are required")
+	}
+	switch fs.Arg(0) {
+	case "export":
+		return membrane.ExportImages(fs.Arg(1))
+	case "import":
+		return membrane.ImportImages(fs.Arg(1))
+	}
+	fs.Usage()
+	return fmt.Errorf("unknown images command %q", fs.Arg(0))
+}
+
+func runUpdate(cmd *command, args []string) error {
+	fs := newCommandFlags(cmd)
+	fs.Bool("check", false, "show the commits an update would bring in (the default)")
+	apply := fs.Bool("apply", false, "update, and rebuild the images")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	if fs.Changed("check") && *apply {
+		return fmt.Errorf("--check and --apply can't be combined")
+	}
+	return membrane.Update(*apply)
+}
+
+func runGC(cmd *command, args []string) error {
+	fs := newCommandFlags(cmd)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	return membrane.GC()
+}
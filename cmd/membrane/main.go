@@ -12,53 +12,95 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd := lookupCommand(os.Args[1]); cmd != nil && cmd.run == nil {
+			// `membrane run` is the default command spelled out.
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		} else if cmd != nil {
+			if err := cmd.run(cmd, os.Args[2:]); err != nil {
+				if errors.Is(err, flag.ErrHelp) {
+					return
+				}
+				exit(err)
+			}
+			return
+		}
+	}
+
 	noUpdate := flag.Bool("no-update", false, "skip checking for updates")
 	noTrace := flag.Bool("no-trace", false, "disable Tracee eBPF sidecar")
+	detach := flag.BoolP("detach", "d", false, "start the session in the background; reattach with membrane attach")
+	name := flag.String("name", "", "human-friendly session name, usable in place of the session ID")
 	noGlobalConfig := flag.Bool("no-global-config", false, "skip reading ~/.membrane/config.yaml (workspace and CLI flags still apply)")
 	traceLog := flag.String("trace-log", "", "path for trace log file (default: ~/.membrane/trace/<id>.jsonl.gz)")
 	ignore := flag.StringArrayP("ignore", "i", []string{}, "ignore pattern (repeatable)")
 	readonly := flag.StringArrayP("readonly", "r", []string{}, "readonly pattern (repeatable)")
 	allow := flag.StringArrayP("allow", "a", []string{}, "allow rule: hostname, IP, CIDR, or URL (repeatable)")
 	arg := flag.StringArray("arg", []string{}, "extra docker run argument (repeatable)")
-	dnsResolver := flag.String("dns-resolver", "", "DNS resolver (overrides config file)")
+	host := flag.StringArray("host", []string{}, "static host override served by dns-proxy: name=IP[,IP...] (repeatable)")
+	dnsResolver := flag.String("dns-resolver", "", "default DNS resolver, comma-separated for failover (overrides config file)")
+	mediateGit := flag.Bool("mediate-git", false, "let the agent commit to a private git directory and import its commits at exit")
+	offline := flag.Bool("offline", false, "use only what's already here: no updates, clones, pulls or image builds")
+	approve := flag.Bool("approve", false, "prompt to allow blocked requests instead of failing them (interactive only)")
+	timeout := flag.Duration("timeout", 0, "stop the agent after this long, e.g. 45m, and exit with the timeout exit code")
+	idleTimeout := flag.Duration("idle-timeout", 0, "stop the agent after this long with no terminal output, network or trace activity, and exit with the timeout exit code")
+	timeoutExitCode := flag.Int("timeout-exit-code", membrane.ExitTimeout, "exit code when membrane stops the agent for --timeout or --idle-timeout")
+	failureExitCode := flag.Int("failure-exit-code", membrane.ExitFailed, "exit code when membrane itself fails")
+	summaryJSON := flag.String("summary-json", "", "write a JSON summary of the session to this file when it ends")
+	cow := flag.Bool("cow", false, "give the agent a copy-on-write workspace and review its changes at exit")
+	worktree := flag.String("worktree", "", "run the agent in a new git worktree, on `branch` if given as --worktree=branch")
+	flag.Lookup("worktree").NoOptDefVal = membrane.WorktreeDefaultBranch
 	sessionIDFile := flag.String("session-id-file", "", "write session ID to this file on startup (for test harnesses)")
 	var reset stringFlag
 	flag.Var(&reset, "reset", "remove membrane state and exit (c=containers, i=image, d=directory)")
 	flag.Lookup("reset").NoOptDefVal = "cid"
 	optionFlags := flag.NewFlagSet("", flag.ContinueOnError)
-	for _, name := range []string{"no-global-config", "no-trace", "no-update", "reset", "session-id-file", "trace-log"} {
+	for _, name := range []string{"cow", "detach", "failure-exit-code", "idle-timeout", "name", "no-global-config", "no-trace", "no-update", "reset", "session-id-file", "summary-json", "timeout", "timeout-exit-code", "trace-log", "worktree"} {
 		optionFlags.AddFlag(flag.Lookup(name))
 	}
 	configFlags := flag.NewFlagSet("", flag.ContinueOnError)
-	for _, name := range []string{"ignore", "readonly", "allow", "arg", "dns-resolver"} {
+	for _, name := range []string{"ignore", "readonly", "allow", "approve", "arg", "host", "dns-resolver", "mediate-git", "offline"} {
 		configFlags.AddFlag(flag.Lookup(name))
 	}
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "membrane: Selectively permeable boundary for AI agents.\n\n")
 		fmt.Fprintf(os.Stderr, "A lightweight, agent-agnostic, cross-platform sandbox that gives you\n")
 		fmt.Fprintf(os.Stderr, "real-time visibility into everything that your agent does.\n\n")
-		fmt.Fprintf(os.Stderr, "Usage: membrane [options] [-- command...]\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: membrane [run] [options] [-- command...]\n")
+		fmt.Fprintf(os.Stderr, "       membrane <command> [args]\n\n")
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		for _, cmd := range commands {
+			fmt.Fprintf(os.Stderr, "  %-11s %s\n", cmd.name, cmd.short)
+		}
+		fmt.Fprintf(os.Stderr, "\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		fmt.Fprint(os.Stderr, optionFlags.FlagUsages())
 		fmt.Fprintf(os.Stderr, "\nConfig:\n")
 		fmt.Fprint(os.Stderr, configFlags.FlagUsages())
 	}
 	flag.Parse()
+	codes := membrane.ExitCodes{Timeout: *timeoutExitCode, Failed: *failureExitCode}
+	if err := codes.Validate(); err != nil {
+		exit(err)
+	}
+	exitCodes = codes
 
-	for _, arg := range os.Args[1:] {
+	for i, arg := range os.Args[1:] {
 		if arg == "--" {
 			break
 		}
 		if !strings.HasPrefix(arg, "-") {
-			fmt.Fprintf(os.Stderr, "membrane: unexpected argument %q\n", arg)
-			os.Exit(1)
+			// The branch is optional, so it can't be a separate argument.
+			if os.Args[i] == "--worktree" {
+				exit(fmt.Errorf("unexpected argument %q; give a worktree branch as --worktree=%s", arg, arg))
+			}
+			exit(fmt.Errorf("unexpected argument %q", arg))
 		}
 	}
 
 	if isFlagPassed("reset") {
 		if err := membrane.Reset(reset.val); err != nil {
-			fmt.Fprintf(os.Stderr, "membrane: %v\n", err)
-			os.Exit(1)
+			exit(err)
 		}
 		return
 	}
@@ -68,17 +110,53 @@ func main() {
 		Readonly:    *readonly,
 		Allow:       *allow,
 		Args:        *arg,
+		Hosts:       *host,
 		DNSResolver: *dnsResolver,
+		Approve:     *approve,
+		MediateGit:  *mediateGit,
+		Offline:     *offline,
 	}
 
-	if err := membrane.Run(*noUpdate, !*noTrace, *noGlobalConfig, *traceLog, *sessionIDFile, flag.Args(), cli); err != nil {
-		var exitErr *membrane.ExitError
-		if errors.As(err, &exitErr) {
-			os.Exit(exitErr.Code)
+	opts := membrane.Options{
+		NoUpdate:       *noUpdate,
+		Trace:          !*noTrace,
+		NoGlobalConfig: *noGlobalConfig,
+		Detach:         *detach,
+		Name:           *name,
+		TraceLog:       *traceLog,
+		SessionIDFile:  *sessionIDFile,
+		Timeout:        *timeout,
+		IdleTimeout:    *idleTimeout,
+		SummaryJSON:    *summaryJSON,
+		Cow:            *cow,
+		Worktree:       *worktree,
+		ExitCodes:      codes,
+	}
+	if err := membrane.Run(opts, flag.Args(), cli); err != nil {
+		exit(err)
+	}
+}
+
+// exitCodes are membrane's own exit codes, from --timeout-exit-code and
+// --failure-exit-code.
+var exitCodes = membrane.DefaultExitCodes
+
+// exit ends membrane after err: with the agent's exit code if it ran,
+// and exitCodes.Failed otherwise. An agent that exits with one of
+// membrane's codes itself gets a warning, since a caller can't tell the
+// two apart by the code.
+func exit(err error) {
+	var exitErr *membrane.ExitError
+	if errors.As(err, &exitErr) {
+		if exitErr.Reason != "" {
+			fmt.Fprintf(os.Stderr, "membrane: %s\n", exitErr.Reason)
+		} else if exitCodes.Reserved(exitErr.Code) {
+			fmt.Fprintf(os.Stderr, "membrane: the agent itself exited with code %d, which membrane also uses for its own outcomes; set --timeout-exit-code and --failure-exit-code to codes the agent doesn't use\n", exitErr.Code)
 		}
-		fmt.Fprintf(os.Stderr, "membrane: %v\n", err)
-		os.Exit(1)
+		os.Exit(exitErr.Code)
 	}
+	fmt.Fprintf(os.Stderr, "membrane: %v\n", err)
+	os.Exit(exitCodes.Failed)
 }
 
 func isFlagPassed(name string) bool {
@@ -0,0 +1,8 @@
+#!/bin/bash
+# Run a command (default: bash) as the agent user, without the
+# capabilities the entrypoint needed to set up networking. Shared by
+# entrypoint.sh and membrane-exec.
+
+# shellcheck disable=SC2016
+exec capsh --drop=cap_net_admin,cap_net_raw,cap_setpcap,cap_setfcap \
+    -- -c 'exec gosu agent "${@:-bash}"' -- "$@"
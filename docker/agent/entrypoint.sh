@@ -44,6 +44,4 @@ if [ -n "$MEMBRANE_TITLE" ]; then
 fi
 
 cd /workspace
-# shellcheck disable=SC2016
-exec capsh --drop=cap_net_admin,cap_net_raw,cap_setpcap,cap_setfcap \
-    -- -c 'exec gosu agent "${@:-bash}"' -- "$@"
+exec as-agent.sh "$@"
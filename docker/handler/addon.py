@@ -2,11 +2,14 @@
 
 Reads allow rules from /etc/membrane/allow.json (or MEMBRANE_ALLOW_FILE
 env var) at startup and enforces http rules on intercepted requests.
+Rules are reloaded whenever dns-proxy swaps in a new allow file.
 
 All requests fail closed: unknown hostname → 403, unknown IP (when no
-hostname) → 403, URL rule mismatch → 403.
+hostname) → 403, URL rule mismatch → 403. In approval mode a blocked
+request is held while the user is asked, and let through if they allow it.
 """
 
+import asyncio
 import json
 import os
 import posixpath
@@ -30,9 +33,33 @@ class RejectLayer(proxy_layer.Layer):
         # ignore all subsequent events — connection is already closed
 
 
+ALLOW_FILE = os.environ.get("MEMBRANE_ALLOW_FILE", "/etc/membrane/allow.json")
+# Approval mode holds blocked requests for the user; see dns-proxy.
+APPROVE = bool(os.environ.get("MEMBRANE_APPROVE_TIMEOUT"))
+CONTROL_SOCKET = "/run/membrane/dns-proxy.sock"
+# Learning mode appends each distinct connection and request here; see
+# dns-proxy/learn.go.
+LEARN_FILE = os.environ.get("MEMBRANE_LEARN_FILE", "")
+_LEARN_SEEN = set()
+
+
+def _observe(record):
+    """Append record to the learn file once per distinct record."""
+    if not LEARN_FILE:
+        return
+    line = json.dumps(record, sort_keys=True)
+    if line in _LEARN_SEEN:
+        return
+    _LEARN_SEEN.add(line)
+    try:
+        with open(LEARN_FILE, "a") as f:
+            f.write(line + "\n")
+    except OSError:
+        pass
+
+
 def _load_rules():
-    allow_file = os.environ.get("MEMBRANE_ALLOW_FILE", "/etc/membrane/allow.json")
-    with open(allow_file) as f:
+    with open(ALLOW_FILE) as f:
         rules = json.load(f)
 
     allowed_cidrs = []
@@ -112,9 +139,38 @@ def _load_rules():
     return allowed_cidrs, url_rules, host_patterns, any_rules, any_tcp
 
 
+def _rules_stamp():
+    st = os.stat(ALLOW_FILE)
+    return (st.st_ino, st.st_mtime_ns)
+
+
+_RULES_STAMP = _rules_stamp()
 ALLOWED_CIDRS, URL_RULES, HOST_PATTERNS, ANY_RULES, ANY_TCP = _load_rules()
 
 
+def _maybe_reload():
+    """Reload rules if dns-proxy has replaced the allow file since the
+    last load. dns-proxy renames the new file into place only after the
+    firewall has been updated, so a half-written file is never seen. On
+    any error the current rules stay in force."""
+    global _RULES_STAMP, ALLOWED_CIDRS, URL_RULES, HOST_PATTERNS, ANY_RULES, ANY_TCP
+    try:
+        stamp = _rules_stamp()
+        if stamp == _RULES_STAMP:
+            return
+        rules = _load_rules()
+    except Exception:
+        return
+    ALLOWED_CIDRS, URL_RULES, HOST_PATTERNS, ANY_RULES, ANY_TCP = rules
+    _RULES_STAMP = stamp
+
+
+def _decision(verdict, what):
+    """Log an allowed or blocked request; membrane counts these lines for
+    --summary-json."""
+    print(f"l7-filter: {verdict} {what}", flush=True)
+
+
 def _is_http_or_tls(data: bytes) -> bool:
     """Return True if the first bytes look like TLS or plain HTTP."""
     if starts_like_tls_record(data):
@@ -176,8 +232,12 @@ def next_layer(nextlayer: proxy_layer.NextLayer) -> None:
     if nextlayer.layer is not None:
         return  # another addon already decided
 
+    _maybe_reload()
+
     host = (nextlayer.context.server.sni or "").lower()
     addr = nextlayer.context.server.address
+    if addr:
+        _observe({"kind": "conn", "ip": addr[0], "port": addr[1], "sni": host})
 
     # No SNI — try reverse lookup from dns-proxy map
     if not host and addr:
@@ -211,6 +271,7 @@ def next_layer(nextlayer: proxy_layer.NextLayer) -> None:
         return  # HTTP/TLS — allow through
 
     # Non-HTTP bytes to an http-only dest — block immediately
+    _decision("blocked", f"{host or addr[0]}:{addr[1]} non-HTTP" if addr else host)
     nextlayer.layer = RejectLayer(nextlayer.context)
 
 
@@ -264,33 +325,60 @@ def normalize_path(path):
     return path
 
 
-def request(flow: mhttp.HTTPFlow) -> None:
+def _request_allowed(host, addr, method, path):
+    """Return True if any rule matching host or addr permits the request."""
+    for rule_list in _collect_matching_sources(host, addr):
+        for url_path, http_rules in rule_list:
+            if not http_rules:
+                # No http constraints — permit anything under url_path
+                if path == url_path or path.startswith(url_path.rstrip("/") + "/"):
+                    return True
+            else:
+                for rule in http_rules:
+                    if _matches_rule(url_path, rule, method, path):
+                        return True
+    return False
+
+
+async def _ask(host, method, path):
+    """Hold a blocked request while dns-proxy asks the user about it.
+    Returns True if the user allowed it. Any failure denies."""
+    try:
+        reader, writer = await asyncio.open_unix_connection(CONTROL_SOCKET)
+        ask = {"kind": "http", "host": host, "method": method, "path": path}
+        writer.write(b"ask\n" + json.dumps(ask).encode() + b"\n")
+        await writer.drain()
+        reply = (await reader.readline()).decode().strip()
+        writer.close()
+    except OSError:
+        return False
+    return reply in ("once", "session", "always")
+
+
+async def request(flow: mhttp.HTTPFlow) -> None:
+    _maybe_reload()
     host = flow.request.pretty_host.lower() if flow.request.pretty_host else ""
     path = normalize_path(flow.request.path)
     method = flow.request.method
 
-    # Collect all matching rule lists
     peername = flow.server_conn.peername
     addr = peername if peername else None
+    _observe({"kind": "http", "host": host, "port": flow.request.port,
+              "method": method, "path": path.split("?", 1)[0]})
 
-    matched = _collect_matching_sources(host, addr)
-
-    if not matched:
-        flow.response = mhttp.Response.make(403, b"", {"Content-Type": "text/plain"})
+    what = f"{method} {host or (addr[0] if addr else '')}{path.split('?', 1)[0]}"
+    if _request_allowed(host, addr, method, path):
+        _decision("allowed", what)
         return
 
-    for rule_list in matched:
-        for url_path, http_rules in rule_list:
-            if not http_rules:
-                # No http constraints — permit anything under url_path
-                if path == url_path or path.startswith(url_path.rstrip("/") + "/"):
-                    return
-            else:
-                for rule in http_rules:
-                    if _matches_rule(url_path, rule, method, path):
-                        return  # matched — allow
+    # Approval mode: dns-proxy has already added the rule for session
+    # and always decisions by the time it replies.
+    if APPROVE and host and await _ask(host, method, path):
+        _decision("allowed", what)
+        return
 
     # No rule matched — block
+    _decision("blocked", what)
     flow.response = mhttp.Response.make(
         403,
         b"",
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Interactive approval. When MEMBRANE_APPROVE_TIMEOUT is set, a DNS query
+// or HTTP request that no rule allows is held while the host-side membrane
+// process (attached with `dns-proxy approvals` over docker exec) asks the
+// user what to do. With no host attached, or if the user doesn't answer in
+// time, the request is denied as usual.
+
+// approvalRequest is sent to the host, one JSON object per line.
+type approvalRequest struct {
+	ID     uint64 `json:"id"`
+	Kind   string `json:"kind"` // "dns" or "http"
+	Host   string `json:"host"`
+	Method string `json:"method,omitempty"`
+	Path   string `json:"path,omitempty"`
+}
+
+// approvalDecision is the host's answer. For session and always decisions
+// Rule is the allow rule to add to the running session.
+type approvalDecision struct {
+	ID       uint64          `json:"id"`
+	Decision string          `json:"decision"`
+	Rule     json.RawMessage `json:"rule,omitempty"`
+}
+
+const (
+	decisionOnce    = "once"
+	decisionSession = "session"
+	decisionAlways  = "always"
+	decisionDeny    = "deny"
+)
+
+// onceGrant is how long an "allow once" DNS decision also covers the same
+// lookup, such as the AAAA query after the A query or a resolver's retry,
+// and how long the addresses it resolved to stay reachable.
+const onceGrant = time.Minute
+
+// oncePorts are what a lookup allowed once opens: HTTP and HTTPS, through
+// the L7 filter, which asks about the requests that follow in turn.
+var oncePorts = []portRule{{Port: 80, Proto: "tcp"}, {Port: 443, Proto: "tcp"}}
+
+// approvals is nil when approval mode is off.
+var approvals *broker
+
+type pendingAsk struct {
+	key      string
+	req      approvalRequest
+	done     chan struct{}
+	decision string
+}
+
+type broker struct {
+	timeout      time.Duration
+	allowFile    string
+	globalQTypes []uint16
+
+	mu      sync.Mutex
+	host    *json.Encoder // attached host stream; nil when none
+	nextID  uint64
+	pending map[string]*pendingAsk // by kind, host, method and path
+	byID    map[uint64]*pendingAsk
+	grants  map[string]time.Time // ask key → expiry of an "allow once"
+}
+
+func newBroker(timeout time.Duration, allowFile string, globalQTypes []uint16) *broker {
+	return &broker{
+		timeout:      timeout,
+		allowFile:    allowFile,
+		globalQTypes: globalQTypes,
+		pending:      map[string]*pendingAsk{},
+		byID:         map[uint64]*pendingAsk{},
+		grants:       map[string]time.Time{},
+	}
+}
+
+// ask holds the caller until the host decides or the timeout expires.
+// Concurrent asks for the same request share one prompt.
+func (b *broker) ask(req approvalRequest) string {
+	if b == nil {
+		return decisionDeny
+	}
+	key := req.Kind + " " + req.Host + " " + req.Method + " " + req.Path
+
+	b.mu.Lock()
+	if exp, ok := b.grants[key]; ok {
+		if time.Now().Before(exp) {
+			b.mu.Unlock()
+			return decisionOnce
+		}
+		delete(b.grants, key)
+	}
+	if b.host == nil {
+		b.mu.Unlock()
+		return decisionDeny
+	}
+	p, ok := b.pending[key]
+	if !ok {
+		b.nextID++
+		req.ID = b.nextID
+		p = &pendingAsk{key: key, req: req, done: make(chan struct{})}
+		b.pending[key] = p
+		b.byID[req.ID] = p
+		if err := b.host.Encode(req); err != nil {
+			log.Printf("dns-proxy: send approval request: %v", err)
+			b.finishLocked(p, decisionDeny)
+		}
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-p.done:
+	case <-time.After(b.timeout):
+		b.mu.Lock()
+		b.finishLocked(p, decisionDeny)
+		b.mu.Unlock()
+		log.Printf("dns-proxy: approval for %s timed out", key)
+	}
+	return p.decision
+}
+
+// finishLocked resolves p once; later calls are no-ops.
+func (b *broker) finishLocked(p *pendingAsk, decision string) {
+	if _, ok := b.byID[p.req.ID]; !ok {
+		return
+	}
+	delete(b.byID, p.req.ID)
+	delete(b.pending, p.key)
+	p.decision = decision
+	close(p.done)
+}
+
+// decide applies a decision from the host. Rules are added before the
+// waiting request is released so it sees them on its retry. A decision
+// that arrives after its request timed out still adds its rule.
+func (b *broker) decide(d approvalDecision) {
+	switch d.Decision {
+	case decisionSession, decisionAlways:
+		if len(d.Rule) == 0 {
+			break
+		}
+		if err := addRule(d.Rule, b.allowFile, b.globalQTypes); err != nil {
+			log.Printf("dns-proxy: add approved rule: %v", err)
+			d.Decision = decisionDeny
+		}
+	case decisionOnce:
+	default:
+		d.Decision = decisionDeny
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p, ok := b.byID[d.ID]
+	if !ok {
+		return
+	}
+	if d.Decision == decisionOnce && p.req.Kind == "dns" {
+		b.grants[p.key] = time.Now().Add(onceGrant)
+	}
+	log.Printf("dns-proxy: %s %s %s%s: %s", p.req.Kind, p.req.Method, p.req.Host, p.req.Path, d.Decision)
+	b.finishLocked(p, d.Decision)
+}
+
+// allowOnce opens oncePorts on ips for onceGrant. Unlike allowIPs, the
+// addresses aren't remembered for reloads, which drop them.
+func allowOnce(name string, ips []net.IP) {
+	resolvedMu.Lock()
+	defer resolvedMu.Unlock()
+	for _, ip := range ips {
+		for _, pr := range oncePorts {
+			elem := fmt.Sprintf("%s . %s . %d timeout %ds", ip, pr.Proto, pr.Port, int(onceGrant.Seconds()))
+			if err := exec.Command("nft", "add", "element", "ip", "membrane",
+				"allowed-once", "{", elem, "}").Run(); err != nil {
+				log.Printf("dns-proxy: nft add %s to allowed-once: %v", elem, err)
+			}
+		}
+		updateReverseMap(ip.String(), name)
+	}
+}
+
+// attach makes c the host stream until it disconnects. Only one host may
+// be attached at a time.
+func (b *broker) attach(c net.Conn, r *bufio.Reader) {
+	if b == nil {
+		fmt.Fprintln(c, "error: approval mode is off")
+		return
+	}
+	enc := json.NewEncoder(c)
+	b.mu.Lock()
+	if b.host != nil {
+		b.mu.Unlock()
+		fmt.Fprintln(c, "error: another approver is attached")
+		return
+	}
+	b.host = enc
+	b.mu.Unlock()
+	log.Printf("dns-proxy: approver attached")
+
+	dec := json.NewDecoder(r)
+	for {
+		var d approvalDecision
+		if err := dec.Decode(&d); err != nil {
+			if err != io.EOF {
+				log.Printf("dns-proxy: read approval decision: %v", err)
+			}
+			break
+		}
+		b.decide(d)
+	}
+
+	b.mu.Lock()
+	b.host = nil
+	for _, p := range b.byID {
+		b.finishLocked(p, decisionDeny)
+	}
+	b.mu.Unlock()
+	log.Printf("dns-proxy: approver detached")
+}
+
+// serveAsk answers one ask from the mitmproxy addon: a JSON
+// approvalRequest line in, a decision line out.
+func (b *broker) serveAsk(c net.Conn, r *bufio.Reader) {
+	var req approvalRequest
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		fmt.Fprintln(c, decisionDeny)
+		return
+	}
+	fmt.Fprintln(c, b.ask(req))
+}
+
+// runApprovals connects stdin and stdout to the approval stream. It is
+// the `dns-proxy approvals` client, run by the host via docker exec -i.
+func runApprovals() error {
+	c, err := net.Dial("unix", controlSocket)
+	if err != nil {
+		return fmt.Errorf("connect to dns-proxy: %w", err)
+	}
+	defer c.Close()
+	if _, err := io.WriteString(c, "approvals\n"); err != nil {
+		return fmt.Errorf("attach: %w", err)
+	}
+	go func() {
+		io.Copy(c, os.Stdin)
+		c.(*net.UnixConn).CloseWrite()
+	}()
+	if _, err := io.Copy(os.Stdout, c); err != nil {
+		return fmt.Errorf("read approvals: %w", err)
+	}
+	return nil
+}
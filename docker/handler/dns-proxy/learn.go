@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"sync"
+)
+
+// Learning mode. When MEMBRANE_LEARN_FILE is set, each distinct name the
+// agent resolves is appended to that file as a JSON line. The mitmproxy
+// addon appends connections and HTTP requests to the same file, and the
+// host reads it back at the end of `membrane learn`.
+
+var (
+	learnFile = os.Getenv("MEMBRANE_LEARN_FILE")
+	learnMu   sync.Mutex
+	learnSeen = map[string]bool{}
+)
+
+type dnsObservation struct {
+	Kind  string   `json:"kind"` // always "dns"
+	Name  string   `json:"name"`
+	QType string   `json:"qtype"`
+	IPs   []string `json:"ips,omitempty"`
+}
+
+// observeDNS records that name was resolved to ips. Repeats of the same
+// name, qtype and answer are recorded once.
+func observeDNS(name string, qtype uint16, ips []net.IP) {
+	if learnFile == "" {
+		return
+	}
+	obs := dnsObservation{Kind: "dns", Name: name, QType: qtypeName(qtype)}
+	for _, ip := range ips {
+		obs.IPs = append(obs.IPs, ip.String())
+	}
+	line, err := json.Marshal(obs)
+	if err != nil {
+		return
+	}
+
+	learnMu.Lock()
+	defer learnMu.Unlock()
+	if learnSeen[string(line)] {
+		return
+	}
+	learnSeen[string(line)] = true
+
+	f, err := os.OpenFile(learnFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Printf("dns-proxy: learn: %v", err)
+		return
+	}
+	defer f.Close()
+	f.Write(append(line, '\n'))
+}
@@ -21,21 +21,119 @@ type portRule struct {
 }
 
 type allowRule struct {
-	Type  string     `json:"type"`
-	Host  string     `json:"host"`
-	Ports []portRule `json:"ports"`
+	Type   string     `json:"type"`
+	Host   string     `json:"host"`
+	Ports  []portRule `json:"ports"`
+	QTypes []string   `json:"qtypes"`
 }
 
 type patternEntry struct {
 	pattern string
 	ports   []portRule // nil = any-port
+	qtypes  []uint16   // nil = any qtype
 }
 
 type allowedSet struct {
-	exact    map[string][]portRule
-	patterns []patternEntry
-	anyHost  bool
-	anyPorts []portRule // from bare-* rule; nil = any-port
+	exact       map[string][]portRule
+	exactQTypes map[string][]uint16 // nil value = any qtype
+	patterns    []patternEntry
+	anyHost     bool
+	anyPorts    []portRule // from bare-* rule; nil = any-port
+	anyQTypes   []uint16   // from bare-* rule; nil = any qtype
+}
+
+// qtypeCodes maps the query type names accepted in config to their wire
+// values. pkg/membrane's list of them is generated from this map: run go
+// generate ./pkg/membrane after changing it.
+var qtypeCodes = map[string]uint16{
+	"A":      1,
+	"NS":     2,
+	"CNAME":  5,
+	"SOA":    6,
+	"NULL":   10,
+	"PTR":    12,
+	"MX":     15,
+	"TXT":    16,
+	"AAAA":   28,
+	"SRV":    33,
+	"NAPTR":  35,
+	"DS":     43,
+	"DNSKEY": 48,
+	"SVCB":   64,
+	"HTTPS":  65,
+	"ANY":    255,
+	"CAA":    257,
+}
+
+// defaultQTypes is used when MEMBRANE_DNS_QTYPES is unset.
+var defaultQTypes = []string{"A", "AAAA", "CNAME", "HTTPS"}
+
+// parseQTypes converts qtype names to wire values. A "*" entry means any
+// qtype and yields nil. Unknown names are logged and skipped.
+func parseQTypes(names []string) []uint16 {
+	out := []uint16{}
+	for _, n := range names {
+		n = strings.ToUpper(strings.TrimSpace(n))
+		if n == "" {
+			continue
+		}
+		if n == "*" {
+			return nil
+		}
+		code, ok := qtypeCodes[n]
+		if !ok {
+			log.Printf("dns-proxy: ignoring unknown qtype %q", n)
+			continue
+		}
+		out = appendUniqueQTypes(out, code)
+	}
+	return out
+}
+
+// unionQTypes merges src into dst. nil means any qtype and wins.
+func unionQTypes(dst []uint16, src []uint16) []uint16 {
+	if dst == nil || src == nil {
+		return nil
+	}
+	return appendUniqueQTypes(dst, src...)
+}
+
+func appendUniqueQTypes(s []uint16, vals ...uint16) []uint16 {
+	for _, v := range vals {
+		found := false
+		for _, x := range s {
+			if x == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			s = append(s, v)
+		}
+	}
+	return s
+}
+
+func qtypePermitted(qtypes []uint16, qtype uint16) bool {
+	if qtypes == nil {
+		return true
+	}
+	for _, q := range qtypes {
+		if q == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// qtypeName returns the config name for a wire qtype, or TYPEnnn.
+func qtypeName(qtype uint16) string {
+	for name, code := range qtypeCodes {
+		if code == qtype {
+			return name
+		}
+	}
+	return fmt.Sprintf("TYPE%d", qtype)
 }
 
 // unionPorts merges src into dst. nil means any-port and wins over specific ports.
@@ -49,18 +147,24 @@ func unionPorts(dst []portRule, src []portRule) []portRule {
 
 // buildAllowedHosts parses MEMBRANE_ALLOW JSON and returns an allowedSet
 // containing exact hosts, wildcard patterns, and the any-host flag.
-func buildAllowedHosts(allowJSON string) *allowedSet {
+// Rules without their own qtypes inherit globalQTypes.
+func buildAllowedHosts(allowJSON string, globalQTypes []uint16) *allowedSet {
 	var rules []allowRule
 	if err := json.Unmarshal([]byte(allowJSON), &rules); err != nil {
 		log.Printf("dns-proxy: parse MEMBRANE_ALLOW: %v", err)
-		return &allowedSet{exact: make(map[string][]portRule)}
+		return &allowedSet{exact: make(map[string][]portRule), exactQTypes: make(map[string][]uint16)}
 	}
-	as := &allowedSet{exact: make(map[string][]portRule)}
+	as := &allowedSet{exact: make(map[string][]portRule), exactQTypes: make(map[string][]uint16)}
 	for _, r := range rules {
+		qtypes := globalQTypes
+		if len(r.QTypes) > 0 {
+			qtypes = parseQTypes(r.QTypes)
+		}
 		switch r.Type {
 		case "any":
 			if as.anyHost {
 				as.anyPorts = unionPorts(as.anyPorts, r.Ports)
+				as.anyQTypes = unionQTypes(as.anyQTypes, qtypes)
 			} else {
 				as.anyHost = true
 				if len(r.Ports) == 0 {
@@ -68,6 +172,7 @@ func buildAllowedHosts(allowJSON string) *allowedSet {
 				} else {
 					as.anyPorts = append([]portRule(nil), r.Ports...)
 				}
+				as.anyQTypes = qtypes
 			}
 		case "host-pattern":
 			pattern := strings.ToLower(r.Host)
@@ -83,18 +188,24 @@ func buildAllowedHosts(allowJSON string) *allowedSet {
 			for i := range as.patterns {
 				if as.patterns[i].pattern == pattern {
 					as.patterns[i].ports = unionPorts(as.patterns[i].ports, ports)
+					as.patterns[i].qtypes = unionQTypes(as.patterns[i].qtypes, qtypes)
 					found = true
 					break
 				}
 			}
 			if !found {
-				as.patterns = append(as.patterns, patternEntry{pattern: pattern, ports: ports})
+				as.patterns = append(as.patterns, patternEntry{pattern: pattern, ports: ports, qtypes: qtypes})
 			}
 		case "host", "url":
 			host := strings.ToLower(r.Host)
 			if host == "" {
 				continue
 			}
+			if existing, ok := as.exactQTypes[host]; ok {
+				as.exactQTypes[host] = unionQTypes(existing, qtypes)
+			} else {
+				as.exactQTypes[host] = qtypes
+			}
 			if existing, ok := as.exact[host]; ok && existing == nil {
 				continue
 			}
@@ -143,25 +254,72 @@ func appendUniquePorts(s []portRule, vals ...portRule) []portRule {
 }
 
 func main() {
-	upstream := os.Getenv("MEMBRANE_DNS_RESOLVER")
-	if upstream == "" {
-		upstream = "1.1.1.1"
+	if len(os.Args) > 1 && (os.Args[1] == "allow" || os.Args[1] == "revoke") {
+		if err := requestRules(os.Args[1], os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "dns-proxy: %v\n", err)
+			os.Exit(1)
+		}
+		return
 	}
-	if !strings.Contains(upstream, ":") {
-		upstream += ":53"
+	if len(os.Args) > 1 && os.Args[1] == "approvals" {
+		if err := runApprovals(); err != nil {
+			fmt.Fprintf(os.Stderr, "dns-proxy: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	dnsFile := os.Getenv("MEMBRANE_DNS_FILE")
+	if dnsFile == "" {
+		dnsFile = "/etc/membrane/dns.json"
+	}
+	upstream, err := loadUpstreams(dnsFile)
+	if err != nil {
+		log.Fatalf("dns-proxy: load resolvers: %v", err)
 	}
 
 	allowFile := os.Getenv("MEMBRANE_ALLOW_FILE")
 	if allowFile == "" {
 		allowFile = "/etc/membrane/allow.json"
 	}
+	qtypeNames := defaultQTypes
+	if env := os.Getenv("MEMBRANE_DNS_QTYPES"); env != "" {
+		qtypeNames = strings.Split(env, ",")
+	}
+	globalQTypes := parseQTypes(qtypeNames)
+
 	data, err := os.ReadFile(allowFile)
 	if err != nil {
 		log.Fatalf("dns-proxy: read allow file: %v", err)
 	}
-	allowed := buildAllowedHosts(string(data))
-	log.Printf("dns-proxy: tracking %d hostnames, %d patterns, anyHost=%v, upstream=%s",
-		len(allowed.exact), len(allowed.patterns), allowed.anyHost, upstream)
+	allowed := buildAllowedHosts(string(data), globalQTypes)
+	current.Store(allowed)
+	log.Printf("dns-proxy: tracking %d hostnames, %d patterns, anyHost=%v, qtypes=%v, upstream=%v",
+		len(allowed.exact), len(allowed.patterns), allowed.anyHost, qtypeNames, upstream)
+
+	hostsFile := os.Getenv("MEMBRANE_HOSTS_FILE")
+	if hostsFile == "" {
+		hostsFile = "/etc/membrane/hosts.json"
+	}
+	hosts := loadHosts(hostsFile)
+	for name, ips := range hosts {
+		if _, _, matched, _ := allowed.match(name); !matched {
+			log.Printf("dns-proxy: static host %s has no matching allow rule; queries will be blocked", name)
+			continue
+		}
+		log.Printf("dns-proxy: static host %s → %v", name, ips)
+	}
+
+	if env := os.Getenv("MEMBRANE_APPROVE_TIMEOUT"); env != "" {
+		timeout, err := time.ParseDuration(env)
+		if err != nil {
+			log.Fatalf("dns-proxy: MEMBRANE_APPROVE_TIMEOUT: %v", err)
+		}
+		approvals = newBroker(timeout, allowFile, globalQTypes)
+		log.Printf("dns-proxy: approval mode on (timeout %v)", timeout)
+	}
+
+	go serveControl(allowFile, globalQTypes)
 
 	addr, err := net.ResolveUDPAddr("udp", "0.0.0.0:53")
 	if err != nil {
@@ -183,140 +341,277 @@ func main() {
 		}
 		pkt := make([]byte, n)
 		copy(pkt, buf[:n])
-		go handleQuery(pkt, clientAddr, conn, upstream, *allowed)
+		go handleQuery(pkt, clientAddr, conn, upstream, current.Load(), hosts)
 	}
 }
 
-func extractQueryName(pkt []byte) string {
+// DNS response codes used when answering locally.
+const (
+	rcodeNXDomain = 3
+	rcodeRefused  = 5
+)
+
+// extractQuestion returns the lowercased name and qtype of the first
+// question in pkt.
+func extractQuestion(pkt []byte) (string, uint16) {
 	if len(pkt) < 12 {
-		return ""
+		return "", 0
 	}
 	if binary.BigEndian.Uint16(pkt[4:6]) == 0 {
-		return ""
+		return "", 0
 	}
-	name, _ := parseDNSName(pkt, 12)
-	return strings.TrimRight(strings.ToLower(name), ".")
-}
-
-func handleQuery(query []byte, clientAddr *net.UDPAddr, conn *net.UDPConn, upstream string, allowed allowedSet) {
-	// Reject packets with more than one question — we only validate the
-	// first question name, so additional questions are an exfiltration
-	// channel. Standard DNS always uses QDCOUNT=1.
-	if len(query) >= 6 && binary.BigEndian.Uint16(query[4:6]) != 1 {
-		resp := make([]byte, len(query))
-		copy(resp, query)
-		resp[2] = (query[2] & 0x01) | 0x80
-		resp[3] = 0x83
-		resp[6], resp[7] = 0, 0
-		resp[8], resp[9] = 0, 0
-		resp[10], resp[11] = 0, 0
-		conn.WriteToUDP(resp, clientAddr)
-		log.Printf("dns-proxy: blocked multi-question packet from %s", clientAddr)
-		return
+	name, off := parseDNSName(pkt, 12)
+	var qtype uint16
+	if off+2 <= len(pkt) {
+		qtype = binary.BigEndian.Uint16(pkt[off : off+2])
 	}
+	return strings.TrimRight(strings.ToLower(name), "."), qtype
+}
 
-	name := extractQueryName(query)
-
-	// Determine if name is allowed and collect union of ports.
-	// populateSets indicates whether resolved IPs should be added to nftables.
-	var ports []portRule
-	matched := false
-	populateSets := false
+// errorResponse builds a reply to query with the given RCODE and empty
+// answer, authority, and additional sections.
+func errorResponse(query []byte, rcode byte) []byte {
+	resp := make([]byte, len(query))
+	copy(resp, query)
+	resp[2] = (query[2] & 0x01) | 0x80 // QR=1 (response), preserve RD bit
+	resp[3] = 0x80 | rcode             // RA=1
+	resp[6], resp[7] = 0, 0            // ANCOUNT = 0
+	resp[8], resp[9] = 0, 0            // NSCOUNT = 0
+	resp[10], resp[11] = 0, 0          // ARCOUNT = 0
+	return resp
+}
 
+// match determines whether name is allowed and collects the union of ports
+// and qtypes from every matching rule. populateSets indicates whether
+// resolved IPs should be added to nftables.
+func (as *allowedSet) match(name string) (ports []portRule, qtypes []uint16, matched, populateSets bool) {
 	// 1. Exact match
-	if p, ok := allowed.exact[name]; ok {
+	if p, ok := as.exact[name]; ok {
 		ports = p
+		qtypes = as.exactQTypes[name]
 		matched = true
 		populateSets = true
 	}
 
 	// 2. Pattern matches — union ports from all matching patterns
-	for _, pe := range allowed.patterns {
+	for _, pe := range as.patterns {
 		if ok, _ := filepath.Match(pe.pattern, name); ok {
 			if !matched {
 				ports = pe.ports
+				qtypes = pe.qtypes
 				matched = true
 				populateSets = true
 			} else {
 				ports = unionPorts(ports, pe.ports)
+				qtypes = unionQTypes(qtypes, pe.qtypes)
 				populateSets = true
 			}
 		}
 	}
 
 	// 3. Any-host fallback — resolve but do NOT populate nftables sets
-	if !matched && allowed.anyHost {
+	if !matched && as.anyHost {
+		qtypes = as.anyQTypes
 		matched = true
 		populateSets = false
 	}
+	return ports, qtypes, matched, populateSets
+}
 
-	if !matched {
-		resp := make([]byte, len(query))
-		copy(resp, query)
-		resp[2] = (query[2] & 0x01) | 0x80 // QR=1 (response), preserve RD bit
-		resp[3] = 0x83                     // RA=1, RCODE=3 (NXDOMAIN)
-		resp[6], resp[7] = 0, 0            // ANCOUNT = 0
-		resp[8], resp[9] = 0, 0            // NSCOUNT = 0
-		resp[10], resp[11] = 0, 0          // ARCOUNT = 0
-		conn.WriteToUDP(resp, clientAddr)
-		log.Printf("dns-proxy: blocked %s (not in allow list)", name)
+func handleQuery(query []byte, clientAddr *net.UDPAddr, conn *net.UDPConn, upstream *upstreams, allowed *allowedSet, hosts map[string][]net.IP) {
+	if len(query) < 12 {
 		return
 	}
 
-	upstreamAddr, err := net.ResolveUDPAddr("udp", upstream)
-	if err != nil {
-		log.Printf("dns-proxy: resolve upstream: %v", err)
+	// Reject packets with more than one question — we only validate the
+	// first question name, so additional questions are an exfiltration
+	// channel. Standard DNS always uses QDCOUNT=1.
+	if binary.BigEndian.Uint16(query[4:6]) != 1 {
+		conn.WriteToUDP(errorResponse(query, rcodeNXDomain), clientAddr)
+		log.Printf("dns-proxy: blocked multi-question packet from %s", clientAddr)
 		return
 	}
-	upConn, err := net.DialUDP("udp", nil, upstreamAddr)
-	if err != nil {
-		log.Printf("dns-proxy: dial upstream: %v", err)
+
+	name, qtype := extractQuestion(query)
+
+	ports, qtypes, matched, populateSets := allowed.match(name)
+	once := false
+	if !matched && name != "" && approvals != nil {
+		switch approvals.ask(approvalRequest{Kind: "dns", Host: name}) {
+		case decisionOnce:
+			qtypes, matched, once = approvals.globalQTypes, true, true
+		case decisionSession, decisionAlways:
+			ports, qtypes, matched, populateSets = current.Load().match(name)
+		}
+	}
+	if !matched {
+		conn.WriteToUDP(errorResponse(query, rcodeNXDomain), clientAddr)
+		log.Printf("dns-proxy: blocked %s (not in allow list)", name)
 		return
 	}
-	defer upConn.Close()
 
-	if _, err := upConn.Write(query); err != nil {
-		log.Printf("dns-proxy: write upstream: %v", err)
+	// 4. Query type policy — TXT, NULL and friends are tunnelling vectors,
+	// so only the permitted types are forwarded for an allowed name.
+	if !qtypePermitted(qtypes, qtype) {
+		conn.WriteToUDP(errorResponse(query, rcodeRefused), clientAddr)
+		log.Printf("dns-proxy: refused %s %s (qtype not permitted)", name, qtypeName(qtype))
 		return
 	}
+	log.Printf("dns-proxy: allowed %s %s", name, qtypeName(qtype))
 
-	resp := make([]byte, 4096)
-	upConn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	rn, err := upConn.Read(resp)
+	// 5. Static host overrides — answered authoritatively without
+	// touching the upstream resolver.
+	if ips, ok := hosts[name]; ok {
+		if populateSets {
+			allowIPs(name, ips)
+		} else if once {
+			allowOnce(name, ips)
+		}
+		conn.WriteToUDP(hostsResponse(query, qtype, ips), clientAddr)
+		observeDNS(name, qtype, ips)
+		log.Printf("dns-proxy: %s → %v (static, ports=%v)", name, ips, ports)
+		return
+	}
+
+	resolvers := upstream.resolversFor(name)
+	resp, via, err := forward(query, resolvers)
 	if err != nil {
-		log.Printf("dns-proxy: read upstream: %v", err)
+		log.Printf("dns-proxy: %s: all upstreams failed: %v", name, err)
 		return
 	}
-	resp = resp[:rn]
+	failover := ""
+	if via != resolvers[0].Address {
+		failover = " after failover"
+	}
 
 	// Parse response and update nftables before returning to client
 	respName, ips := extractARecords(resp)
-	if respName != "" && len(ips) > 0 && populateSets {
+	if respName != "" && len(ips) > 0 {
 		respName = strings.ToLower(strings.TrimRight(respName, "."))
-		for _, ip := range ips {
-			if ports == nil {
-				// any port: add to allowed-any-port
+		switch {
+		case populateSets:
+			allowIPs(respName, ips)
+		case once:
+			allowOnce(respName, ips)
+		}
+	}
+	switch {
+	case populateSets:
+		log.Printf("dns-proxy: %s → %v (ports=%v, via %s%s)", name, ips, ports, via, failover)
+	case once:
+		log.Printf("dns-proxy: %s → %v (once, via %s%s)", name, ips, via, failover)
+	default:
+		log.Printf("dns-proxy: %s → %v (via %s%s)", name, ips, via, failover)
+	}
+
+	conn.WriteToUDP(resp, clientAddr)
+	observeDNS(name, qtype, ips)
+}
+
+// allowIPs adds resolved IPs to the nftables sets with the ports the
+// current rules give name, and records them in the reverse map for the
+// mitmproxy addon. name is matched again under resolvedMu, so a query
+// that was forwarding while a reload revoked it adds nothing.
+func allowIPs(name string, ips []net.IP) {
+	resolvedMu.Lock()
+	defer resolvedMu.Unlock()
+	ports, _, _, populate := current.Load().match(name)
+	if !populate {
+		log.Printf("dns-proxy: %s no longer allowed, not adding %v", name, ips)
+		return
+	}
+	for _, ip := range ips {
+		if ports == nil {
+			// any port: add to allowed-any-port
+			if err := exec.Command("nft", "add", "element", "ip", "membrane",
+				"allowed-any-port", "{", ip.String()+"/32", "}").Run(); err != nil {
+				log.Printf("dns-proxy: nft add %s to allowed-any-port: %v", ip, err)
+			}
+		} else {
+			// port-constrained: add ip . proto . port triples
+			for _, pr := range ports {
+				elem := fmt.Sprintf("%s . %s . %d", ip.String(), pr.Proto, pr.Port)
 				if err := exec.Command("nft", "add", "element", "ip", "membrane",
-					"allowed-any-port", "{", ip.String()+"/32", "}").Run(); err != nil {
-					log.Printf("dns-proxy: nft add %s to allowed-any-port: %v", ip, err)
-				}
-				updateReverseMap(ip.String(), respName)
-			} else {
-				// port-constrained: add ip . proto . port triples
-				for _, pr := range ports {
-					elem := fmt.Sprintf("%s . %s . %d", ip.String(), pr.Proto, pr.Port)
-					if err := exec.Command("nft", "add", "element", "ip", "membrane",
-						"allowed", "{", elem, "}").Run(); err != nil {
-						log.Printf("dns-proxy: nft add %s to allowed: %v", elem, err)
-					}
+					"allowed", "{", elem, "}").Run(); err != nil {
+					log.Printf("dns-proxy: nft add %s to allowed: %v", elem, err)
 				}
-				updateReverseMap(ip.String(), respName)
 			}
 		}
-		log.Printf("dns-proxy: %s → %v (ports=%v)", respName, ips, ports)
+		updateReverseMap(ip.String(), name)
 	}
+	resolved[name] = ips
+}
 
-	conn.WriteToUDP(resp, clientAddr)
+// hostsTTL is the TTL on answers synthesised from static host overrides.
+const hostsTTL = 60
+
+// hostsResponse builds an authoritative answer for a static host override.
+// A queries get one A record per IP; every other permitted qtype gets an
+// empty NOERROR (NODATA) answer so resolvers don't fall through upstream.
+// Any additional records in the query (e.g. EDNS OPT) are dropped.
+func hostsResponse(query []byte, qtype uint16, ips []net.IP) []byte {
+	_, off := parseDNSName(query, 12)
+	end := off + 4 // QTYPE + QCLASS
+	if end > len(query) {
+		end = len(query)
+	}
+	resp := make([]byte, end, end+len(ips)*16)
+	copy(resp, query[:end])
+	resp[2] = (query[2] & 0x01) | 0x84 // QR=1, AA=1, preserve RD bit
+	resp[3] = 0x80                     // RA=1, RCODE=0 (NOERROR)
+	resp[8], resp[9] = 0, 0            // NSCOUNT = 0
+	resp[10], resp[11] = 0, 0          // ARCOUNT = 0
+
+	var ancount uint16
+	if qtype == 1 {
+		for _, ip := range ips {
+			ip4 := ip.To4()
+			if ip4 == nil {
+				continue
+			}
+			rr := make([]byte, 16)
+			binary.BigEndian.PutUint16(rr[0:2], 0xC00C) // pointer to question name
+			binary.BigEndian.PutUint16(rr[2:4], 1)      // TYPE A
+			binary.BigEndian.PutUint16(rr[4:6], 1)      // CLASS IN
+			binary.BigEndian.PutUint32(rr[6:10], hostsTTL)
+			binary.BigEndian.PutUint16(rr[10:12], 4)
+			copy(rr[12:16], ip4)
+			resp = append(resp, rr...)
+			ancount++
+		}
+	}
+	binary.BigEndian.PutUint16(resp[6:8], ancount)
+	return resp
+}
+
+// loadHosts reads the static host overrides file (name → IPv4 list).
+// A missing file means no overrides.
+func loadHosts(path string) map[string][]net.IP {
+	hosts := map[string][]net.IP{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("dns-proxy: read hosts file: %v", err)
+		}
+		return hosts
+	}
+	var raw map[string][]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		log.Printf("dns-proxy: parse hosts file: %v", err)
+		return hosts
+	}
+	for name, addrs := range raw {
+		name = strings.TrimRight(strings.ToLower(name), ".")
+		for _, a := range addrs {
+			ip := net.ParseIP(a).To4()
+			if ip == nil {
+				log.Printf("dns-proxy: ignoring non-IPv4 address %q for %s", a, name)
+				continue
+			}
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	return hosts
 }
 
 // parseDNSName parses a DNS name from pkt at offset off,
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// controlSocket is where dns-proxy accepts rule changes and approval
+// traffic. Each connection starts with a verb line: "allow" or "revoke"
+// (client: `dns-proxy allow|revoke`), "approvals" (client: `dns-proxy
+// approvals`) or "ask" (client: the mitmproxy addon).
+const controlSocket = "/run/membrane/dns-proxy.sock"
+
+// current holds the allowedSet used for new queries; replaced on reload.
+var current atomic.Pointer[allowedSet]
+
+// resolved remembers the IPs most recently returned for each name that was
+// added to the nftables sets, so a reload can carry them into the new table
+// if the name is still allowed. resolvedMu is held while elements are
+// added and across a reload's table swap, so no element is added to a
+// table that's being replaced.
+var (
+	resolvedMu sync.Mutex
+	resolved   = map[string][]net.IP{}
+)
+
+// reloadMu serialises rule changes, from the read of the active rules to
+// the reload, so two changes can't lose each other's rules or interleave
+// their firewall and allow-file updates.
+var reloadMu sync.Mutex
+
+// serveControl listens on the control socket and dispatches each
+// connection on its verb. A rule change replies with a line per rule,
+// then "ok" or "error: <reason>".
+func serveControl(allowFile string, globalQTypes []uint16) {
+	os.Remove(controlSocket)
+	ln, err := net.Listen("unix", controlSocket)
+	if err != nil {
+		log.Printf("dns-proxy: control socket: %v (runtime reload disabled)", err)
+		return
+	}
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			log.Printf("dns-proxy: control accept: %v", err)
+			continue
+		}
+		go func() {
+			defer c.Close()
+			r := bufio.NewReader(c)
+			verb, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch verb = strings.TrimSpace(verb); verb {
+			case "allow", "revoke":
+				var rules []json.RawMessage
+				data, err := io.ReadAll(r)
+				if err == nil {
+					err = json.Unmarshal(data, &rules)
+				}
+				var notes []string
+				if err == nil {
+					edit := allowRules
+					if verb == "revoke" {
+						edit = revokeRules
+					}
+					notes, err = editRules(allowFile, globalQTypes, func(active []json.RawMessage) ([]json.RawMessage, []string, error) {
+						return edit(active, rules)
+					})
+				}
+				if err != nil {
+					log.Printf("dns-proxy: %s failed: %v", verb, err)
+					fmt.Fprintf(c, "error: %v\n", err)
+					return
+				}
+				for _, n := range notes {
+					fmt.Fprintln(c, n)
+				}
+				fmt.Fprintln(c, "ok")
+			case "approvals":
+				approvals.attach(c, r)
+			case "ask":
+				approvals.serveAsk(c, r)
+			default:
+				fmt.Fprintf(c, "error: unknown command %q\n", strings.TrimSpace(verb))
+			}
+		}()
+	}
+}
+
+// editRules applies edit to the active rule set and reloads the result,
+// returning edit's notes for the client. It holds reloadMu throughout, so
+// `membrane allow`, `membrane revoke` and approval decisions each see the
+// others' changes.
+func editRules(allowFile string, globalQTypes []uint16, edit func([]json.RawMessage) ([]json.RawMessage, []string, error)) ([]string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	data, err := os.ReadFile(allowFile)
+	if err != nil {
+		return nil, fmt.Errorf("read active rules: %w", err)
+	}
+	var rules []json.RawMessage
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse active rules: %w", err)
+	}
+	rules, notes, err := edit(rules)
+	if err != nil {
+		return nil, err
+	}
+	if rules == nil {
+		rules = []json.RawMessage{}
+	}
+	if data, err = json.Marshal(rules); err != nil {
+		return nil, fmt.Errorf("encode rules: %w", err)
+	}
+	return notes, reloadLocked(data, allowFile, globalQTypes)
+}
+
+// addRule appends one rule to the active rule set and reloads it.
+func addRule(rule json.RawMessage, allowFile string, globalQTypes []uint16) error {
+	_, err := editRules(allowFile, globalQTypes, func(rules []json.RawMessage) ([]json.RawMessage, []string, error) {
+		return append(rules, rule), nil, nil
+	})
+	return err
+}
+
+// allowRules adds each of add that isn't already in rules.
+func allowRules(rules, add []json.RawMessage) ([]json.RawMessage, []string, error) {
+	var notes []string
+	for _, r := range add {
+		f, err := parseRuleFields(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		if indexRule(rules, f) >= 0 {
+			notes = append(notes, fmt.Sprintf("%s already allowed", f.dest()))
+			continue
+		}
+		rules = append(rules, r)
+		notes = append(notes, fmt.Sprintf("allowed %s", f.dest()))
+	}
+	return rules, notes, nil
+}
+
+// revokeRules removes what each of remove revokes from rules. An entry
+// with only a destination (no port, path, http or qtypes constraints)
+// removes every rule for that destination; otherwise only identical rules
+// are removed. An entry that removes nothing fails the whole revoke.
+func revokeRules(rules, remove []json.RawMessage) ([]json.RawMessage, []string, error) {
+	var notes []string
+	for _, r := range remove {
+		f, err := parseRuleFields(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		kept := rules[:0:0]
+		for _, existing := range rules {
+			e, err := parseRuleFields(existing)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !f.revokes(e) {
+				kept = append(kept, existing)
+			}
+		}
+		if len(kept) == len(rules) {
+			return nil, nil, fmt.Errorf("no rule matching %s in session", f.dest())
+		}
+		notes = append(notes, fmt.Sprintf("revoked %d rule(s) for %s", len(rules)-len(kept), f.dest()))
+		rules = kept
+	}
+	return rules, notes, nil
+}
+
+// ruleFields is a rule as decoded JSON, for comparing rules field by
+// field, including those allowRule leaves to the L7 filter.
+type ruleFields map[string]any
+
+func parseRuleFields(r json.RawMessage) (ruleFields, error) {
+	var f ruleFields
+	if err := json.Unmarshal(r, &f); err != nil {
+		return nil, fmt.Errorf("parse rule %s: %w", r, err)
+	}
+	return f, nil
+}
+
+// dest returns the destination of the rule as written in config.
+func (f ruleFields) dest() string {
+	switch f["type"] {
+	case "any":
+		return "*"
+	case "cidr":
+		return fmt.Sprint(f["cidr"])
+	}
+	return fmt.Sprint(f["host"])
+}
+
+// revokes reports whether revoking f removes existing.
+func (f ruleFields) revokes(existing ruleFields) bool {
+	if reflect.DeepEqual(f, existing) {
+		return true
+	}
+	for _, k := range []string{"ports", "path", "http", "qtypes"} {
+		if _, ok := f[k]; ok {
+			return false
+		}
+	}
+	return f.dest() == existing.dest()
+}
+
+func indexRule(rules []json.RawMessage, f ruleFields) int {
+	for i, r := range rules {
+		if e, err := parseRuleFields(r); err == nil && reflect.DeepEqual(f, e) {
+			return i
+		}
+	}
+	return -1
+}
+
+// reloadLocked replaces the active rule set with rulesJSON. The new
+// nftables table (static CIDRs from the rules plus previously resolved
+// IPs for names that are still allowed) is loaded in one nft transaction
+// before the active allow file is swapped, so the L3 and L7 views change
+// together and a failed reload leaves the old rules in force. The caller
+// holds reloadMu.
+func reloadLocked(rulesJSON []byte, allowFile string, globalQTypes []uint16) error {
+	var rules []allowRule
+	if err := json.Unmarshal(rulesJSON, &rules); err != nil {
+		return fmt.Errorf("parse rules: %w", err)
+	}
+	next := buildAllowedHosts(string(rulesJSON), globalQTypes)
+
+	var anyPort, constrained []string
+	carried := map[string][]net.IP{}
+	resolvedMu.Lock()
+	defer resolvedMu.Unlock()
+	for name, ips := range resolved {
+		ports, _, _, populate := next.match(name)
+		if !populate {
+			continue
+		}
+		carried[name] = ips
+		for _, ip := range ips {
+			if ports == nil {
+				anyPort = appendUnique(anyPort, ip.String()+"/32")
+				continue
+			}
+			for _, pr := range ports {
+				constrained = appendUnique(constrained,
+					fmt.Sprintf("%s . %s . %d", ip, pr.Proto, pr.Port))
+			}
+		}
+	}
+
+	tmp := allowFile + ".next"
+	if err := os.WriteFile(tmp, rulesJSON, 0644); err != nil {
+		return fmt.Errorf("write %s: %w", tmp, err)
+	}
+	cmd := exec.Command("/firewall.sh", tmp)
+	cmd.Env = append(os.Environ(),
+		"MEMBRANE_EXTRA_ANY_PORT="+strings.Join(anyPort, ","),
+		"MEMBRANE_EXTRA_ALLOWED="+strings.Join(constrained, ","),
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("load firewall: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	// The mitmproxy addon notices the new file and reloads its L7 rules.
+	if err := os.Rename(tmp, allowFile); err != nil {
+		return fmt.Errorf("activate rules: %w", err)
+	}
+
+	current.Store(next)
+	resolved = carried
+	// Connections already established to addresses that are no longer
+	// allowed stay open; the L7 filter checks their new requests.
+
+	log.Printf("dns-proxy: reloaded %d rules: tracking %d hostnames, %d patterns, anyHost=%v, kept %d resolved names",
+		len(rules), len(next.exact), len(next.patterns), next.anyHost, len(carried))
+	return nil
+}
+
+// requestRules sends the rules read from r to the running dns-proxy to
+// allow or revoke (verb), waits for them to be applied, and copies its
+// notes on each rule to out.
+func requestRules(verb string, r io.Reader, out io.Writer) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("read rules: %w", err)
+	}
+	c, err := net.Dial("unix", controlSocket)
+	if err != nil {
+		return fmt.Errorf("connect to dns-proxy: %w", err)
+	}
+	defer c.Close()
+	if _, err := c.Write(append([]byte(verb+"\n"), data...)); err != nil {
+		return fmt.Errorf("send rules: %w", err)
+	}
+	if err := c.(*net.UnixConn).CloseWrite(); err != nil {
+		return fmt.Errorf("send rules: %w", err)
+	}
+	replies := bufio.NewReader(c)
+	for {
+		reply, err := replies.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("read reply: %w", err)
+		}
+		switch reply = strings.TrimSpace(reply); {
+		case reply == "ok":
+			return nil
+		case strings.HasPrefix(reply, "error: "):
+			return fmt.Errorf("%s", strings.TrimPrefix(reply, "error: "))
+		}
+		fmt.Fprintln(out, reply)
+	}
+}
+
+func appendUnique(s []string, v string) []string {
+	for _, x := range s {
+		if x == v {
+			return s
+		}
+	}
+	return append(s, v)
+}
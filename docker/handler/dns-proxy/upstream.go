@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultUpstreamTimeout applies to resolvers without an explicit timeout.
+const defaultUpstreamTimeout = 5 * time.Second
+
+// resolver is a single upstream DNS server.
+type resolver struct {
+	Address string        `json:"address"` // host:port
+	Timeout time.Duration `json:"-"`
+}
+
+func (r *resolver) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Address string `json:"address"`
+		Timeout string `json:"timeout"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	r.Address = withDefaultPort(raw.Address)
+	r.Timeout = defaultUpstreamTimeout
+	if raw.Timeout != "" {
+		d, err := time.ParseDuration(raw.Timeout)
+		if err != nil {
+			return fmt.Errorf("resolver %s: invalid timeout %q: %w", raw.Address, raw.Timeout, err)
+		}
+		r.Timeout = d
+	}
+	return nil
+}
+
+// dnsRoute sends queries for names under suffix to its resolvers, tried
+// in order.
+type dnsRoute struct {
+	Suffix    string     `json:"suffix"`
+	Resolvers []resolver `json:"resolvers"`
+}
+
+// upstreams is the split-horizon resolver configuration: routes are
+// matched longest-suffix first, falling back to the default resolvers.
+type upstreams struct {
+	Default []resolver `json:"default"`
+	Routes  []dnsRoute `json:"routes"`
+}
+
+func withDefaultPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+}
+
+// loadUpstreams reads the resolver config file. When the file is absent it
+// falls back to the single resolver in MEMBRANE_DNS_RESOLVER (or 1.1.1.1).
+func loadUpstreams(path string) (*upstreams, error) {
+	u := &upstreams{}
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	default:
+		if err := json.Unmarshal(data, u); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	if len(u.Default) == 0 {
+		addr := os.Getenv("MEMBRANE_DNS_RESOLVER")
+		if addr == "" {
+			addr = "1.1.1.1"
+		}
+		u.Default = []resolver{{Address: withDefaultPort(addr), Timeout: defaultUpstreamTimeout}}
+	}
+	for i := range u.Routes {
+		u.Routes[i].Suffix = strings.Trim(strings.ToLower(u.Routes[i].Suffix), ".")
+	}
+	// Longest suffix wins, so check the most specific routes first.
+	sort.SliceStable(u.Routes, func(i, j int) bool {
+		return len(u.Routes[i].Suffix) > len(u.Routes[j].Suffix)
+	})
+	return u, nil
+}
+
+// resolversFor returns the ordered resolvers responsible for name.
+func (u *upstreams) resolversFor(name string) []resolver {
+	for _, r := range u.Routes {
+		if name == r.Suffix || strings.HasSuffix(name, "."+r.Suffix) {
+			return r.Resolvers
+		}
+	}
+	return u.Default
+}
+
+func (u *upstreams) String() string {
+	var parts []string
+	for _, r := range u.Default {
+		parts = append(parts, r.Address)
+	}
+	s := strings.Join(parts, ",")
+	for _, rt := range u.Routes {
+		parts = parts[:0]
+		for _, r := range rt.Resolvers {
+			parts = append(parts, r.Address)
+		}
+		s += fmt.Sprintf(" %s→%s", rt.Suffix, strings.Join(parts, ","))
+	}
+	return s
+}
+
+// forward sends query to each resolver in turn until one answers with
+// something other than SERVFAIL. It returns the response and the address
+// of the resolver that produced it. If every resolver fails, the last
+// SERVFAIL response (if any) is returned so the client sees the error.
+func forward(query []byte, resolvers []resolver) ([]byte, string, error) {
+	var lastResp []byte
+	var lastAddr string
+	var lastErr error
+	for _, r := range resolvers {
+		resp, err := exchange(query, r)
+		if err != nil {
+			log.Printf("dns-proxy: upstream %s: %v", r.Address, err)
+			lastErr = err
+			continue
+		}
+		if len(resp) >= 4 && resp[3]&0x0F == 2 { // SERVFAIL
+			log.Printf("dns-proxy: upstream %s returned SERVFAIL", r.Address)
+			lastResp, lastAddr = resp, r.Address
+			continue
+		}
+		return resp, r.Address, nil
+	}
+	if lastResp != nil {
+		return lastResp, lastAddr, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no resolvers configured")
+	}
+	return nil, "", lastErr
+}
+
+// exchange performs a single UDP round trip with r, discarding replies
+// whose transaction ID doesn't match the query.
+func exchange(query []byte, r resolver) ([]byte, error) {
+	addr, err := net.ResolveUDPAddr("udp", r.Address)
+	if err != nil {
+		return nil, fmt.Errorf("resolve: %w", err)
+	}
+	upConn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+	defer upConn.Close()
+
+	if _, err := upConn.Write(query); err != nil {
+		return nil, fmt.Errorf("write: %w", err)
+	}
+
+	upConn.SetReadDeadline(time.Now().Add(r.Timeout))
+	resp := make([]byte, 4096)
+	for {
+		n, err := upConn.Read(resp)
+		if err != nil {
+			return nil, fmt.Errorf("read: %w", err)
+		}
+		if n >= 2 && binary.BigEndian.Uint16(resp[:2]) == binary.BigEndian.Uint16(query[:2]) {
+			return resp[:n], nil
+		}
+	}
+}
@@ -38,57 +38,16 @@ echo "Interfaces: external=$DEFAULT_GW_IF internal=$INTERNAL_IF"
 # Enable IP forwarding
 sysctl -w net.ipv4.ip_forward=1 >/dev/null 2>&1 || true
 
-DNS_RESOLVER="${MEMBRANE_DNS_RESOLVER:-1.1.1.1}"
+DNS_FILE="${MEMBRANE_DNS_FILE:-/etc/membrane/dns.json}"
 ALLOW_FILE="${MEMBRANE_ALLOW_FILE:-/etc/membrane/allow.json}"
+HOSTS_FILE="${MEMBRANE_HOSTS_FILE:-/etc/membrane/hosts.json}"
 
-# Extract CIDRs from allow file for initial nftables population.
-# CIDRs without ports → @allowed-any-port (TCP only via forward rule).
-# CIDRs with ports → @allowed (ip . proto . port).
-# Hostnames are resolved dynamically by dns-proxy at query time.
-read -r -d '' _EXTRACT_RULES <<'PYEOF' || true
-import json, sys
-with open(sys.argv[1]) as f:
-    rules = json.load(f)
-any_port = []
-port_constrained = []
-any_host = False
-any_host_tcp_ports = []
-any_host_udp_ports = []
-for r in rules:
-    if r.get('type') == 'cidr' and r.get('cidr'):
-        ports = r.get('ports') or []
-        if not ports:
-            any_port.append(r['cidr'])
-        else:
-            for p in ports:
-                port_constrained.append(f"{r['cidr']} . {p['proto']} . {p['port']}")
-    elif r.get('type') == 'any':
-        any_host = True
-        ports = r.get('ports') or []
-        if not ports:
-            # No ports = any port; clear lists to signal "any"
-            any_host_tcp_ports = None
-            any_host_udp_ports = None
-        elif any_host_tcp_ports is not None:
-            for p in ports:
-                if p['proto'] == 'tcp' and p['port'] not in any_host_tcp_ports:
-                    any_host_tcp_ports.append(p['port'])
-                elif p['proto'] == 'udp' and any_host_udp_ports is not None and p['port'] not in any_host_udp_ports:
-                    any_host_udp_ports.append(p['port'])
-print('ANY_PORT=' + ','.join(any_port))
-print('PORT_CONSTRAINED=' + ','.join(port_constrained))
-print('ANY_HOST=' + ('1' if any_host else ''))
-print('ANY_HOST_TCP_PORTS=' + (','.join(str(p) for p in any_host_tcp_ports) if any_host_tcp_ports else ''))
-print('ANY_HOST_UDP_PORTS=' + (','.join(str(p) for p in any_host_udp_ports) if any_host_udp_ports else ''))
-PYEOF
-_EXTRACT_OUTPUT=$(python3 -c "$_EXTRACT_RULES" "$ALLOW_FILE" 2>/dev/null)
-ANY_PORT=$(echo "$_EXTRACT_OUTPUT" | grep '^ANY_PORT=' | cut -d= -f2-)
-PORT_CONSTRAINED=$(echo "$_EXTRACT_OUTPUT" | grep '^PORT_CONSTRAINED=' | cut -d= -f2-)
-ANY_HOST=$(echo "$_EXTRACT_OUTPUT" | grep '^ANY_HOST=' | cut -d= -f2-)
-ANY_HOST_TCP_PORTS=$(echo "$_EXTRACT_OUTPUT" | grep '^ANY_HOST_TCP_PORTS=' | cut -d= -f2-)
-ANY_HOST_UDP_PORTS=$(echo "$_EXTRACT_OUTPUT" | grep '^ANY_HOST_UDP_PORTS=' | cut -d= -f2-)
-
-[ -n "$ANY_PORT" ] || ANY_PORT="127.0.0.2/32"
+# Components read the active copy of the allow file, which dns-proxy
+# replaces when rules are reloaded at runtime. The mounted file is only
+# the initial rule set.
+mkdir -p /run/membrane
+ACTIVE_ALLOW_FILE=/run/membrane/allow.json
+cp "$ALLOW_FILE" "$ACTIVE_ALLOW_FILE"
 
 MITMPROXY_PORT=8080
 
@@ -97,85 +56,10 @@ if [ "${MEMBRANE_SSL_INSECURE:-false}" = "true" ]; then
     SSL_INSECURE_FLAG="--ssl-insecure"
 fi
 
-# Build elements clauses (nftables requires non-empty elements list)
-ANY_PORT_ELEMENTS="elements = { $ANY_PORT }"
-if [ -n "$PORT_CONSTRAINED" ]; then
-    ALLOWED_ELEMENTS="elements = { $PORT_CONSTRAINED }"
-else
-    ALLOWED_ELEMENTS=""
-fi
-
 # Set up nftables
-nft -f - <<EOF
-table ip membrane
-delete table ip membrane
-table ip membrane {
-    set allowed {
-        type ipv4_addr . inet_proto . inet_service
-        flags interval
-        $ALLOWED_ELEMENTS
-    }
-
-    set allowed-any-port {
-        type ipv4_addr
-        flags interval
-        $ANY_PORT_ELEMENTS
-    }
-
-    chain prerouting {
-        type nat hook prerouting priority dstnat; policy accept;
-        iifname "$INTERNAL_IF" ip daddr @allowed-any-port meta l4proto tcp redirect to :$MITMPROXY_PORT
-        iifname "$INTERNAL_IF" ip daddr . meta l4proto . th dport @allowed meta l4proto tcp redirect to :$MITMPROXY_PORT
-        iifname "$INTERNAL_IF" ip daddr . meta l4proto . th dport @allowed meta l4proto udp accept
-        $(if [ "$ANY_HOST" = "1" ]; then
-    if [ -z "$ANY_HOST_TCP_PORTS" ]; then
-        echo "iifname \"$INTERNAL_IF\" meta l4proto tcp redirect to :$MITMPROXY_PORT"
-    else
-        IFS=',' read -ra _ports <<<"$ANY_HOST_TCP_PORTS"
-        for _p in "${_ports[@]}"; do
-            echo "iifname \"$INTERNAL_IF\" tcp dport $_p redirect to :$MITMPROXY_PORT"
-        done
-    fi
-fi)
-    }
-
-    chain postrouting {
-        type nat hook postrouting priority srcnat; policy accept;
-        oifname "$DEFAULT_GW_IF" masquerade
-    }
-
-    chain input {
-        type filter hook input priority filter; policy accept;
-        iifname "$INTERNAL_IF" udp dport 53 accept
-    }
-
-    chain forward {
-        type filter hook forward priority filter; policy drop;
-        ct state established,related accept
-        tcp flags syn tcp option maxseg size set rt mtu
-        iifname "$INTERNAL_IF" ip daddr @allowed-any-port meta l4proto tcp accept
-        iifname "$INTERNAL_IF" ip daddr . meta l4proto . th dport @allowed accept
-        $(if [ "$ANY_HOST" = "1" ]; then
-    if [ -z "$ANY_HOST_TCP_PORTS" ]; then
-        echo "iifname \"$INTERNAL_IF\" meta l4proto tcp accept"
-    else
-        IFS=',' read -ra _ports <<<"$ANY_HOST_TCP_PORTS"
-        for _p in "${_ports[@]}"; do
-            echo "iifname \"$INTERNAL_IF\" tcp dport $_p accept"
-        done
-    fi
-    if [ -n "$ANY_HOST_UDP_PORTS" ]; then
-        IFS=',' read -ra _uports <<<"$ANY_HOST_UDP_PORTS"
-        for _u in "${_uports[@]}"; do
-            echo "iifname \"$INTERNAL_IF\" udp dport $_u accept"
-        done
-    fi
-fi)
-        iifname "$INTERNAL_IF" log prefix "[membrane BLOCKED] " limit rate 5/second
-        iifname "$INTERNAL_IF" reject with icmp admin-prohibited
-    }
-}
-EOF
+export MEMBRANE_INTERNAL_IF="$INTERNAL_IF" MEMBRANE_EXTERNAL_IF="$DEFAULT_GW_IF"
+export MEMBRANE_MITMPROXY_PORT="$MITMPROXY_PORT"
+/firewall.sh "$ACTIVE_ALLOW_FILE"
 
 echo "Firewall rules loaded."
 
@@ -185,7 +69,8 @@ ip6tables -P FORWARD DROP 2>/dev/null || true
 ip6tables -P OUTPUT DROP 2>/dev/null || true
 
 # Start DNS proxy (updates nftables sets on resolution)
-MEMBRANE_DNS_RESOLVER="$DNS_RESOLVER" MEMBRANE_ALLOW_FILE="$ALLOW_FILE" dns-proxy &
+MEMBRANE_DNS_FILE="$DNS_FILE" MEMBRANE_ALLOW_FILE="$ACTIVE_ALLOW_FILE" \
+    MEMBRANE_HOSTS_FILE="$HOSTS_FILE" dns-proxy &
 DNS_PROXY_PID=$!
 echo "DNS proxy started (PID $DNS_PROXY_PID)."
 
@@ -200,7 +85,7 @@ cat /tmp/ca.key /membrane-ca/ca.crt >/tmp/mitmproxy/mitmproxy-ca.pem
 echo "CA cert generated."
 
 # Start mitmproxy in transparent mode
-PYTHONUNBUFFERED=1 mitmdump \
+PYTHONUNBUFFERED=1 MEMBRANE_ALLOW_FILE="$ACTIVE_ALLOW_FILE" mitmdump \
     --mode transparent \
     --listen-port "$MITMPROXY_PORT" \
     --set confdir=/tmp/mitmproxy \
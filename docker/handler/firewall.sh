@@ -0,0 +1,164 @@
+#!/usr/bin/env bash
+# Generates the membrane nftables table from an allow file and loads it in
+# a single transaction, replacing any previous table atomically. Run by
+# entrypoint.sh at startup and by dns-proxy when rules are reloaded.
+#
+# Usage: firewall.sh ALLOW_FILE
+#
+# MEMBRANE_INTERNAL_IF and MEMBRANE_EXTERNAL_IF name the handler's
+# interfaces. dns-proxy passes addresses it has already resolved for
+# still-allowed names via MEMBRANE_EXTRA_ANY_PORT and MEMBRANE_EXTRA_ALLOWED
+# (comma-separated set elements) so they survive the table replacement.
+set -euo pipefail
+
+ALLOW_FILE="$1"
+INTERNAL_IF="${MEMBRANE_INTERNAL_IF:?}"
+DEFAULT_GW_IF="${MEMBRANE_EXTERNAL_IF:?}"
+MITMPROXY_PORT="${MEMBRANE_MITMPROXY_PORT:-8080}"
+
+# Extract CIDRs from allow file for nftables population.
+# CIDRs without ports → @allowed-any-port (TCP only via forward rule).
+# CIDRs with ports → @allowed (ip . proto . port).
+# Hostnames are resolved dynamically by dns-proxy at query time.
+read -r -d '' _EXTRACT_RULES <<'PYEOF' || true
+import json, sys
+with open(sys.argv[1]) as f:
+    rules = json.load(f)
+any_port = []
+port_constrained = []
+any_host = False
+any_host_tcp_ports = []
+any_host_udp_ports = []
+for r in rules:
+    if r.get('type') == 'cidr' and r.get('cidr'):
+        ports = r.get('ports') or []
+        if not ports:
+            any_port.append(r['cidr'])
+        else:
+            for p in ports:
+                port_constrained.append(f"{r['cidr']} . {p['proto']} . {p['port']}")
+    elif r.get('type') == 'any':
+        any_host = True
+        ports = r.get('ports') or []
+        if not ports:
+            # No ports = any port; clear lists to signal "any"
+            any_host_tcp_ports = None
+            any_host_udp_ports = None
+        elif any_host_tcp_ports is not None:
+            for p in ports:
+                if p['proto'] == 'tcp' and p['port'] not in any_host_tcp_ports:
+                    any_host_tcp_ports.append(p['port'])
+                elif p['proto'] == 'udp' and any_host_udp_ports is not None and p['port'] not in any_host_udp_ports:
+                    any_host_udp_ports.append(p['port'])
+print('ANY_PORT=' + ','.join(any_port))
+print('PORT_CONSTRAINED=' + ','.join(port_constrained))
+print('ANY_HOST=' + ('1' if any_host else ''))
+print('ANY_HOST_TCP_PORTS=' + (','.join(str(p) for p in any_host_tcp_ports) if any_host_tcp_ports else ''))
+print('ANY_HOST_UDP_PORTS=' + (','.join(str(p) for p in any_host_udp_ports) if any_host_udp_ports else ''))
+PYEOF
+_EXTRACT_OUTPUT=$(python3 -c "$_EXTRACT_RULES" "$ALLOW_FILE" 2>/dev/null)
+ANY_PORT=$(echo "$_EXTRACT_OUTPUT" | grep '^ANY_PORT=' | cut -d= -f2-)
+PORT_CONSTRAINED=$(echo "$_EXTRACT_OUTPUT" | grep '^PORT_CONSTRAINED=' | cut -d= -f2-)
+ANY_HOST=$(echo "$_EXTRACT_OUTPUT" | grep '^ANY_HOST=' | cut -d= -f2-)
+ANY_HOST_TCP_PORTS=$(echo "$_EXTRACT_OUTPUT" | grep '^ANY_HOST_TCP_PORTS=' | cut -d= -f2-)
+ANY_HOST_UDP_PORTS=$(echo "$_EXTRACT_OUTPUT" | grep '^ANY_HOST_UDP_PORTS=' | cut -d= -f2-)
+
+# Carry over elements resolved by dns-proxy before the reload.
+if [ -n "${MEMBRANE_EXTRA_ANY_PORT:-}" ]; then
+    ANY_PORT="${ANY_PORT:+$ANY_PORT,}$MEMBRANE_EXTRA_ANY_PORT"
+fi
+if [ -n "${MEMBRANE_EXTRA_ALLOWED:-}" ]; then
+    PORT_CONSTRAINED="${PORT_CONSTRAINED:+$PORT_CONSTRAINED,}$MEMBRANE_EXTRA_ALLOWED"
+fi
+
+[ -n "$ANY_PORT" ] || ANY_PORT="127.0.0.2/32"
+
+# Build elements clauses (nftables requires non-empty elements list)
+ANY_PORT_ELEMENTS="elements = { $ANY_PORT }"
+if [ -n "$PORT_CONSTRAINED" ]; then
+    ALLOWED_ELEMENTS="elements = { $PORT_CONSTRAINED }"
+else
+    ALLOWED_ELEMENTS=""
+fi
+
+# Set up nftables
+nft -f - <<EOF
+table ip membrane
+delete table ip membrane
+table ip membrane {
+    set allowed {
+        type ipv4_addr . inet_proto . inet_service
+        flags interval
+        $ALLOWED_ELEMENTS
+    }
+
+    set allowed-any-port {
+        type ipv4_addr
+        flags interval
+        auto-merge
+        $ANY_PORT_ELEMENTS
+    }
+
+    # Addresses of lookups the user allowed once (--approve). dns-proxy
+    # adds them with a timeout, for HTTP and HTTPS only.
+    set allowed-once {
+        type ipv4_addr . inet_proto . inet_service
+        flags timeout
+    }
+
+    chain prerouting {
+        type nat hook prerouting priority dstnat; policy accept;
+        iifname "$INTERNAL_IF" ip daddr @allowed-any-port meta l4proto tcp redirect to :$MITMPROXY_PORT
+        iifname "$INTERNAL_IF" ip daddr . meta l4proto . th dport @allowed meta l4proto tcp redirect to :$MITMPROXY_PORT
+        iifname "$INTERNAL_IF" ip daddr . meta l4proto . th dport @allowed meta l4proto udp accept
+        iifname "$INTERNAL_IF" ip daddr . meta l4proto . th dport @allowed-once meta l4proto tcp redirect to :$MITMPROXY_PORT
+        $(if [ "$ANY_HOST" = "1" ]; then
+    if [ -z "$ANY_HOST_TCP_PORTS" ]; then
+        echo "iifname \"$INTERNAL_IF\" meta l4proto tcp redirect to :$MITMPROXY_PORT"
+    else
+        IFS=',' read -ra _ports <<<"$ANY_HOST_TCP_PORTS"
+        for _p in "${_ports[@]}"; do
+            echo "iifname \"$INTERNAL_IF\" tcp dport $_p redirect to :$MITMPROXY_PORT"
+        done
+    fi
+fi)
+    }
+
+    chain postrouting {
+        type nat hook postrouting priority srcnat; policy accept;
+        oifname "$DEFAULT_GW_IF" masquerade
+    }
+
+    chain input {
+        type filter hook input priority filter; policy accept;
+        iifname "$INTERNAL_IF" udp dport 53 accept
+    }
+
+    chain forward {
+        type filter hook forward priority filter; policy drop;
+        ct state established,related accept
+        tcp flags syn tcp option maxseg size set rt mtu
+        iifname "$INTERNAL_IF" ip daddr @allowed-any-port meta l4proto tcp accept
+        iifname "$INTERNAL_IF" ip daddr . meta l4proto . th dport @allowed accept
+        iifname "$INTERNAL_IF" ip daddr . meta l4proto . th dport @allowed-once accept
+        $(if [ "$ANY_HOST" = "1" ]; then
+    if [ -z "$ANY_HOST_TCP_PORTS" ]; then
+        echo "iifname \"$INTERNAL_IF\" meta l4proto tcp accept"
+    else
+        IFS=',' read -ra _ports <<<"$ANY_HOST_TCP_PORTS"
+        for _p in "${_ports[@]}"; do
+            echo "iifname \"$INTERNAL_IF\" tcp dport $_p accept"
+        done
+    fi
+    if [ -n "$ANY_HOST_UDP_PORTS" ]; then
+        IFS=',' read -ra _uports <<<"$ANY_HOST_UDP_PORTS"
+        for _u in "${_uports[@]}"; do
+            echo "iifname \"$INTERNAL_IF\" udp dport $_u accept"
+        done
+    fi
+fi)
+        iifname "$INTERNAL_IF" log prefix "[membrane BLOCKED] " limit rate 5/second
+        iifname "$INTERNAL_IF" reject with icmp admin-prohibited
+    }
+}
+EOF
@@ -5,8 +5,8 @@ go 1.23.2
 require (
 	github.com/creack/pty/v2 v2.0.1
 	github.com/spf13/pflag v1.0.10
-	golang.org/x/term v0.27.0
+	golang.org/x/net v0.34.0
+	golang.org/x/sys v0.29.0
+	golang.org/x/term v0.28.0
 	gopkg.in/yaml.v3 v3.0.1
 )
-
-require golang.org/x/sys v0.28.0 // indirect
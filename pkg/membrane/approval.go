@@ -0,0 +1,296 @@
+package membrane
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+)
+
+// approvalTimeout is how long the handler holds a blocked request while
+// the user is asked about it. Unanswered requests are denied.
+const approvalTimeout = 30 * time.Second
+
+// approvalRequest and approvalDecision mirror the JSON lines exchanged
+// with `dns-proxy approvals`; see docker/handler/dns-proxy/approval.go.
+type approvalRequest struct {
+	ID     uint64 `json:"id"`
+	Kind   string `json:"kind"` // "dns" or "http"
+	Host   string `json:"host"`
+	Method string `json:"method,omitempty"`
+	Path   string `json:"path,omitempty"`
+}
+
+type approvalDecision struct {
+	ID       uint64     `json:"id"`
+	Decision string     `json:"decision"` // once, session, always, or deny
+	Rule     *AllowRule `json:"rule,omitempty"`
+}
+
+func (r approvalRequest) String() string {
+	if r.Kind == "dns" {
+		return "to resolve " + r.Host
+	}
+	return r.Method + " " + r.Host + r.Path
+}
+
+// rule returns the allow rule that approving r for the session adds:
+// the bare host for a lookup, or the method and path for a request.
+func (r approvalRequest) rule() (AllowRule, error) {
+	var rule AllowRule
+	if err := rule.parseAuto(r.Host); err != nil {
+		return rule, err
+	}
+	if r.Kind == "http" {
+		rule.HTTP = []HTTPRule{{
+			Methods: []string{r.Method},
+			Paths:   []PathRule{{Path: r.Path}},
+		}}
+	}
+	return rule, nil
+}
+
+// yamlNode returns r's rule as it is written in .membrane.yaml.
+func (r approvalRequest) yamlNode() *yaml.Node {
+	if r.Kind == "dns" {
+		return allowEntryNode(r.Host, nil, nil)
+	}
+	return allowEntryNode(r.Host, nil, []HTTPRule{{
+		Methods: []string{r.Method},
+		Paths:   []PathRule{{Path: r.Path}},
+	}})
+}
+
+// startApprovals attaches to the handler's approval stream and prompts
+// for each blocked request through gate. The returned stop function
+// detaches and reports rules written to the workspace config; call it
+// after the agent has exited so the report doesn't land in the PTY.
+func startApprovals(s sessionNames, workspaceDir string, gate *promptGate) (func(), error) {
+	if _, err := containers.InspectContainer(s.handlerContainer); err != nil {
+		return nil, fmt.Errorf("start approval stream: %w", err)
+	}
+	stdinR, stdin := io.Pipe()
+	stdout, stdoutW := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	var streamErr error
+	streamDone := make(chan struct{})
+	go func() {
+		defer close(streamDone)
+		_, streamErr = containers.Exec(ctx, s.handlerContainer,
+			[]string{"dns-proxy", "approvals"}, stdinR, stdoutW, nil)
+		stdoutW.CloseWithError(streamErr)
+	}()
+
+	type received struct {
+		req approvalRequest
+		at  time.Time
+	}
+	reqs := make(chan received)
+	var notes []string
+	var errLine string
+	go func() {
+		defer close(reqs)
+		sc := bufio.NewScanner(stdout)
+		for sc.Scan() {
+			line := sc.Text()
+			if strings.HasPrefix(line, "error: ") {
+				errLine = strings.TrimPrefix(line, "error: ")
+				continue
+			}
+			var req approvalRequest
+			if err := json.Unmarshal([]byte(line), &req); err != nil {
+				continue
+			}
+			reqs <- received{req, time.Now()}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		enc := json.NewEncoder(stdin)
+		for r := range reqs {
+			// The handler has already denied requests that waited in
+			// line longer than the timeout.
+			remaining := approvalTimeout - time.Since(r.at)
+			if remaining <= 0 {
+				continue
+			}
+			d := approvalDecision{ID: r.req.ID, Decision: "deny"}
+			key := gate.ask(fmt.Sprintf("membrane: agent wants %s — [o]nce [s]ession [a]lways [d]eny", r.req),
+				"osad", remaining)
+			switch key {
+			case 'o':
+				d.Decision = "once"
+			case 's', 'a':
+				rule, err := r.req.rule()
+				if err != nil {
+					notes = append(notes, fmt.Sprintf("could not allow %s: %v", r.req, err))
+					break
+				}
+				d.Decision, d.Rule = "session", &rule
+				if key == 'a' {
+					if err := appendWorkspaceRules(workspaceDir, r.req.yamlNode()); err != nil {
+						notes = append(notes, fmt.Sprintf("could not save rule for %s: %v", r.req.Host, err))
+						break
+					}
+					d.Decision = "always"
+					notes = append(notes, fmt.Sprintf("added %s to .membrane.yaml", r.req))
+				}
+			}
+			if err := enc.Encode(d); err != nil {
+				for range reqs {
+				}
+				return
+			}
+		}
+	}()
+
+	return func() {
+		stdin.Close()
+		cancel()
+		<-streamDone
+		<-done
+		if streamErr != nil && !errors.Is(streamErr, context.Canceled) {
+			fmt.Fprintf(os.Stderr, "Warning: approval stream: %v\n", streamErr)
+		}
+		if errLine != "" {
+			fmt.Fprintf(os.Stderr, "Warning: approval mode unavailable: %s\n", errLine)
+		}
+		for _, n := range notes {
+			fmt.Fprintf(os.Stderr, "membrane: %s\n", n)
+		}
+	}, nil
+}
+
+// promptGate lets approval prompts take over the interactive terminal
+// from execDocker's PTY proxy. While a prompt is shown the agent's output
+// is held back and keystrokes go to the prompt instead of the agent.
+type promptGate struct {
+	out sync.Mutex // held while the agent's output is paused
+
+	mu   sync.Mutex
+	ptmx *os.File  // the agent's PTY; nil until execDocker attaches
+	keys chan byte // non-nil while a prompt is reading keys
+}
+
+func (g *promptGate) attach(ptmx *os.File) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.ptmx = ptmx
+}
+
+func (g *promptGate) detach() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.ptmx = nil
+}
+
+// output wraps w so that writes wait while a prompt is shown.
+func (g *promptGate) output(w io.Writer) io.Writer {
+	return gatedWriter{g, w}
+}
+
+type gatedWriter struct {
+	g *promptGate
+	w io.Writer
+}
+
+func (w gatedWriter) Write(p []byte) (int, error) {
+	w.g.out.Lock()
+	defer w.g.out.Unlock()
+	return w.w.Write(p)
+}
+
+// copyInput copies src to dst, diverting keystrokes to the prompt while
+// one is shown.
+func (g *promptGate) copyInput(dst io.Writer, src io.Reader) {
+	buf := make([]byte, 1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			g.mu.Lock()
+			keys := g.keys
+			g.mu.Unlock()
+			if keys != nil {
+				for _, b := range buf[:n] {
+					select {
+					case keys <- b:
+					default:
+					}
+				}
+			} else if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ask shows question on the bottom row of the terminal and waits for one
+// of the keys in choices. Esc and Ctrl-C choose the last key. It returns
+// 0 if no key is pressed within timeout or no agent terminal is attached.
+func (g *promptGate) ask(question, choices string, timeout time.Duration) byte {
+	g.out.Lock()
+	defer g.out.Unlock()
+
+	g.mu.Lock()
+	ptmx := g.ptmx
+	if ptmx == nil {
+		g.mu.Unlock()
+		return 0
+	}
+	keys := make(chan byte, 16)
+	g.keys = keys
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		g.keys = nil
+		g.mu.Unlock()
+	}()
+
+	rows := 24
+	if _, h, err := term.GetSize(int(os.Stdin.Fd())); err == nil {
+		rows = h
+	}
+	// Save the cursor, draw in reverse video on the last row, and put
+	// everything back afterwards.
+	fmt.Fprintf(os.Stdout, "\x1b7\x1b[%d;1H\x1b[2K\x1b[7m %s \x1b[0m", rows, question)
+
+	var key byte
+	deadline := time.After(timeout)
+wait:
+	for {
+		select {
+		case b := <-keys:
+			if b == 0x03 || b == 0x1b {
+				b = choices[len(choices)-1]
+			}
+			if b >= 'A' && b <= 'Z' {
+				b += 'a' - 'A'
+			}
+			if strings.IndexByte(choices, b) >= 0 {
+				key = b
+				break wait
+			}
+		case <-deadline:
+			break wait
+		}
+	}
+	fmt.Fprintf(os.Stdout, "\x1b[%d;1H\x1b[2K\x1b8", rows)
+
+	// Nudge the PTY size so full-screen programs redraw over the prompt.
+	nudgeSize(ptmx)
+	return key
+}
@@ -0,0 +1,291 @@
+package membrane
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// Checkpoints (`membrane checkpoint` and `membrane resume`). A checkpoint
+// keeps what a session needs to start again after a reboot, under
+// ~/.membrane/checkpoints/<id>:
+//
+//	checkpoint.json  the session's spec, its live allow rules, and the image
+//	config.yaml      the config files as they were when the session started
+//	.membrane.yaml
+//	home/            an ephemeral agent home; other homes outlive the session
+//	criu/            the agent's processes, with Docker and CRIU
+//
+// The agent's filesystem is committed as the image
+// membrane-checkpoint:<id>. Resuming starts a new session from the spec,
+// with a new handler, networks and firewall built from the saved rules,
+// and the agent started from that image. Its processes are restored only
+// if Docker can: CRIU is experimental, and can't restore every process
+// (open connections, for one). Otherwise the agent's command starts
+// afresh on the restored filesystem.
+
+// checkpointImageName is the repository of checkpoint images; the tag is
+// the session ID.
+const checkpointImageName = "membrane-checkpoint"
+
+// checkpointName is the name of the CRIU checkpoint in criu/.
+const checkpointName = "membrane"
+
+type checkpoint struct {
+	Session     string      `json:"session"`
+	Created     time.Time   `json:"created"`
+	Image       string      `json:"image"`
+	Process     bool        `json:"process"`                // criu/ holds the agent's processes
+	ProcessNote string      `json:"process_note,omitempty"` // why it doesn't
+	Spec        sessionSpec `json:"spec"`
+	Rules       []AllowRule `json:"rules"`
+
+	dir string
+}
+
+func checkpointDir(id string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("get home dir: %w", err)
+	}
+	return filepath.Join(home, ".membrane", "checkpoints", id), nil
+}
+
+func loadCheckpoint(id string) (*checkpoint, error) {
+	dir, err := checkpointDir(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "checkpoint.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("session %s has no checkpoint", id)
+		}
+		return nil, fmt.Errorf("read checkpoint: %w", err)
+	}
+	ck := &checkpoint{dir: dir}
+	if err := json.Unmarshal(data, ck); err != nil {
+		return nil, fmt.Errorf("parse checkpoint: %w", err)
+	}
+	return ck, nil
+}
+
+// config loads the session's config from the checkpoint's copies of its
+// config files.
+func (ck *checkpoint) config() (*config, error) {
+	return loadConfigFiles(
+		filepath.Join(ck.dir, "config.yaml"),
+		filepath.Join(ck.dir, ".membrane.yaml"),
+		ck.Spec.NoGlobalConfig)
+}
+
+// apply makes cfg restore the checkpoint: its rules replace the configured
+// ones, since they include any allowed or revoked while the session ran.
+func (ck *checkpoint) apply(cfg *config) {
+	cfg.Allow = ck.Rules
+	cfg.image = ck.Image
+	cfg.restore = ck
+	if _, err := os.Stat(filepath.Join(ck.dir, "home")); err == nil {
+		cfg.Home.restore = filepath.Join(ck.dir, "home")
+	}
+}
+
+// restoreProcess starts the created agent container from the checkpoint's
+// processes, if it has them. It reports whether the agent is running;
+// if not, the agent is started as usual.
+func (ck *checkpoint) restoreProcess(s sessionNames) bool {
+	if ck == nil || !ck.Process {
+		return false
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(containerCLI, "start",
+		"--checkpoint", checkpointName,
+		"--checkpoint-dir", filepath.Join(ck.dir, "criu"),
+		s.agentContainer)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: restore agent processes: %s; starting the agent afresh\n", strings.TrimSpace(stderr.String()))
+		return false
+	}
+	return agentRunning(s)
+}
+
+// Checkpoint saves a running session so `membrane resume` can start it
+// again. A session's earlier checkpoint is replaced.
+func Checkpoint(ref string) error {
+	if err := selectEngine(); err != nil {
+		return err
+	}
+	r, err := loadSessionRecord(resolveSession(ref))
+	if err != nil {
+		return fmt.Errorf("session %s not found", ref)
+	}
+	r.refresh()
+	s := sessionNamesFor(r.ID)
+	if !r.live() || !agentRunning(s) {
+		return fmt.Errorf("session %s is not running", ref)
+	}
+	switch {
+	case r.Spec == nil, r.Spec.Config == nil:
+		return fmt.Errorf("session %s was started by an older membrane and can't be checkpointed", ref)
+	case r.Overlay != "", r.Worktree != "", r.GitDir != "":
+		// Their state lives outside the agent container, and is reviewed
+		// or cleaned up when the session ends.
+		return fmt.Errorf("sessions run with --cow, --worktree or mediate_git can't be checkpointed")
+	}
+
+	rules, err := sessionRules(s)
+	if err != nil {
+		return fmt.Errorf("read session rules: %w", err)
+	}
+	dir, err := checkpointDir(r.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("remove old checkpoint: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("create checkpoint dir: %w", err)
+	}
+	ck := &checkpoint{
+		Session: r.ID,
+		Created: time.Now().UTC(),
+		Image:   checkpointImageName + ":" + r.ID,
+		Spec:    *r.Spec,
+		Rules:   rules,
+		dir:     dir,
+	}
+
+	// The config the session started with, not the files as they are now.
+	for name, data := range map[string]string{
+		"config.yaml":    r.Spec.Config.Global,
+		".membrane.yaml": r.Spec.Config.Workspace,
+	} {
+		if data == "" {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o600); err != nil {
+			return fmt.Errorf("save %s: %w", name, err)
+		}
+	}
+	cfg, err := ck.config()
+	if err != nil {
+		return err
+	}
+	agent, err := containers.InspectContainer(s.agentContainer)
+	if err != nil {
+		return fmt.Errorf("inspect agent: %w", err)
+	}
+	if h := agent.Mounts["/home/agent"]; h != "" && cfg.Home.Mode == homeEphemeral {
+		if err := copyHomePath(h, filepath.Join(dir, "home"), "."); err != nil {
+			return fmt.Errorf("save agent home: %w", err)
+		}
+	}
+
+	if err := containers.CommitContainer(s.agentContainer, ck.Image, map[string]string{"membrane.checkpoint": r.ID}); err != nil {
+		return fmt.Errorf("save agent filesystem: %w", err)
+	}
+	ck.Process, ck.ProcessNote = checkpointProcess(s, dir)
+
+	data, err := json.MarshalIndent(ck, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode checkpoint: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "checkpoint.json"), append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("write checkpoint: %w", err)
+	}
+
+	what := "filesystem and processes"
+	if !ck.Process {
+		what = "filesystem only: " + ck.ProcessNote
+	}
+	fmt.Fprintf(os.Stderr, "membrane: checkpointed session %s (%s)\n", r.ID, what)
+	fmt.Fprintf(os.Stderr, "membrane: resume it with: membrane resume %s\n", r.ID)
+	return nil
+}
+
+// checkpointProcess saves the agent's processes with CRIU, leaving them
+// running. It returns why it couldn't, if it couldn't.
+func checkpointProcess(s sessionNames, dir string) (bool, string) {
+	if _, ok := usingPodman(); ok {
+		return false, "process checkpoints need Docker"
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(containerCLI, "checkpoint", "create", "--leave-running",
+		"--checkpoint-dir", filepath.Join(dir, "criu"),
+		s.agentContainer, checkpointName)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return false, "docker checkpoint: " + msg
+	}
+	return true, ""
+}
+
+// RemoveCheckpoint deletes a session's checkpoint and its image.
+func RemoveCheckpoint(ref string) error {
+	if err := selectEngine(); err != nil {
+		return err
+	}
+	ck, err := loadCheckpoint(resolveSession(ref))
+	if err != nil {
+		return err
+	}
+	if err := containers.RemoveImage(ck.Image); err != nil && !isNotFound(err) {
+		return fmt.Errorf("remove checkpoint image: %w", err)
+	}
+	if err := os.RemoveAll(ck.dir); err != nil {
+		return fmt.Errorf("remove checkpoint: %w", err)
+	}
+	return nil
+}
+
+// Resume starts a checkpointed session again, in its workspace, with the
+// options it was started with. The checkpoint is kept, so a session can
+// be resumed again from the same point.
+func Resume(ref string, detach bool) error {
+	if err := selectEngine(); err != nil {
+		return err
+	}
+	id := resolveSession(ref)
+	ck, err := loadCheckpoint(id)
+	if err != nil {
+		return err
+	}
+	if r, err := loadSessionRecord(id); err == nil {
+		r.refresh()
+		if r.live() {
+			return fmt.Errorf("session %s is still running; stop it first: membrane stop %s", ref, ref)
+		}
+	}
+	if ok, err := containers.ImageExists(ck.Image); err != nil {
+		return fmt.Errorf("look up checkpoint image: %w", err)
+	} else if !ok {
+		return fmt.Errorf("checkpoint image %s is gone; remove the checkpoint with: membrane checkpoint --rm %s", ck.Image, ref)
+	}
+	if !detach && !term.IsTerminal(int(os.Stdin.Fd())) {
+		return fmt.Errorf("resume needs an interactive terminal, or -d")
+	}
+	if err := os.Chdir(ck.Spec.WorkspaceDir); err != nil {
+		return fmt.Errorf("workspace of session %s: %w", ref, err)
+	}
+
+	opts := ck.Spec.options()
+	opts.detach = detach
+	opts.resume = id
+	opts.noUpdate = true
+	opts.sessionIDFile = ""
+	opts.summaryJSON = ""
+	return run(opts)
+}
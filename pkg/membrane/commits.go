@@ -0,0 +1,433 @@
+package membrane
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+// Mediated git commits (mediate_git, --mediate-git). The workspace's .git
+// stays read-only, as the default config has it, but the agent can still
+// commit: it gets a session-private git directory under
+// ~/.membrane/git/<id> with copies of the repository's HEAD, refs, index
+// and config, which borrows the repository's objects read-only as an
+// alternate. Its commits and refs stay there. When the session ends the
+// new commits on its HEAD are listed, checked, and imported onto a branch
+// of the repository if the user says so.
+//
+// The private directory is the agent's to tamper with, so git never runs
+// in it on the host. Its refs are read here, and its objects are only
+// read as an alternate of the repository itself.
+
+// protectedGitPaths may not be changed by imported commits, on top of the
+// session's readonly patterns: they configure git or hold hooks that run
+// on the host.
+var protectedGitPaths = []string{".gitmodules", ".githooks", ".husky"}
+
+var objectIDPattern = regexp.MustCompile(`^[0-9a-f]{40}([0-9a-f]{24})?$`)
+
+// mediatedGit is a session's private git directory.
+type mediatedGit struct {
+	dir       string   // the private git directory
+	objects   string   // the repository's object directory
+	base      string   // the commit the agent starts from
+	protected []string // patterns of paths its commits may not change
+}
+
+// gitPrivateDir is where session id's private git directory lives.
+func gitPrivateDir(id string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("get home dir: %w", err)
+	}
+	return filepath.Join(home, ".membrane", "git", id), nil
+}
+
+// createMediatedGit sets up the private git directory for session id of
+// the repository at workspaceDir, which must be its top level. Commits
+// may not change paths matching the readonly patterns.
+func createMediatedGit(workspaceDir, id string, readonly []string) (*mediatedGit, error) {
+	top, err := gitOutput(workspaceDir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, fmt.Errorf("mediate_git needs a git repository: %w", err)
+	}
+	if top, err = filepath.EvalSymlinks(top); err != nil || top != workspaceDir {
+		return nil, fmt.Errorf("mediate_git needs the workspace to be the repository's top level (%s)", top)
+	}
+	base, err := gitOutput(workspaceDir, "rev-parse", "--verify", "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("mediate_git needs a commit to start from: %w", err)
+	}
+	gitDir, err := gitOutput(workspaceDir, "rev-parse", "--path-format=absolute", "--git-common-dir")
+	if err != nil {
+		return nil, fmt.Errorf("find git directory: %w", err)
+	}
+	index, err := gitOutput(workspaceDir, "rev-parse", "--path-format=absolute", "--git-path", "index")
+	if err != nil {
+		return nil, fmt.Errorf("find git index: %w", err)
+	}
+	refs, err := gitOutput(workspaceDir, "for-each-ref", "--format=%(objectname) %(refname)")
+	if err != nil {
+		return nil, fmt.Errorf("list refs: %w", err)
+	}
+	dir, err := gitPrivateDir(id)
+	if err != nil {
+		return nil, err
+	}
+	g := &mediatedGit{dir: dir, objects: filepath.Join(gitDir, "objects"), base: base}
+
+	// HEAD follows the checked-out branch, whose private copy starts at
+	// base; a detached HEAD stays detached.
+	head := g.base + "\n"
+	files := map[string]string{
+		"objects/info/alternates": g.objects + "\n",
+		"packed-refs":             refs + "\n",
+	}
+	if branch, err := gitOutput(workspaceDir, "symbolic-ref", "-q", "HEAD"); err == nil {
+		head = "ref: " + branch + "\n"
+		files[branch] = g.base + "\n"
+	}
+	files["HEAD"] = head
+	for _, d := range []string{"objects/pack", "refs/heads", "refs/tags", "info"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0o755); err != nil {
+			return nil, fmt.Errorf("create private git dir: %w", err)
+		}
+	}
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			return nil, fmt.Errorf("create private git dir: %w", err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			return nil, fmt.Errorf("create private git dir: %w", err)
+		}
+	}
+	for name, src := range map[string]string{
+		"config":       filepath.Join(gitDir, "config"),
+		"index":        index,
+		"info/exclude": filepath.Join(gitDir, "info", "exclude"),
+		"shallow":      filepath.Join(gitDir, "shallow"),
+	} {
+		data, err := os.ReadFile(src)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("copy git %s: %w", name, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			return nil, fmt.Errorf("copy git %s: %w", name, err)
+		}
+	}
+
+	g.protected = append(append([]string(nil), readonly...), protectedGitPaths...)
+	if hooks, err := gitOutput(workspaceDir, "config", "core.hooksPath"); err == nil && hooks != "" && !filepath.IsAbs(hooks) {
+		g.protected = append(g.protected, filepath.Clean(hooks))
+	}
+	return g, nil
+}
+
+// args gives the agent the private git directory. Both directories are
+// mounted at their host paths, so the alternates file works on either
+// side.
+func (g *mediatedGit) args() []string {
+	return []string{
+		"-e", "GIT_DIR=" + g.dir,
+		"-e", "GIT_WORK_TREE=/workspace",
+		"-v", g.dir + ":" + g.dir,
+		"-v", g.objects + ":" + g.objects + ":ro",
+	}
+}
+
+// privateHead resolves the private git directory's HEAD to a commit ID,
+// following symbolic refs without letting them leave refs/.
+func privateHead(dir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "HEAD"))
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(string(data))
+	for i := 0; i < 5; i++ {
+		ref, ok := strings.CutPrefix(value, "ref: ")
+		if !ok {
+			if !objectIDPattern.MatchString(value) {
+				return "", fmt.Errorf("HEAD is %q, not a commit", value)
+			}
+			return value, nil
+		}
+		if !strings.HasPrefix(ref, "refs/") || strings.Contains(ref, "..") {
+			return "", fmt.Errorf("HEAD points outside refs/: %q", ref)
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(ref))); err == nil {
+			value = strings.TrimSpace(string(data))
+			continue
+		}
+		value, err = packedRef(dir, ref)
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("HEAD: too many levels of symbolic refs")
+}
+
+func packedRef(dir, ref string) (string, error) {
+	f, err := os.Open(filepath.Join(dir, "packed-refs"))
+	if err != nil {
+		return "", fmt.Errorf("%s: not found", ref)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if id, name, ok := strings.Cut(scanner.Text(), " "); ok && name == ref {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("%s: not found", ref)
+}
+
+// gitWithPrivate runs git in the repository with the session's objects
+// readable as an alternate.
+func gitWithPrivate(workspaceDir, dir string, stdin string, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", append([]string{"-C", workspaceDir}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_ALTERNATE_OBJECT_DIRECTORIES="+filepath.Join(dir, "objects"))
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// sessionCommits returns the session's new commits on its private HEAD,
+// oldest first, after checking that they descend from where the session
+// started and leave protected paths alone.
+func sessionCommits(r *sessionRecord) (head string, commits []string, err error) {
+	// The agent could have pointed the alternates anywhere.
+	if err := resetAlternates(r.GitDir, r.GitObjects); err != nil {
+		return "", nil, fmt.Errorf("reset alternates: %w", err)
+	}
+	head, err = privateHead(r.GitDir)
+	if err != nil {
+		return "", nil, fmt.Errorf("read the session's HEAD: %w", err)
+	}
+	if head == r.GitBase {
+		return head, nil, nil
+	}
+	if _, err := gitWithPrivate(r.Workspace, r.GitDir, "", "merge-base", "--is-ancestor", r.GitBase, head); err != nil {
+		return "", nil, fmt.Errorf("the session's HEAD %s doesn't descend from %s, where it started", head, r.GitBase)
+	}
+	out, err := gitWithPrivate(r.Workspace, r.GitDir, "", "rev-list", "--reverse", r.GitBase+".."+head)
+	if err != nil {
+		return "", nil, err
+	}
+	commits = strings.Fields(out)
+
+	var bad []string
+	for _, c := range commits {
+		// -m lists a merge's changes against each parent.
+		out, err := gitWithPrivate(r.Workspace, r.GitDir, "", "diff-tree", "-r", "-m", "--no-commit-id", "--name-only", "-z", c)
+		if err != nil {
+			return "", nil, err
+		}
+		for _, p := range strings.Split(out, "\x00") {
+			if p != "" && protectedPath(p, r.GitProtected) {
+				bad = append(bad, c[:12]+" "+p)
+			}
+		}
+	}
+	if len(bad) > 0 {
+		return "", nil, fmt.Errorf("commits change protected paths:\n  %s", strings.Join(bad, "\n  "))
+	}
+	return head, commits, nil
+}
+
+// resetAlternates rewrites the alternates file of the private git
+// directory dir to name only objects. The agent could have replaced the
+// file, or a directory above it, with a link to a file of the user's, so
+// no link is followed: a linked directory is refused, and the file itself
+// is replaced rather than written through.
+func resetAlternates(dir, objects string) error {
+	if err := checkNoSymlinks(dir, filepath.Join("objects", "info")); err != nil {
+		return err
+	}
+	info := filepath.Join(dir, "objects", "info")
+	if err := os.MkdirAll(info, 0o755); err != nil {
+		return err
+	}
+	p := filepath.Join(info, "alternates")
+	if err := os.RemoveAll(p); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(objects + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// protectedPath reports whether p, or a directory it's in, is a .git
+// directory or matches one of patterns.
+func protectedPath(p string, patterns []string) bool {
+	parts := strings.Split(p, "/")
+	for i, name := range parts {
+		if strings.EqualFold(name, ".git") {
+			return true
+		}
+		if matchesAny(strings.Join(parts[:i+1], "/"), name, patterns) {
+			return true
+		}
+	}
+	return false
+}
+
+// importCommits copies the session's objects up to head into the
+// repository and points branch at head. An existing branch must be an
+// ancestor of head, and not the one checked out.
+func importCommits(r *sessionRecord, head, branch string) error {
+	if _, err := gitOutput(r.Workspace, "check-ref-format", "--branch", branch); err != nil {
+		return fmt.Errorf("%q is not a valid branch name", branch)
+	}
+	ref := "refs/heads/" + branch
+	old := ""
+	if tip, err := gitOutput(r.Workspace, "rev-parse", "--verify", "--quiet", ref); err == nil {
+		if current, _ := gitOutput(r.Workspace, "symbolic-ref", "-q", "HEAD"); current == ref {
+			return fmt.Errorf("%s is checked out; import onto another branch and merge it", branch)
+		}
+		if _, err := gitWithPrivate(r.Workspace, r.GitDir, "", "merge-base", "--is-ancestor", tip, head); err != nil {
+			return fmt.Errorf("%s exists and the session's commits don't build on it", branch)
+		}
+		old = tip
+	}
+	pack, err := gitOutput(r.Workspace, "rev-parse", "--path-format=absolute", "--git-path", "objects/pack/pack")
+	if err != nil {
+		return err
+	}
+	if _, err := gitWithPrivate(r.Workspace, r.GitDir, head+"\n^"+r.GitBase+"\n", "pack-objects", "--revs", "-q", pack); err != nil {
+		return fmt.Errorf("copy commits: %w", err)
+	}
+	// Without the alternate, so the commit must now be in the repository.
+	if _, err := gitOutput(r.Workspace, "update-ref", "-m", "membrane: import session "+r.ID, ref, head, old); err != nil {
+		return fmt.Errorf("create %s: %w", branch, err)
+	}
+	return nil
+}
+
+// reviewCommits lists the session's new commits and, on a terminal, asks
+// whether to import them onto a branch, keep them for `membrane import`,
+// or discard them. Without a terminal they're kept.
+func reviewCommits(r *sessionRecord) error {
+	head, commits, err := sessionCommits(r)
+	if err != nil {
+		return err
+	}
+	if len(commits) == 0 {
+		return os.RemoveAll(r.GitDir)
+	}
+	branch := "membrane/" + r.ID
+	log, _ := gitWithPrivate(r.Workspace, r.GitDir, "", "log", "--oneline", "--no-decorate", r.GitBase+".."+head)
+	fmt.Fprintf(os.Stderr, "\nThe agent made %d commit(s):\n%s\n", len(commits), log)
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprintf(os.Stderr, "membrane: import them with: membrane import %s [branch]\n", r.ID)
+		return nil
+	}
+	in := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Fprintf(os.Stderr, "[i]mport onto %s, import onto [b]ranch..., [k]eep for later, or [d]iscard? ", branch)
+		answer, err := in.ReadString('\n')
+		if err != nil {
+			answer = "k"
+		}
+		switch strings.TrimSpace(strings.ToLower(answer)) {
+		case "b":
+			fmt.Fprint(os.Stderr, "Branch: ")
+			name, _ := in.ReadString('\n')
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			branch = name
+			fallthrough
+		case "i":
+			if err := importCommits(r, head, branch); err != nil {
+				fmt.Fprintf(os.Stderr, "membrane: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "membrane: imported %d commit(s) onto %s\n", len(commits), branch)
+			return os.RemoveAll(r.GitDir)
+		case "k":
+			fmt.Fprintf(os.Stderr, "membrane: kept; import them with: membrane import %s [branch]\n", r.ID)
+			return nil
+		case "d":
+			fmt.Fprintln(os.Stderr, "membrane: discarded the agent's commits")
+			return os.RemoveAll(r.GitDir)
+		}
+	}
+}
+
+// finishCommits reviews a mediate_git session's commits once its agent has
+// exited. Errors leave them for `membrane import`.
+func finishCommits(r *sessionRecord) {
+	if r == nil || r.GitDir == "" {
+		return
+	}
+	if _, err := os.Stat(r.GitDir); err != nil {
+		return
+	}
+	if err := reviewCommits(r); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: review the agent's commits: %v\n", err)
+	}
+}
+
+// ImportCommits imports the commits of an ended mediate_git session onto
+// branch, membrane/<id> by default.
+func ImportCommits(ref, branch string) error {
+	r, err := loadSessionRecord(resolveSession(ref))
+	if err != nil {
+		return fmt.Errorf("session %s not found", ref)
+	}
+	if r.GitDir == "" {
+		return fmt.Errorf("session %s didn't run with mediate_git", ref)
+	}
+	if _, err := os.Stat(r.GitDir); err != nil {
+		return fmt.Errorf("session %s has no commits left to import", ref)
+	}
+	if err := selectEngine(); err != nil {
+		return err
+	}
+	r.refresh()
+	if r.live() {
+		return fmt.Errorf("session %s is still running", ref)
+	}
+	head, commits, err := sessionCommits(r)
+	if err != nil {
+		return err
+	}
+	if len(commits) == 0 {
+		fmt.Fprintln(os.Stderr, "membrane: the agent made no commits")
+		return os.RemoveAll(r.GitDir)
+	}
+	if branch == "" {
+		branch = "membrane/" + r.ID
+	}
+	if err := importCommits(r, head, branch); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "membrane: imported %d commit(s) onto %s\n", len(commits), branch)
+	return os.RemoveAll(r.GitDir)
+}
@@ -1,6 +1,7 @@
 package membrane
 
 import (
+	"bytes"
 	"fmt"
 	"net"
 	"net/url"
@@ -8,24 +9,203 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type config struct {
-	DNSResolver string      `yaml:"dns_resolver"`
-	SSLInsecure bool        `yaml:"ssl_insecure"`
-	Ignore      []string    `yaml:"ignore"`
-	Readonly    []string    `yaml:"readonly"`
-	Args        []string    `yaml:"args"`
-	Allow       []AllowRule `yaml:"allow"`
+	DNSResolver resolverList `yaml:"dns_resolver"`
+	DNSRoutes   []dnsRoute   `yaml:"dns_routes"`
+	DNSQTypes   []string     `yaml:"dns_qtypes"`
+	SSLInsecure bool         `yaml:"ssl_insecure"`
+	Approve     bool         `yaml:"approve"`
+	MediateGit  bool         `yaml:"mediate_git"`
+	Offline     bool         `yaml:"offline"`
+	Ignore      []string     `yaml:"ignore"`
+	Readonly    []string     `yaml:"readonly"`
+	Args        []string     `yaml:"args"`
+	Allow       []AllowRule  `yaml:"allow"`
+	Hosts       hostsMap     `yaml:"hosts"`
+	Limits      limits       `yaml:"limits"`
+	Home        homeConfig   `yaml:"home"`
+	Image       string       `yaml:"image"`  // agent image to run instead of membrane-agent
+	Build       string       `yaml:"build"`  // Dockerfile to build the agent image from
+	Update      updateConfig `yaml:"update"` // read from the global config only; see update.go
+
+	learn        bool         // set by `membrane learn`; see learn.go
+	cow          bool         // set by --cow; see cow.go
+	worktree     *worktree    // set by --worktree; see worktree.go
+	git          *mediatedGit // set with mediate_git; see commits.go
+	image        string       // the agent image; see image.go
+	handlerImage string       // see ensureImages
+	restore      *checkpoint  // set by membrane resume; see checkpoint.go
+	sources      configSources
+	source       string // the file's contents, from loadConfigFile
+}
+
+// configSources are the config files a session's config was loaded from,
+// as they were then, so a checkpoint can resume the session with the
+// config it started with.
+type configSources struct {
+	Global    string `json:"global,omitempty"`
+	Workspace string `json:"workspace,omitempty"`
 }
 
-func (c *config) dnsResolver() string {
-	if c.DNSResolver != "" {
+func (c *config) dnsResolver() resolverList {
+	if len(c.DNSResolver) > 0 {
 		return c.DNSResolver
 	}
-	return "1.1.1.1"
+	return resolverList{{Address: "1.1.1.1:53"}}
+}
+
+// upstreamResolver is a single upstream DNS server for the dns-proxy.
+// Timeout is a Go duration string; empty means the dns-proxy default (5s).
+type upstreamResolver struct {
+	Address string `json:"address"`
+	Timeout string `json:"timeout,omitempty"`
+}
+
+func (r *upstreamResolver) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		r.Address = value.Value
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			switch value.Content[i].Value {
+			case "address":
+				r.Address = value.Content[i+1].Value
+			case "timeout":
+				r.Timeout = value.Content[i+1].Value
+			}
+		}
+	default:
+		return fmt.Errorf("resolver must be an address or mapping with address and timeout")
+	}
+	return r.normalize()
+}
+
+// normalize validates the resolver and adds the default port 53. The
+// address must be an IP: the handler has no resolver of its own to look
+// up a hostname with.
+func (r *upstreamResolver) normalize() error {
+	host, port, err := net.SplitHostPort(r.Address)
+	if err != nil {
+		host, port = strings.Trim(r.Address, "[]"), "53"
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("resolver %q must be an IP address", r.Address)
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return fmt.Errorf("resolver %q has invalid port", r.Address)
+	}
+	r.Address = net.JoinHostPort(host, port)
+	if r.Timeout != "" {
+		if _, err := time.ParseDuration(r.Timeout); err != nil {
+			return fmt.Errorf("resolver %q: invalid timeout %q", r.Address, r.Timeout)
+		}
+	}
+	return nil
+}
+
+// resolverList is an ordered failover list of resolvers. In YAML it may be
+// a single resolver or a sequence of them.
+type resolverList []upstreamResolver
+
+func (l *resolverList) UnmarshalYAML(value *yaml.Node) error {
+	nodes := []*yaml.Node{value}
+	if value.Kind == yaml.SequenceNode {
+		nodes = value.Content
+	}
+	*l = nil
+	for _, n := range nodes {
+		if n.Kind == yaml.ScalarNode && n.Value == "" {
+			continue
+		}
+		var r upstreamResolver
+		if err := r.UnmarshalYAML(n); err != nil {
+			return err
+		}
+		*l = append(*l, r)
+	}
+	return nil
+}
+
+// ParseResolverList parses a raw CLI --dns-resolver string: one or more
+// comma-separated resolver addresses, tried in order.
+func ParseResolverList(raw string) (resolverList, error) {
+	var l resolverList
+	for _, addr := range strings.Split(raw, ",") {
+		r := upstreamResolver{Address: strings.TrimSpace(addr)}
+		if err := r.normalize(); err != nil {
+			return nil, err
+		}
+		l = append(l, r)
+	}
+	return l, nil
+}
+
+// dnsRoute sends queries for names equal to or under Suffix to its own
+// resolvers instead of the default dns_resolver. The longest matching
+// suffix wins.
+type dnsRoute struct {
+	Suffix    string       `yaml:"suffix" json:"suffix"`
+	Resolvers resolverList `yaml:"resolver" json:"resolvers"`
+}
+
+// dnsUpstreams is serialised for the dns-proxy (see writeDNSFile).
+type dnsUpstreams struct {
+	Default resolverList `json:"default"`
+	Routes  []dnsRoute   `json:"routes"`
+}
+
+func validateDNSRoutes(routes []dnsRoute) error {
+	for i, r := range routes {
+		suffix := strings.Trim(strings.ToLower(r.Suffix), ".")
+		suffix = strings.TrimPrefix(suffix, "*.")
+		if suffix == "" {
+			return fmt.Errorf("dns_routes entry %d missing 'suffix'", i+1)
+		}
+		if len(r.Resolvers) == 0 {
+			return fmt.Errorf("dns_routes entry %q has no resolver", r.Suffix)
+		}
+		routes[i].Suffix = suffix
+	}
+	return nil
+}
+
+// defaultDNSQTypes are the query types the dns-proxy forwards for an allowed
+// name when dns_qtypes is not set.
+var defaultDNSQTypes = []string{"A", "AAAA", "CNAME", "HTTPS"}
+
+func (c *config) dnsQTypes() []string {
+	if len(c.DNSQTypes) > 0 {
+		return c.DNSQTypes
+	}
+	return defaultDNSQTypes
+}
+
+//go:generate ../../scripts/gen-qtypes.sh qtypes.go
+
+// validateQTypes normalises qtype names to upper case and rejects unknown
+// ones, those missing from dnsQTypeNames. "*" permits every query type.
+func validateQTypes(qtypes []string) ([]string, error) {
+	out := make([]string, 0, len(qtypes))
+	for _, q := range qtypes {
+		q = strings.ToUpper(strings.TrimSpace(q))
+		known := q == "*"
+		for _, name := range dnsQTypeNames {
+			if q == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown DNS query type %q", q)
+		}
+		out = append(out, q)
+	}
+	return out, nil
 }
 
 // portRule is a port with an explicit transport protocol.
@@ -45,6 +225,7 @@ type AllowRule struct {
 	Scheme string     `json:"scheme,omitempty"`
 	Path   string     `json:"path,omitempty"`
 	HTTP   []HTTPRule `json:"http,omitempty"`
+	QTypes []string   `json:"qtypes,omitempty"` // nil = global dns_qtypes
 }
 
 type HTTPRule struct {
@@ -153,6 +334,7 @@ func (r *AllowRule) parseMappingNode(value *yaml.Node) error {
 	var destStr string
 	var portsNode *yaml.Node
 	var httpNode *yaml.Node
+	var qtypesNode *yaml.Node
 
 	for i := 0; i+1 < len(value.Content); i += 2 {
 		key := value.Content[i].Value
@@ -164,6 +346,8 @@ func (r *AllowRule) parseMappingNode(value *yaml.Node) error {
 			portsNode = val
 		case "http":
 			httpNode = val
+		case "qtypes":
+			qtypesNode = val
 		}
 	}
 
@@ -206,6 +390,25 @@ func (r *AllowRule) parseMappingNode(value *yaml.Node) error {
 		}
 	}
 
+	if qtypesNode != nil {
+		var names []string
+		switch qtypesNode.Kind {
+		case yaml.ScalarNode: // qtypes: SRV
+			names = []string{qtypesNode.Value}
+		case yaml.SequenceNode:
+			for _, n := range qtypesNode.Content {
+				names = append(names, n.Value)
+			}
+		default:
+			return fmt.Errorf("allow entry %q: qtypes must be a query type or a list of them", destStr)
+		}
+		qtypes, err := validateQTypes(names)
+		if err != nil {
+			return err
+		}
+		r.QTypes = qtypes
+	}
+
 	return nil
 }
 
@@ -237,6 +440,74 @@ func appendUniquePort(s []portRule, pr portRule) []portRule {
 	return append(s, pr)
 }
 
+// hostsMap maps a hostname to the IPv4 addresses the dns-proxy answers
+// with for it, bypassing the upstream resolver.
+type hostsMap map[string][]string
+
+func (h *hostsMap) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return fmt.Errorf("hosts must be a mapping of hostname to IP list")
+	}
+	if *h == nil {
+		*h = hostsMap{}
+	}
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		name := value.Content[i].Value
+		val := value.Content[i+1]
+		var addrs []string
+		switch val.Kind {
+		case yaml.ScalarNode:
+			addrs = []string{val.Value}
+		case yaml.SequenceNode:
+			for _, n := range val.Content {
+				addrs = append(addrs, n.Value)
+			}
+		default:
+			return fmt.Errorf("hosts entry %q must be an IP or list of IPs", name)
+		}
+		if err := h.add(name, addrs...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add validates and appends addrs to the entry for name. The firewall is
+// IPv4-only, so IPv6 addresses are rejected.
+func (h hostsMap) add(name string, addrs ...string) error {
+	name = strings.TrimRight(strings.ToLower(name), ".")
+	if name == "" {
+		return fmt.Errorf("hosts entry has empty hostname")
+	}
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("hosts entry %q: %q is not an IPv4 address", name, a)
+		}
+		h[name] = appendUnique(h[name], ip.String())
+	}
+	return nil
+}
+
+func appendUnique(s []string, v string) []string {
+	for _, x := range s {
+		if x == v {
+			return s
+		}
+	}
+	return append(s, v)
+}
+
+// ParseHostEntry parses a raw CLI --host string of the form
+// name=IP[,IP...] into hosts.
+func ParseHostEntry(hosts map[string][]string, raw string) error {
+	name, addrs, ok := strings.Cut(raw, "=")
+	if !ok {
+		return fmt.Errorf("expected name=IP[,IP...]")
+	}
+	return hostsMap(hosts).add(name, strings.Split(addrs, ",")...)
+}
+
 // ParseAllowEntry parses a raw CLI --allow string into an AllowRule.
 func ParseAllowEntry(raw string) (AllowRule, error) {
 	var r AllowRule
@@ -252,9 +523,15 @@ func loadConfig(workspaceDir string, skipGlobal bool) (*config, error) {
 		return nil, fmt.Errorf("get home dir: %w", err)
 	}
 
-	localPath := filepath.Join(home, ".membrane", "config.yaml")
-	workspacePath := filepath.Join(workspaceDir, ".membrane.yaml")
+	return loadConfigFiles(
+		filepath.Join(home, ".membrane", "config.yaml"),
+		filepath.Join(workspaceDir, ".membrane.yaml"),
+		skipGlobal)
+}
 
+// loadConfigFiles is loadConfig with the local and workspace config files
+// given, e.g. the copies in a checkpoint.
+func loadConfigFiles(localPath, workspacePath string, skipGlobal bool) (*config, error) {
 	base := config{}
 
 	if !skipGlobal {
@@ -264,7 +541,11 @@ func loadConfig(workspaceDir string, skipGlobal bool) (*config, error) {
 			return nil, fmt.Errorf("load local config: %w", localErr)
 		}
 		if !localMissing {
+			if err := localCfg.resolveBuild(localPath); err != nil {
+				return nil, err
+			}
 			base = *localCfg
+			base.sources.Global = localCfg.source
 		}
 	}
 
@@ -276,22 +557,165 @@ func loadConfig(workspaceDir string, skipGlobal bool) (*config, error) {
 	}
 
 	if !workspaceMissing {
+		base.sources.Workspace = workspace.source
+		if err := workspace.resolveBuild(workspacePath); err != nil {
+			return nil, err
+		}
+		if workspace.Image != "" || workspace.Build != "" {
+			base.Image, base.Build = workspace.Image, workspace.Build
+		}
 		base.Ignore = append(base.Ignore, workspace.Ignore...)
 		base.Readonly = append(base.Readonly, workspace.Readonly...)
 		base.Args = append(base.Args, workspace.Args...)
 		base.Allow = append(base.Allow, workspace.Allow...)
+		if len(workspace.DNSQTypes) > 0 && len(base.DNSQTypes) == 0 {
+			// Extend the defaults rather than replace them.
+			base.DNSQTypes = append([]string(nil), defaultDNSQTypes...)
+		}
+		base.DNSQTypes = append(base.DNSQTypes, workspace.DNSQTypes...)
+		base.DNSRoutes = append(base.DNSRoutes, workspace.DNSRoutes...)
+		for name, addrs := range workspace.Hosts {
+			if base.Hosts == nil {
+				base.Hosts = hostsMap{}
+			}
+			_ = base.Hosts.add(name, addrs...) // already validated
+		}
+		base.Limits.merge(workspace.Limits)
+		base.Home.merge(workspace.Home)
+		base.MediateGit = base.MediateGit || workspace.MediateGit
+		base.Offline = base.Offline || workspace.Offline
+	}
+
+	if err := base.Limits.validate(); err != nil {
+		return nil, err
+	}
+	if err := base.Home.validate(); err != nil {
+		return nil, err
+	}
+
+	qtypes, err := validateQTypes(base.DNSQTypes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns_qtypes: %w", err)
+	}
+	base.DNSQTypes = qtypes
+
+	if err := validateDNSRoutes(base.DNSRoutes); err != nil {
+		return nil, err
 	}
 
 	expandArgs(base.Args)
 	return &base, nil
 }
 
+// appendWorkspaceRules adds entries to the allow list in the workspace's
+// .membrane.yaml, creating the file if needed.
+func appendWorkspaceRules(workspaceDir string, entries ...*yaml.Node) error {
+	path := filepath.Join(workspaceDir, ".membrane.yaml")
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	data, err = addAllowEntries(data, entries...)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// addAllowEntries returns the config document data with entries appended
+// to its allow list, creating the list as needed. Comments and the rest
+// of the document are kept.
+func addAllowEntries(data []byte, entries ...*yaml.Node) ([]byte, error) {
+	var doc yaml.Node
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("parse: %w", err)
+		}
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("top level is not a mapping")
+	}
+
+	var list *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "allow" {
+			list = root.Content[i+1]
+		}
+	}
+	switch {
+	case list == nil:
+		list = &yaml.Node{Kind: yaml.SequenceNode}
+		root.Content = append(root.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: "allow"}, list)
+	case list.Kind == yaml.ScalarNode && list.Tag == "!!null":
+		*list = yaml.Node{Kind: yaml.SequenceNode}
+	case list.Kind != yaml.SequenceNode:
+		return nil, fmt.Errorf("allow is not a list")
+	}
+	list.Content = append(list.Content, entries...)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, fmt.Errorf("encode: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("encode: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// allowEntryNode returns an allow entry as written in config: a bare
+// destination, or a mapping when there are ports or http constraints.
+func allowEntryNode(dest string, ports []string, http []HTTPRule) *yaml.Node {
+	scalar := func(v string) *yaml.Node { return &yaml.Node{Kind: yaml.ScalarNode, Value: v} }
+	flowSeq := func(vals []string) *yaml.Node {
+		n := &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+		for _, v := range vals {
+			n.Content = append(n.Content, scalar(v))
+		}
+		return n
+	}
+	if len(ports) == 0 && len(http) == 0 {
+		return scalar(dest)
+	}
+
+	n := &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{scalar("dest"), scalar(dest)}}
+	if len(ports) > 0 {
+		n.Content = append(n.Content, scalar("ports"), flowSeq(ports))
+	}
+	if len(http) > 0 {
+		rules := &yaml.Node{Kind: yaml.SequenceNode}
+		for _, hr := range http {
+			rn := &yaml.Node{Kind: yaml.MappingNode}
+			if len(hr.Methods) > 0 {
+				rn.Content = append(rn.Content, scalar("methods"), flowSeq(hr.Methods))
+			}
+			if len(hr.Paths) > 0 {
+				var paths []string
+				for _, p := range hr.Paths {
+					paths = append(paths, p.Path)
+				}
+				rn.Content = append(rn.Content, scalar("paths"), flowSeq(paths))
+			}
+			rules.Content = append(rules.Content, rn)
+		}
+		n.Content = append(n.Content, scalar("http"), rules)
+	}
+	return n
+}
+
 func loadConfigFile(path string) (*config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	cfg := &config{}
+	cfg := &config{source: string(data)}
 	if err := yaml.Unmarshal(data, cfg); err != nil {
 		return nil, fmt.Errorf("parse %s: %w", path, err)
 	}
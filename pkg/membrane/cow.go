@@ -0,0 +1,495 @@
+package membrane
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// Copy-on-write workspaces (--cow). The agent's /workspace is an overlayfs
+// volume: the workspace is the read-only lower layer, and everything the
+// agent changes lands in an upper layer under ~/.membrane/overlays/<id>.
+// The engine mounts it, so it needs no privileges here. Ignore and
+// readonly mounts are layered over /workspace as usual. When the session
+// ends the changes are reviewed and applied to the workspace, discarded,
+// or kept for `membrane review`.
+
+// overlayDir is where session id's upper and work layers live.
+func overlayDir(id string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("get home dir: %w", err)
+	}
+	return filepath.Join(home, ".membrane", "overlays", id), nil
+}
+
+// createOverlay creates the session's workspace volume over workspaceDir.
+func createOverlay(s sessionNames, workspaceDir string) error {
+	dir, err := overlayDir(s.id)
+	if err != nil {
+		return err
+	}
+	upper, work := filepath.Join(dir, "upper"), filepath.Join(dir, "work")
+	for _, d := range []string{upper, work} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			return fmt.Errorf("create overlay dir: %w", err)
+		}
+	}
+	for _, p := range []string{workspaceDir, dir} {
+		if strings.ContainsAny(p, ",:") {
+			return fmt.Errorf("--cow can't overlay %s: overlayfs paths can't contain ',' or ':'", p)
+		}
+	}
+	if rel, err := filepath.Rel(workspaceDir, dir); err == nil && !strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("--cow can't overlay %s: it contains the overlay's own layers in %s", workspaceDir, dir)
+	}
+	// redirect_dir and metacopy are off so that the upper layer holds
+	// whole files and directories, which is what the review reads.
+	opts := map[string]string{
+		"type":   "overlay",
+		"device": "overlay",
+		"o": fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s,redirect_dir=off,metacopy=off",
+			workspaceDir, upper, work),
+	}
+	if err := containers.CreateVolume(s.workspaceVolume, s.labels(), opts); err != nil {
+		return fmt.Errorf("create workspace overlay %s: %w", s.workspaceVolume, err)
+	}
+	return nil
+}
+
+// overlayChange is a path the agent added, modified or deleted.
+type overlayChange struct {
+	path string // relative to the workspace
+	kind byte   // 'A', 'M' or 'D'
+	dir  bool
+}
+
+// overlayChanges compares the upper layer with the workspace, given the
+// upper layer's opaque directories (see opaqueDirs). Changes are in walk
+// order, so applying them in order replaces a file with a directory (or
+// the reverse) before filling it.
+func overlayChanges(upper, lower string, opaque map[string]bool) ([]overlayChange, error) {
+	var changes []overlayChange
+	err := filepath.WalkDir(upper, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upper, p)
+		if err != nil {
+			return err
+		}
+		// A path under a symlink in the workspace isn't in the workspace.
+		lp := filepath.Join(lower, rel)
+		var li fs.FileInfo
+		lerr := checkNoSymlinks(lower, filepath.Dir(rel))
+		if lerr == nil {
+			li, lerr = os.Lstat(lp)
+		}
+		inLower := lerr == nil
+
+		if rel == "." {
+			if opaque[rel] {
+				changes = append(changes, hiddenByOpaque(upper, lower, rel)...)
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if isWhiteout(info) {
+			if inLower {
+				changes = append(changes, overlayChange{path: rel, kind: 'D', dir: li.IsDir()})
+			}
+			return nil
+		}
+		if d.IsDir() {
+			switch {
+			case !inLower:
+				if empty, _ := isEmptyDir(p); empty {
+					changes = append(changes, overlayChange{path: rel, kind: 'A', dir: true})
+				}
+			case !li.IsDir():
+				changes = append(changes, overlayChange{path: rel, kind: 'D'})
+				if empty, _ := isEmptyDir(p); empty {
+					changes = append(changes, overlayChange{path: rel, kind: 'A', dir: true})
+				}
+			case opaque[rel]:
+				changes = append(changes, hiddenByOpaque(p, lp, rel)...)
+			}
+			return nil
+		}
+		switch {
+		case !inLower:
+			changes = append(changes, overlayChange{path: rel, kind: 'A'})
+		case li.IsDir():
+			changes = append(changes, overlayChange{path: rel, kind: 'D', dir: true}, overlayChange{path: rel, kind: 'A'})
+		case !sameFile(p, info, lp, li):
+			changes = append(changes, overlayChange{path: rel, kind: 'M'})
+		}
+		return nil
+	})
+	return changes, err
+}
+
+// isWhiteout reports whether info is overlayfs's mark for a deleted
+// path: a 0/0 character device.
+func isWhiteout(info fs.FileInfo) bool {
+	if info.Mode()&fs.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Rdev == 0
+}
+
+// opaqueDirs lists the directories of the upper layer that replaced the
+// ones below them entirely, relative to upper. The mark is the xattr
+// trusted.overlay.opaque, which only root can read, and reading it as
+// anyone else just finds nothing; so unless membrane runs as root, the
+// engine reads it, from a root container of the handler image, which
+// has python3, with upper mounted read-only.
+func opaqueDirs(id, upper string) (map[string]bool, error) {
+	opaque := map[string]bool{}
+	if os.Geteuid() == 0 {
+		err := filepath.WalkDir(upper, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return err
+			}
+			buf := make([]byte, 1)
+			if n, err := unix.Lgetxattr(p, "trusted.overlay.opaque", buf); err == nil && n == 1 && buf[0] == 'y' {
+				rel, _ := filepath.Rel(upper, p)
+				opaque[rel] = true
+			}
+			return nil
+		})
+		return opaque, err
+	}
+
+	const script = `
+import os, sys
+for root, dirs, files in os.walk("/upper"):
+    try:
+        if os.getxattr(root, "trusted.overlay.opaque", follow_symlinks=False) == b"y":
+            sys.stdout.write(os.path.relpath(root, "/upper") + "\0")
+    except OSError:
+        pass
+`
+	s := sessionNamesFor(id)
+	name := "membrane-opaque-" + id
+	_ = containers.RemoveContainer(name)
+	if _, err := containers.RunContainer(containerSpec{
+		Name:       name,
+		Image:      handlerImageName,
+		Entrypoint: []string{"python3", "-c", script},
+		Labels:     s.labels(),
+		Network:    "none",
+		CapAdd:     []string{"SYS_ADMIN"}, // to read trusted.* xattrs
+		Binds:      []string{upper + ":/upper:ro"},
+	}); err != nil {
+		return nil, fmt.Errorf("read the overlay's opaque directories: %w", err)
+	}
+	defer containers.RemoveContainer(name)
+	code, err := containers.WaitContainer(context.Background(), name)
+	var out bytes.Buffer
+	if err == nil {
+		err = containers.Logs(context.Background(), name, false, &out)
+	}
+	if err == nil && code != 0 {
+		err = fmt.Errorf("exited with code %d: %s", code, strings.TrimSpace(out.String()))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read the overlay's opaque directories: %w", err)
+	}
+	for _, rel := range strings.Split(out.String(), "\x00") {
+		if rel != "" {
+			opaque[rel] = true
+		}
+	}
+	return opaque, nil
+}
+
+// hiddenByOpaque lists the entries of lowerDir an opaque upperDir hides.
+func hiddenByOpaque(upperDir, lowerDir, rel string) []overlayChange {
+	var changes []overlayChange
+	entries, _ := os.ReadDir(lowerDir)
+	for _, e := range entries {
+		if _, err := os.Lstat(filepath.Join(upperDir, e.Name())); os.IsNotExist(err) {
+			changes = append(changes, overlayChange{path: filepath.Join(rel, e.Name()), kind: 'D', dir: e.IsDir()})
+		}
+	}
+	return changes
+}
+
+func isEmptyDir(dir string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	return len(entries) == 0, err
+}
+
+// sameFile reports whether a copied-up file still matches the original,
+// as after a touch.
+func sameFile(a string, ai fs.FileInfo, b string, bi fs.FileInfo) bool {
+	if ai.Mode() != bi.Mode() || ai.Size() != bi.Size() {
+		return false
+	}
+	if ai.Mode()&fs.ModeSymlink != 0 {
+		la, _ := os.Readlink(a)
+		lb, _ := os.Readlink(b)
+		return la == lb
+	}
+	da, err := os.ReadFile(a)
+	if err != nil {
+		return false
+	}
+	db, err := os.ReadFile(b)
+	return err == nil && bytes.Equal(da, db)
+}
+
+// applyChange makes change c to the workspace. It refuses a path under a
+// symlink, which an earlier change in the list would have replaced: one
+// applied on its own would otherwise write through the link.
+func applyChange(c overlayChange, upper, lower string) error {
+	if err := checkNoSymlinks(lower, filepath.Dir(c.path)); err != nil {
+		return err
+	}
+	dst := filepath.Join(lower, c.path)
+	if c.kind == 'D' {
+		return os.RemoveAll(dst)
+	}
+	src := filepath.Join(upper, c.path)
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	switch {
+	case info.IsDir():
+		return os.MkdirAll(dst, info.Mode().Perm())
+	case info.Mode()&fs.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		_ = os.Remove(dst)
+		return os.Symlink(link, dst)
+	}
+	// Write beside the file and rename over it, so a failure leaves the
+	// original.
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".membrane-apply-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// overlayDiff is a unified diff of changes, from git diff --no-index.
+func overlayDiff(changes []overlayChange, upper, lower string) string {
+	var out strings.Builder
+	for _, c := range changes {
+		if c.dir {
+			continue
+		}
+		a, b := filepath.Join(lower, c.path), filepath.Join(upper, c.path)
+		switch c.kind {
+		case 'A':
+			a = os.DevNull
+		case 'D':
+			b = os.DevNull
+		}
+		// Exits 1 when the files differ.
+		diff, _ := exec.Command("git", "-c", "core.quotePath=false", "diff", "--no-index", "--no-color", "--no-prefix", "--", a, b).Output()
+		// git prints the paths without their leading slash.
+		d := strings.ReplaceAll(string(diff), strings.TrimPrefix(upper, "/")+"/", "b/")
+		out.WriteString(strings.ReplaceAll(d, strings.TrimPrefix(lower, "/")+"/", "a/"))
+	}
+	return out.String()
+}
+
+func printChanges(changes []overlayChange) {
+	for i, c := range changes {
+		path := c.path
+		if c.dir {
+			path += "/"
+		}
+		fmt.Fprintf(os.Stderr, "  %3d  %c  %s\n", i+1, c.kind, path)
+	}
+}
+
+// reviewOverlay shows what the session changed in its copy-on-write
+// workspace and asks what to do with it: apply all of it, apply some and
+// ask again, discard it, or keep it for `membrane review`. Without a
+// terminal the overlay is kept.
+func reviewOverlay(id, workspaceDir string) error {
+	dir, err := overlayDir(id)
+	if err != nil {
+		return err
+	}
+	upper := filepath.Join(dir, "upper")
+	if _, err := os.Stat(upper); err != nil {
+		return fmt.Errorf("session %s has no workspace overlay", id)
+	}
+	opaque, err := opaqueDirs(id, upper)
+	if err != nil {
+		return err
+	}
+	interactive := term.IsTerminal(int(os.Stdin.Fd()))
+	in := bufio.NewReader(os.Stdin)
+	showDiff := true
+	for {
+		changes, err := overlayChanges(upper, workspaceDir, opaque)
+		if err != nil {
+			return fmt.Errorf("read workspace overlay: %w", err)
+		}
+		if len(changes) == 0 {
+			fmt.Fprintln(os.Stderr, "membrane: no workspace changes left to review")
+			return removeOverlay(dir)
+		}
+		if !interactive {
+			fmt.Fprintf(os.Stderr, "membrane: the agent's %d workspace changes are kept in %s; review them with: membrane review %s\n",
+				len(changes), dir, id)
+			return nil
+		}
+		if showDiff {
+			fmt.Fprint(os.Stderr, overlayDiff(changes, upper, workspaceDir))
+			showDiff = false
+		}
+		fmt.Fprintf(os.Stderr, "\nThe agent changed %d paths in the workspace (A added, M modified, D deleted):\n", len(changes))
+		printChanges(changes)
+		fmt.Fprint(os.Stderr, "[a]pply all, apply [s]elected, show [d]iff, dis[c]ard, or [k]eep for later? ")
+		answer, err := in.ReadString('\n')
+		if err != nil {
+			answer = "k"
+		}
+		switch strings.TrimSpace(strings.ToLower(answer)) {
+		case "a":
+			if err := applyChanges(changes, upper, workspaceDir); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "membrane: applied %d changes\n", len(changes))
+			return removeOverlay(dir)
+		case "s":
+			fmt.Fprint(os.Stderr, "Paths to apply (e.g. 1 3-5): ")
+			answer, _ := in.ReadString('\n')
+			picked, err := pickChanges(changes, answer)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "membrane: %v\n", err)
+				continue
+			}
+			if err := applyChanges(picked, upper, workspaceDir); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "membrane: applied %d changes\n", len(picked))
+		case "d":
+			showDiff = true
+		case "c":
+			fmt.Fprintln(os.Stderr, "membrane: discarded the agent's workspace changes")
+			return removeOverlay(dir)
+		case "k":
+			fmt.Fprintf(os.Stderr, "membrane: kept in %s; review with: membrane review %s\n", dir, id)
+			return nil
+		}
+	}
+}
+
+func applyChanges(changes []overlayChange, upper, lower string) error {
+	for _, c := range changes {
+		if err := applyChange(c, upper, lower); err != nil {
+			return fmt.Errorf("apply %s: %w", c.path, err)
+		}
+	}
+	return nil
+}
+
+// pickChanges parses a selection such as "1 3-5" into changes, in their
+// original order.
+func pickChanges(changes []overlayChange, sel string) ([]overlayChange, error) {
+	picked := make([]bool, len(changes))
+	for _, f := range strings.FieldsFunc(sel, func(r rune) bool { return r == ' ' || r == ',' }) {
+		lo, hi, isRange := strings.Cut(f, "-")
+		a, err := strconv.Atoi(lo)
+		b := a
+		if err == nil && isRange {
+			b, err = strconv.Atoi(hi)
+		}
+		if err != nil || a < 1 || b > len(changes) || a > b {
+			return nil, fmt.Errorf("%q is not a path number or range from 1 to %d", f, len(changes))
+		}
+		for i := a; i <= b; i++ {
+			picked[i-1] = true
+		}
+	}
+	var out []overlayChange
+	for i, c := range changes {
+		if picked[i] {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// removeOverlay deletes an overlay's layers. The engine leaves an empty,
+// root-owned directory in the work layer, which can still be removed.
+func removeOverlay(dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("remove workspace overlay: %w", err)
+	}
+	return nil
+}
+
+// finishOverlay reviews a --cow session's changes once its agent has
+// exited. Errors leave the overlay for `membrane review`.
+func finishOverlay(id, workspaceDir string) {
+	if err := reviewOverlay(id, workspaceDir); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: review workspace changes: %v; retry with: membrane review %s\n", err, id)
+	}
+}
+
+// ReviewSession reviews the kept workspace overlay of an ended --cow
+// session.
+func ReviewSession(ref string) error {
+	r, err := loadSessionRecord(resolveSession(ref))
+	if err != nil {
+		return fmt.Errorf("session %s not found", ref)
+	}
+	if r.Overlay == "" {
+		return fmt.Errorf("session %s didn't run with --cow", ref)
+	}
+	if err := selectEngine(); err != nil {
+		return err
+	}
+	r.refresh()
+	if r.live() {
+		return fmt.Errorf("session %s is still running", ref)
+	}
+	return reviewOverlay(r.ID, r.Workspace)
+}
@@ -0,0 +1,74 @@
+package membrane
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// symlinkedWorkspace returns an upper layer where the agent replaced the
+// workspace's symlink foo with a directory holding x, the workspace, and
+// the directory outside it that foo points to.
+func symlinkedWorkspace(t *testing.T) (upper, lower, outside string) {
+	t.Helper()
+	upper, lower, outside = t.TempDir(), t.TempDir(), t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(lower, "foo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "x"), []byte("outside\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(upper, "foo"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(upper, "foo", "x"), []byte("agent\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return upper, lower, outside
+}
+
+func TestOverlayChangesDontFollowSymlinks(t *testing.T) {
+	upper, lower, _ := symlinkedWorkspace(t)
+
+	changes, err := overlayChanges(upper, lower, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []overlayChange{{path: "foo", kind: 'D'}, {path: filepath.Join("foo", "x"), kind: 'A'}}
+	if !slices.Equal(changes, want) {
+		t.Errorf("changes = %+v, want %+v", changes, want)
+	}
+}
+
+func TestApplyChangeRefusesSymlinkedParent(t *testing.T) {
+	upper, lower, outside := symlinkedWorkspace(t)
+
+	for _, kind := range []byte{'A', 'D'} {
+		c := overlayChange{path: filepath.Join("foo", "x"), kind: kind}
+		if err := applyChange(c, upper, lower); err == nil {
+			t.Errorf("applyChange(%c foo/x) wrote through the workspace's symlink", kind)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(outside, "x")); err != nil || string(data) != "outside\n" {
+		t.Errorf("file outside the workspace = %q, %v", data, err)
+	}
+}
+
+func TestApplyChangesReplacesSymlinkFirst(t *testing.T) {
+	upper, lower, outside := symlinkedWorkspace(t)
+
+	changes, err := overlayChanges(upper, lower, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyChanges(changes, upper, lower); err != nil {
+		t.Fatalf("applyChanges: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(lower, "foo", "x")); err != nil || string(data) != "agent\n" {
+		t.Errorf("workspace foo/x = %q, %v", data, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(outside, "x")); err != nil || string(data) != "outside\n" {
+		t.Errorf("file outside the workspace = %q, %v", data, err)
+	}
+}
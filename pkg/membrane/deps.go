@@ -14,6 +14,9 @@ import (
 // ensureDeps checks that all required dependencies are installed,
 // configured, and running. Runs at startup after ensureRepo.
 func ensureDeps(repoDir string) error {
+	if _, ok := usingPodman(); ok {
+		return ensureDepsPodman()
+	}
 	if runtime.GOOS == "darwin" {
 		return ensureDepsDarwin(repoDir)
 	}
@@ -108,6 +111,27 @@ func ensureDepsLinux(repoDir string) error {
 	return nil
 }
 
+// ensureDepsPodman checks that podman is installed and its API socket is
+// up. There is no install script; Sysbox isn't used.
+func ensureDepsPodman() error {
+	if _, err := exec.LookPath("podman"); err != nil {
+		return fmt.Errorf("podman not found; install it with your distribution's package manager")
+	}
+	if _, err := containers.Info(); err != nil {
+		start := []string{"systemctl", "--user", "start", "podman.socket"}
+		if os.Geteuid() == 0 {
+			start = []string{"systemctl", "start", "podman.socket"}
+		}
+		return offerStart(
+			fmt.Sprintf("Podman API socket is not reachable (%v).", err),
+			func() error {
+				return exec.Command(start[0], start[1:]...).Run()
+			},
+		)
+	}
+	return nil
+}
+
 // checkBinary checks if a binary is in PATH. If not, offers to run
 // the install script.
 func checkBinary(name, installScript, repoDir string) error {
@@ -139,6 +163,9 @@ func checkSysbox() error {
 // the install script. If yes, runs it. If no, returns an error so
 // membrane exits cleanly.
 func offerInstall(problem, script, repoDir string) error {
+	if offline {
+		return fmt.Errorf("dependency check failed: %s\nmembrane is offline; run %s once you're online", problem, script)
+	}
 	scriptPath := filepath.Join(repoDir, script)
 	if _, err := os.Stat(scriptPath); err != nil {
 		return fmt.Errorf("%s\nInstall script not found at %s — try: git clone https://github.com/noperator/membrane",
@@ -0,0 +1,445 @@
+package membrane
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// Detached sessions. Interactive and `run -d` sessions are owned by a
+// supervisor process (the hidden `membrane __supervise` command) rather
+// than by the foreground membrane process. The supervisor sets up the
+// handler, networks, volumes and tracer, creates the agent container, and
+// reports back on a pipe. It then leaves the terminal and cleans the
+// session up once the agent exits. The foreground process only attaches
+// to the agent's terminal, so it can detach (Ctrl-P Ctrl-Q) or lose its
+// terminal without ending the session.
+
+// sessionSpec is what runSupervised hands to the supervisor: the parts
+// of runOptions a session needs once the host is set up.
+type sessionSpec struct {
+	WorkspaceDir   string         `json:"workspace_dir"`
+	Trace          bool           `json:"trace"`
+	NoGlobalConfig bool           `json:"no_global_config"`
+	Detach         bool           `json:"detach"`
+	Name           string         `json:"name,omitempty"`
+	TraceLog       string         `json:"trace_log,omitempty"`
+	SessionIDFile  string         `json:"session_id_file,omitempty"`
+	Timeout        time.Duration  `json:"timeout,omitempty"`
+	IdleTimeout    time.Duration  `json:"idle_timeout,omitempty"`
+	SummaryJSON    string         `json:"summary_json,omitempty"`
+	Cow            bool           `json:"cow,omitempty"`
+	Worktree       string         `json:"worktree,omitempty"`
+	ExitCodes      ExitCodes      `json:"exit_codes"`
+	Resume         string         `json:"resume,omitempty"` // the checkpointed session to resume
+	Config         *configSources `json:"config,omitempty"` // the config files it started with
+	Passthrough    []string       `json:"passthrough,omitempty"`
+	CLI            CLIOverrides   `json:"cli"`
+}
+
+func specOf(opts runOptions, workspaceDir string) sessionSpec {
+	return sessionSpec{
+		WorkspaceDir:   workspaceDir,
+		Trace:          opts.trace,
+		NoGlobalConfig: opts.noGlobalConfig,
+		Detach:         opts.detach,
+		Name:           opts.name,
+		TraceLog:       opts.traceLog,
+		SessionIDFile:  opts.sessionIDFile,
+		Timeout:        opts.timeout,
+		IdleTimeout:    opts.idleTimeout,
+		SummaryJSON:    opts.summaryJSON,
+		Cow:            opts.cow,
+		Worktree:       opts.worktree,
+		ExitCodes:      opts.exitCodes,
+		Resume:         opts.resume,
+		Config:         opts.config,
+		Passthrough:    opts.passthrough,
+		CLI:            opts.cli,
+	}
+}
+
+func (spec sessionSpec) options() runOptions {
+	return runOptions{
+		trace:          spec.Trace,
+		noGlobalConfig: spec.NoGlobalConfig,
+		detach:         spec.Detach,
+		name:           spec.Name,
+		traceLog:       spec.TraceLog,
+		sessionIDFile:  spec.SessionIDFile,
+		timeout:        spec.Timeout,
+		idleTimeout:    spec.IdleTimeout,
+		summaryJSON:    spec.SummaryJSON,
+		cow:            spec.Cow,
+		worktree:       spec.Worktree,
+		exitCodes:      spec.ExitCodes.orDefault(),
+		resume:         spec.Resume,
+		passthrough:    spec.Passthrough,
+		cli:            spec.CLI,
+	}
+}
+
+// supervisorReady is the supervisor's report once the session is up, or
+// why it couldn't start.
+type supervisorReady struct {
+	ID      string `json:"id,omitempty"`
+	Approve bool   `json:"approve,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// runSupervised starts a supervisor for the session and, unless the
+// session is detached, attaches to the agent's terminal.
+func runSupervised(opts runOptions, workspaceDir string) error {
+	specFile, err := writeTempJSON("session", specOf(opts, workspaceDir))
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		os.Remove(specFile)
+		return fmt.Errorf("find membrane executable: %w", err)
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		os.Remove(specFile)
+		return fmt.Errorf("create supervisor pipe: %w", err)
+	}
+
+	// The supervisor shares this terminal until the session is up, so
+	// sudo prompts, warnings and the setup spinner still reach the user.
+	cmd := exec.Command(exe, "__supervise", specFile)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{pw}
+	if err := cmd.Start(); err != nil {
+		pr.Close()
+		pw.Close()
+		os.Remove(specFile)
+		return fmt.Errorf("start session supervisor: %w", err)
+	}
+	pw.Close()
+
+	var ready supervisorReady
+	err = json.NewDecoder(pr).Decode(&ready)
+	pr.Close()
+	if err != nil || ready.ID == "" {
+		_ = cmd.Wait()
+		if ready.Error != "" {
+			return errors.New(ready.Error)
+		}
+		return fmt.Errorf("session supervisor exited before the session started")
+	}
+
+	if opts.detach {
+		_ = cmd.Process.Release()
+		fmt.Println(ready.ID)
+		fmt.Fprintf(os.Stderr, "membrane: session %s started in the background; attach with: membrane attach %s\n",
+			ready.ID, ready.ID)
+		return nil
+	}
+
+	// As when membrane ran the agent itself, SIGINT and SIGTERM to this
+	// process stop the agent, and the supervisor tears the session down.
+	// SIGHUP, the terminal or SSH connection going away, leaves the
+	// session running to attach to later.
+	s := sessionNamesFor(ready.ID)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		if _, ok := <-sigs; ok {
+			fmt.Fprintln(os.Stderr, "\r\nmembrane: stopping...")
+			_ = containers.StopContainer(s.agentContainer, 2*time.Second)
+		}
+	}()
+	err = attachSession(s, []string{"start", "-ai", s.agentContainer}, ready.Approve, workspaceDir, false)
+	signal.Stop(sigs)
+	close(sigs)
+	if errors.Is(err, errDetached) {
+		_ = cmd.Process.Release()
+		return nil
+	}
+	// The agent has exited; wait for the supervisor to tear the session
+	// down so a following command sees it gone.
+	_ = cmd.Wait()
+	if opts.cow {
+		finishOverlay(s.id, workspaceDir)
+	}
+	r, rerr := loadSessionRecord(s.id)
+	if rerr == nil {
+		reportWorktree(r)
+		finishCommits(r)
+	}
+	// The supervisor records why the agent was stopped, if membrane
+	// stopped it, and the exit code membrane reports for it.
+	var exitErr *ExitError
+	if rerr == nil && r.Reason != "" && r.ExitCode != nil {
+		if err == nil || errors.As(err, &exitErr) {
+			return &ExitError{Code: *r.ExitCode, Reason: r.Reason}
+		}
+		fmt.Fprintf(os.Stderr, "membrane: %s\n", r.Reason)
+	}
+	return err
+}
+
+// Attach reconnects the terminal to a running session's agent.
+func Attach(sessionID string) error {
+	if err := selectEngine(); err != nil {
+		return err
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return fmt.Errorf("attach needs an interactive terminal")
+	}
+	s := sessionNamesFor(resolveSession(sessionID))
+	if !agentRunning(s) {
+		return fmt.Errorf("session %s not found or not running", sessionID)
+	}
+
+	agent, err := containers.InspectContainer(s.agentContainer)
+	if err != nil {
+		return fmt.Errorf("inspect session %s: %w", sessionID, err)
+	}
+	workspaceDir := agent.Mounts["/workspace"]
+	r, rerr := loadSessionRecord(s.id)
+	if rerr == nil {
+		// With --cow, /workspace is the overlay volume.
+		workspaceDir = r.Workspace
+	}
+
+	// Approval mode is on if the handler was started with it.
+	handler, err := containers.InspectContainer(s.handlerContainer)
+	if err != nil {
+		return fmt.Errorf("inspect session %s: %w", sessionID, err)
+	}
+	approve := false
+	for _, e := range handler.Env {
+		if strings.HasPrefix(e, "MEMBRANE_APPROVE_TIMEOUT=") {
+			approve = true
+		}
+	}
+
+	err = attachSession(s, []string{"attach", s.agentContainer}, approve, workspaceDir, true)
+	if errors.Is(err, errDetached) {
+		return nil
+	}
+	if rerr == nil && r.Overlay != "" {
+		finishOverlay(s.id, workspaceDir)
+	}
+	finishCommits(r)
+	return err
+}
+
+// attachSession runs docker with args (start -ai or attach) on this
+// terminal with the detach keys enabled. It returns errDetached if the
+// user detached or the agent is otherwise still running afterwards.
+func attachSession(s sessionNames, args []string, approve bool, workspaceDir string, redraw bool) error {
+	var gate *promptGate
+	if approve {
+		gate = &promptGate{}
+		stop, err := startApprovals(s, workspaceDir, gate)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	err := execDocker(args, ptyProxy{gate: gate, detach: true, redraw: redraw})
+	if errors.Is(err, errDetached) || agentRunning(s) {
+		fmt.Fprintf(os.Stderr, "membrane: detached from session %s; reattach with: membrane attach %s\n", s.id, s.id)
+		return errDetached
+	}
+	return err
+}
+
+func agentRunning(s sessionNames) bool {
+	st, err := containers.InspectContainer(s.agentContainer)
+	return err == nil && st.Running
+}
+
+// Supervise owns a session on behalf of runSupervised; it is the hidden
+// `membrane __supervise` command. It reports on fd 3 once the agent
+// container exists, then runs until the agent exits and cleans up.
+func Supervise(specFile string) error {
+	ready := os.NewFile(3, "ready")
+	reported := false
+	err := supervise(specFile, func(id string, approve bool) {
+		_ = json.NewEncoder(ready).Encode(supervisorReady{ID: id, Approve: approve})
+		ready.Close()
+		reported = true
+	})
+	if err != nil && !reported {
+		// The foreground process reports the error.
+		_ = json.NewEncoder(ready).Encode(supervisorReady{Error: err.Error()})
+		ready.Close()
+		return nil
+	}
+	return err
+}
+
+func supervise(specFile string, ready func(id string, approve bool)) (err error) {
+	// A hangup on the terminal that started the session must not end it.
+	signal.Ignore(syscall.SIGHUP)
+	if err := selectEngine(); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(specFile)
+	if err != nil {
+		return fmt.Errorf("read session spec: %w", err)
+	}
+	os.Remove(specFile)
+	var spec sessionSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return fmt.Errorf("parse session spec: %w", err)
+	}
+	opts := spec.options()
+	opts.supervised = true
+
+	cfg, m, s, rec, err := prepareSession(opts, spec.WorkspaceDir)
+	// Runs last, once cleanup has compressed the handler log.
+	var code int
+	defer func() { rec.finish(code, err) }()
+	if err != nil {
+		return err
+	}
+
+	// Runs after the agent has exited; runSupervised reports what's left.
+	defer cfg.worktree.finish()
+
+	cleanup, gatewayIP, err := startSession(s, cfg, spec.WorkspaceDir)
+	defer cleanup()
+	if err != nil {
+		return fmt.Errorf("start session: %w", err)
+	}
+
+	agentHome, err := prepareAgentHome(cfg.Home, s, spec.WorkspaceDir)
+	if err != nil {
+		return err
+	}
+	// Runs after the agent has exited, before cleanup removes the session's
+	// temp files.
+	defer agentHome.finish()
+
+	agentArgs, err := buildAgentArgs(spec.WorkspaceDir, m, cfg, opts.passthrough, s, gatewayIP, agentHome)
+	if err != nil {
+		return err
+	}
+
+	var tracer *Tracer
+	if opts.trace {
+		traceLogFile, err := traceLogPath(opts, s)
+		if err != nil {
+			return err
+		}
+		tracer = NewTracer(s.agentContainer, traceLogFile)
+		if err := tracer.Start(); err != nil {
+			return fmt.Errorf("tracee failed to start: %w\nRe-run with --no-trace to start without tracing", err)
+		}
+		defer tracer.Stop()
+	}
+
+	agentID, err := containers.CreateContainer(append([]string{"-it"}, agentArgs...))
+	if err != nil {
+		return fmt.Errorf("create agent container: %w", err)
+	}
+	defer containers.RemoveContainer(s.agentContainer)
+	// Started before the tracer streams, so trace events count as
+	// activity.
+	wd := startWatchdog(s, opts.timeout, opts.idleTimeout, tracer)
+	if tracer != nil {
+		tracer.StartStreaming(agentID)
+	}
+	mon := watchLimits(s, cfg.Limits.res)
+
+	restored := cfg.restore.restoreProcess(s)
+	if opts.detach && !restored {
+		if err := containers.StartContainer(s.agentContainer); err != nil {
+			return fmt.Errorf("start agent: %w", err)
+		}
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return fmt.Errorf("get home dir: %w", err)
+	}
+	logPath := filepath.Join(home, ".membrane", "logs", "membrane-supervisor-"+s.id+".log")
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return fmt.Errorf("create supervisor log: %w", err)
+	}
+	defer logFile.Close()
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", os.DevNull, err)
+	}
+	defer devNull.Close()
+
+	rec.running()
+	ready(s.id, cfg.Approve)
+
+	// Leave the terminal: drop our references to it and start a new
+	// session so it is no longer our controlling terminal.
+	os.Stdin.Close()
+	os.Stdout.Close()
+	os.Stderr.Close()
+	os.Stdin, os.Stdout, os.Stderr = devNull, logFile, logFile
+	if _, err := syscall.Setsid(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: setsid: %v\n", err)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-sigs
+		fmt.Fprintln(os.Stderr, "membrane: stopping...")
+		_ = containers.StopContainer(s.agentContainer, 2*time.Second)
+	}()
+
+	// An attached session's agent is started by the foreground process;
+	// give it a minute before giving up on it. Subscribe before looking,
+	// so a start in between isn't missed.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	events, _ := containers.Events(ctx, map[string][]string{
+		"container": {s.agentContainer},
+		"event":     {"start"},
+	})
+	agent, err := containers.InspectContainer(s.agentContainer)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("inspect agent: %w", err)
+	}
+	if agent.Status == "created" {
+		if _, ok := <-events; !ok {
+			// Timed out, or the event stream broke; look once more.
+			if agent, err := containers.InspectContainer(s.agentContainer); err != nil || agent.Status == "created" {
+				cancel()
+				return fmt.Errorf("agent container was never started")
+			}
+		}
+	}
+	cancel()
+
+	code, err = containers.WaitContainer(context.Background(), s.agentContainer)
+	if err != nil {
+		return fmt.Errorf("wait for agent: %w", err)
+	}
+	rec.agentExited()
+	fmt.Fprintf(os.Stderr, "membrane: agent exited with code %d\n", code)
+	var exitErr *ExitError
+	if errors.As(withTimeoutReason(withLimitReason(&ExitError{Code: code}, s, cfg.Limits, mon), wd, opts.exitCodes.Timeout), &exitErr) && exitErr.Reason != "" {
+		fmt.Fprintf(os.Stderr, "membrane: %s\n", exitErr.Reason)
+		code, rec.Reason = exitErr.Code, exitErr.Reason
+		rec.OOMKilled, rec.Timeout = exitErr.OOMKilled, exitErr.Timeout
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package membrane
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// engine is the container engine sessions run on. dockerAPI talks to the
+// Docker Engine API, and podmanAPI to Podman's compatible API; tests use
+// fakeEngine.
+//
+// Interactive terminals (docker run -it, start -ai, attach, exec -it) and
+// image builds still go through the docker CLI; see execDocker.
+type engine interface {
+	CreateNetwork(name string, internal bool, labels map[string]string) (id string, err error)
+	ConnectNetwork(network, container string) error
+	RemoveNetwork(name string) error
+	ListNetworks(label string) ([]resource, error)
+
+	// CreateVolume creates a local volume; driverOpts are its mount
+	// options (type, device, o), as in docker volume create --opt.
+	CreateVolume(name string, labels, driverOpts map[string]string) error
+	RemoveVolume(name string) error
+	ListVolumes(label string) ([]resource, error)
+
+	// RunContainer creates and starts a container.
+	RunContainer(spec containerSpec) (id string, err error)
+	// CreateContainer creates a container from docker create flags, its
+	// image and command, as the agent is made: its `args` config is raw
+	// docker run flags, so dockerAPI hands them to the CLI.
+	CreateContainer(args []string) (id string, err error)
+	StartContainer(name string) error
+	InspectContainer(name string) (containerState, error)
+	StopContainer(name string, timeout time.Duration) error
+	RemoveContainer(name string) error // forced, like docker rm -f
+	// WaitContainer blocks until the container stops and returns its
+	// exit code.
+	WaitContainer(ctx context.Context, name string) (int, error)
+	ListContainers(label string, all bool) ([]resource, error)
+
+	// Exec runs cmd in a running container and returns its exit code.
+	// stdin may be nil; it is closed on the container side at EOF.
+	Exec(ctx context.Context, container string, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error)
+	// Logs copies the container's output to w; with follow, until the
+	// container stops or ctx is done.
+	Logs(ctx context.Context, container string, follow bool, w io.Writer) error
+	// Events streams container events matching filters (e.g.
+	// "container": {name}, "event": {"start"}) until ctx is done.
+	Events(ctx context.Context, filters map[string][]string) (<-chan engineEvent, <-chan error)
+
+	ImageExists(name string) (bool, error)
+	InspectImage(name string) (imageInfo, error)
+	// ListImages lists the tagged images of repository repo; each has
+	// its tags in repo only.
+	ListImages(repo string) ([]imageInfo, error)
+	// TagImage adds the tag ref (repo:tag) to image.
+	TagImage(image, ref string) error
+	PullImage(name string, progress io.Writer) error
+	RemoveImage(name string) error
+	// SaveImages writes images to w as one tar archive, like docker save.
+	SaveImages(names []string, w io.Writer) error
+	// LoadImages loads the images in a tar archive from SaveImages.
+	LoadImages(r io.Reader) error
+	// CommitContainer saves the container's filesystem, without its
+	// mounts, as image, like docker commit. The container is paused
+	// meanwhile.
+	CommitContainer(container, image string, labels map[string]string) error
+	// Info describes the engine: its runtimes and storage.
+	Info() (engineInfo, error)
+	// Stats samples a running container's resource usage.
+	Stats(name string) (containerStats, error)
+}
+
+// engineInfo is what Info reports.
+type engineInfo struct {
+	Runtimes          []string // OCI runtimes, e.g. sysbox-runc
+	StorageDriver     string   // e.g. overlay2
+	BackingFilesystem string   // e.g. xfs, for overlay drivers
+	SecurityOptions   []string // e.g. name=rootless
+}
+
+// imageInfo is what InspectImage reports.
+type imageInfo struct {
+	ID         string
+	Tags       []string // repo:tag; from ListImages only
+	Created    time.Time
+	Entrypoint []string
+	Labels     map[string]string
+}
+
+// splitImageRef splits an image reference into its repository and tag,
+// latest if there's none.
+func splitImageRef(name string) (repo, tag string) {
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		return name[:i], name[i+1:]
+	}
+	return name, "latest"
+}
+
+// containerStats is a sample from Stats.
+type containerStats struct {
+	Pids      int64
+	PidsLimit int64 // 0 if unlimited
+	Memory    int64
+}
+
+// containerSpec describes a container for RunContainer.
+type containerSpec struct {
+	Name       string
+	Image      string
+	Entrypoint []string
+	Cmd        []string
+	Env        []string
+	Labels     map[string]string
+	Network    string
+	CapAdd     []string
+	Privileged bool
+	PidMode    string
+	Binds      []string // src:dst[:ro]
+	Sysctls    map[string]string
+	AutoRemove bool
+	Resources  resources
+}
+
+// resources are a container's resource limits. Zero means unlimited.
+type resources struct {
+	NanoCPUs   int64
+	Memory     int64 // bytes
+	MemorySwap int64 // memory plus swap, in bytes; -1 for unlimited swap
+	PidsLimit  int64
+	NoFile     int64  // open files (RLIMIT_NOFILE)
+	DiskSize   string // writable layer size, e.g. 20G
+}
+
+// containerState is what InspectContainer reports.
+type containerState struct {
+	ID        string
+	Name      string
+	Status    string // created, running, exited, ...
+	Running   bool
+	ExitCode  int
+	OOMKilled bool
+	Pid       int  // of its init process, in the engine host's pid namespace
+	Tty       bool // output is a raw terminal stream, not multiplexed
+	Env       []string
+	Labels    map[string]string
+	Mounts    map[string]string // destination → source
+	IPs       map[string]string // network → address
+}
+
+// resource is a container, network or volume in a listing.
+type resource struct {
+	ID      string
+	Name    string
+	Labels  map[string]string
+	Image   string // containers only
+	Running bool   // containers only
+	Created time.Time
+}
+
+// engineEvent is one event from Events.
+type engineEvent struct {
+	Action string // e.g. start, die
+	ID     string
+	Name   string
+}
+
+// errNotFound is returned (wrapped) for missing containers, networks,
+// volumes, images and execs.
+var errNotFound = errors.New("not found")
+
+// containers is the engine sessions use, and containerCLI the matching
+// command-line tool for the paths that still shell out. Both are set by
+// selectEngine; tests swap in a fakeEngine.
+var (
+	containers   engine = &dockerAPI{}
+	containerCLI        = "docker"
+)
+
+// selectEngine picks the engine named by MEMBRANE_ENGINE (docker, the
+// default, or podman). Every command calls it before touching containers.
+func selectEngine() error {
+	switch name := os.Getenv("MEMBRANE_ENGINE"); name {
+	case "", "docker":
+		if runtime.GOOS == "darwin" {
+			os.Setenv("DOCKER_CONTEXT", "colima-membrane")
+		}
+		return nil
+	case "podman":
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("the podman engine is only supported on Linux")
+		}
+		containers = newPodmanAPI()
+		containerCLI = "podman"
+		return nil
+	default:
+		return fmt.Errorf("unknown MEMBRANE_ENGINE %q (want docker or podman)", name)
+	}
+}
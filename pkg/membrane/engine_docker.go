@@ -0,0 +1,949 @@
+package membrane
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dockerAPI is an engine backed by the Docker Engine API, spoken over the
+// daemon's socket with net/http. The endpoint is resolved like the docker
+// CLI does: DOCKER_HOST, then DOCKER_CONTEXT or the CLI's current context,
+// then the default socket. TCP endpoints may use TLS, and ssh:// ones are
+// reached through `docker system dial-stdio` on the remote host.
+type dockerAPI struct {
+	host   string // fixed endpoint, e.g. unix:///run/podman/podman.sock
+	once   sync.Once
+	dial   func(ctx context.Context) (net.Conn, error)
+	client *http.Client
+	err    error
+}
+
+const defaultDockerSocket = "/var/run/docker.sock"
+
+func (d *dockerAPI) connect() error {
+	d.once.Do(func() {
+		ep := dockerEndpoint{host: d.host}
+		if ep.host == "" {
+			if ep, d.err = resolveDockerEndpoint(); d.err != nil {
+				return
+			}
+		}
+		if d.dial, d.err = ep.dialer(); d.err != nil {
+			return
+		}
+		d.client = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return d.dial(ctx)
+			},
+		}}
+	})
+	return d.err
+}
+
+// dockerEndpoint is a daemon endpoint and, for TCP, its TLS settings.
+type dockerEndpoint struct {
+	host       string
+	tlsDir     string // ca.pem, cert.pem and key.pem; "" without TLS
+	skipVerify bool
+}
+
+// dialer returns a function that connects to the endpoint.
+func (ep dockerEndpoint) dialer() (func(ctx context.Context) (net.Conn, error), error) {
+	u, err := url.Parse(ep.host)
+	if err != nil {
+		return nil, fmt.Errorf("docker host %q: %w", ep.host, err)
+	}
+	var dialer net.Dialer
+	switch u.Scheme {
+	case "unix":
+		return func(ctx context.Context) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", u.Path)
+		}, nil
+	case "tcp":
+		if ep.tlsDir == "" {
+			return func(ctx context.Context) (net.Conn, error) {
+				return dialer.DialContext(ctx, "tcp", u.Host)
+			}, nil
+		}
+		cfg, err := ep.tlsConfig(u.Hostname())
+		if err != nil {
+			return nil, fmt.Errorf("docker host %s: %w", ep.host, err)
+		}
+		tlsDialer := &tls.Dialer{Config: cfg}
+		return func(ctx context.Context) (net.Conn, error) {
+			return tlsDialer.DialContext(ctx, "tcp", u.Host)
+		}, nil
+	case "ssh":
+		return func(ctx context.Context) (net.Conn, error) {
+			return dialSSH(ctx, u)
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported docker host %q", ep.host)
+}
+
+// tlsConfig loads the endpoint's client certificate and, unless
+// skipVerify, the CA that the daemon's certificate must chain to. Missing
+// files are left out, as the docker CLI does.
+func (ep dockerEndpoint) tlsConfig(serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: serverName, InsecureSkipVerify: ep.skipVerify}
+	if ca, err := os.ReadFile(filepath.Join(ep.tlsDir, "ca.pem")); err == nil && !ep.skipVerify {
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in %s", filepath.Join(ep.tlsDir, "ca.pem"))
+		}
+	}
+	certFile, keyFile := filepath.Join(ep.tlsDir, "cert.pem"), filepath.Join(ep.tlsDir, "key.pem")
+	if _, err := os.Stat(certFile); err == nil {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// resolveDockerEndpoint resolves the daemon endpoint the docker CLI would
+// use.
+func resolveDockerEndpoint() (dockerEndpoint, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return dockerEndpoint{}, fmt.Errorf("get home dir: %w", err)
+	}
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		ep := dockerEndpoint{host: host}
+		if os.Getenv("DOCKER_TLS_VERIFY") != "" || os.Getenv("DOCKER_TLS") != "" {
+			ep.tlsDir = os.Getenv("DOCKER_CERT_PATH")
+			if ep.tlsDir == "" {
+				ep.tlsDir = filepath.Join(home, ".docker")
+			}
+			ep.skipVerify = os.Getenv("DOCKER_TLS_VERIFY") == ""
+		}
+		return ep, nil
+	}
+	name := os.Getenv("DOCKER_CONTEXT")
+	if name == "" {
+		var cfg struct {
+			CurrentContext string `json:"currentContext"`
+		}
+		if data, err := os.ReadFile(filepath.Join(home, ".docker", "config.json")); err == nil {
+			_ = json.Unmarshal(data, &cfg)
+		}
+		name = cfg.CurrentContext
+	}
+	if name == "" || name == "default" {
+		return dockerEndpoint{host: "unix://" + defaultDockerSocket}, nil
+	}
+	sum := sha256.Sum256([]byte(name))
+	dir := hex.EncodeToString(sum[:])
+	data, err := os.ReadFile(filepath.Join(home, ".docker", "contexts", "meta", dir, "meta.json"))
+	if err != nil {
+		return dockerEndpoint{}, fmt.Errorf("read docker context %s: %w", name, err)
+	}
+	var meta struct {
+		Endpoints map[string]struct {
+			Host          string `json:"Host"`
+			SkipTLSVerify bool   `json:"SkipTLSVerify"`
+		} `json:"Endpoints"`
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return dockerEndpoint{}, fmt.Errorf("parse docker context %s: %w", name, err)
+	}
+	docker := meta.Endpoints["docker"]
+	if docker.Host == "" {
+		return dockerEndpoint{}, fmt.Errorf("docker context %s has no docker endpoint", name)
+	}
+	ep := dockerEndpoint{host: docker.Host, skipVerify: docker.SkipTLSVerify}
+	// A context's TLS material is stored beside its metadata.
+	tlsDir := filepath.Join(home, ".docker", "contexts", "tls", dir, "docker")
+	if _, err := os.Stat(tlsDir); err == nil || docker.SkipTLSVerify {
+		ep.tlsDir = tlsDir
+	}
+	return ep, nil
+}
+
+// dialSSH connects to the daemon on the host of an ssh:// endpoint, as
+// the docker CLI does: the remote `docker system dial-stdio` relays the
+// connection to its socket.
+func dialSSH(ctx context.Context, u *url.URL) (net.Conn, error) {
+	args := []string{"-o", "ConnectTimeout=30"}
+	if u.Port() != "" {
+		args = append(args, "-p", u.Port())
+	}
+	dest := u.Hostname()
+	if u.User != nil {
+		dest = u.User.Username() + "@" + dest
+	}
+	args = append(args, "--", dest, "docker", "system", "dial-stdio")
+	// The connection outlives ctx, which only bounds the dial.
+	cmd := exec.Command("ssh", args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("ssh to %s: %w", dest, err)
+	}
+	return &cmdConn{cmd: cmd, stdin: stdin, stdout: stdout}, nil
+}
+
+// cmdConn is a connection over a command's stdin and stdout.
+type cmdConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	once   sync.Once
+}
+
+func (c *cmdConn) Read(p []byte) (int, error)  { return c.stdout.Read(p) }
+func (c *cmdConn) Write(p []byte) (int, error) { return c.stdin.Write(p) }
+func (c *cmdConn) CloseWrite() error           { return c.stdin.Close() }
+
+func (c *cmdConn) Close() error {
+	c.once.Do(func() {
+		c.stdin.Close()
+		_ = c.cmd.Process.Kill()
+		_ = c.cmd.Wait()
+	})
+	return nil
+}
+
+func (c *cmdConn) LocalAddr() net.Addr              { return cmdAddr{} }
+func (c *cmdConn) RemoteAddr() net.Addr             { return cmdAddr{} }
+func (c *cmdConn) SetDeadline(time.Time) error      { return nil }
+func (c *cmdConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *cmdConn) SetWriteDeadline(time.Time) error { return nil }
+
+type cmdAddr struct{}
+
+func (cmdAddr) Network() string { return "cmd" }
+func (cmdAddr) String() string  { return "stdio" }
+
+// apiError is a non-2xx response from the daemon.
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string { return e.message }
+
+func (e *apiError) Unwrap() error {
+	if e.status == http.StatusNotFound {
+		return errNotFound
+	}
+	return nil
+}
+
+// do sends a request and returns the response for the caller to read and
+// close. body is sent as JSON, or as a tar archive if it's an io.Reader.
+// Non-2xx responses are returned as an *apiError.
+func (d *dockerAPI) do(ctx context.Context, method, path string, query url.Values, body any) (*http.Response, error) {
+	if err := d.connect(); err != nil {
+		return nil, err
+	}
+	var r io.Reader
+	contentType := "application/json"
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		r, contentType = b, "application/x-tar"
+	default:
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	u := "http://docker" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("docker API: %w", err)
+	}
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotModified {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		var msg struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &msg) != nil || msg.Message == "" {
+			msg.Message = strings.TrimSpace(string(data))
+		}
+		return nil, &apiError{resp.StatusCode, msg.Message}
+	}
+	return resp, nil
+}
+
+// call sends a request and decodes a JSON response into out, if non-nil.
+func (d *dockerAPI) call(method, path string, query url.Values, body, out any) error {
+	resp, err := d.do(context.Background(), method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// parseTime parses an RFC 3339 time from the API, or returns the zero
+// time.
+func parseTime(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, s)
+	return t
+}
+
+func labelFilter(label string) url.Values {
+	q := url.Values{}
+	if label != "" {
+		f, _ := json.Marshal(map[string][]string{"label": {label}})
+		q.Set("filters", string(f))
+	}
+	return q
+}
+
+func (d *dockerAPI) CreateNetwork(name string, internal bool, labels map[string]string) (string, error) {
+	var out struct {
+		ID string `json:"Id"`
+	}
+	err := d.call("POST", "/networks/create", nil, map[string]any{
+		"Name":           name,
+		"Internal":       internal,
+		"Labels":         labels,
+		"CheckDuplicate": true,
+	}, &out)
+	return out.ID, err
+}
+
+func (d *dockerAPI) ConnectNetwork(network, container string) error {
+	return d.call("POST", "/networks/"+url.PathEscape(network)+"/connect", nil,
+		map[string]string{"Container": container}, nil)
+}
+
+func (d *dockerAPI) RemoveNetwork(name string) error {
+	return d.call("DELETE", "/networks/"+url.PathEscape(name), nil, nil, nil)
+}
+
+func (d *dockerAPI) ListNetworks(label string) ([]resource, error) {
+	var out []struct {
+		ID      string            `json:"Id"`
+		Name    string            `json:"Name"`
+		Labels  map[string]string `json:"Labels"`
+		Created string            `json:"Created"`
+	}
+	if err := d.call("GET", "/networks", labelFilter(label), nil, &out); err != nil {
+		return nil, err
+	}
+	var list []resource
+	for _, n := range out {
+		list = append(list, resource{ID: n.ID, Name: n.Name, Labels: n.Labels, Created: parseTime(n.Created)})
+	}
+	return list, nil
+}
+
+func (d *dockerAPI) CreateVolume(name string, labels, driverOpts map[string]string) error {
+	return d.call("POST", "/volumes/create", nil, map[string]any{
+		"Name":       name,
+		"Labels":     labels,
+		"DriverOpts": driverOpts,
+	}, nil)
+}
+
+func (d *dockerAPI) RemoveVolume(name string) error {
+	return d.call("DELETE", "/volumes/"+url.PathEscape(name), nil, nil, nil)
+}
+
+func (d *dockerAPI) ListVolumes(label string) ([]resource, error) {
+	var out struct {
+		Volumes []struct {
+			Name      string            `json:"Name"`
+			Labels    map[string]string `json:"Labels"`
+			CreatedAt string            `json:"CreatedAt"`
+		} `json:"Volumes"`
+	}
+	if err := d.call("GET", "/volumes", labelFilter(label), nil, &out); err != nil {
+		return nil, err
+	}
+	var list []resource
+	for _, v := range out.Volumes {
+		list = append(list, resource{ID: v.Name, Name: v.Name, Labels: v.Labels, Created: parseTime(v.CreatedAt)})
+	}
+	return list, nil
+}
+
+func (d *dockerAPI) RunContainer(spec containerSpec) (string, error) {
+	hostConfig := map[string]any{
+		"NetworkMode": spec.Network,
+		"CapAdd":      spec.CapAdd,
+		"Privileged":  spec.Privileged,
+		"PidMode":     spec.PidMode,
+		"Binds":       spec.Binds,
+		"Sysctls":     spec.Sysctls,
+		"AutoRemove":  spec.AutoRemove,
+	}
+	r := spec.Resources
+	if r.NanoCPUs > 0 {
+		hostConfig["NanoCpus"] = r.NanoCPUs
+	}
+	if r.Memory > 0 {
+		hostConfig["Memory"] = r.Memory
+	}
+	if r.MemorySwap != 0 {
+		hostConfig["MemorySwap"] = r.MemorySwap
+	}
+	if r.PidsLimit > 0 {
+		hostConfig["PidsLimit"] = r.PidsLimit
+	}
+	if r.NoFile > 0 {
+		hostConfig["Ulimits"] = []map[string]any{{"Name": "nofile", "Soft": r.NoFile, "Hard": r.NoFile}}
+	}
+	if r.DiskSize != "" {
+		hostConfig["StorageOpt"] = map[string]string{"size": r.DiskSize}
+	}
+	body := map[string]any{
+		"Image":      spec.Image,
+		"Env":        spec.Env,
+		"Labels":     spec.Labels,
+		"HostConfig": hostConfig,
+	}
+	if spec.Entrypoint != nil {
+		body["Entrypoint"] = spec.Entrypoint
+	}
+	if spec.Cmd != nil {
+		body["Cmd"] = spec.Cmd
+	}
+	var out struct {
+		ID string `json:"Id"`
+	}
+	q := url.Values{"name": {spec.Name}}
+	if err := d.call("POST", "/containers/create", q, body, &out); err != nil {
+		return "", fmt.Errorf("create container %s: %w", spec.Name, err)
+	}
+	if err := d.StartContainer(out.ID); err != nil {
+		return out.ID, err
+	}
+	return out.ID, nil
+}
+
+func (d *dockerAPI) CreateContainer(args []string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(containerCLI, append([]string{"create"}, args...)...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s create: %s: %w", containerCLI, strings.TrimSpace(stderr.String()), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (d *dockerAPI) StartContainer(name string) error {
+	if err := d.call("POST", "/containers/"+url.PathEscape(name)+"/start", nil, nil, nil); err != nil {
+		return fmt.Errorf("start container %s: %w", name, err)
+	}
+	return nil
+}
+
+func (d *dockerAPI) InspectContainer(name string) (containerState, error) {
+	var out struct {
+		ID    string `json:"Id"`
+		Name  string `json:"Name"`
+		State struct {
+			Status    string `json:"Status"`
+			Running   bool   `json:"Running"`
+			ExitCode  int    `json:"ExitCode"`
+			OOMKilled bool   `json:"OOMKilled"`
+			Pid       int    `json:"Pid"`
+		} `json:"State"`
+		Config struct {
+			Tty    bool              `json:"Tty"`
+			Env    []string          `json:"Env"`
+			Labels map[string]string `json:"Labels"`
+		} `json:"Config"`
+		Mounts []struct {
+			Source      string `json:"Source"`
+			Destination string `json:"Destination"`
+		} `json:"Mounts"`
+		NetworkSettings struct {
+			Networks map[string]struct {
+				IPAddress string `json:"IPAddress"`
+			} `json:"Networks"`
+		} `json:"NetworkSettings"`
+	}
+	if err := d.call("GET", "/containers/"+url.PathEscape(name)+"/json", nil, nil, &out); err != nil {
+		return containerState{}, fmt.Errorf("inspect container %s: %w", name, err)
+	}
+	st := containerState{
+		ID:        out.ID,
+		Name:      strings.TrimPrefix(out.Name, "/"),
+		Status:    out.State.Status,
+		Running:   out.State.Running,
+		ExitCode:  out.State.ExitCode,
+		OOMKilled: out.State.OOMKilled,
+		Pid:       out.State.Pid,
+		Tty:       out.Config.Tty,
+		Env:       out.Config.Env,
+		Labels:    out.Config.Labels,
+		Mounts:    map[string]string{},
+		IPs:       map[string]string{},
+	}
+	for _, m := range out.Mounts {
+		st.Mounts[m.Destination] = m.Source
+	}
+	for n, s := range out.NetworkSettings.Networks {
+		st.IPs[n] = s.IPAddress
+	}
+	return st, nil
+}
+
+func (d *dockerAPI) StopContainer(name string, timeout time.Duration) error {
+	q := url.Values{"t": {fmt.Sprint(int(timeout.Seconds()))}}
+	return d.call("POST", "/containers/"+url.PathEscape(name)+"/stop", q, nil, nil)
+}
+
+func (d *dockerAPI) RemoveContainer(name string) error {
+	return d.call("DELETE", "/containers/"+url.PathEscape(name), url.Values{"force": {"1"}}, nil, nil)
+}
+
+func (d *dockerAPI) WaitContainer(ctx context.Context, name string) (int, error) {
+	resp, err := d.do(ctx, "POST", "/containers/"+url.PathEscape(name)+"/wait", nil, nil)
+	if err != nil {
+		return 0, fmt.Errorf("wait for container %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	var out struct {
+		StatusCode int `json:"StatusCode"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return 0, fmt.Errorf("wait for container %s: %w", name, err)
+	}
+	return out.StatusCode, nil
+}
+
+func (d *dockerAPI) ListContainers(label string, all bool) ([]resource, error) {
+	q := labelFilter(label)
+	if all {
+		q.Set("all", "1")
+	}
+	var out []struct {
+		ID      string            `json:"Id"`
+		Names   []string          `json:"Names"`
+		Labels  map[string]string `json:"Labels"`
+		Image   string            `json:"Image"`
+		State   string            `json:"State"`
+		Created int64             `json:"Created"`
+	}
+	if err := d.call("GET", "/containers/json", q, nil, &out); err != nil {
+		return nil, err
+	}
+	var list []resource
+	for _, c := range out {
+		r := resource{ID: c.ID, Labels: c.Labels, Image: c.Image, Running: c.State == "running", Created: time.Unix(c.Created, 0)}
+		if len(c.Names) > 0 {
+			r.Name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		list = append(list, r)
+	}
+	return list, nil
+}
+
+func (d *dockerAPI) Exec(ctx context.Context, container string, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if err := d.call("POST", "/containers/"+url.PathEscape(container)+"/exec", nil, map[string]any{
+		"AttachStdin":  stdin != nil,
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Cmd":          cmd,
+	}, &created); err != nil {
+		return -1, fmt.Errorf("exec in %s: %w", container, err)
+	}
+
+	// Starting an exec hijacks the connection: after the response
+	// header it carries stdin one way and multiplexed output the other.
+	conn, br, err := d.hijack(ctx, "/exec/"+created.ID+"/start", map[string]any{"Detach": false, "Tty": false})
+	if err != nil {
+		return -1, fmt.Errorf("exec in %s: %w", container, err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if stdin != nil {
+		go func() {
+			_, _ = io.Copy(conn, stdin)
+			if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+				_ = cw.CloseWrite()
+			}
+		}()
+	}
+	if err := demux(br, stdout, stderr); err != nil && ctx.Err() == nil {
+		return -1, fmt.Errorf("exec in %s: %w", container, err)
+	}
+	if ctx.Err() != nil {
+		return -1, ctx.Err()
+	}
+
+	var inspect struct {
+		ExitCode int  `json:"ExitCode"`
+		Running  bool `json:"Running"`
+	}
+	if err := d.call("GET", "/exec/"+created.ID+"/json", nil, nil, &inspect); err != nil {
+		return -1, fmt.Errorf("exec in %s: %w", container, err)
+	}
+	return inspect.ExitCode, nil
+}
+
+// hijack POSTs body to path and returns the raw connection, positioned
+// after the response header.
+func (d *dockerAPI) hijack(ctx context.Context, path string, body any) (net.Conn, *bufio.Reader, error) {
+	if err := d.connect(); err != nil {
+		return nil, nil, err
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := d.dial(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("docker API: %w", err)
+	}
+	req, err := http.NewRequest("POST", "http://docker"+path, bytes.NewReader(data))
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("docker API: %w", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("docker API: %w", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		conn.Close()
+		return nil, nil, &apiError{resp.StatusCode, strings.TrimSpace(string(msg))}
+	}
+	return conn, br, nil
+}
+
+// demux splits the daemon's multiplexed stream (an 8-byte header with the
+// stream and length before each frame) into stdout and stderr. Either may
+// be nil to discard it.
+func demux(r io.Reader, stdout, stderr io.Writer) error {
+	var hdr [8]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		w := stdout
+		if hdr[0] == 2 {
+			w = stderr
+		}
+		if w == nil {
+			w = io.Discard
+		}
+		if _, err := io.CopyN(w, r, int64(binary.BigEndian.Uint32(hdr[4:]))); err != nil {
+			return err
+		}
+	}
+}
+
+func (d *dockerAPI) Logs(ctx context.Context, container string, follow bool, w io.Writer) error {
+	st, err := d.InspectContainer(container)
+	if err != nil {
+		return fmt.Errorf("logs of %s: %w", container, err)
+	}
+	q := url.Values{"stdout": {"1"}, "stderr": {"1"}}
+	if follow {
+		q.Set("follow", "1")
+	}
+	resp, err := d.do(ctx, "GET", "/containers/"+url.PathEscape(container)+"/logs", q, nil)
+	if err != nil {
+		return fmt.Errorf("logs of %s: %w", container, err)
+	}
+	defer resp.Body.Close()
+	// A TTY container's output is sent as is.
+	if st.Tty {
+		_, err = io.Copy(w, resp.Body)
+	} else {
+		err = demux(resp.Body, w, w)
+	}
+	if err != nil && ctx.Err() == nil {
+		return fmt.Errorf("logs of %s: %w", container, err)
+	}
+	return nil
+}
+
+func (d *dockerAPI) Events(ctx context.Context, filters map[string][]string) (<-chan engineEvent, <-chan error) {
+	events := make(chan engineEvent)
+	errc := make(chan error, 1)
+	f, _ := json.Marshal(filters)
+	resp, err := d.do(ctx, "GET", "/events", url.Values{"filters": {string(f)}}, nil)
+	if err != nil {
+		errc <- err
+		close(events)
+		return events, errc
+	}
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var ev struct {
+				Action string `json:"Action"`
+				Actor  struct {
+					ID         string            `json:"ID"`
+					Attributes map[string]string `json:"Attributes"`
+				} `json:"Actor"`
+			}
+			if err := dec.Decode(&ev); err != nil {
+				if ctx.Err() == nil {
+					errc <- err
+				}
+				return
+			}
+			select {
+			case events <- engineEvent{Action: ev.Action, ID: ev.Actor.ID, Name: ev.Actor.Attributes["name"]}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, errc
+}
+
+func (d *dockerAPI) ImageExists(name string) (bool, error) {
+	err := d.call("GET", "/images/"+name+"/json", nil, nil, nil)
+	if err == nil {
+		return true, nil
+	}
+	if isNotFound(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (d *dockerAPI) InspectImage(name string) (imageInfo, error) {
+	var out struct {
+		ID     string `json:"Id"`
+		Config struct {
+			Entrypoint []string          `json:"Entrypoint"`
+			Labels     map[string]string `json:"Labels"`
+		} `json:"Config"`
+	}
+	if err := d.call("GET", "/images/"+name+"/json", nil, nil, &out); err != nil {
+		return imageInfo{}, err
+	}
+	return imageInfo{ID: out.ID, Entrypoint: out.Config.Entrypoint, Labels: out.Config.Labels}, nil
+}
+
+func (d *dockerAPI) ListImages(repo string) ([]imageInfo, error) {
+	var out []struct {
+		ID       string   `json:"Id"`
+		RepoTags []string `json:"RepoTags"`
+		Created  int64    `json:"Created"`
+	}
+	f, _ := json.Marshal(map[string][]string{"reference": {repo}})
+	if err := d.call("GET", "/images/json", url.Values{"filters": {string(f)}}, nil, &out); err != nil {
+		return nil, err
+	}
+	var list []imageInfo
+	for _, img := range out {
+		info := imageInfo{ID: img.ID, Created: time.Unix(img.Created, 0)}
+		for _, t := range img.RepoTags {
+			// Podman qualifies local images with localhost/.
+			t = strings.TrimPrefix(t, "localhost/")
+			if r, _ := splitImageRef(t); r == repo {
+				info.Tags = append(info.Tags, t)
+			}
+		}
+		if len(info.Tags) > 0 {
+			list = append(list, info)
+		}
+	}
+	return list, nil
+}
+
+func (d *dockerAPI) TagImage(image, ref string) error {
+	repo, tag := splitImageRef(ref)
+	return d.call("POST", "/images/"+image+"/tag", url.Values{"repo": {repo}, "tag": {tag}}, nil, nil)
+}
+
+func (d *dockerAPI) PullImage(name string, progress io.Writer) error {
+	ref, tag := splitImageRef(name)
+	resp, err := d.do(context.Background(), "POST", "/images/create",
+		url.Values{"fromImage": {ref}, "tag": {tag}}, nil)
+	if err != nil {
+		return fmt.Errorf("pull %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	// The body is a stream of progress messages; errors arrive in-band.
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Status string `json:"status"`
+			ID     string `json:"id"`
+			Error  string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("pull %s: %w", name, err)
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("pull %s: %s", name, msg.Error)
+		}
+		if progress != nil && msg.Status != "" && !strings.HasPrefix(msg.Status, "Downloading") &&
+			!strings.HasPrefix(msg.Status, "Extracting") {
+			if msg.ID != "" {
+				fmt.Fprintf(progress, "%s: %s\n", msg.ID, msg.Status)
+			} else {
+				fmt.Fprintln(progress, msg.Status)
+			}
+		}
+	}
+}
+
+func (d *dockerAPI) RemoveImage(name string) error {
+	return d.call("DELETE", "/images/"+name, nil, nil, nil)
+}
+
+func (d *dockerAPI) SaveImages(names []string, w io.Writer) error {
+	resp, err := d.do(context.Background(), "GET", "/images/get", url.Values{"names": names}, nil)
+	if err != nil {
+		return fmt.Errorf("save images: %w", err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("save images: %w", err)
+	}
+	return nil
+}
+
+func (d *dockerAPI) LoadImages(r io.Reader) error {
+	resp, err := d.do(context.Background(), "POST", "/images/load", url.Values{"quiet": {"1"}}, r)
+	if err != nil {
+		return fmt.Errorf("load images: %w", err)
+	}
+	defer resp.Body.Close()
+	// Like a pull, errors arrive in-band.
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("load images: %w", err)
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("load images: %s", msg.Error)
+		}
+	}
+}
+
+func (d *dockerAPI) CommitContainer(container, image string, labels map[string]string) error {
+	ref, tag := splitImageRef(image)
+	return d.call("POST", "/commit", url.Values{
+		"container": {container},
+		"repo":      {ref},
+		"tag":       {tag},
+		"pause":     {"true"},
+	}, map[string]any{"Labels": labels}, nil)
+}
+
+func (d *dockerAPI) Info() (engineInfo, error) {
+	var out struct {
+		Runtimes        map[string]json.RawMessage `json:"Runtimes"`
+		Driver          string                     `json:"Driver"`
+		DriverStatus    [][2]string                `json:"DriverStatus"`
+		SecurityOptions []string                   `json:"SecurityOptions"`
+	}
+	if err := d.call("GET", "/info", nil, nil, &out); err != nil {
+		return engineInfo{}, err
+	}
+	info := engineInfo{StorageDriver: out.Driver, SecurityOptions: out.SecurityOptions}
+	for name := range out.Runtimes {
+		info.Runtimes = append(info.Runtimes, name)
+	}
+	for _, kv := range out.DriverStatus {
+		if kv[0] == "Backing Filesystem" {
+			info.BackingFilesystem = kv[1]
+		}
+	}
+	return info, nil
+}
+
+func (d *dockerAPI) Stats(name string) (containerStats, error) {
+	var out struct {
+		PidsStats struct {
+			Current int64 `json:"current"`
+			Limit   int64 `json:"limit"`
+		} `json:"pids_stats"`
+		MemoryStats struct {
+			Usage int64 `json:"usage"`
+		} `json:"memory_stats"`
+	}
+	q := url.Values{"stream": {"0"}, "one-shot": {"1"}}
+	if err := d.call("GET", "/containers/"+url.PathEscape(name)+"/stats", q, nil, &out); err != nil {
+		return containerStats{}, fmt.Errorf("stats of %s: %w", name, err)
+	}
+	return containerStats{
+		Pids:      out.PidsStats.Current,
+		PidsLimit: out.PidsStats.Limit,
+		Memory:    out.MemoryStats.Usage,
+	}, nil
+}
+
+func isNotFound(err error) bool {
+	return errors.Is(err, errNotFound)
+}
@@ -0,0 +1,622 @@
+package membrane
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeEngine is an in-memory engine for tests. Containers run until
+// stopped; nothing executes. Exec and Logs are answered by the optional
+// hooks, so a test can play the handler's part (e.g. the ready file or
+// `dns-proxy allow`) and check what a session sent it.
+type fakeEngine struct {
+	mu         sync.Mutex
+	seq        int
+	networks   map[string]*fakeNetwork
+	volumes    map[string]map[string]string // name → labels
+	containers map[string]*fakeContainer
+	images     map[string]bool
+	stats      map[string]containerStats
+	info       engineInfo
+	subs       []chan engineEvent
+
+	// ExecHook answers Exec; without it every command exits 0.
+	ExecHook func(container string, cmd []string, stdin io.Reader, stdout, stderr io.Writer) int
+	// LogsHook supplies a container's output for Logs.
+	LogsHook func(container string, w io.Writer)
+	// Calls records each mutating call, e.g. "run membrane-handler-…".
+	Calls []string
+}
+
+type fakeNetwork struct {
+	id       string
+	internal bool
+	labels   map[string]string
+	members  []string
+}
+
+type fakeContainer struct {
+	spec containerSpec
+	containerState
+	stopped chan struct{}
+}
+
+func newFakeEngine() *fakeEngine {
+	return &fakeEngine{
+		networks:   map[string]*fakeNetwork{},
+		volumes:    map[string]map[string]string{},
+		containers: map[string]*fakeContainer{},
+		images:     map[string]bool{},
+		stats:      map[string]containerStats{},
+	}
+}
+
+func (f *fakeEngine) record(format string, args ...any) {
+	f.Calls = append(f.Calls, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeEngine) nextID() string {
+	f.seq++
+	return fmt.Sprintf("%064x", f.seq)
+}
+
+func (f *fakeEngine) notFound(kind, name string) error {
+	return fmt.Errorf("no such %s: %s: %w", kind, name, errNotFound)
+}
+
+func (f *fakeEngine) emit(action string, c *fakeContainer) {
+	for _, ch := range f.subs {
+		select {
+		case ch <- engineEvent{Action: action, ID: c.ID, Name: c.Name}:
+		default:
+		}
+	}
+}
+
+// container finds a container by name or ID. f.mu must be held.
+func (f *fakeEngine) container(ref string) *fakeContainer {
+	if c, ok := f.containers[ref]; ok {
+		return c
+	}
+	for _, c := range f.containers {
+		if c.ID == ref {
+			return c
+		}
+	}
+	return nil
+}
+
+func hasLabel(labels map[string]string, filter string) bool {
+	if filter == "" {
+		return true
+	}
+	k, v, withValue := strings.Cut(filter, "=")
+	got, ok := labels[k]
+	return ok && (!withValue || got == v)
+}
+
+func (f *fakeEngine) CreateNetwork(name string, internal bool, labels map[string]string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.networks[name]; ok {
+		return "", fmt.Errorf("network with name %s already exists", name)
+	}
+	n := &fakeNetwork{id: f.nextID(), internal: internal, labels: labels}
+	f.networks[name] = n
+	f.record("network create %s", name)
+	return n.id, nil
+}
+
+func (f *fakeEngine) ConnectNetwork(network, container string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, ok := f.networks[network]
+	if !ok {
+		return f.notFound("network", network)
+	}
+	c := f.container(container)
+	if c == nil {
+		return f.notFound("container", container)
+	}
+	n.members = append(n.members, c.Name)
+	c.IPs[network] = fmt.Sprintf("10.0.%d.%d", len(f.networks), len(n.members)+1)
+	f.record("network connect %s %s", network, c.Name)
+	return nil
+}
+
+func (f *fakeEngine) RemoveNetwork(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, ok := f.networks[name]
+	if !ok {
+		return f.notFound("network", name)
+	}
+	for _, m := range n.members {
+		if _, ok := f.containers[m]; ok {
+			return fmt.Errorf("network %s has active endpoints", name)
+		}
+	}
+	delete(f.networks, name)
+	f.record("network rm %s", name)
+	return nil
+}
+
+func (f *fakeEngine) ListNetworks(label string) ([]resource, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var list []resource
+	for name, n := range f.networks {
+		if hasLabel(n.labels, label) {
+			list = append(list, resource{ID: n.id, Name: name, Labels: n.labels})
+		}
+	}
+	sortResources(list)
+	return list, nil
+}
+
+func (f *fakeEngine) CreateVolume(name string, labels, driverOpts map[string]string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.volumes[name] = labels
+	f.record("volume create %s", name)
+	return nil
+}
+
+func (f *fakeEngine) RemoveVolume(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.volumes[name]; !ok {
+		return f.notFound("volume", name)
+	}
+	for _, c := range f.containers {
+		for _, b := range c.spec.Binds {
+			if strings.HasPrefix(b, name+":") {
+				return fmt.Errorf("volume %s is in use", name)
+			}
+		}
+	}
+	delete(f.volumes, name)
+	f.record("volume rm %s", name)
+	return nil
+}
+
+func (f *fakeEngine) ListVolumes(label string) ([]resource, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var list []resource
+	for name, labels := range f.volumes {
+		if hasLabel(labels, label) {
+			list = append(list, resource{ID: name, Name: name, Labels: labels})
+		}
+	}
+	sortResources(list)
+	return list, nil
+}
+
+func (f *fakeEngine) RunContainer(spec containerSpec) (string, error) {
+	f.mu.Lock()
+	if _, ok := f.containers[spec.Name]; ok {
+		f.mu.Unlock()
+		return "", fmt.Errorf("container name %s is already in use", spec.Name)
+	}
+	if spec.Network != "" {
+		if _, ok := f.networks[spec.Network]; !ok && spec.Network != "host" {
+			f.mu.Unlock()
+			return "", f.notFound("network", spec.Network)
+		}
+	}
+	c := &fakeContainer{
+		spec: spec,
+		containerState: containerState{
+			ID:     f.nextID(),
+			Name:   spec.Name,
+			Status: "created",
+			Env:    spec.Env,
+			Labels: spec.Labels,
+			Mounts: map[string]string{},
+			IPs:    map[string]string{},
+		},
+		stopped: make(chan struct{}),
+	}
+	for _, b := range spec.Binds {
+		parts := strings.Split(b, ":")
+		if len(parts) >= 2 {
+			c.Mounts[parts[1]] = parts[0]
+		}
+	}
+	f.containers[spec.Name] = c
+	if n, ok := f.networks[spec.Network]; ok {
+		n.members = append(n.members, spec.Name)
+		c.IPs[spec.Network] = fmt.Sprintf("10.0.%d.%d", len(f.networks), len(n.members)+1)
+	}
+	f.record("run %s", spec.Name)
+	f.mu.Unlock()
+	return c.ID, f.StartContainer(spec.Name)
+}
+
+// CreateContainer creates a container from docker create flags. Only
+// --name and --label are read; the rest are kept as the spec's Cmd.
+func (f *fakeEngine) CreateContainer(args []string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var name string
+	labels := map[string]string{}
+	for i := 0; i < len(args)-1; i++ {
+		switch args[i] {
+		case "--name":
+			name = args[i+1]
+		case "--label", "-l":
+			k, v, _ := strings.Cut(args[i+1], "=")
+			labels[k] = v
+		}
+	}
+	if name == "" {
+		return "", fmt.Errorf("create: no --name")
+	}
+	if _, ok := f.containers[name]; ok {
+		return "", fmt.Errorf("container name %s is already in use", name)
+	}
+	c := &fakeContainer{
+		spec: containerSpec{Name: name, Labels: labels, Cmd: args},
+		containerState: containerState{
+			ID: f.nextID(), Name: name, Status: "created", Labels: labels,
+			Mounts: map[string]string{}, IPs: map[string]string{},
+		},
+		stopped: make(chan struct{}),
+	}
+	f.containers[name] = c
+	f.record("create %s", name)
+	return c.ID, nil
+}
+
+// AddContainer registers a container made outside the engine, such as one
+// another membrane left behind.
+func (f *fakeEngine) AddContainer(name string, labels map[string]string, running bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := &fakeContainer{
+		containerState: containerState{
+			ID: f.nextID(), Name: name, Status: "created", Labels: labels,
+			Mounts: map[string]string{}, IPs: map[string]string{},
+		},
+		stopped: make(chan struct{}),
+	}
+	if running {
+		c.Status, c.Running = "running", true
+	}
+	f.containers[name] = c
+}
+
+func (f *fakeEngine) StartContainer(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.container(name)
+	if c == nil {
+		return f.notFound("container", name)
+	}
+	if c.Running {
+		return nil
+	}
+	c.Status, c.Running = "running", true
+	f.emit("start", c)
+	return nil
+}
+
+func (f *fakeEngine) InspectContainer(name string) (containerState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.container(name)
+	if c == nil {
+		return containerState{}, f.notFound("container", name)
+	}
+	return c.containerState, nil
+}
+
+// Exit stops a running container as if its process exited with code.
+func (f *fakeEngine) Exit(name string, code int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c := f.container(name); c != nil {
+		f.exit(c, code)
+	}
+}
+
+// exit stops c. f.mu must be held.
+func (f *fakeEngine) exit(c *fakeContainer, code int) {
+	if !c.Running {
+		return
+	}
+	c.Status, c.Running, c.ExitCode = "exited", false, code
+	close(c.stopped)
+	f.emit("die", c)
+	if c.spec.AutoRemove {
+		delete(f.containers, c.Name)
+	}
+}
+
+func (f *fakeEngine) StopContainer(name string, timeout time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.container(name)
+	if c == nil {
+		return f.notFound("container", name)
+	}
+	f.exit(c, 143)
+	f.record("stop %s", c.Name)
+	return nil
+}
+
+func (f *fakeEngine) RemoveContainer(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.container(name)
+	if c == nil {
+		return f.notFound("container", name)
+	}
+	f.exit(c, 137)
+	delete(f.containers, c.Name)
+	f.record("rm %s", c.Name)
+	return nil
+}
+
+func (f *fakeEngine) WaitContainer(ctx context.Context, name string) (int, error) {
+	f.mu.Lock()
+	c := f.container(name)
+	f.mu.Unlock()
+	if c == nil {
+		return 0, f.notFound("container", name)
+	}
+	select {
+	case <-c.stopped:
+		return c.ExitCode, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (f *fakeEngine) ListContainers(label string, all bool) ([]resource, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var list []resource
+	for _, c := range f.containers {
+		if (all || c.Running) && hasLabel(c.Labels, label) {
+			list = append(list, resource{ID: c.ID, Name: c.Name, Labels: c.Labels,
+				Image: c.spec.Image, Running: c.Running})
+		}
+	}
+	sortResources(list)
+	return list, nil
+}
+
+func (f *fakeEngine) Exec(ctx context.Context, container string, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	f.mu.Lock()
+	c := f.container(container)
+	running := c != nil && c.Running
+	hook := f.ExecHook
+	f.mu.Unlock()
+	if !running {
+		return -1, fmt.Errorf("container %s is not running", container)
+	}
+	if hook == nil {
+		return 0, nil
+	}
+	if stdout == nil {
+		stdout = io.Discard
+	}
+	if stderr == nil {
+		stderr = io.Discard
+	}
+	return hook(c.Name, cmd, stdin, stdout, stderr), nil
+}
+
+func (f *fakeEngine) Logs(ctx context.Context, container string, follow bool, w io.Writer) error {
+	f.mu.Lock()
+	c := f.container(container)
+	hook := f.LogsHook
+	f.mu.Unlock()
+	if c == nil {
+		return f.notFound("container", container)
+	}
+	if hook != nil {
+		hook(c.Name, w)
+	}
+	if follow {
+		select {
+		case <-c.stopped:
+		case <-ctx.Done():
+		}
+	}
+	return nil
+}
+
+func (f *fakeEngine) Events(ctx context.Context, filters map[string][]string) (<-chan engineEvent, <-chan error) {
+	all := make(chan engineEvent, 16)
+	out := make(chan engineEvent)
+	f.mu.Lock()
+	f.subs = append(f.subs, all)
+	f.mu.Unlock()
+	match := func(want []string, got string) bool {
+		if len(want) == 0 {
+			return true
+		}
+		for _, w := range want {
+			if w == got {
+				return true
+			}
+		}
+		return false
+	}
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case ev := <-all:
+				if !match(filters["event"], ev.Action) || !match(filters["container"], ev.Name) {
+					continue
+				}
+				select {
+				case out <- ev:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, make(chan error)
+}
+
+func (f *fakeEngine) ImageExists(name string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.images[name], nil
+}
+
+func (f *fakeEngine) InspectImage(name string) (imageInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.images[name] {
+		return imageInfo{}, f.notFound("image", name)
+	}
+	return imageInfo{ID: "sha256:" + name, Entrypoint: []string{agentEntrypoint}}, nil
+}
+
+func (f *fakeEngine) ListImages(repo string) ([]imageInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var list []imageInfo
+	for name := range f.images {
+		if r, _ := splitImageRef(name); r == repo {
+			list = append(list, imageInfo{ID: "sha256:" + name, Tags: []string{name}})
+		}
+	}
+	return list, nil
+}
+
+func (f *fakeEngine) TagImage(image, ref string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.images[image] {
+		return f.notFound("image", image)
+	}
+	f.images[ref] = true
+	f.record("tag %s %s", image, ref)
+	return nil
+}
+
+func (f *fakeEngine) PullImage(name string, progress io.Writer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.images[name] = true
+	f.record("pull %s", name)
+	return nil
+}
+
+func (f *fakeEngine) RemoveImage(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.images[name] {
+		return f.notFound("image", name)
+	}
+	delete(f.images, name)
+	f.record("rmi %s", name)
+	return nil
+}
+
+// SaveImages writes an archive with an empty entry per image.
+func (f *fakeEngine) SaveImages(names []string, w io.Writer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tw := tar.NewWriter(w)
+	for _, name := range names {
+		if !f.images[name] {
+			return f.notFound("image", name)
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644}); err != nil {
+			return err
+		}
+	}
+	f.record("save %s", strings.Join(names, " "))
+	return tw.Close()
+}
+
+// LoadImages loads an archive from SaveImages.
+func (f *fakeEngine) LoadImages(r io.Reader) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("load images: %w", err)
+		}
+		f.images[hdr.Name] = true
+		f.record("load %s", hdr.Name)
+	}
+}
+
+func (f *fakeEngine) CommitContainer(container, image string, labels map[string]string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.container(container) == nil {
+		return f.notFound("container", container)
+	}
+	f.images[image] = true
+	f.record("commit %s %s", container, image)
+	return nil
+}
+
+func (f *fakeEngine) Info() (engineInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	info := f.info
+	info.Runtimes = append([]string{"runc"}, info.Runtimes...)
+	if info.StorageDriver == "" {
+		info.StorageDriver = "overlay2"
+	}
+	return info, nil
+}
+
+func (f *fakeEngine) Stats(name string) (containerStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.container(name)
+	if c == nil || !c.Running {
+		return containerStats{}, fmt.Errorf("container %s is not running", name)
+	}
+	st := f.stats[c.Name]
+	st.PidsLimit = c.spec.Resources.PidsLimit
+	return st, nil
+}
+
+// SetStats sets what Stats reports for a container; PidsLimit comes from
+// the container's resources.
+func (f *fakeEngine) SetStats(name string, st containerStats) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stats[name] = st
+}
+
+// OOMKill stops a running container as the kernel's OOM killer would.
+func (f *fakeEngine) OOMKill(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c := f.container(name); c != nil && c.Running {
+		c.OOMKilled = true
+		f.exit(c, 137)
+	}
+}
+
+func sortResources(list []resource) {
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+}
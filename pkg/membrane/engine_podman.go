@@ -0,0 +1,98 @@
+package membrane
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// podmanAPI is an engine backed by Podman's Docker-compatible API, served
+// by `podman system service` or the podman.socket unit. Networks, volumes
+// and containers map one to one; what Podman can't provide is listed by
+// podmanDifferences.
+type podmanAPI struct {
+	*dockerAPI
+
+	rootlessOnce sync.Once
+	isRootless   bool
+}
+
+func newPodmanAPI() *podmanAPI {
+	return &podmanAPI{dockerAPI: &dockerAPI{host: podmanHost()}}
+}
+
+// podmanHost resolves Podman's API socket: CONTAINER_HOST, then the
+// rootless socket for non-root users, then the system socket.
+func podmanHost() string {
+	if host := os.Getenv("CONTAINER_HOST"); host != "" {
+		return host
+	}
+	if os.Geteuid() != 0 {
+		dir := os.Getenv("XDG_RUNTIME_DIR")
+		if dir == "" {
+			dir = fmt.Sprintf("/run/user/%d", os.Getuid())
+		}
+		return "unix://" + filepath.Join(dir, "podman", "podman.sock")
+	}
+	return "unix:///run/podman/podman.sock"
+}
+
+// rootless reports whether the Podman service runs rootless, as Podman
+// lists in its security options.
+func (p *podmanAPI) rootless() bool {
+	p.rootlessOnce.Do(func() {
+		info, err := p.Info()
+		if err != nil {
+			p.isRootless = os.Geteuid() != 0
+			return
+		}
+		for _, o := range info.SecurityOptions {
+			if strings.Contains(o, "name=rootless") {
+				p.isRootless = true
+			}
+		}
+	})
+	return p.isRootless
+}
+
+// usingPodman returns the Podman engine if sessions run on it.
+func usingPodman() (*podmanAPI, bool) {
+	p, ok := containers.(*podmanAPI)
+	return p, ok
+}
+
+// podmanAgentArgs are the extra agent options Podman needs. Rootless, the
+// host user is root in the container, so the workspace would look
+// root-owned; keep-id maps it to the same UID instead, and the
+// entrypoint still starts as root to set up routing.
+func podmanAgentArgs() []string {
+	if p, ok := usingPodman(); ok && p.rootless() {
+		return []string{"--userns=keep-id", "--user=root"}
+	}
+	return nil
+}
+
+// podmanDifferences lists the guarantees a session on Podman doesn't get
+// compared with Docker and Sysbox.
+func podmanDifferences(trace bool) []string {
+	p, ok := usingPodman()
+	if !ok {
+		return nil
+	}
+	diffs := []string{
+		"no nested containers: Sysbox doesn't run under Podman, so the agent has no Docker daemon",
+	}
+	if trace {
+		diffs = append(diffs, "no tracing: the Tracee sidecar needs Docker; --no-trace is implied")
+	}
+	if p.rootless() {
+		diffs = append(diffs,
+			"rootless: network isolation is enforced by netavark inside Podman's rootless network namespace, not by the host firewall",
+			"rootless: the agent runs in a keep-id user namespace, so its UID matches yours on the host")
+	} else {
+		diffs = append(diffs, "network isolation is enforced by netavark's firewall rules, not Docker's isolation chains")
+	}
+	return diffs
+}
@@ -0,0 +1,28 @@
+package membrane
+
+import (
+	"context"
+	"fmt"
+)
+
+// Exec runs command (default: bash) in a running session's agent
+// container, as the agent user with the same capabilities dropped as the
+// agent itself. It shares the agent's network policy and mounts. The
+// tracer tags its processes with "membraneExec"; see Tracer.streamEvents.
+func Exec(sessionID string, command []string) error {
+	if err := selectEngine(); err != nil {
+		return err
+	}
+	s := sessionNamesFor(resolveSession(sessionID))
+	if !agentRunning(s) {
+		return fmt.Errorf("session %s not found or not running", sessionID)
+	}
+	if code, err := containers.Exec(context.Background(), s.agentContainer,
+		[]string{"test", "-x", "/usr/local/bin/" + execProcessName}, nil, nil, nil); err != nil || code != 0 {
+		return fmt.Errorf("session %s was started from an agent image without %s; rebuild the images and start a new session", sessionID, execProcessName)
+	}
+
+	args := []string{"exec", "-it", s.agentContainer, execProcessName}
+	args = append(args, command...)
+	return execDocker(args, ptyProxy{})
+}
@@ -0,0 +1,258 @@
+package membrane
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sessionLabel marks every container, network and volume a session
+// creates, and its DOCKER-USER rule, with the session ID.
+const sessionLabel = "membrane.session"
+
+// ownerLabel marks a session's containers, networks and volumes with the
+// uid of the user that started it. On a daemon shared between users, gc
+// only removes the user's own.
+const ownerLabel = "membrane.owner"
+
+// staleAge is how old an unowned file in ~/.membrane/tmp, or a resource
+// of a session with no record here, must be before gc removes it, so it
+// never races a session that is starting.
+const staleAge = time.Hour
+
+// sessionTmpPattern matches temp files and dirs that belong to a session.
+var sessionTmpPattern = regexp.MustCompile(`^membrane-([0-9a-f]{16})-`)
+
+// GC removes what sessions that are no longer live left behind:
+// containers, networks, volumes, DOCKER-USER rules, and temp files.
+func GC() error {
+	if err := selectEngine(); err != nil {
+		return err
+	}
+	removed, err := collectGarbage(true)
+	if err != nil {
+		return err
+	}
+	if len(removed) == 0 {
+		fmt.Fprintln(os.Stderr, "membrane: nothing to clean up")
+	}
+	for _, r := range removed {
+		fmt.Fprintf(os.Stderr, "membrane: removed %s\n", r)
+	}
+	return nil
+}
+
+// collectGarbage removes this user's resources of sessions that aren't
+// live and returns a description of each. With interactive false, as at
+// startup, it never prompts for sudo, and leaves resources without an
+// owner, from membranes before ownerLabel, to `membrane gc`.
+func collectGarbage(interactive bool) ([]string, error) {
+	live, err := liveSessions()
+	if err != nil {
+		return nil, err
+	}
+	// Sessions this user started, by their records and their resources.
+	mine := map[string]bool{}
+	recorded := map[string]bool{}
+	if records, err := loadSessionRecords(); err == nil {
+		for _, r := range records {
+			mine[r.ID], recorded[r.ID] = true, true
+		}
+	}
+	var removed []string
+
+	for _, kind := range sessionResourceKinds() {
+		list, err := kind.list(sessionLabel)
+		if err != nil {
+			return removed, fmt.Errorf("list %ss: %w", kind.name, err)
+		}
+		for _, r := range list {
+			id := r.Labels[sessionLabel]
+			switch owner := r.Labels[ownerLabel]; {
+			case live[id]:
+				continue
+			case owner == "" && !interactive, owner != "" && owner != resourceOwner():
+				continue
+			case !recorded[id] && time.Since(r.Created) < staleAge:
+				// Perhaps a session that's still starting, from another
+				// home directory.
+				continue
+			}
+			mine[id] = true
+			if kind.remove(r.Name) == nil {
+				removed = append(removed, kind.name+" "+r.Name)
+			}
+		}
+	}
+
+	removed = append(removed, removeStaleDockerUserRules(live, mine, interactive)...)
+	removed = append(removed, removeStaleTmp(live)...)
+
+	// Records of dead sessions that never recorded their end.
+	if records, err := loadSessionRecords(); err == nil {
+		for _, r := range records {
+			if r.live() && !live[r.ID] {
+				r.Status = statusLost
+				_ = r.save()
+			}
+		}
+	}
+	return removed, nil
+}
+
+// resourceKind is a kind of engine resource sessions create.
+type resourceKind struct {
+	name   string
+	list   func(label string) ([]resource, error)
+	remove func(name string) error
+}
+
+// resourceOwner is the value of ownerLabel for this user.
+func resourceOwner() string {
+	return strconv.Itoa(os.Getuid())
+}
+
+// sessionResourceKinds returns what sessions create, in removal order:
+// containers first, since networks and volumes can't go while in use.
+func sessionResourceKinds() []resourceKind {
+	return []resourceKind{
+		{"container", func(label string) ([]resource, error) { return containers.ListContainers(label, true) }, containers.RemoveContainer},
+		{"network", containers.ListNetworks, containers.RemoveNetwork},
+		{"volume", containers.ListVolumes, containers.RemoveVolume},
+	}
+}
+
+// liveSessions returns the IDs of sessions whose owning process is still
+// alive or whose agent is still running. Such a session owns its
+// resources, even if it is still starting.
+func liveSessions() (map[string]bool, error) {
+	live := map[string]bool{}
+	records, err := loadSessionRecords()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		if r.live() && r.OwnerPID > 0 && processAlive(r.OwnerPID) {
+			live[r.ID] = true
+		}
+	}
+	running, err := containers.ListContainers(sessionLabel, false)
+	if err != nil {
+		return nil, fmt.Errorf("list running agents: %w", err)
+	}
+	for _, c := range running {
+		id := c.Labels[sessionLabel]
+		if c.Name == sessionNamesFor(id).agentContainer {
+			live[id] = true
+		}
+	}
+	return live, nil
+}
+
+// removeStaleDockerUserRules deletes DOCKER-USER rules commented with the
+// ID of one of this user's sessions that isn't live. Only Linux hosts with
+// br_netfilter get these rules.
+func removeStaleDockerUserRules(live, mine map[string]bool, interactive bool) []string {
+	if runtime.GOOS != "linux" || !needsDockerUserRule() {
+		return nil
+	}
+	if _, err := exec.LookPath("sudo"); err != nil {
+		return nil
+	}
+	sudo := func(args ...string) *exec.Cmd {
+		if !interactive {
+			args = append([]string{"-n"}, args...)
+		}
+		return exec.Command("sudo", args...)
+	}
+	out, err := sudo("iptables", "--wait", "-S", "DOCKER-USER").Output()
+	if err != nil {
+		return nil
+	}
+	var removed []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "-A" {
+			continue
+		}
+		var id string
+		for i, f := range fields {
+			if f == "--comment" && i+1 < len(fields) {
+				id, _ = strings.CutPrefix(strings.Trim(fields[i+1], `"`), sessionLabel+"=")
+			}
+		}
+		if id == "" || live[id] || !mine[id] {
+			continue
+		}
+		args := append([]string{"iptables", "--wait", "-D"}, fields[1:]...)
+		for i, a := range args {
+			args[i] = strings.Trim(a, `"`)
+		}
+		if sudo(args...).Run() == nil {
+			removed = append(removed, "DOCKER-USER rule for session "+id)
+		}
+	}
+	return removed
+}
+
+// removeStaleTmp deletes temp files and dirs of sessions that aren't
+// live, and unowned ones older than staleAge.
+func removeStaleTmp(live map[string]bool) []string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	dir := filepath.Join(home, ".membrane", "tmp")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var removed []string
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, "membrane-") {
+			continue
+		}
+		if m := sessionTmpPattern.FindStringSubmatch(name); m != nil {
+			if live[m[1]] {
+				continue
+			}
+		} else if info, err := e.Info(); err != nil || time.Since(info.ModTime()) < staleAge {
+			continue
+		}
+		if err := removeTmpEntry(filepath.Join(dir, name)); err == nil {
+			removed = append(removed, filepath.Join("~/.membrane/tmp", name))
+		}
+	}
+	return removed
+}
+
+// removeSessionTmp deletes session id's temp files and dirs.
+func removeSessionTmp(id string) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return
+	}
+	matches, _ := filepath.Glob(filepath.Join(home, ".membrane", "tmp", "membrane-"+id+"-*"))
+	for _, m := range matches {
+		_ = removeTmpEntry(m)
+	}
+}
+
+// removeTmpEntry removes path, first making the read-only placeholder
+// dirs from scan writable so their contents can go too.
+func removeTmpEntry(path string) error {
+	_ = filepath.WalkDir(path, func(p string, d os.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			_ = os.Chmod(p, 0o755)
+		}
+		return nil
+	})
+	return os.RemoveAll(path)
+}
@@ -0,0 +1,266 @@
+package membrane
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Agent home modes. /home/agent holds credentials, shell history, caches
+// and agent memory, so the directory behind it decides what sessions share.
+const (
+	homeShared    = "shared"    // ~/.membrane/home, for every session
+	homeWorkspace = "workspace" // ~/.membrane/homes/<workspace>-<hash>, kept between sessions
+	homeEphemeral = "ephemeral" // a fresh directory per session, removed at exit
+)
+
+// defaultHomeSeed is what a new home gets from the template when
+// home.seed is not set: git identity and agent login, not history.
+var defaultHomeSeed = []string{
+	".gitconfig",
+	".claude.json",
+	".claude/.credentials.json",
+	".claude/settings.json",
+}
+
+// homeConfig is the `home:` config section. It may also be just the mode,
+// as in `home: workspace`.
+type homeConfig struct {
+	Mode     string   `yaml:"mode"`
+	Template string   `yaml:"template"` // seeds new homes; default ~/.membrane/home
+	Seed     []string `yaml:"seed"`     // paths under the template copied into new homes
+	Persist  bool     `yaml:"persist"`  // ephemeral: copy the seeded paths back at exit
+
+	restore string // ephemeral: fill new homes from this copy instead; see checkpoint.go
+}
+
+func (h *homeConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		h.Mode = value.Value
+		return nil
+	}
+	type plain homeConfig
+	return value.Decode((*plain)(h))
+}
+
+// merge overrides h with the keys set in o; seed lists are appended.
+func (h *homeConfig) merge(o homeConfig) {
+	if o.Mode != "" {
+		h.Mode = o.Mode
+	}
+	if o.Template != "" {
+		h.Template = o.Template
+	}
+	h.Seed = append(h.Seed, o.Seed...)
+	h.Persist = h.Persist || o.Persist
+}
+
+// validate fills in defaults and checks h.
+func (h *homeConfig) validate() error {
+	switch h.Mode {
+	case "":
+		h.Mode = homeShared
+	case homeShared, homeWorkspace, homeEphemeral:
+	default:
+		return fmt.Errorf("home.mode: %q is not shared, workspace or ephemeral", h.Mode)
+	}
+	if h.Persist && h.Mode != homeEphemeral {
+		return fmt.Errorf("home.persist only applies to ephemeral homes")
+	}
+	if h.Template != "" {
+		t := os.ExpandEnv(h.Template)
+		if rest, ok := strings.CutPrefix(t, "~/"); ok {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return fmt.Errorf("get home dir: %w", err)
+			}
+			t = filepath.Join(home, rest)
+		}
+		if !filepath.IsAbs(t) {
+			return fmt.Errorf("home.template: %q must be an absolute path", h.Template)
+		}
+		h.Template = t
+	}
+	if len(h.Seed) == 0 {
+		h.Seed = append([]string(nil), defaultHomeSeed...)
+	}
+	for i, p := range h.Seed {
+		p = filepath.Clean(p)
+		if filepath.IsAbs(p) || p == "." || p == ".." || strings.HasPrefix(p, "../") {
+			return fmt.Errorf("home.seed: %q must be a path inside the template", h.Seed[i])
+		}
+		h.Seed[i] = p
+	}
+	return nil
+}
+
+// agentHome is the host directory mounted as the agent's /home/agent.
+type agentHome struct {
+	dir      string
+	template string
+	cfg      homeConfig
+}
+
+// prepareAgentHome returns the session's home, creating and seeding it
+// if it's new.
+func prepareAgentHome(h homeConfig, s sessionNames, workspaceDir string) (*agentHome, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("get home dir: %w", err)
+	}
+	a := &agentHome{
+		dir:      filepath.Join(home, ".membrane", "home"),
+		template: h.Template,
+		cfg:      h,
+	}
+	if a.template == "" {
+		a.template = a.dir
+	}
+	switch h.Mode {
+	case homeWorkspace:
+		sum := sha256.Sum256([]byte(workspaceDir))
+		a.dir = filepath.Join(home, ".membrane", "homes", filepath.Base(workspaceDir)+"-"+hex.EncodeToString(sum[:6]))
+	case homeEphemeral:
+		// With the session's temp files, so gc removes it if the session
+		// can't.
+		a.dir = filepath.Join(home, ".membrane", "tmp", "membrane-"+s.id+"-home")
+	}
+
+	if _, err := os.Stat(a.dir); err == nil {
+		return a, nil
+	}
+	if err := os.MkdirAll(a.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create agent home dir: %w", err)
+	}
+	if h.Mode == homeShared {
+		return a, nil
+	}
+	if h.restore != "" && h.Mode == homeEphemeral {
+		if err := copyHomePath(h.restore, a.dir, "."); err != nil {
+			return nil, fmt.Errorf("restore agent home: %w", err)
+		}
+		return a, nil
+	}
+	for _, p := range h.Seed {
+		if err := copyHomePath(a.template, a.dir, p); err != nil {
+			return nil, fmt.Errorf("seed agent home: %w", err)
+		}
+	}
+	return a, nil
+}
+
+// finish copies an ephemeral home's seeded paths back to the template if
+// home.persist is set, so refreshed logins outlive the session. Call it
+// after the agent exits; the home itself goes with the session's temp
+// files.
+func (a *agentHome) finish() {
+	if a == nil || !a.cfg.Persist {
+		return
+	}
+	for _, p := range a.cfg.Seed {
+		if err := copyHomePath(a.dir, a.template, p); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: persist agent home: %v\n", err)
+		}
+	}
+}
+
+// copyHomePath copies the file or directory rel from one home to another,
+// replacing what's there. A missing rel is skipped. Symlinks are copied as
+// links, never followed: one of the homes is the agent's, so a link in
+// rel's path on either side, as to ~/.ssh, is refused, and a link in the
+// way of a copied directory or file is replaced.
+func copyHomePath(from, to, rel string) error {
+	if err := checkNoSymlinks(from, filepath.Dir(rel)); err != nil {
+		return err
+	}
+	if err := checkNoSymlinks(to, filepath.Dir(rel)); err != nil {
+		return err
+	}
+	src, dst := filepath.Join(from, rel), filepath.Join(to, rel)
+	if _, err := os.Lstat(src); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		r, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, r)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		// Whatever is at target that isn't a directory to copy into goes,
+		// links especially. Credentials are often read-only; replace
+		// rather than overwrite.
+		if ti, err := os.Lstat(target); err == nil && (!d.IsDir() || !ti.IsDir()) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+		switch {
+		case d.IsDir():
+			if err := os.Mkdir(target, info.Mode().Perm()|0o700); err != nil && !os.IsExist(err) {
+				return err
+			}
+			return nil
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, info.Mode().Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := f.Write(data); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		}
+		return nil // sockets and the like
+	})
+}
+
+// checkNoSymlinks returns an error if any component of rel under root is
+// a symlink. Missing components are fine.
+func checkNoSymlinks(root, rel string) error {
+	p := root
+	for _, part := range strings.Split(filepath.Clean(rel), string(filepath.Separator)) {
+		if part == "." || part == "" {
+			continue
+		}
+		p = filepath.Join(p, part)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink, which membrane won't follow", p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package membrane
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Custom agent images (`image:` and `build:`). The agent container's
+// entrypoint runs as root to point the default route and DNS at the
+// handler and trust its CA, then drops to the agent user. An image built
+// FROM membrane-agent keeps that entrypoint and needs the tools it uses;
+// an image with its own entrypoint must say it does that setup itself
+// with the label membrane.entrypoint=wrapper. Either way the image is
+// checked before its first session, and refused if it falls short.
+
+const (
+	// agentEntrypoint is membrane-agent's entrypoint.
+	agentEntrypoint = "/usr/local/bin/entrypoint.sh"
+	// builtImageName is the repository of images built from `build:`.
+	builtImageName = "membrane-agent-build"
+	// wrapperLabel marks an image whose entrypoint sets up the gateway,
+	// DNS and CA itself.
+	wrapperLabel = "membrane.entrypoint"
+)
+
+// contractTools are what membrane's entrypoint runs, and the packages
+// that provide them.
+var contractTools = []struct{ cmd, pkg string }{
+	{"gosu", "gosu"},
+	{"capsh", "libcap2-bin"},
+	{"ip", "iproute2"},
+	{"update-ca-certificates", "ca-certificates"},
+	{"as-agent.sh", "membrane-agent"},
+	{"membrane-exec", "membrane-agent"},
+}
+
+// resolveBuild makes a `build:` path from the config file at path
+// absolute, relative to the file.
+func (c *config) resolveBuild(path string) error {
+	if c.Image != "" && c.Build != "" {
+		return fmt.Errorf("%s: image and build can't both be set", path)
+	}
+	if c.Build == "" {
+		return nil
+	}
+	b := os.ExpandEnv(c.Build)
+	if rest, ok := strings.CutPrefix(b, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("get home dir: %w", err)
+		}
+		b = filepath.Join(home, rest)
+	}
+	if !filepath.IsAbs(b) {
+		b = filepath.Join(filepath.Dir(path), b)
+	}
+	c.Build = b
+	return nil
+}
+
+// agentImage returns the image the config's sessions run, building it if
+// need be, and checks that it meets the entrypoint contract. base is the
+// current membrane-agent image, the default.
+func (c *config) agentImage(base string) (string, error) {
+	switch {
+	case c.Build != "":
+		name, err := buildAgentImage(c.Build, base)
+		if err != nil {
+			return "", err
+		}
+		return name, checkImageContract(name)
+	case c.Image != "":
+		ok, err := containers.ImageExists(c.Image)
+		if err != nil {
+			return "", fmt.Errorf("check docker image %s: %w", c.Image, err)
+		}
+		if !ok {
+			if offline {
+				return "", fmt.Errorf("agent image %s is missing, and membrane is offline", c.Image)
+			}
+			if err := containers.PullImage(c.Image, os.Stderr); err != nil {
+				return "", fmt.Errorf("agent image %s: %w", c.Image, err)
+			}
+		}
+		return c.Image, checkImageContract(c.Image)
+	}
+	return base, nil
+}
+
+// buildAgentImage builds the Dockerfile at path, or in the directory at
+// path, with its directory as the context. The image is tagged with a
+// hash of the whole context, which holds the Dockerfile and whatever it
+// copies in, and of base, the membrane-agent image it's presumably built
+// on, so it's rebuilt when any of them changes.
+func buildAgentImage(path, base string) (string, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, "Dockerfile")
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("build: %w", err)
+	}
+	ctxDir := filepath.Dir(path)
+	ctxHash, err := contextHash(ctxDir)
+	if err != nil {
+		return "", fmt.Errorf("hash %s: %w", ctxDir, err)
+	}
+	sum := sha256.Sum256([]byte(base + "\n" + filepath.Base(path) + "\n" + ctxHash))
+	name := builtImageName + ":" + hex.EncodeToString(sum[:6])
+
+	lock, err := acquireLock(lockImages, true, "Waiting for another membrane to finish building...")
+	if err != nil {
+		return "", err
+	}
+	defer lock.unlock()
+	ok, err := containers.ImageExists(name)
+	if err != nil {
+		return "", fmt.Errorf("check docker image %s: %w", name, err)
+	}
+	if ok {
+		return name, nil
+	}
+	if offline {
+		return "", fmt.Errorf("agent image %s, built from %s, is missing, and membrane is offline; %s", name, path, importHint)
+	}
+	if err := buildImageFromDir(name, ctxDir, "-f", path); err != nil {
+		return "", err
+	}
+	pruneImageTags(builtImageName, name)
+	return name, nil
+}
+
+// checkImageContract checks that image can run as the agent: it has the
+// agent user, and either membrane's entrypoint and the tools it uses or
+// a wrapper entrypoint. Images that pass are remembered by ID.
+func checkImageContract(image string) error {
+	info, err := containers.InspectImage(image)
+	if err != nil {
+		return fmt.Errorf("inspect agent image %s: %w", image, err)
+	}
+	checked, err := checkedImagesFile()
+	if err != nil {
+		return err
+	}
+	if data, err := os.ReadFile(checked); err == nil && slices.Contains(strings.Fields(string(data)), info.ID) {
+		return nil
+	}
+
+	wrapper := info.Labels[wrapperLabel] == "wrapper"
+	if !wrapper && !slices.Equal(info.Entrypoint, []string{agentEntrypoint}) {
+		return fmt.Errorf("agent image %s has its own entrypoint %q: membrane's entrypoint sets up the gateway, DNS and CA before dropping to the agent user. "+
+			"Keep ENTRYPOINT [%q] (build FROM %s), or do that setup in yours and add LABEL %s=wrapper",
+			image, info.Entrypoint, agentEntrypoint, agentImageName, wrapperLabel)
+	}
+
+	script := `id agent >/dev/null 2>&1 || echo agent`
+	if !wrapper {
+		for _, t := range contractTools {
+			script += fmt.Sprintf("\ncommand -v %s >/dev/null 2>&1 || echo %s", t.cmd, t.cmd)
+		}
+	}
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	name := "membrane-check-" + hex.EncodeToString(b[:])
+	if _, err := containers.RunContainer(containerSpec{
+		Name:       name,
+		Image:      image,
+		Entrypoint: []string{"/bin/sh", "-c", script},
+		Network:    "none",
+	}); err != nil {
+		return fmt.Errorf("check agent image %s: %w", image, err)
+	}
+	defer containers.RemoveContainer(name)
+	code, err := containers.WaitContainer(context.Background(), name)
+	var out bytes.Buffer
+	if err == nil {
+		err = containers.Logs(context.Background(), name, false, &out)
+	}
+	if err == nil && code != 0 {
+		err = fmt.Errorf("exited with code %d: %s", code, strings.TrimSpace(out.String()))
+	}
+	if err != nil {
+		return fmt.Errorf("check agent image %s: %w", image, err)
+	}
+
+	var missing []string
+	sc := bufio.NewScanner(&out)
+	for sc.Scan() {
+		switch m := sc.Text(); m {
+		case "agent":
+			missing = append(missing, "the agent user")
+		default:
+			for _, t := range contractTools {
+				if t.cmd == m {
+					missing = append(missing, fmt.Sprintf("%s (%s)", t.cmd, t.pkg))
+				}
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("agent image %s can't run membrane's entrypoint; it's missing %s. Build it FROM %s, or see \"Bring your own agent image\" in the README",
+			image, strings.Join(missing, ", "), agentImageName)
+	}
+
+	f, err := os.OpenFile(checked, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err == nil {
+		fmt.Fprintln(f, info.ID)
+		f.Close()
+	}
+	return nil
+}
+
+// checkedImagesFile lists the IDs of images that passed
+// checkImageContract.
+func checkedImagesFile() (string, error) {
+	home, err := membraneHome()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "checked-images"), nil
+}
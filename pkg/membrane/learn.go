@@ -0,0 +1,629 @@
+package membrane
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+	"gopkg.in/yaml.v3"
+)
+
+// learnFile is where the handler records what the agent used during
+// `membrane learn`; see docker/handler/dns-proxy/learn.go and addon.py.
+const learnFile = "/run/membrane/observed.jsonl"
+
+// Thresholds for collapsing observations into broader rules.
+const (
+	minHostsForPattern = 3 // sibling hostnames before *.parent is proposed
+	minIPsForSubnet    = 3 // addresses in one /24 before the /24 is proposed
+	maxPathPrefixes    = 5 // path prefixes per host before paths are dropped
+)
+
+// Learn runs passthrough with a permissive policy and records every name,
+// connection and HTTP request the agent makes. When the agent exits it
+// prints the allow rules that would have been needed, beyond those already
+// configured, as a diff against the workspace .membrane.yaml. With apply
+// the rules are also written to the file.
+// Of o, only NoUpdate, Trace and NoGlobalConfig apply.
+func Learn(o Options, apply bool, passthrough []string, cli CLIOverrides) error {
+	return run(runOptions{
+		noUpdate:       o.NoUpdate,
+		trace:          o.Trace,
+		noGlobalConfig: o.NoGlobalConfig,
+		exitCodes:      DefaultExitCodes,
+		passthrough:    passthrough,
+		cli:            cli,
+		learn:          &learner{apply: apply},
+	})
+}
+
+type learner struct {
+	apply    bool
+	baseline []AllowRule // the effective allow rules before learning
+}
+
+// start swaps the configured allow rules for a single any-host rule,
+// keeping them to compare observations against.
+func (l *learner) start(cfg *config) {
+	l.baseline = cfg.Allow
+	cfg.Allow = []AllowRule{{Type: "any"}}
+	cfg.Approve = false
+	cfg.learn = true
+}
+
+// report reads the handler's observations and prints the proposed rules.
+// Failures are warnings: the agent has already run.
+func (l *learner) report(s sessionNames, workspaceDir string) {
+	var out bytes.Buffer
+	if _, err := containers.Exec(context.Background(), s.handlerContainer,
+		[]string{"sh", "-c", "cat " + learnFile + " 2>/dev/null || true"}, nil, &out, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: learn: read observations: %v\n", err)
+		return
+	}
+	entries := proposeAllow(parseObservations(out.Bytes()), l.baseline)
+	if len(entries) == 0 {
+		fmt.Fprintln(os.Stderr, "membrane: learn: no new allow rules needed")
+		return
+	}
+
+	path := filepath.Join(workspaceDir, ".membrane.yaml")
+	old, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "Warning: learn: %v\n", err)
+		return
+	}
+	updated, err := addAllowEntries(old, entries...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: learn: %s: %v\n", path, err)
+		return
+	}
+	fmt.Print(unifiedDiff(".membrane.yaml", old, updated))
+
+	if !l.apply {
+		return
+	}
+	if err := os.WriteFile(path, updated, 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: learn: %v\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "membrane: learn: added %d allow rules to %s\n", len(entries), path)
+}
+
+// observation is one line of the learn file.
+type observation struct {
+	Kind   string   `json:"kind"` // "dns", "conn", or "http"
+	Name   string   `json:"name"` // dns
+	IPs    []string `json:"ips"`  // dns
+	IP     string   `json:"ip"`   // conn
+	SNI    string   `json:"sni"`  // conn
+	Host   string   `json:"host"` // http
+	Port   int      `json:"port"` // conn, http
+	Method string   `json:"method"`
+	Path   string   `json:"path"`
+}
+
+func parseObservations(data []byte) []observation {
+	var obs []observation
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var o observation
+		if json.Unmarshal(line, &o) == nil {
+			obs = append(obs, o)
+		}
+	}
+	return obs
+}
+
+type request struct {
+	port         int
+	method, path string
+}
+
+// destUse is what the agent did with one destination: a hostname, IP,
+// or, after collapsing, a host pattern or subnet.
+type destUse struct {
+	resolved bool
+	ips      []string     // addresses a hostname resolved to
+	ports    map[int]bool // TCP ports connected to
+	requests map[request]bool
+}
+
+// rawPorts returns the ports that were connected to without any HTTP
+// request being seen on them.
+func (u *destUse) rawPorts() []int {
+	var ports []int
+	for p := range u.ports {
+		http := false
+		for r := range u.requests {
+			if r.port == p {
+				http = true
+				break
+			}
+		}
+		if !http {
+			ports = append(ports, p)
+		}
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+func (u *destUse) merge(o *destUse) {
+	u.resolved = u.resolved || o.resolved
+	for _, ip := range o.ips {
+		u.ips = appendUnique(u.ips, ip)
+	}
+	for p := range o.ports {
+		u.ports[p] = true
+	}
+	for r := range o.requests {
+		u.requests[r] = true
+	}
+}
+
+// proposeAllow turns observations into allow entries for whatever
+// baseline doesn't already permit, collapsing them where sensible.
+func proposeAllow(obs []observation, baseline []AllowRule) []*yaml.Node {
+	uses := map[string]*destUse{}
+	use := func(dest string) *destUse {
+		u, ok := uses[dest]
+		if !ok {
+			u = &destUse{ports: map[int]bool{}, requests: map[request]bool{}}
+			uses[dest] = u
+		}
+		return u
+	}
+
+	// Names first, so connections without SNI can be attributed to the
+	// name that resolved to their address.
+	ipNames := map[string][]string{}
+	for _, o := range obs {
+		if o.Kind != "dns" || o.Name == "" {
+			continue
+		}
+		u := use(o.Name)
+		u.resolved = true
+		for _, ip := range o.IPs {
+			u.ips = appendUnique(u.ips, ip)
+			ipNames[ip] = appendUnique(ipNames[ip], o.Name)
+		}
+	}
+	for _, o := range obs {
+		switch o.Kind {
+		case "conn":
+			dest := o.SNI
+			if dest == "" {
+				dest = o.IP
+				if names := ipNames[o.IP]; len(names) > 0 {
+					dest = names[0]
+				}
+			}
+			use(dest).ports[o.Port] = true
+		case "http":
+			if o.Host == "" {
+				continue
+			}
+			u := use(o.Host)
+			u.ports[o.Port] = true
+			u.requests[request{o.Port, strings.ToUpper(o.Method), o.Path}] = true
+		}
+	}
+
+	// Drop whatever the configured rules already allow.
+	for dest, u := range uses {
+		ips := u.ips
+		if net.ParseIP(dest) != nil {
+			ips = []string{dest}
+		}
+		raw := u.rawPorts()
+		for _, p := range raw {
+			if portAllowed(baseline, dest, ips, p) {
+				delete(u.ports, p)
+			}
+		}
+		for r := range u.requests {
+			if requestAllowed(baseline, dest, ips, r) {
+				delete(u.requests, r)
+			}
+		}
+		// A port whose requests are all allowed needs nothing new.
+		for p := range u.ports {
+			if containsInt(raw, p) {
+				continue
+			}
+			needed := false
+			for r := range u.requests {
+				needed = needed || r.port == p
+			}
+			if !needed {
+				delete(u.ports, p)
+			}
+		}
+		if u.resolved && destAllowed(baseline, dest, ips) {
+			u.resolved = false
+		}
+		if len(u.ports) == 0 && !u.resolved {
+			delete(uses, dest)
+		}
+	}
+
+	collapse(uses, hostParent, minHostsForPattern)
+	collapse(uses, ipSubnet, minIPsForSubnet)
+
+	dests := make([]string, 0, len(uses))
+	for dest := range uses {
+		dests = append(dests, dest)
+	}
+	sort.Strings(dests)
+
+	var entries []*yaml.Node
+	for _, dest := range dests {
+		u := uses[dest]
+		if len(u.ports) == 0 {
+			n := allowEntryNode(dest, nil, nil)
+			n.LineComment = "# resolved only; no connections seen"
+			entries = append(entries, n)
+			continue
+		}
+		if raw := u.rawPorts(); len(raw) > 0 {
+			entries = append(entries, allowEntryNode(dest, portStrings(raw), nil))
+		}
+		if len(u.requests) > 0 {
+			var httpPorts []int
+			for r := range u.requests {
+				if !containsInt(httpPorts, r.port) {
+					httpPorts = append(httpPorts, r.port)
+				}
+			}
+			sort.Ints(httpPorts)
+			entries = append(entries, allowEntryNode(dest, portStrings(httpPorts), summarizeRequests(u.requests)))
+		}
+	}
+	return entries
+}
+
+// collapse merges destinations that share a group key into one entry
+// named by the key once at least min of them do. group returns "" for
+// destinations it doesn't apply to.
+func collapse(uses map[string]*destUse, group func(string) string, min int) {
+	members := map[string][]string{}
+	for dest := range uses {
+		if key := group(dest); key != "" {
+			members[key] = append(members[key], dest)
+		}
+	}
+	for key, dests := range members {
+		if len(dests) < min {
+			continue
+		}
+		merged, ok := uses[key]
+		if !ok {
+			merged = &destUse{ports: map[int]bool{}, requests: map[request]bool{}}
+		}
+		for _, dest := range dests {
+			merged.merge(uses[dest])
+			delete(uses, dest)
+		}
+		uses[key] = merged
+	}
+}
+
+// hostParent groups a.b.example.com under *.b.example.com. The parent must
+// be a registrable domain or under one, so patterns never cover a public
+// suffix such as co.uk or github.io.
+func hostParent(dest string) string {
+	if net.ParseIP(dest) != nil || strings.Contains(dest, "*") {
+		return ""
+	}
+	i := strings.Index(dest, ".")
+	if i < 0 {
+		return ""
+	}
+	if _, err := publicsuffix.EffectiveTLDPlusOne(dest[i+1:]); err != nil {
+		return ""
+	}
+	return "*" + dest[i:]
+}
+
+// ipSubnet groups IPv4 addresses by /24.
+func ipSubnet(dest string) string {
+	ip := net.ParseIP(dest).To4()
+	if ip == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d.%d.0/24", ip[0], ip[1], ip[2])
+}
+
+// summarizeRequests turns observed requests into http rules. Paths are
+// grouped by their first segment and each group is reduced to its
+// longest common prefix; groups with the same methods share a rule.
+func summarizeRequests(reqs map[request]bool) []HTTPRule {
+	type group struct {
+		paths   []string
+		methods []string
+	}
+	groups := map[string]*group{}
+	var allMethods []string
+	for r := range reqs {
+		first := strings.SplitN(strings.TrimPrefix(r.path, "/"), "/", 2)[0]
+		g, ok := groups[first]
+		if !ok {
+			g = &group{}
+			groups[first] = g
+		}
+		g.paths = appendUnique(g.paths, r.path)
+		g.methods = appendUnique(g.methods, r.method)
+		allMethods = appendUnique(allMethods, r.method)
+	}
+	sort.Strings(allMethods)
+	if len(groups) > maxPathPrefixes {
+		return []HTTPRule{{Methods: allMethods}}
+	}
+
+	byMethods := map[string]*HTTPRule{}
+	var order []string
+	for _, g := range groups {
+		sort.Strings(g.methods)
+		key := strings.Join(g.methods, ",")
+		hr, ok := byMethods[key]
+		if !ok {
+			hr = &HTTPRule{Methods: g.methods}
+			byMethods[key] = hr
+			order = append(order, key)
+		}
+		hr.Paths = append(hr.Paths, PathRule{Path: commonPathPrefix(g.paths)})
+	}
+	sort.Strings(order)
+	var rules []HTTPRule
+	for _, key := range order {
+		hr := byMethods[key]
+		sort.Slice(hr.Paths, func(i, j int) bool { return hr.Paths[i].Path < hr.Paths[j].Path })
+		rules = append(rules, *hr)
+	}
+	return rules
+}
+
+// commonPathPrefix returns the longest whole-segment prefix of paths.
+func commonPathPrefix(paths []string) string {
+	prefix := strings.Split(paths[0], "/")
+	for _, p := range paths[1:] {
+		segs := strings.Split(p, "/")
+		n := 0
+		for n < len(prefix) && n < len(segs) && prefix[n] == segs[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	if p := strings.Join(prefix, "/"); p != "" {
+		return p
+	}
+	return "/"
+}
+
+// destAllowed reports whether any rule applies to dest at all, which is
+// what lets its name resolve.
+func destAllowed(rules []AllowRule, dest string, ips []string) bool {
+	for _, r := range rules {
+		if ruleMatchesDest(r, dest, ips) {
+			return true
+		}
+	}
+	return false
+}
+
+// portAllowed reports whether a non-HTTP connection to dest:port is
+// allowed, which takes a rule without http constraints.
+func portAllowed(rules []AllowRule, dest string, ips []string, port int) bool {
+	for _, r := range rules {
+		if len(r.HTTP) == 0 && ruleMatchesDest(r, dest, ips) && rulePermitsPort(r, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func requestAllowed(rules []AllowRule, dest string, ips []string, req request) bool {
+	for _, r := range rules {
+		if ruleMatchesDest(r, dest, ips) && rulePermitsPort(r, req.port) && rulePermitsRequest(r, req) {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleMatchesDest mirrors how dns-proxy and the firewall apply r: by name
+// for hosts and patterns, and by address for CIDRs.
+func ruleMatchesDest(r AllowRule, dest string, ips []string) bool {
+	switch r.Type {
+	case "any":
+		return true
+	case "host", "url":
+		return strings.EqualFold(r.Host, dest)
+	case "host-pattern":
+		ok, _ := path.Match(r.Host, strings.ToLower(dest))
+		return ok
+	case "cidr":
+		_, n, err := net.ParseCIDR(r.CIDR)
+		if err != nil || len(ips) == 0 {
+			return false
+		}
+		for _, ip := range ips {
+			if parsed := net.ParseIP(ip); parsed == nil || !n.Contains(parsed) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func rulePermitsPort(r AllowRule, port int) bool {
+	if r.Ports == nil {
+		return true
+	}
+	for _, p := range r.Ports {
+		if p.Proto == "tcp" && p.Port == port {
+			return true
+		}
+	}
+	return false
+}
+
+func rulePermitsRequest(r AllowRule, req request) bool {
+	if len(r.HTTP) == 0 {
+		return true
+	}
+	for _, hr := range r.HTTP {
+		if len(hr.Methods) > 0 && !containsFold(hr.Methods, req.method) {
+			continue
+		}
+		if len(hr.Paths) == 0 {
+			return true
+		}
+		for _, p := range hr.Paths {
+			if req.path == p.Path || strings.HasPrefix(req.path, strings.TrimRight(p.Path, "/")+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsFold(s []string, v string) bool {
+	for _, x := range s {
+		if strings.EqualFold(x, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(s []int, v int) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func portStrings(ports []int) []string {
+	out := make([]string, len(ports))
+	for i, p := range ports {
+		out[i] = strconv.Itoa(p)
+	}
+	return out
+}
+
+// unifiedDiff returns a unified diff (3 lines of context) turning a into
+// b, suitable for `patch -p1` from the workspace.
+func unifiedDiff(name string, a, b []byte) string {
+	x, y := splitLines(a), splitLines(b)
+	n, m := len(x), len(y)
+
+	// Longest common subsequence table, then walk it for the edit script.
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	type edit struct {
+		op     byte // ' ', '-', or '+'
+		line   string
+		ai, bi int // line index in a and b where the edit applies
+	}
+	var edits []edit
+	for i, j := 0, 0; i < n || j < m; {
+		switch {
+		case i < n && j < m && x[i] == y[j]:
+			edits = append(edits, edit{' ', x[i], i, j})
+			i++
+			j++
+		case j < m && (i == n || lcs[i][j+1] >= lcs[i+1][j]):
+			edits = append(edits, edit{'+', y[j], i, j})
+			j++
+		default:
+			edits = append(edits, edit{'-', x[i], i, j})
+			i++
+		}
+	}
+
+	var out strings.Builder
+	from := "a/" + name
+	if len(a) == 0 {
+		from = "/dev/null"
+	}
+	fmt.Fprintf(&out, "--- %s\n+++ b/%s\n", from, name)
+	const context = 3
+	for k := 0; k < len(edits); {
+		if edits[k].op == ' ' {
+			k++
+			continue
+		}
+		start, end := max(k-context, 0), k
+		for end < len(edits) {
+			if edits[end].op != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(edits) && edits[run].op == ' ' {
+				run++
+			}
+			if run == len(edits) || run-end > 2*context {
+				end = min(end+context, len(edits))
+				break
+			}
+			end = run
+		}
+
+		aLen, bLen := 0, 0
+		for _, e := range edits[start:end] {
+			if e.op != '+' {
+				aLen++
+			}
+			if e.op != '-' {
+				bLen++
+			}
+		}
+		aStart, bStart := edits[start].ai, edits[start].bi
+		if aLen > 0 {
+			aStart++
+		}
+		if bLen > 0 {
+			bStart++
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+		for _, e := range edits[start:end] {
+			out.WriteByte(e.op)
+			out.WriteString(e.line)
+			out.WriteByte('\n')
+		}
+		k = end
+	}
+	return out.String()
+}
+
+func splitLines(data []byte) []string {
+	s := strings.TrimSuffix(string(data), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
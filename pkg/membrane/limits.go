@@ -0,0 +1,335 @@
+package membrane
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limits is the `limits:` config section. It applies to the agent and to
+// the handler. Empty values are unlimited; a workspace .membrane.yaml
+// overrides the global config key by key.
+type limits struct {
+	CPUs       string `yaml:"cpus"`        // e.g. 2 or 1.5
+	Memory     string `yaml:"memory"`      // e.g. 4g
+	MemorySwap string `yaml:"memory_swap"` // memory plus swap, e.g. 6g; -1 for unlimited swap
+	Pids       int64  `yaml:"pids"`
+	OpenFiles  int64  `yaml:"open_files"`
+	Disk       string `yaml:"disk"` // writable layer, e.g. 20g
+
+	res resources // parsed by validate
+}
+
+// merge overrides l with the keys set in o.
+func (l *limits) merge(o limits) {
+	if o.CPUs != "" {
+		l.CPUs = o.CPUs
+	}
+	if o.Memory != "" {
+		l.Memory = o.Memory
+	}
+	if o.MemorySwap != "" {
+		l.MemorySwap = o.MemorySwap
+	}
+	if o.Pids != 0 {
+		l.Pids = o.Pids
+	}
+	if o.OpenFiles != 0 {
+		l.OpenFiles = o.OpenFiles
+	}
+	if o.Disk != "" {
+		l.Disk = o.Disk
+	}
+}
+
+// validate parses l into l.res.
+func (l *limits) validate() error {
+	var r resources
+	if l.CPUs != "" {
+		cpus, err := strconv.ParseFloat(l.CPUs, 64)
+		if err != nil || cpus <= 0 {
+			return fmt.Errorf("limits.cpus: %q is not a positive number", l.CPUs)
+		}
+		r.NanoCPUs = int64(cpus * 1e9)
+	}
+	if l.Memory != "" {
+		n, err := parseBytes(l.Memory)
+		if err != nil {
+			return fmt.Errorf("limits.memory: %w", err)
+		}
+		r.Memory = n
+	}
+	if l.MemorySwap != "" {
+		if r.Memory == 0 {
+			return fmt.Errorf("limits.memory_swap needs limits.memory")
+		}
+		if l.MemorySwap == "-1" {
+			r.MemorySwap = -1
+		} else {
+			n, err := parseBytes(l.MemorySwap)
+			if err != nil {
+				return fmt.Errorf("limits.memory_swap: %w", err)
+			}
+			if n < r.Memory {
+				return fmt.Errorf("limits.memory_swap (%s) is memory plus swap and must be at least limits.memory (%s)", l.MemorySwap, l.Memory)
+			}
+			r.MemorySwap = n
+		}
+	}
+	if l.Pids < 0 || l.OpenFiles < 0 {
+		return fmt.Errorf("limits.pids and limits.open_files must be positive")
+	}
+	r.PidsLimit = l.Pids
+	r.NoFile = l.OpenFiles
+	if l.Disk != "" {
+		if _, err := parseBytes(l.Disk); err != nil {
+			return fmt.Errorf("limits.disk: %w", err)
+		}
+		r.DiskSize = l.Disk
+	}
+	l.res = r
+	return nil
+}
+
+// parseBytes parses a size such as 512m, 4g or 1.5G (binary units, like
+// docker) into bytes.
+func parseBytes(s string) (int64, error) {
+	units := map[string]float64{"": 1, "b": 1, "k": 1 << 10, "m": 1 << 20, "g": 1 << 30, "t": 1 << 40}
+	v := strings.ToLower(strings.TrimSpace(s))
+	v = strings.TrimSuffix(v, "b")
+	num := strings.TrimRight(v, "kmgt")
+	unit := v[len(num):]
+	mult, ok := units[unit]
+	n, err := strconv.ParseFloat(num, 64)
+	if !ok || err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not a size like 512m or 4g", s)
+	}
+	return int64(n * mult), nil
+}
+
+// agentArgs are the docker run options for r.
+func (r resources) agentArgs() []string {
+	var args []string
+	if r.NanoCPUs > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(float64(r.NanoCPUs)/1e9, 'f', -1, 64))
+	}
+	if r.Memory > 0 {
+		args = append(args, "--memory", strconv.FormatInt(r.Memory, 10))
+	}
+	if r.MemorySwap != 0 {
+		args = append(args, "--memory-swap", strconv.FormatInt(r.MemorySwap, 10))
+	}
+	if r.PidsLimit > 0 {
+		args = append(args, "--pids-limit", strconv.FormatInt(r.PidsLimit, 10))
+	}
+	if r.NoFile > 0 {
+		n := strconv.FormatInt(r.NoFile, 10)
+		args = append(args, "--ulimit", "nofile="+n+":"+n)
+	}
+	if r.DiskSize != "" {
+		args = append(args, "--storage-opt", "size="+r.DiskSize)
+	}
+	return args
+}
+
+// applyDiskLimit drops limits.disk, with a warning, if the engine's
+// storage driver can't limit a container's writable layer.
+func (l *limits) applyDiskLimit() {
+	if l.res.DiskSize == "" {
+		return
+	}
+	info, err := containers.Info()
+	if err != nil {
+		return // let the engine decide
+	}
+	switch info.StorageDriver {
+	case "btrfs", "zfs", "devicemapper", "windowsfilter":
+		return
+	case "overlay2", "overlay":
+		// Also needs the pquota mount option, which isn't reported; the
+		// engine refuses to create the container without it.
+		if info.BackingFilesystem == "xfs" {
+			return
+		}
+	}
+	where := info.StorageDriver
+	if info.BackingFilesystem != "" {
+		where += " on " + info.BackingFilesystem
+	}
+	fmt.Fprintf(os.Stderr, "Warning: limits.disk ignored: the %s storage driver can't limit a container's writable layer\n", where)
+	l.res.DiskSize = ""
+}
+
+// limitMonitor watches for the agent reaching its pid limit while it
+// runs, since that makes forks fail without stopping the container. Where
+// the agent's cgroup is on this host, it reads the cgroup's pids.events,
+// whose max count records every fork the limit refused, however brief;
+// elsewhere, as on macOS, it falls back to sampling the pid count.
+type limitMonitor struct {
+	s     sessionNames
+	limit int64
+	stop  chan struct{}
+	done  chan struct{}
+
+	mu      sync.Mutex
+	hitMax  bool  // pids.events counted a refused fork
+	maxPids int64 // the most pids sampled
+}
+
+// watchLimits starts a limitMonitor if the agent has a pid limit.
+func watchLimits(s sessionNames, r resources) *limitMonitor {
+	m := &limitMonitor{s: s, limit: r.PidsLimit, stop: make(chan struct{}), done: make(chan struct{})}
+	if m.limit == 0 {
+		close(m.done)
+		return m
+	}
+	go func() {
+		defer close(m.done)
+		t := time.NewTicker(2 * time.Second)
+		defer t.Stop()
+		var events string // the agent's pids.events, once found
+		sample := false   // no cgroup here; sample Stats instead
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-t.C:
+			}
+			if events == "" && !sample {
+				st, err := containers.InspectContainer(s.agentContainer)
+				if err != nil || !st.Running {
+					continue // not started yet, or already gone
+				}
+				if events, err = pidsEventsPath(st.Pid); err != nil {
+					sample = true
+				}
+			}
+			if sample {
+				st, err := containers.Stats(s.agentContainer)
+				if err != nil {
+					continue
+				}
+				m.mu.Lock()
+				m.maxPids = max(m.maxPids, st.Pids)
+				m.mu.Unlock()
+				continue
+			}
+			// The count only grows, so a read that fails as the container
+			// exits loses nothing earlier reads saw.
+			if n, err := readPidsMax(events); err == nil && n > 0 {
+				m.mu.Lock()
+				m.hitMax = true
+				m.mu.Unlock()
+			}
+		}
+	}()
+	return m
+}
+
+// pidsEventsPath finds the pids.events file of the cgroup of process pid,
+// under cgroup v2 or v1's pids controller.
+func pidsEventsPath(pid int) (string, error) {
+	if pid <= 0 {
+		return "", fmt.Errorf("no pid")
+	}
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		// hierarchy-ID:controllers:path
+		f := strings.SplitN(line, ":", 3)
+		if len(f) != 3 {
+			continue
+		}
+		var path string
+		switch {
+		case f[0] == "0" && f[1] == "":
+			path = filepath.Join("/sys/fs/cgroup", f[2], "pids.events")
+		case strings.Contains(","+f[1]+",", ",pids,"):
+			path = filepath.Join("/sys/fs/cgroup/pids", f[2], "pids.events")
+		default:
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no pids.events for pid %d", pid)
+}
+
+// readPidsMax returns the max count in a pids.events file: how many forks
+// the pid limit has refused.
+func readPidsMax(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if n, ok := strings.CutPrefix(line, "max "); ok {
+			return strconv.ParseInt(strings.TrimSpace(n), 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("%s has no max count", path)
+}
+
+// hitPidLimit stops watching and reports whether the agent reached its
+// pid limit.
+func (m *limitMonitor) hitPidLimit() bool {
+	select {
+	case <-m.stop:
+	default:
+		close(m.stop)
+	}
+	<-m.done
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.limit > 0 && (m.hitMax || m.maxPids >= m.limit)
+}
+
+// limitReason explains an agent exit caused by a resource limit, or
+// returns "", along with the containers that ran out of memory. Call it
+// after the agent has exited but before its container is removed.
+func limitReason(s sessionNames, l limits, mon *limitMonitor) (string, []string) {
+	var reasons, oom []string
+	if st, err := containers.InspectContainer(s.agentContainer); err == nil && st.OOMKilled {
+		reasons = append(reasons, fmt.Sprintf("the agent ran out of memory and was killed (limits.memory: %s)", orUnset(l.Memory)))
+		oom = append(oom, "agent")
+	}
+	if mon != nil && mon.hitPidLimit() {
+		reasons = append(reasons, fmt.Sprintf("the agent reached its process limit, so new processes failed to start (limits.pids: %d)", l.Pids))
+	}
+	if st, err := containers.InspectContainer(s.handlerContainer); err == nil && st.OOMKilled {
+		reasons = append(reasons, fmt.Sprintf("the handler ran out of memory and was killed, cutting off the network (limits.memory: %s)", orUnset(l.Memory)))
+		oom = append(oom, "handler")
+	}
+	return strings.Join(reasons, "; "), oom
+}
+
+func orUnset(v string) string {
+	if v == "" {
+		return "unset"
+	}
+	return v
+}
+
+// withLimitReason attaches limitReason to the agent's ExitError, if any.
+func withLimitReason(err error, s sessionNames, l limits, mon *limitMonitor) error {
+	reason, oom := limitReason(s, l, mon)
+	if reason == "" {
+		return err
+	}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		exitErr.Reason, exitErr.OOMKilled = reason, oom
+		return err
+	}
+	// Exited 0 despite the limit; just say so.
+	fmt.Fprintf(os.Stderr, "membrane: %s\n", reason)
+	return err
+}
@@ -0,0 +1,83 @@
+package membrane
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+// Cross-process locks. Concurrent membranes, e.g. under GNU parallel,
+// share ~/.membrane/src and the images built from it, so cloning,
+// updating and building each happen under a lock file in
+// ~/.membrane/locks. The locks are flock(2) locks, so a membrane that
+// dies holding one releases it.
+
+// Lock names.
+const (
+	lockSrc    = "src"    // ~/.membrane/src: exclusive to clone or update, shared to build from
+	lockImages = "images" // building and tagging images
+)
+
+type fileLock struct {
+	f *os.File
+}
+
+// acquireLock takes the named lock, exclusive or shared. If another
+// membrane holds it, it waits, with a spinner labelled waiting on a
+// terminal.
+func acquireLock(name string, exclusive bool, waiting string) (*fileLock, error) {
+	home, err := membraneHome()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(home, "locks")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create locks dir: %w", err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, name+".lock"), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open %s lock: %w", name, err)
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	err = syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		var s *spinner
+		if term.IsTerminal(int(os.Stdin.Fd())) {
+			s = newSpinner()
+			s.Start(waiting)
+		} else {
+			fmt.Fprintf(os.Stderr, "membrane: %s\n", waiting)
+		}
+		for {
+			err = syscall.Flock(int(f.Fd()), how)
+			if !errors.Is(err, syscall.EINTR) {
+				break
+			}
+		}
+		if s != nil {
+			s.Stop()
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("take %s lock: %w", name, err)
+	}
+	return &fileLock{f: f}, nil
+}
+
+// unlock releases l. A nil lock is a no-op.
+func (l *fileLock) unlock() {
+	if l == nil {
+		return
+	}
+	_ = syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	l.f.Close()
+}
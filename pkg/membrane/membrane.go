@@ -4,13 +4,12 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
-	"runtime"
-	"strings"
 	"syscall"
 	"time"
+
+	"golang.org/x/term"
 )
 
 // CLIOverrides holds config values passed via CLI flags. List fields are
@@ -20,16 +19,134 @@ type CLIOverrides struct {
 	Readonly    []string
 	Allow       []string // raw strings, parsed via ParseAllowEntry
 	Args        []string
-	DNSResolver string
+	Hosts       []string // raw name=IP[,IP...] strings, parsed via ParseHostEntry
+	DNSResolver string   // comma-separated, parsed via ParseResolverList
+	Approve     bool
+	MediateGit  bool
+	Offline     bool
+}
+
+// runOptions carries everything a session run needs from the command line.
+type runOptions struct {
+	noUpdate       bool
+	trace          bool
+	noGlobalConfig bool
+	detach         bool
+	supervised     bool // set in the supervisor process
+	name           string
+	traceLog       string
+	sessionIDFile  string
+	timeout        time.Duration  // stop the agent after this long; 0 for never
+	idleTimeout    time.Duration  // stop the agent after this long without activity
+	summaryJSON    string         // write a sessionSummary here when the session ends
+	cow            bool           // run the agent on a copy-on-write workspace
+	worktree       string         // run the agent in a git worktree on this branch
+	exitCodes      ExitCodes      // membrane's own exit codes
+	resume         string         // restart this session from its checkpoint; see checkpoint.go
+	config         *configSources // the config files as loaded, set by prepareSession
+	passthrough    []string
+	cli            CLIOverrides
+	learn          *learner // non-nil for `membrane learn`
+}
+
+// Options are the command-line options of a session, besides the config
+// overrides in CLIOverrides.
+type Options struct {
+	NoUpdate       bool
+	Trace          bool
+	NoGlobalConfig bool
+	Detach         bool
+	Name           string
+	TraceLog       string
+	SessionIDFile  string
+	Timeout        time.Duration // stop the agent after this long; 0 for never
+	IdleTimeout    time.Duration // stop the agent after this long without activity
+	SummaryJSON    string        // write a JSON summary here when the session ends
+	Cow            bool          // run the agent on a copy-on-write workspace
+	Worktree       string        // run the agent in a git worktree on this branch
+	ExitCodes      ExitCodes     // membrane's own exit codes; DefaultExitCodes if unset
 }
 
 // Run is the main entry point called from cmd/membrane/main.go.
 // passthrough args are forwarded as the container command.
-func Run(noUpdate bool, trace bool, noGlobalConfig bool, traceLog string, sessionIDFile string, passthrough []string, cli CLIOverrides) error {
+func Run(o Options, passthrough []string, cli CLIOverrides) error {
+	opts := runOptions{
+		noUpdate:       o.NoUpdate,
+		trace:          o.Trace,
+		noGlobalConfig: o.NoGlobalConfig,
+		detach:         o.Detach,
+		name:           o.Name,
+		traceLog:       o.TraceLog,
+		sessionIDFile:  o.SessionIDFile,
+		timeout:        o.Timeout,
+		idleTimeout:    o.IdleTimeout,
+		summaryJSON:    o.SummaryJSON,
+		cow:            o.Cow,
+		worktree:       o.Worktree,
+		exitCodes:      o.ExitCodes.orDefault(),
+		passthrough:    passthrough,
+		cli:            cli,
+	}
+	if opts.summaryJSON == "" {
+		return run(opts)
+	}
+
+	// The session writes the summary as it ends; a stale one mustn't be
+	// mistaken for it. If membrane fails before there's a session, the
+	// summary just says so.
+	var err error
+	if opts.summaryJSON, err = filepath.Abs(opts.summaryJSON); err != nil {
+		return fmt.Errorf("resolve --summary-json: %w", err)
+	}
+	if err := os.Remove(opts.summaryJSON); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove old summary: %w", err)
+	}
+	started := time.Now().UTC()
+	err = run(opts)
+	if _, serr := os.Stat(opts.summaryJSON); err != nil && os.IsNotExist(serr) {
+		workspaceDir, _ := os.Getwd()
+		ended := time.Now().UTC()
+		if serr := writeSummary(opts.summaryJSON, opts.exitCodes, &sessionRecord{
+			Workspace: workspaceDir,
+			Command:   passthrough,
+			Started:   started,
+			Ended:     &ended,
+			Status:    statusFailed,
+			Error:     err.Error(),
+		}); serr != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", serr)
+		}
+	}
+	return err
+}
+
+func run(opts runOptions) error {
+	if opts.timeout < 0 || opts.idleTimeout < 0 {
+		return fmt.Errorf("--timeout and --idle-timeout must be positive")
+	}
+	if err := opts.exitCodes.Validate(); err != nil {
+		return err
+	}
+	if err := selectEngine(); err != nil {
+		return err
+	}
+
+	workspaceDir, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("get working directory: %w", err)
+	}
 
-	if runtime.GOOS == "darwin" {
-		os.Setenv("DOCKER_CONTEXT", "colima-membrane")
+	workspaceDir, err = filepath.EvalSymlinks(workspaceDir)
+	if err != nil {
+		return fmt.Errorf("resolve workspace symlinks: %w", err)
+	}
+
+	// Read before anything that might reach the network; the session
+	// reads its config again once it's set up.
+	if cfg, err := loadConfig(workspaceDir, opts.noGlobalConfig); err == nil && cfg.Offline {
+		opts.cli.Offline = true
 	}
+	offline = opts.cli.Offline
 
 	repoDir, err := ensureRepo()
 	if err != nil {
@@ -40,6 +157,20 @@ func Run(noUpdate bool, trace bool, noGlobalConfig bool, traceLog string, sessio
 		return err
 	}
 
+	if diffs := podmanDifferences(opts.trace); len(diffs) > 0 {
+		fmt.Fprintln(os.Stderr, "membrane: using Podman; these guarantees differ from Docker:")
+		for _, d := range diffs {
+			fmt.Fprintf(os.Stderr, "  - %s\n", d)
+		}
+		opts.trace = false
+	}
+	if opts.cow && opts.worktree != "" {
+		return fmt.Errorf("--cow and --worktree can't be combined; a worktree already keeps the agent's changes out of your working tree")
+	}
+	if p, ok := usingPodman(); ok && p.rootless() && opts.cow {
+		return fmt.Errorf("--cow needs rootful Podman or Docker: rootless Podman can't create overlay volumes")
+	}
+
 	// Write default config if it doesn't exist yet. Safe to call every run.
 	// Must run after ensureRepo — reads config-default.yaml from the cloned repo.
 	home, err := os.UserHomeDir()
@@ -51,83 +182,252 @@ func Run(noUpdate bool, trace bool, noGlobalConfig bool, traceLog string, sessio
 		return err
 	}
 
-	if !noUpdate {
+	if !opts.noUpdate && !offline {
 		if err := checkAndUpdate(repoDir); err != nil {
 			// Non-fatal: warn and continue.
 			fmt.Fprintf(os.Stderr, "Warning: update check failed: %v\n", err)
 		}
 	}
 
-	if err := ensureImages(repoDir); err != nil {
-		return err
+	// Opportunistically clean up after sessions that were killed before
+	// their own cleanup ran.
+	if removed, err := collectGarbage(false); err == nil && len(removed) > 0 {
+		fmt.Fprintf(os.Stderr, "membrane: removed %d leftovers of earlier sessions\n", len(removed))
 	}
 
-	workspaceDir, err := os.Getwd()
+	// Interactive and detached sessions are owned by a background
+	// supervisor so they can outlive this process: an interactive session
+	// can be detached from, and survives its terminal or SSH connection
+	// going away. Signals to this process still stop it; see detach.go.
+	if opts.learn == nil && (opts.detach || term.IsTerminal(int(os.Stdin.Fd()))) {
+		return runSupervised(opts, workspaceDir)
+	}
+	return runAttached(opts, workspaceDir)
+}
+
+// prepareSession loads the workspace config, applies CLI overrides,
+// registers the session, and scans the workspace for mounts.
+func prepareSession(opts runOptions, workspaceDir string) (*config, *mounts, sessionNames, *sessionRecord, error) {
+	var s sessionNames
+	var ck *checkpoint
+	var cfg *config
+	var err error
+	if opts.resume != "" {
+		if ck, err = loadCheckpoint(opts.resume); err == nil {
+			cfg, err = ck.config()
+		}
+	} else {
+		cfg, err = loadConfig(workspaceDir, opts.noGlobalConfig)
+	}
 	if err != nil {
-		return fmt.Errorf("get working directory: %w", err)
+		return nil, nil, s, nil, err
 	}
 
-	workspaceDir, err = filepath.EvalSymlinks(workspaceDir)
+	cfg.Ignore = append(cfg.Ignore, opts.cli.Ignore...)
+	cfg.Readonly = append(cfg.Readonly, opts.cli.Readonly...)
+	cfg.Args = append(cfg.Args, opts.cli.Args...)
+	for _, entry := range opts.cli.Allow {
+		rule, err := ParseAllowEntry(entry)
+		if err != nil {
+			return nil, nil, s, nil, fmt.Errorf("invalid --allow value %q: %w", entry, err)
+		}
+		cfg.Allow = append(cfg.Allow, rule)
+	}
+	for _, entry := range opts.cli.Hosts {
+		if cfg.Hosts == nil {
+			cfg.Hosts = hostsMap{}
+		}
+		if err := ParseHostEntry(cfg.Hosts, entry); err != nil {
+			return nil, nil, s, nil, fmt.Errorf("invalid --host value %q: %w", entry, err)
+		}
+	}
+	if opts.cli.DNSResolver != "" {
+		resolvers, err := ParseResolverList(opts.cli.DNSResolver)
+		if err != nil {
+			return nil, nil, s, nil, fmt.Errorf("invalid --dns-resolver value %q: %w", opts.cli.DNSResolver, err)
+		}
+		cfg.DNSResolver = resolvers
+	}
+	if opts.cli.Approve {
+		cfg.Approve = true
+	}
+	if opts.cli.MediateGit {
+		cfg.MediateGit = true
+	}
+	if opts.cli.Offline {
+		cfg.Offline = true
+	}
+	offline = cfg.Offline
+	repoDir, err := ensureRepo()
 	if err != nil {
-		return fmt.Errorf("resolve workspace symlinks: %w", err)
+		return nil, nil, s, nil, err
+	}
+	images, err := ensureImages(repoDir)
+	if err != nil {
+		return nil, nil, s, nil, err
+	}
+	cfg.handlerImage = images.handler
+	if ck != nil {
+		ck.apply(cfg)
+	} else if cfg.image, err = cfg.agentImage(images.agent); err != nil {
+		return nil, nil, s, nil, err
+	}
+	if opts.learn != nil {
+		opts.learn.start(cfg)
+	}
+	cfg.cow = opts.cow
+	cfg.Limits.applyDiskLimit()
+	if cfg.Approve && !term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprintln(os.Stderr, "Warning: approval mode needs an interactive terminal; blocked requests will be denied")
+		cfg.Approve = false
 	}
 
-	cfg, err := loadConfig(workspaceDir, noGlobalConfig)
+	s = newSessionNames()
+
+	// Registered before anything is created for the session, so gc
+	// leaves its resources alone.
+	opts.config = &cfg.sources
+	rec, err := registerSession(s, opts, workspaceDir)
 	if err != nil {
-		return err
+		return nil, nil, s, nil, err
 	}
 
-	cfg.Ignore = append(cfg.Ignore, cli.Ignore...)
-	cfg.Readonly = append(cfg.Readonly, cli.Readonly...)
-	cfg.Args = append(cfg.Args, cli.Args...)
-	for _, entry := range cli.Allow {
-		rule, err := ParseAllowEntry(entry)
+	if opts.worktree != "" {
+		cfg.worktree, err = createWorktree(workspaceDir, s.id, opts.worktree)
 		if err != nil {
-			return fmt.Errorf("invalid --allow value %q: %w", entry, err)
+			return nil, nil, s, rec, err
+		}
+		rec.Worktree, rec.WorktreeBranch, rec.WorktreeBase = cfg.worktree.dir, cfg.worktree.branch, cfg.worktree.base
+		if g := cfg.worktree.git; g != nil {
+			// So that `membrane import` can rescue commits that couldn't
+			// be imported at exit.
+			rec.GitDir, rec.GitObjects, rec.GitBase, rec.GitProtected = g.dir, g.objects, g.base, g.protected
+		}
+		if err := rec.save(); err != nil {
+			cfg.worktree.finish()
+			return nil, nil, s, rec, err
 		}
-		cfg.Allow = append(cfg.Allow, rule)
 	}
-	if cli.DNSResolver != "" {
-		cfg.DNSResolver = cli.DNSResolver
+
+	if cfg.MediateGit {
+		switch {
+		case cfg.worktree != nil:
+			err = fmt.Errorf("mediate_git and --worktree can't be combined; a worktree already lets the agent commit")
+		case matchesAny(".git", ".git", cfg.Ignore):
+			err = fmt.Errorf("mediate_git can't be used with .git ignored; the agent would read its objects")
+		default:
+			cfg.git, err = createMediatedGit(workspaceDir, s.id, cfg.Readonly)
+		}
+		if err != nil {
+			return nil, nil, s, rec, err
+		}
+		rec.GitDir, rec.GitObjects, rec.GitBase, rec.GitProtected = cfg.git.dir, cfg.git.objects, cfg.git.base, cfg.git.protected
+		if err := rec.save(); err != nil {
+			return nil, nil, s, rec, err
+		}
 	}
 
-	m, err := scan(workspaceDir, cfg)
+	m, err := scan(cfg.agentWorkspace(workspaceDir), cfg, s.id)
 	if err != nil {
-		return err
+		cfg.worktree.finish()
+		return nil, nil, s, rec, err
 	}
 
-	s := newSessionNames()
+	if opts.sessionIDFile != "" {
+		if err := os.WriteFile(opts.sessionIDFile, []byte(s.id), 0o644); err != nil {
+			return nil, nil, s, rec, fmt.Errorf("write session id file: %w", err)
+		}
+	}
+	return cfg, m, s, rec, nil
+}
 
-	if sessionIDFile != "" {
-		if err := os.WriteFile(sessionIDFile, []byte(s.id), 0o644); err != nil {
-			return fmt.Errorf("write session id file: %w", err)
+// traceLogPath resolves the trace log for session s and creates its
+// directory.
+func traceLogPath(opts runOptions, s sessionNames) (string, error) {
+	traceLogFile := opts.traceLog
+	if traceLogFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("get home dir: %w", err)
 		}
+		traceLogFile = filepath.Join(home, ".membrane", "trace", s.agentContainer+".jsonl.gz")
+	}
+	if err := os.MkdirAll(filepath.Dir(traceLogFile), 0o755); err != nil {
+		return "", fmt.Errorf("create trace dir: %w", err)
+	}
+	return traceLogFile, nil
+}
+
+// runAttached runs a session whose lifetime is tied to this process: the
+// agent runs with docker run and everything is cleaned up on return.
+func runAttached(opts runOptions, workspaceDir string) (err error) {
+	cfg, m, s, rec, err := prepareSession(opts, workspaceDir)
+	// Runs last, once cleanup has compressed the handler log.
+	defer func() { rec.finish(0, err) }()
+	if err != nil {
+		return err
 	}
+	if opts.cow {
+		// Runs once the agent and the overlay volume are gone.
+		defer finishOverlay(s.id, workspaceDir)
+	}
+	defer func() {
+		cfg.worktree.finish()
+		reportWorktree(rec)
+		finishCommits(rec)
+	}()
 
-	cleanup, gatewayIP, err := startSession(s, cfg)
+	cleanup, gatewayIP, err := startSession(s, cfg, workspaceDir)
 	defer cleanup()
 	if err != nil {
 		return fmt.Errorf("start session: %w", err)
 	}
+	if opts.learn != nil {
+		// Runs before cleanup, while the handler still exists.
+		defer opts.learn.report(s, workspaceDir)
+	}
 
-	args, err := buildAgentArgs(workspaceDir, m, cfg, passthrough, s, gatewayIP)
+	agentHome, err := prepareAgentHome(cfg.Home, s, workspaceDir)
 	if err != nil {
 		return err
 	}
+	// Runs after the agent has exited, before cleanup removes the session's
+	// temp files.
+	defer agentHome.finish()
 
-	if !trace {
-		return execDocker(args)
+	agentArgs, err := buildAgentArgs(workspaceDir, m, cfg, opts.passthrough, s, gatewayIP, agentHome)
+	if err != nil {
+		return err
+	}
+	args := append([]string{"run", "-it"}, agentArgs...)
+	// Removed once limitReason has looked at how it exited.
+	defer containers.RemoveContainer(s.agentContainer)
+	mon := watchLimits(s, cfg.Limits.res)
+
+	// Approval mode: prompt on this terminal for requests the handler holds.
+	var gate *promptGate
+	if cfg.Approve {
+		gate = &promptGate{}
+		stop, err := startApprovals(s, workspaceDir, gate)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	rec.running()
+	if !opts.trace {
+		wd := startWatchdog(s, opts.timeout, opts.idleTimeout, nil)
+		err := execDocker(args, ptyProxy{gate: gate})
+		rec.agentExited()
+		return withTimeoutReason(withLimitReason(err, s, cfg.Limits, mon), wd, opts.exitCodes.Timeout)
 	}
 
 	// -- Traced run: Tracee sidecar → agent container → cleanup --
 
-	// Resolve trace log path.
-	traceLogFile := traceLog
-	if traceLogFile == "" {
-		traceLogFile = filepath.Join(membraneDir, "trace", s.agentContainer+".jsonl.gz")
-	}
-	if err := os.MkdirAll(filepath.Dir(traceLogFile), 0o755); err != nil {
-		return fmt.Errorf("create trace dir: %w", err)
+	traceLogFile, err := traceLogPath(opts, s)
+	if err != nil {
+		return err
 	}
 
 	tracer := NewTracer(s.agentContainer, traceLogFile)
@@ -135,6 +435,7 @@ func Run(noUpdate bool, trace bool, noGlobalConfig bool, traceLog string, sessio
 		return fmt.Errorf("tracee failed to start: %w\nRe-run with --no-trace to start without tracing", err)
 	}
 	defer tracer.Stop()
+	wd := startWatchdog(s, opts.timeout, opts.idleTimeout, tracer)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -149,14 +450,13 @@ func Run(noUpdate bool, trace bool, noGlobalConfig bool, traceLog string, sessio
 	// Run the agent container in a goroutine so we can resolve its
 	// container ID and set up event filtering while it runs.
 	agentErr := make(chan error, 1)
-	go func() { agentErr <- execDocker(args) }()
+	go func() { agentErr <- execDocker(args, ptyProxy{gate: gate}) }()
 
-	// Retry docker inspect until the container exists (up to ~5s).
+	// Retry until the container exists (up to ~5s).
 	var cid string
 	for i := 0; i < 10; i++ {
-		out, err := exec.Command("docker", "inspect", "-f", "{{.Id}}", s.agentContainer).Output()
-		if err == nil {
-			cid = strings.TrimSpace(string(out))
+		if st, err := containers.InspectContainer(s.agentContainer); err == nil {
+			cid = st.ID
 			break
 		}
 		time.Sleep(500 * time.Millisecond)
@@ -175,48 +475,9 @@ func Run(noUpdate bool, trace bool, noGlobalConfig bool, traceLog string, sessio
 		// Signal received; stop the agent container so execDocker unblocks
 		// and restores the terminal. Tracee cleaned up by deferred tracer.Stop().
 		fmt.Fprintln(os.Stderr, "\r\nmembrane: stopping...")
-		_ = exec.Command("docker", "stop", "-t", "2", s.agentContainer).Run()
+		_ = containers.StopContainer(s.agentContainer, 2*time.Second)
 		<-agentErr
 	}
-	return result
-}
-
-func checkAndUpdate(repoDir string) error {
-	// Skip update if not on main (e.g. src is a symlink to a dev working dir).
-	branchOut, err := exec.Command("git", "-C", repoDir, "rev-parse", "--abbrev-ref", "HEAD").Output()
-	if err != nil || strings.TrimSpace(string(branchOut)) != "main" {
-		return nil
-	}
-
-	remote, err := remoteCommit()
-	if err != nil {
-		return err
-	}
-
-	localOut, err := exec.Command("git", "-C", repoDir, "rev-parse", "HEAD").Output()
-	if err != nil {
-		return fmt.Errorf("get local commit: %w", err)
-	}
-	local := strings.TrimSpace(string(localOut))
-
-	if remote == local {
-		return nil
-	}
-
-	dirty, err := isDirty(repoDir)
-	if err != nil {
-		return err
-	}
-	if dirty {
-		if err := backupSrc(repoDir); err != nil {
-			return err
-		}
-	}
-
-	fmt.Fprintf(os.Stderr, "Updating to %s...\n", remote[:7])
-	if err := update(repoDir); err != nil {
-		return err
-	}
-
-	return buildImages(repoDir)
+	rec.agentExited()
+	return withTimeoutReason(withLimitReason(result, s, cfg.Limits, mon), wd, opts.exitCodes.Timeout)
 }
@@ -0,0 +1,351 @@
+package membrane
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Offline mode (--offline, or `offline: true`). membrane doesn't check
+// for updates, clone its source, pull images or build its own, and says
+// which of them is missing rather than waiting on the network. For
+// air-gapped machines, `membrane images export` bundles the images and
+// the source they were built from on a connected machine, along with the
+// agent image the workspace's config names or builds, and `membrane
+// images import` unpacks the bundle.
+
+// offline is set for the process from --offline or the config.
+var offline bool
+
+const importHint = "bring what's missing from a connected machine with membrane images export and membrane images import"
+
+// imageBundle is the manifest.json of an images export. The bundle also
+// holds images.tar, from docker save, and the source under src/.
+type imageBundle struct {
+	Created time.Time `json:"created"`
+	Agent   string    `json:"agent"`
+	Handler string    `json:"handler"`
+	Tracee  string    `json:"tracee"`
+	Custom  string    `json:"custom,omitempty"` // the workspace's image: or build:
+}
+
+// ExportImages writes the membrane images, the Tracee image, the agent
+// image the config for the current directory names or builds, if any,
+// and the source the images are built from to path, a gzipped tarball,
+// building and pulling what's missing.
+func ExportImages(path string) error {
+	if err := selectEngine(); err != nil {
+		return err
+	}
+	repoDir, err := ensureRepo()
+	if err != nil {
+		return err
+	}
+	images, err := ensureImages(repoDir)
+	if err != nil {
+		return err
+	}
+	if ok, _ := containers.ImageExists(traceeImage); !ok {
+		if offline {
+			return fmt.Errorf("the tracee image %s is missing, and membrane is offline", traceeImage)
+		}
+		if err := containers.PullImage(traceeImage, os.Stderr); err != nil {
+			return fmt.Errorf("pull tracee image: %w", err)
+		}
+	}
+	bundle := imageBundle{
+		Created: time.Now().UTC(),
+		Agent:   images.agent,
+		Handler: images.handler,
+		Tracee:  traceeImage,
+	}
+	workspaceDir, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("get working directory: %w", err)
+	}
+	cfg, err := loadConfig(workspaceDir, false)
+	if err != nil {
+		return err
+	}
+	if cfg.Image != "" || cfg.Build != "" {
+		if bundle.Custom, err = cfg.agentImage(images.agent); err != nil {
+			return err
+		}
+	}
+
+	saved, err := os.CreateTemp("", "membrane-images-*.tar")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(saved.Name())
+	names := []string{bundle.Agent, agentImageName, bundle.Handler, handlerImageName, bundle.Tracee}
+	if bundle.Custom != "" {
+		names = append(names, bundle.Custom)
+	}
+	fmt.Fprintf(os.Stderr, "Saving images...\n")
+	if err := containers.SaveImages(names, saved); err != nil {
+		saved.Close()
+		return err
+	}
+	if err := saved.Close(); err != nil {
+		return fmt.Errorf("save images: %w", err)
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", path, err)
+	}
+	defer out.Close()
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+
+	manifest, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode manifest: %w", err)
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0o644, Size: int64(len(manifest)), ModTime: bundle.Created}); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	if err := addFileToTar(tw, saved.Name(), "images.tar"); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	// ~/.membrane/src may be a link to a working copy; see run-dev.sh.
+	src, err := filepath.EvalSymlinks(repoDir)
+	if err != nil {
+		return fmt.Errorf("resolve %s: %w", repoDir, err)
+	}
+	if err := addDirToTar(tw, src, "src"); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	fmt.Fprintf(os.Stderr, "membrane: exported %s and their source to %s\n", bundle.images(), path)
+	return nil
+}
+
+// images lists the bundle's images, as in "a, b and c".
+func (b *imageBundle) images() string {
+	list := []string{b.Agent, b.Handler, b.Tracee}
+	if b.Custom != "" {
+		list = append(list, b.Custom)
+	}
+	return strings.Join(list[:len(list)-1], ", ") + " and " + list[len(list)-1]
+}
+
+func addFileToTar(tw *tar.Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// addDirToTar adds the tree at dir to tw under prefix.
+func addDirToTar(tw *tar.Writer, dir, prefix string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		link := ""
+		if d.Type()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = prefix + "/" + filepath.ToSlash(rel)
+		if rel == "." {
+			hdr.Name = prefix
+		}
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// ImportImages loads the images in an images export at path, and its
+// source into ~/.membrane/src if there's none there yet.
+func ImportImages(path string) error {
+	if err := selectEngine(); err != nil {
+		return err
+	}
+	home, err := membraneHome()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", path, err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("%s is not an images export: %w", path, err)
+	}
+	tmpDir, err := os.MkdirTemp(home, "import-")
+	if err != nil {
+		return fmt.Errorf("create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if tmpDir, err = filepath.EvalSymlinks(tmpDir); err != nil {
+		return fmt.Errorf("resolve temp dir: %w", err)
+	}
+
+	var bundle *imageBundle
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read %s: %w", path, err)
+		}
+		if hdr.Name == "manifest.json" {
+			bundle = &imageBundle{}
+			if err := json.NewDecoder(tr).Decode(bundle); err != nil {
+				return fmt.Errorf("read %s manifest: %w", path, err)
+			}
+			continue
+		}
+		if err := extractTarEntry(tmpDir, hdr, tr); err != nil {
+			return fmt.Errorf("read %s: %w", path, err)
+		}
+	}
+	if bundle == nil {
+		return fmt.Errorf("%s is not an images export: no manifest", path)
+	}
+
+	fmt.Fprintf(os.Stderr, "Loading images...\n")
+	images, err := os.Open(filepath.Join(tmpDir, "images.tar"))
+	if err != nil {
+		return fmt.Errorf("read %s: %w", path, err)
+	}
+	err = containers.LoadImages(images)
+	images.Close()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "membrane: imported %s\n", bundle.images())
+
+	srcDir := filepath.Join(home, "src")
+	lock, err := acquireLock(lockSrc, true, "Waiting for another membrane to finish updating...")
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	if _, err := os.Stat(filepath.Join(srcDir, ".git")); err != nil {
+		if err := os.Rename(filepath.Join(tmpDir, "src"), srcDir); err != nil {
+			return fmt.Errorf("move source to %s: %w", srcDir, err)
+		}
+		fmt.Fprintf(os.Stderr, "membrane: imported their source to %s\n", srcDir)
+		return nil
+	}
+	// The images only match the source they were built from.
+	for _, img := range []struct{ tag, context string }{
+		{bundle.Agent, "docker/agent"},
+		{bundle.Handler, "docker/handler"},
+	} {
+		hash, err := contextHash(filepath.Join(srcDir, img.context))
+		if _, tag := splitImageRef(img.tag); err != nil || hash != tag {
+			fmt.Fprintf(os.Stderr, "Warning: %s has other source than these images were built from, so sessions won't use them; "+
+				"move it aside and import again to use the imported source\n", srcDir)
+			break
+		}
+	}
+	return nil
+}
+
+// extractTarEntry extracts hdr under root. Entries can't reach outside
+// root, through .. or a symlink extracted earlier.
+func extractTarEntry(root string, hdr *tar.Header, r io.Reader) error {
+	name := filepath.Clean(filepath.FromSlash(hdr.Name))
+	if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("unsafe path %q", hdr.Name)
+	}
+	target := filepath.Join(root, name)
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	if parent != root && !strings.HasPrefix(parent, root+string(filepath.Separator)) {
+		return fmt.Errorf("unsafe path %q", hdr.Name)
+	}
+
+	mode := os.FileMode(hdr.Mode).Perm()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(target, mode|0o700)
+	case tar.TypeSymlink:
+		return os.Symlink(hdr.Linkname, target)
+	case tar.TypeReg:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+// Code generated by scripts/gen-qtypes.sh from qtypeCodes in
+// docker/handler/dns-proxy/main.go. DO NOT EDIT.
+
+package membrane
+
+// dnsQTypeNames lists the query types the dns-proxy understands.
+var dnsQTypeNames = []string{
+	"A",
+	"NS",
+	"CNAME",
+	"SOA",
+	"NULL",
+	"PTR",
+	"MX",
+	"TXT",
+	"AAAA",
+	"SRV",
+	"NAPTR",
+	"DS",
+	"DNSKEY",
+	"SVCB",
+	"HTTPS",
+	"ANY",
+	"CAA",
+}
@@ -0,0 +1,436 @@
+package membrane
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// Session registry. Each session has a record at
+// ~/.membrane/sessions/<id>.json, written by the process that owns the
+// session (the supervisor, or the foreground process for non-interactive
+// runs) as the session starts and ends. Records are kept after the
+// session ends so `membrane ls -a` and `inspect` can show how it went.
+
+// Session statuses.
+const (
+	statusStarting = "starting"
+	statusRunning  = "running"
+	statusExited   = "exited"
+	statusFailed   = "failed"
+	statusLost     = "lost" // recorded as live, but its owner and agent are gone
+)
+
+type sessionRecord struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name,omitempty"`
+	Workspace string     `json:"workspace"`
+	Command   []string   `json:"command,omitempty"` // empty for the image's default
+	Engine    string     `json:"engine,omitempty"`  // docker or podman
+	Profile   string     `json:"profile,omitempty"` // Docker context, e.g. colima-membrane on macOS
+	Detached  bool       `json:"detached"`
+	Started   time.Time  `json:"started"`
+	Ended     *time.Time `json:"ended,omitempty"`
+
+	// When the agent started and exited, for the summary's phases.
+	AgentStarted *time.Time `json:"agent_started,omitempty"`
+	AgentEnded   *time.Time `json:"agent_ended,omitempty"`
+
+	Containers sessionContainers `json:"containers"`
+	Networks   []string          `json:"networks"`
+	Volumes    []string          `json:"volumes"`
+	Overlay    string            `json:"overlay,omitempty"` // --cow upper layer, until reviewed
+
+	// The --worktree the agent worked in, kept if it left work behind.
+	Worktree       string `json:"worktree,omitempty"`
+	WorktreeBranch string `json:"worktree_branch,omitempty"`
+	WorktreeBase   string `json:"worktree_base,omitempty"`
+
+	// The mediate_git private git directory, until its commits are
+	// imported or discarded, and what they're checked against.
+	GitDir        string       `json:"git_dir,omitempty"`
+	GitObjects    string       `json:"git_objects,omitempty"`
+	GitBase       string       `json:"git_base,omitempty"`
+	GitProtected  []string     `json:"git_protected,omitempty"`
+	TraceLog      string       `json:"trace_log,omitempty"`
+	HandlerLog    string       `json:"handler_log"`
+	SupervisorLog string       `json:"supervisor_log,omitempty"`
+	OwnerPID      int          `json:"owner_pid"`
+	Summary       string       `json:"summary,omitempty"` // --summary-json path
+	Spec          *sessionSpec `json:"spec,omitempty"`    // how the session was started, for membrane resume
+	ResumedFrom   string       `json:"resumed_from,omitempty"`
+
+	Status   string `json:"status"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Reason   string `json:"reason,omitempty"` // a resource limit or timeout that stopped the agent
+	Error    string `json:"error,omitempty"`
+
+	OOMKilled []string `json:"oom_killed,omitempty"` // agent, handler
+	Timeout   string   `json:"timeout,omitempty"`    // timeout or idle-timeout
+}
+
+type sessionContainers struct {
+	Agent   string `json:"agent"`
+	Handler string `json:"handler"`
+	Tracer  string `json:"tracer,omitempty"`
+}
+
+var sessionNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+func sessionsDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("get home dir: %w", err)
+	}
+	return filepath.Join(home, ".membrane", "sessions"), nil
+}
+
+// registerSession writes the starting record for session s. The name, if
+// any, must not be in use by another live session.
+func registerSession(s sessionNames, opts runOptions, workspaceDir string) (*sessionRecord, error) {
+	if opts.name != "" {
+		if !sessionNamePattern.MatchString(opts.name) {
+			return nil, fmt.Errorf("invalid session name %q: use letters, digits, '.', '_' and '-'", opts.name)
+		}
+		records, err := loadSessionRecords()
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			r.refresh()
+			if r.Name == opts.name && r.live() {
+				return nil, fmt.Errorf("session name %q is already used by session %s", opts.name, r.ID)
+			}
+		}
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("get home dir: %w", err)
+	}
+	logDir := filepath.Join(home, ".membrane", "logs")
+	rec := &sessionRecord{
+		ID:        s.id,
+		Name:      opts.name,
+		Workspace: workspaceDir,
+		Command:   opts.passthrough,
+		Engine:    containerCLI,
+		Profile:   os.Getenv("DOCKER_CONTEXT"),
+		Detached:  opts.detach,
+		Started:   time.Now().UTC(),
+		Containers: sessionContainers{
+			Agent:   s.agentContainer,
+			Handler: s.handlerContainer,
+		},
+		Networks:   []string{s.internalNetwork, s.externalNetwork},
+		Volumes:    []string{s.caVolume},
+		HandlerLog: filepath.Join(logDir, s.handlerContainer+".log"),
+		OwnerPID:   os.Getpid(),
+		Summary:    opts.summaryJSON,
+		Status:     statusStarting,
+	}
+	spec := specOf(opts, workspaceDir)
+	rec.Spec = &spec
+	if opts.resume != "" {
+		rec.ResumedFrom = opts.resume
+	}
+	if opts.cow {
+		rec.Volumes = append(rec.Volumes, s.workspaceVolume)
+		if rec.Overlay, err = overlayDir(s.id); err != nil {
+			return nil, err
+		}
+	}
+	if opts.trace {
+		rec.Containers.Tracer = NewTracer(s.agentContainer, "").containerName
+		rec.TraceLog, err = traceLogPath(opts, s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.supervised {
+		rec.SupervisorLog = filepath.Join(logDir, "membrane-supervisor-"+s.id+".log")
+	}
+	return rec, rec.save()
+}
+
+// save writes r atomically. A nil record is a no-op, so callers needn't
+// check whether registration succeeded.
+func (r *sessionRecord) save() error {
+	if r == nil {
+		return nil
+	}
+	dir, err := sessionsDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("create sessions dir: %w", err)
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode session record: %w", err)
+	}
+	f, err := os.CreateTemp(dir, r.ID+"-*.tmp")
+	if err != nil {
+		return fmt.Errorf("write session record: %w", err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("write session record: %w", err)
+	}
+	f.Close()
+	if err := os.Rename(f.Name(), filepath.Join(dir, r.ID+".json")); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("write session record: %w", err)
+	}
+	return nil
+}
+
+// running marks the session's agent as started.
+func (r *sessionRecord) running() {
+	if r == nil {
+		return
+	}
+	now := time.Now().UTC()
+	r.Status = statusRunning
+	r.AgentStarted = &now
+	_ = r.save()
+}
+
+// agentExited notes when the agent exited, before the session is torn
+// down.
+func (r *sessionRecord) agentExited() {
+	if r == nil || r.AgentEnded != nil {
+		return
+	}
+	now := time.Now().UTC()
+	r.AgentEnded = &now
+}
+
+// finish records how the session ended: the agent's exit code, or the
+// error that stopped the session from starting.
+func (r *sessionRecord) finish(code int, err error) {
+	if r == nil {
+		return
+	}
+	ended := time.Now().UTC()
+	r.Ended = &ended
+	var exitErr *ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		r.Status = statusExited
+		r.ExitCode = &exitErr.Code
+		r.Reason = exitErr.Reason
+		r.OOMKilled = exitErr.OOMKilled
+		r.Timeout = exitErr.Timeout
+	case err != nil:
+		r.Status = statusFailed
+		r.Error = err.Error()
+	default:
+		r.Status = statusExited
+		r.ExitCode = &code
+	}
+	// The handler log is compressed during cleanup.
+	if _, err := os.Stat(r.HandlerLog + ".gz"); err == nil {
+		r.HandlerLog += ".gz"
+	}
+	_ = r.save()
+	if r.Summary != "" {
+		codes := DefaultExitCodes
+		if r.Spec != nil {
+			codes = r.Spec.ExitCodes.orDefault()
+		}
+		if err := writeSummary(r.Summary, codes, r); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}
+}
+
+// live reports whether the session may still be running.
+func (r *sessionRecord) live() bool {
+	return r.Status == statusStarting || r.Status == statusRunning
+}
+
+// refresh marks a live record lost if neither its owner nor its agent
+// container exists any more, e.g. after a reboot.
+func (r *sessionRecord) refresh() {
+	if !r.live() {
+		return
+	}
+	if agentRunning(sessionNamesFor(r.ID)) {
+		return
+	}
+	if r.OwnerPID > 0 && processAlive(r.OwnerPID) {
+		return // still cleaning up
+	}
+	r.Status = statusLost
+}
+
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
+
+func loadSessionRecord(id string) (*sessionRecord, error) {
+	dir, err := sessionsDir()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var r sessionRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("parse session record %s: %w", id, err)
+	}
+	return &r, nil
+}
+
+// loadSessionRecords returns every record, newest first.
+func loadSessionRecords() ([]*sessionRecord, error) {
+	dir, err := sessionsDir()
+	if err != nil {
+		return nil, err
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("list sessions: %w", err)
+	}
+	var records []*sessionRecord
+	for _, m := range matches {
+		r, err := loadSessionRecord(strings.TrimSuffix(filepath.Base(m), ".json"))
+		if err != nil {
+			continue
+		}
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Started.After(records[j].Started)
+	})
+	return records, nil
+}
+
+// resolveSession maps a session ID or name to an ID. Names match the most
+// recent live session with that name. A reference that matches nothing is
+// returned unchanged, so sessions started without a record still work.
+func resolveSession(ref string) string {
+	if r, err := loadSessionRecord(ref); err == nil {
+		return r.ID
+	}
+	records, err := loadSessionRecords()
+	if err != nil {
+		return ref
+	}
+	var fallback string
+	for _, r := range records {
+		if r.Name != ref {
+			continue
+		}
+		if r.live() {
+			return r.ID
+		}
+		if fallback == "" {
+			fallback = r.ID
+		}
+	}
+	if fallback != "" {
+		return fallback
+	}
+	return ref
+}
+
+// ListSessions prints a table of live sessions, or of every recorded
+// session with all.
+func ListSessions(all bool) error {
+	if err := selectEngine(); err != nil {
+		return err
+	}
+	records, err := loadSessionRecords()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tSTATUS\tSTARTED\tWORKSPACE\tCOMMAND")
+	for _, r := range records {
+		r.refresh()
+		if !all && !r.live() {
+			continue
+		}
+		status := r.Status
+		if r.ExitCode != nil {
+			status = fmt.Sprintf("%s (%d)", status, *r.ExitCode)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.ID, r.Name, status,
+			r.Started.Local().Format("2006-01-02 15:04"), r.Workspace, strings.Join(r.Command, " "))
+	}
+	return tw.Flush()
+}
+
+// InspectSession prints a session's record as JSON.
+func InspectSession(ref string) error {
+	if err := selectEngine(); err != nil {
+		return err
+	}
+	r, err := loadSessionRecord(resolveSession(ref))
+	if err != nil {
+		return fmt.Errorf("session %s not found", ref)
+	}
+	r.refresh()
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode session record: %w", err)
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// StopSession stops a session's agent and waits for its owner to clean
+// up the rest of the session.
+func StopSession(ref string) error {
+	if err := selectEngine(); err != nil {
+		return err
+	}
+	id := resolveSession(ref)
+	s := sessionNamesFor(id)
+	if !agentRunning(s) {
+		return fmt.Errorf("session %s not found or not running", ref)
+	}
+	if err := containers.StopContainer(s.agentContainer, 2*time.Second); err != nil {
+		return fmt.Errorf("stop agent: %w", err)
+	}
+
+	// Wait for the owner to record the end of the session, or for the
+	// handler to go for sessions without a record.
+	_, err := loadSessionRecord(id)
+	recorded := err == nil
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		var done bool
+		if recorded {
+			r, err := loadSessionRecord(id)
+			done = err != nil || !r.live()
+		} else {
+			_, err := containers.InspectContainer(s.handlerContainer)
+			done = isNotFound(err)
+		}
+		if done {
+			fmt.Fprintf(os.Stderr, "membrane: stopped session %s\n", id)
+			return nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return fmt.Errorf("session %s: agent stopped but the session was not cleaned up within 30 seconds", id)
+}
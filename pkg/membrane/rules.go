@@ -0,0 +1,103 @@
+package membrane
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// activeAllowFile is the handler's live copy of the session's allow rules.
+// dns-proxy replaces it on reload; see docker/handler/dns-proxy/reload.go.
+const activeAllowFile = "/run/membrane/allow.json"
+
+// AllowRules adds rules to a running session. Each entry is parsed like
+// --allow. The handler's firewall, dns-proxy and L7 rules are updated
+// together without restarting the handler or the agent.
+func AllowRules(sessionID string, entries []string) error {
+	add, err := parseAllowEntries(entries)
+	if err != nil {
+		return err
+	}
+	return changeSessionRules(sessionID, "allow", add)
+}
+
+// RevokeRules removes rules from a running session. An entry with only a
+// destination (no port, path, or http constraints) removes every rule for
+// that destination; otherwise only identical rules are removed.
+func RevokeRules(sessionID string, entries []string) error {
+	remove, err := parseAllowEntries(entries)
+	if err != nil {
+		return err
+	}
+	return changeSessionRules(sessionID, "revoke", remove)
+}
+
+func parseAllowEntries(entries []string) ([]AllowRule, error) {
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no rules given")
+	}
+	var rules []AllowRule
+	for _, entry := range entries {
+		r, err := ParseAllowEntry(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %w", entry, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// changeSessionRules asks the session's dns-proxy to allow or revoke
+// (verb) rules. dns-proxy edits its active rules itself, under the lock
+// its reloads take, so concurrent changes, approval decisions among them,
+// don't lose each other's rules.
+func changeSessionRules(sessionID, verb string, rules []AllowRule) error {
+	if err := selectEngine(); err != nil {
+		return err
+	}
+	s := sessionNamesFor(resolveSession(sessionID))
+	data, err := json.Marshal(rules)
+	if err != nil {
+		return fmt.Errorf("encode rules: %w", err)
+	}
+
+	var notes, errOut bytes.Buffer
+	code, err := containers.Exec(context.Background(), s.handlerContainer,
+		[]string{"dns-proxy", verb}, bytes.NewReader(data), &notes, &errOut)
+	if err != nil {
+		return fmt.Errorf("session %s not found or not running: %w", sessionID, err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(notes.String()), "\n") {
+		if line != "" {
+			fmt.Fprintf(os.Stderr, "membrane: %s\n", line)
+		}
+	}
+	if code != 0 {
+		if msg := strings.TrimPrefix(strings.TrimSpace(errOut.String()), "dns-proxy: "); msg != "" {
+			return fmt.Errorf("%s", msg)
+		}
+		return fmt.Errorf("%s rules: dns-proxy exited with code %d", verb, code)
+	}
+	return nil
+}
+
+// sessionRules reads the session's active rules from its handler.
+func sessionRules(s sessionNames) ([]AllowRule, error) {
+	var out bytes.Buffer
+	code, err := containers.Exec(context.Background(), s.handlerContainer,
+		[]string{"cat", activeAllowFile}, nil, &out, nil)
+	if err == nil && code != 0 {
+		err = fmt.Errorf("cat %s exited with code %d", activeAllowFile, code)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rules []AllowRule
+	if err := json.Unmarshal(out.Bytes(), &rules); err != nil {
+		return nil, fmt.Errorf("parse session rules: %w", err)
+	}
+	return rules, nil
+}
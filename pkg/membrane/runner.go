@@ -1,6 +1,8 @@
 package membrane
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
@@ -12,6 +14,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -19,9 +22,41 @@ import (
 	"golang.org/x/term"
 )
 
-// writeAllowFile serialises allow rules to a temp file and returns its path.
-// The caller is responsible for removing the file when done.
-func writeAllowFile(allow []AllowRule) (string, error) {
+// writeAllowFile serialises allow rules to a temp file for session id and
+// returns its path. The caller is responsible for removing the file when
+// done.
+func writeAllowFile(id string, allow []AllowRule) (string, error) {
+	if allow == nil {
+		allow = []AllowRule{}
+	}
+	return writeTempJSON(id+"-allow", allow)
+}
+
+// writeHostsFile serialises static host overrides to a temp file for
+// session id and returns its path. The caller is responsible for removing
+// the file.
+func writeHostsFile(id string, hosts hostsMap) (string, error) {
+	if hosts == nil {
+		hosts = hostsMap{}
+	}
+	return writeTempJSON(id+"-hosts", hosts)
+}
+
+// writeDNSFile serialises the dns-proxy's upstream resolvers and
+// split-horizon routes to a temp file for session id and returns its path.
+// The caller is responsible for removing the file.
+func writeDNSFile(id string, cfg *config) (string, error) {
+	routes := cfg.DNSRoutes
+	if routes == nil {
+		routes = []dnsRoute{}
+	}
+	return writeTempJSON(id+"-dns", dnsUpstreams{Default: cfg.dnsResolver(), Routes: routes})
+}
+
+// writeTempJSON encodes v to ~/.membrane/tmp/membrane-<kind>-*.json. Files
+// belonging to a session start their kind with the session ID so that
+// gc can tell whose they are.
+func writeTempJSON(kind string, v any) (string, error) {
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return "", fmt.Errorf("get home dir: %w", err)
@@ -30,28 +65,32 @@ func writeAllowFile(allow []AllowRule) (string, error) {
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return "", fmt.Errorf("create tmp dir: %w", err)
 	}
-	f, err := os.CreateTemp(dir, "membrane-allow-*.json")
+	f, err := os.CreateTemp(dir, "membrane-"+kind+"-*.json")
 	if err != nil {
-		return "", fmt.Errorf("create allow file: %w", err)
+		return "", fmt.Errorf("create %s file: %w", kind, err)
 	}
 	defer f.Close()
-	if allow == nil {
-		allow = []AllowRule{}
-	}
-	if err := json.NewEncoder(f).Encode(allow); err != nil {
+	if err := json.NewEncoder(f).Encode(v); err != nil {
 		os.Remove(f.Name())
-		return "", fmt.Errorf("write allow file: %w", err)
+		return "", fmt.Errorf("write %s file: %w", kind, err)
 	}
 	return f.Name(), nil
 }
 
 func hasSysbox() bool {
-	out, err := exec.Command("docker", "info", "--format",
-		"{{json .Runtimes}}").Output()
+	if _, ok := usingPodman(); ok {
+		return false
+	}
+	info, err := containers.Info()
 	if err != nil {
 		return false
 	}
-	return strings.Contains(string(out), `"sysbox-runc"`)
+	for _, r := range info.Runtimes {
+		if r == "sysbox-runc" {
+			return true
+		}
+	}
+	return false
 }
 
 type sessionNames struct {
@@ -61,12 +100,28 @@ type sessionNames struct {
 	internalNetwork  string
 	externalNetwork  string
 	caVolume         string
+	workspaceVolume  string // the --cow overlay
 }
 
 func newSessionNames() sessionNames {
 	var b [8]byte
 	_, _ = rand.Read(b[:])
-	id := hex.EncodeToString(b[:])
+	return sessionNamesFor(hex.EncodeToString(b[:]))
+}
+
+// label returns the Docker label that marks a resource as the session's.
+func (s sessionNames) label() string {
+	return sessionLabel + "=" + s.id
+}
+
+// labels are the labels of the session's resources: label, and the user
+// that owns them.
+func (s sessionNames) labels() map[string]string {
+	return map[string]string{sessionLabel: s.id, ownerLabel: resourceOwner()}
+}
+
+// sessionNamesFor derives the resource names of an existing session.
+func sessionNamesFor(id string) sessionNames {
 	return sessionNames{
 		id:               id,
 		agentContainer:   "membrane-agent-" + id,
@@ -74,6 +129,7 @@ func newSessionNames() sessionNames {
 		internalNetwork:  "membrane-internal-" + id,
 		externalNetwork:  "membrane-external-" + id,
 		caVolume:         "membrane-ca-" + id,
+		workspaceVolume:  "membrane-workspace-" + id,
 	}
 }
 
@@ -94,6 +150,13 @@ func brNetfilterLoaded() bool {
 	return false
 }
 
+// needsDockerUserRule reports whether sessions need the DOCKER-USER rule
+// below. Podman's netavark doesn't use Docker's chains.
+func needsDockerUserRule() bool {
+	_, podman := usingPodman()
+	return !podman && brNetfilterLoaded()
+}
+
 // injectDockerUserRule inserts an iptables rule into DOCKER-USER that allows
 // forwarded traffic from the membrane internal bridge. This is necessary when
 // br_netfilter is loaded on the host (Docker versions prior to 27.3.1 loaded
@@ -102,8 +165,10 @@ func brNetfilterLoaded() bool {
 // membrane's transparent proxy. DOCKER-USER is evaluated before
 // DOCKER-ISOLATION-STAGE-1, so an ACCEPT here prevents the DROP from firing.
 //
-// Returns ("", nil) if sudo is not available — non-fatal.
-func injectDockerUserRule(internalNetworkID string) (string, error) {
+// The rule is commented with the session ID so gc can find it if the
+// session's cleanup never runs. Returns ("", nil) if sudo is not
+// available — non-fatal.
+func injectDockerUserRule(internalNetworkID, sessionID string) (string, error) {
 	if len(internalNetworkID) < 12 {
 		return "", fmt.Errorf("unexpected network ID %q", internalNetworkID)
 	}
@@ -111,111 +176,147 @@ func injectDockerUserRule(internalNetworkID string) (string, error) {
 	if _, err := exec.LookPath("sudo"); err != nil {
 		return "", nil
 	}
-	if err := exec.Command("sudo", "iptables", "--wait", "-I", "DOCKER-USER",
-		"-i", bridge, "-j", "ACCEPT").Run(); err != nil {
+	args := append([]string{"iptables", "--wait", "-I", "DOCKER-USER"},
+		dockerUserRule(bridge, sessionID)...)
+	if err := exec.Command("sudo", args...).Run(); err != nil {
 		return "", fmt.Errorf("inject DOCKER-USER rule: %w", err)
 	}
 	return bridge, nil
 }
 
-func removeDockerUserRule(bridge string) {
+func removeDockerUserRule(bridge, sessionID string) {
 	if bridge == "" {
 		return
 	}
 	// Ignore errors — rule may already be gone if Docker restarted
-	_ = exec.Command("sudo", "iptables", "--wait", "-D", "DOCKER-USER",
-		"-i", bridge, "-j", "ACCEPT").Run()
+	args := append([]string{"iptables", "--wait", "-D", "DOCKER-USER"},
+		dockerUserRule(bridge, sessionID)...)
+	_ = exec.Command("sudo", args...).Run()
+}
+
+// dockerUserRule is the DOCKER-USER rule for a session's internal bridge.
+func dockerUserRule(bridge, sessionID string) []string {
+	return []string{"-i", bridge, "-m", "comment", "--comment", sessionLabel + "=" + sessionID, "-j", "ACCEPT"}
 }
 
 // startSession creates per-session networks, starts the handler container,
 // waits for it to signal ready, and returns a cleanup func and the handler's
-// IP on the internal network.
-func startSession(s sessionNames, cfg *config) (func(), string, error) {
+// IP on the internal network. With --cow it also creates the overlay
+// volume over workspaceDir.
+func startSession(s sessionNames, cfg *config, workspaceDir string) (func(), string, error) {
 	cleanup := func() {
-		_ = exec.Command("docker", "stop", "-t", "2", s.handlerContainer).Run()
-		_ = exec.Command("docker", "rm", s.handlerContainer).Run()
-		_ = exec.Command("docker", "network", "rm", s.internalNetwork).Run()
-		_ = exec.Command("docker", "network", "rm", s.externalNetwork).Run()
-		_ = exec.Command("docker", "volume", "rm", s.caVolume).Run()
-	}
-
-	if out, err := exec.Command("docker", "volume", "create",
-		s.caVolume).CombinedOutput(); err != nil {
-		return cleanup, "", fmt.Errorf("create ca volume %s: %s: %w",
-			s.caVolume, out, err)
+		_ = containers.StopContainer(s.handlerContainer, 2*time.Second)
+		_ = containers.RemoveContainer(s.handlerContainer)
+		_ = containers.RemoveNetwork(s.internalNetwork)
+		_ = containers.RemoveNetwork(s.externalNetwork)
+		_ = containers.RemoveVolume(s.caVolume)
+		_ = containers.RemoveVolume(s.workspaceVolume)
+		removeSessionTmp(s.id)
+	}
+
+	// Everything the session creates is labelled with its ID; see gc.go.
+	labels := s.labels()
+	if err := containers.CreateVolume(s.caVolume, labels, nil); err != nil {
+		return cleanup, "", fmt.Errorf("create ca volume %s: %w", s.caVolume, err)
+	}
+	if cfg.cow {
+		if err := createOverlay(s, workspaceDir); err != nil {
+			return cleanup, "", err
+		}
 	}
 
-	if out, err := exec.Command("docker", "network", "create",
-		s.externalNetwork).CombinedOutput(); err != nil {
-		return cleanup, "", fmt.Errorf("create network %s: %s: %w",
-			s.externalNetwork, out, err)
+	if _, err := containers.CreateNetwork(s.externalNetwork, false, labels); err != nil {
+		return cleanup, "", fmt.Errorf("create network %s: %w", s.externalNetwork, err)
 	}
 
-	out, err := exec.Command("docker", "network", "create",
-		"--internal", s.internalNetwork).CombinedOutput()
+	networkID, err := containers.CreateNetwork(s.internalNetwork, true, labels)
 	if err != nil {
-		return cleanup, "", fmt.Errorf("create network %s: %s: %w",
-			s.internalNetwork, out, err)
+		return cleanup, "", fmt.Errorf("create network %s: %w", s.internalNetwork, err)
 	}
-	networkID := strings.TrimSpace(string(out))
 
 	var bridge string
-	if brNetfilterLoaded() {
+	if needsDockerUserRule() {
 		fmt.Fprintf(os.Stderr, "membrane: br_netfilter detected; requesting sudo to add iptables rule for transparent proxy\n")
-		bridge, err = injectDockerUserRule(networkID)
+		bridge, err = injectDockerUserRule(networkID, s.id)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Warning: could not inject DOCKER-USER rule: %v\n", err)
 		}
 	}
 	origCleanup := cleanup
 	cleanup = func() {
-		removeDockerUserRule(bridge)
+		removeDockerUserRule(bridge, s.id)
 		origCleanup()
 	}
 
-	allowFile, err := writeAllowFile(cfg.Allow)
+	allowFile, err := writeAllowFile(s.id, cfg.Allow)
 	if err != nil {
 		return cleanup, "", fmt.Errorf("write allow file: %w", err)
 	}
+	hostsFile, err := writeHostsFile(s.id, cfg.Hosts)
+	if err != nil {
+		os.Remove(allowFile)
+		return cleanup, "", fmt.Errorf("write hosts file: %w", err)
+	}
+	dnsFile, err := writeDNSFile(s.id, cfg)
+	if err != nil {
+		os.Remove(allowFile)
+		os.Remove(hostsFile)
+		return cleanup, "", fmt.Errorf("write dns file: %w", err)
+	}
 	prevCleanup := cleanup
 	cleanup = func() {
 		prevCleanup()
 		os.Remove(allowFile)
+		os.Remove(hostsFile)
+		os.Remove(dnsFile)
 	}
 
-	handlerArgs := []string{
-		"run", "-d",
-		"--name", s.handlerContainer,
-		"--network", s.externalNetwork,
-		"--cap-add=NET_ADMIN",
-		"--sysctl", "net.ipv4.ip_forward=1",
-		"-v", s.caVolume + ":/membrane-ca",
-		"-v", allowFile + ":/etc/membrane/allow.json:ro",
-		"-e", "MEMBRANE_DNS_RESOLVER=" + cfg.dnsResolver(),
-		"-e", fmt.Sprintf("MEMBRANE_SSL_INSECURE=%v", cfg.SSLInsecure),
-		handlerImageName,
+	handler := containerSpec{
+		Name:      s.handlerContainer,
+		Image:     cfg.handlerImage,
+		Labels:    labels,
+		Network:   s.externalNetwork,
+		CapAdd:    []string{"NET_ADMIN"},
+		Sysctls:   map[string]string{"net.ipv4.ip_forward": "1"},
+		Resources: cfg.Limits.res,
+		Binds: []string{
+			s.caVolume + ":/membrane-ca",
+			allowFile + ":/etc/membrane/allow.json:ro",
+			hostsFile + ":/etc/membrane/hosts.json:ro",
+			dnsFile + ":/etc/membrane/dns.json:ro",
+		},
+		Env: []string{
+			"MEMBRANE_DNS_QTYPES=" + strings.Join(cfg.dnsQTypes(), ","),
+			fmt.Sprintf("MEMBRANE_SSL_INSECURE=%v", cfg.SSLInsecure),
+		},
+	}
+	if cfg.Approve {
+		handler.Env = append(handler.Env, "MEMBRANE_APPROVE_TIMEOUT="+approvalTimeout.String())
+	}
+	if cfg.learn {
+		handler.Env = append(handler.Env, "MEMBRANE_LEARN_FILE="+learnFile)
 	}
 
-	if out, err := exec.Command("docker", handlerArgs...).CombinedOutput(); err != nil {
-		return cleanup, "", fmt.Errorf("start handler: %s: %w", out, err)
+	if _, err := containers.RunContainer(handler); err != nil {
+		return cleanup, "", fmt.Errorf("start handler: %w", err)
 	}
 
-	if out, err := exec.Command("docker", "network", "connect",
-		s.internalNetwork, s.handlerContainer).CombinedOutput(); err != nil {
-		return cleanup, "", fmt.Errorf("connect handler to internal network: %s: %w", out, err)
+	if err := containers.ConnectNetwork(s.internalNetwork, s.handlerContainer); err != nil {
+		return cleanup, "", fmt.Errorf("connect handler to internal network: %w", err)
 	}
 
 	// Wait for handler ready signal (timeout 30s).
 	for i := 0; i < 30; i++ {
-		if exec.Command("docker", "exec", s.handlerContainer,
-			"test", "-f", "/tmp/handler-ready").Run() == nil {
+		code, err := containers.Exec(context.Background(), s.handlerContainer,
+			[]string{"test", "-f", "/tmp/handler-ready"}, nil, nil, nil)
+		if err == nil && code == 0 {
 			break
 		}
 		if i == 29 {
-			logs, _ := exec.Command("docker", "logs",
-				s.handlerContainer).CombinedOutput()
+			var logs bytes.Buffer
+			_ = containers.Logs(context.Background(), s.handlerContainer, false, &logs)
 			return cleanup, "", fmt.Errorf(
-				"handler did not become ready within 30s\nHandler logs:\n%s", logs)
+				"handler did not become ready within 30s\nHandler logs:\n%s", logs.String())
 		}
 		time.Sleep(time.Second)
 	}
@@ -238,20 +339,17 @@ func startSession(s sessionNames, cfg *config) (func(), string, error) {
 		return cleanup, "", fmt.Errorf("create handler log file: %w", err)
 	}
 
-	logCmd := exec.Command("docker", "logs", "-f", s.handlerContainer)
-	logCmd.Stdout = logFile
-	logCmd.Stderr = logFile
-	if err := logCmd.Start(); err != nil {
-		logFile.Close()
-		return cleanup, "", fmt.Errorf("start handler log capture: %w", err)
-	}
+	logCtx, stopLogs := context.WithCancel(context.Background())
+	logDone := make(chan struct{})
+	go func() {
+		defer close(logDone)
+		_ = containers.Logs(logCtx, s.handlerContainer, true, logFile)
+	}()
 
 	prevCleanup2 := cleanup
 	cleanup = func() {
-		if logCmd.Process != nil {
-			_ = logCmd.Process.Kill()
-		}
-		_ = logCmd.Wait()
+		stopLogs()
+		<-logDone
 		logFile.Close()
 		if err := gzipFile(logPath + ".gz"); err == nil {
 			os.Remove(logPath)
@@ -259,14 +357,11 @@ func startSession(s sessionNames, cfg *config) (func(), string, error) {
 		prevCleanup2()
 	}
 
-	out, err = exec.Command("docker", "inspect", "-f",
-		fmt.Sprintf("{{(index .NetworkSettings.Networks %q).IPAddress}}",
-			s.internalNetwork),
-		s.handlerContainer).Output()
+	handlerState, err := containers.InspectContainer(s.handlerContainer)
 	if err != nil {
 		return cleanup, "", fmt.Errorf("inspect handler IP: %w", err)
 	}
-	gatewayIP := strings.TrimSpace(string(out))
+	gatewayIP := handlerState.IPs[s.internalNetwork]
 	if gatewayIP == "" {
 		return cleanup, "", fmt.Errorf("handler has no IP on %s", s.internalNetwork)
 	}
@@ -274,24 +369,38 @@ func startSession(s sessionNames, cfg *config) (func(), string, error) {
 	return cleanup, gatewayIP, nil
 }
 
-// buildAgentArgs constructs the full argument list for docker run of the agent.
-// passthrough args are appended after the image name as the container command.
-func buildAgentArgs(workspaceDir string, m *mounts, cfg *config, passthrough []string, s sessionNames, gatewayIP string) ([]string, error) {
+// buildAgentArgs constructs the options, image, and command for the agent
+// container. Callers prepend the docker verb (run or create) and its
+// lifecycle flags. passthrough args are appended after the image name as
+// the container command.
+func buildAgentArgs(workspaceDir string, m *mounts, cfg *config, passthrough []string, s sessionNames, gatewayIP string, home *agentHome) ([]string, error) {
 	sysbox := hasSysbox()
 
-	args := []string{"run", "-it", "--rm", "--init", "--name", s.agentContainer}
+	args := []string{"--init", "--name", s.agentContainer, "--label", s.label()}
 
 	if sysbox {
 		args = append(args, "--runtime=sysbox-runc", "-e", "MEMBRANE_DIND=1")
 	}
 
+	args = append(args, podmanAgentArgs()...)
+	args = append(args, cfg.Limits.res.agentArgs()...)
 	args = append(args,
 		"--cap-add=NET_ADMIN",
 		"--cap-add=CAP_SETPCAP",
 		"--network", s.internalNetwork,
 		"-e", "MEMBRANE_GATEWAY="+gatewayIP,
-		"-v", workspaceDir+":/workspace",
 	)
+	if cfg.cow {
+		args = append(args, "-v", s.workspaceVolume+":/workspace")
+	} else {
+		args = append(args, "-v", cfg.agentWorkspace(workspaceDir)+":/workspace")
+	}
+	if cfg.worktree != nil {
+		args = append(args, cfg.worktree.mountArgs()...)
+	}
+	if cfg.git != nil {
+		args = append(args, cfg.git.args()...)
+	}
 
 	// Add overlay mounts. Readonly first, then shadows (shadows must come
 	// after to override).
@@ -306,15 +415,7 @@ func buildAgentArgs(workspaceDir string, m *mounts, cfg *config, passthrough []s
 		}
 	}
 
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return nil, fmt.Errorf("get home dir: %w", err)
-	}
-	agentHome := filepath.Join(home, ".membrane", "home")
-	if err := os.MkdirAll(agentHome, 0755); err != nil {
-		return nil, fmt.Errorf("create agent home dir: %w", err)
-	}
-	args = append(args, "-v", agentHome+":/home/agent")
+	args = append(args, "-v", home.dir+":/home/agent")
 	args = append(args, "-v", s.caVolume+":/membrane-ca:ro")
 	args = append(args,
 		// CA trust for runtimes that don't use the system store by default
@@ -333,7 +434,7 @@ func buildAgentArgs(workspaceDir string, m *mounts, cfg *config, passthrough []s
 	}
 
 	// Image name.
-	args = append(args, agentImageName)
+	args = append(args, cfg.image)
 
 	// Passthrough args (non-flag arguments to membrane binary).
 	args = append(args, passthrough...)
@@ -341,13 +442,68 @@ func buildAgentArgs(workspaceDir string, m *mounts, cfg *config, passthrough []s
 	return args, nil
 }
 
-// ExitError carries the exit code from the docker run child process.
+// The exit codes membrane keeps for itself by default, as timeout(1) and
+// docker run do; any other code is the agent's.
+const (
+	ExitTimeout = 124 // membrane stopped the agent for --timeout or --idle-timeout
+	ExitFailed  = 125 // membrane failed to set up, run or tear down the session
+)
+
+// ExitCodes are the codes membrane exits with for its own outcomes. No
+// code is outside what an agent could exit with, so they are options
+// (--timeout-exit-code and --failure-exit-code) for an agent that uses
+// the defaults itself, and membrane warns when the agent's own code is
+// one of them.
+type ExitCodes struct {
+	Timeout int `json:"timeout"`
+	Failed  int `json:"failed"`
+}
+
+// DefaultExitCodes are ExitTimeout and ExitFailed.
+var DefaultExitCodes = ExitCodes{Timeout: ExitTimeout, Failed: ExitFailed}
+
+// Validate checks that c are two different codes a process can exit with.
+func (c ExitCodes) Validate() error {
+	for _, code := range []int{c.Timeout, c.Failed} {
+		if code < 1 || code > 255 {
+			return fmt.Errorf("exit code %d: must be from 1 to 255", code)
+		}
+	}
+	if c.Timeout == c.Failed {
+		return fmt.Errorf("--timeout-exit-code and --failure-exit-code must differ")
+	}
+	return nil
+}
+
+// Reserved reports whether code is one of c, which an agent's own exit
+// code would be mistaken for.
+func (c ExitCodes) Reserved(code int) bool {
+	return code == c.Timeout || code == c.Failed
+}
+
+// orDefault returns c, or DefaultExitCodes if it's unset, as in the specs
+// of sessions started before ExitCodes.
+func (c ExitCodes) orDefault() ExitCodes {
+	if c == (ExitCodes{}) {
+		return DefaultExitCodes
+	}
+	return c
+}
+
+// ExitError carries the exit code from the docker run child process, and
+// why the agent was stopped if a resource limit or a timeout did it.
 type ExitError struct {
-	Code int
+	Code      int
+	Reason    string
+	OOMKilled []string // containers that ran out of memory: agent, handler
+	Timeout   string   // timeout or idle-timeout, if membrane stopped the agent
 }
 
 func (e *ExitError) Error() string {
-	return fmt.Sprintf("docker exited with code %d", e.Code)
+	if e.Reason != "" {
+		return e.Reason
+	}
+	return fmt.Sprintf("%s exited with code %d", containerCLI, e.Code)
 }
 
 // execDocker runs docker as a child process, proxies the terminal,
@@ -356,10 +512,12 @@ func (e *ExitError) Error() string {
 // When stdin is a terminal the child gets a PTY (interactive mode).
 // Otherwise stdin/stdout/stderr are wired directly so that output can
 // be captured by scripts and tools like GNU parallel.
-func execDocker(args []string) error {
-	dockerPath, err := exec.LookPath("docker")
+//
+// proxy configures the interactive terminal proxy; see ptyProxy.
+func execDocker(args []string, proxy ptyProxy) error {
+	dockerPath, err := exec.LookPath(containerCLI)
 	if err != nil {
-		return fmt.Errorf("docker not found in PATH: %w", err)
+		return fmt.Errorf("%s not found in PATH: %w", containerCLI, err)
 	}
 
 	interactive := term.IsTerminal(int(os.Stdin.Fd()))
@@ -443,12 +601,38 @@ func execDocker(args []string) error {
 		}
 	}()
 
-	// Proxy I/O between the host terminal and the PTY.
-	go func() { _, _ = io.Copy(ptmx, os.Stdin) }()
-	_, _ = io.Copy(os.Stdout, ptmx)
+	// With detach keys, the detach sequence ends the docker client and
+	// leaves the container running.
+	var input io.Reader = os.Stdin
+	var detached atomic.Bool
+	if proxy.detach {
+		input = &detachReader{r: os.Stdin, onDetach: func() {
+			detached.Store(true)
+			_ = cmd.Process.Kill()
+		}}
+	}
+	if proxy.redraw {
+		go nudgeSize(ptmx)
+	}
+
+	// Proxy I/O between the host terminal and the PTY. With a prompt
+	// gate, approval prompts can take over the terminal in between.
+	if gate := proxy.gate; gate != nil {
+		gate.attach(ptmx)
+		defer gate.detach()
+		go gate.copyInput(ptmx, input)
+		_, _ = io.Copy(gate.output(os.Stdout), ptmx)
+	} else {
+		go func() { _, _ = io.Copy(ptmx, input) }()
+		_, _ = io.Copy(os.Stdout, ptmx)
+	}
 
 	// Wait for the child to exit.
-	if err := cmd.Wait(); err != nil {
+	err = cmd.Wait()
+	if detached.Load() {
+		return errDetached
+	}
+	if err != nil {
 		var exitErr *exec.ExitError
 		if errors.As(err, &exitErr) {
 			return &ExitError{Code: exitErr.ExitCode()}
@@ -457,3 +641,75 @@ func execDocker(args []string) error {
 	}
 	return nil
 }
+
+// ptyProxy configures execDocker's interactive terminal proxy.
+type ptyProxy struct {
+	gate   *promptGate // lets approval prompts share the terminal; may be nil
+	detach bool        // Ctrl-P Ctrl-Q detaches instead of reaching the agent
+	redraw bool        // nudge the PTY size so a running agent redraws
+}
+
+// errDetached is returned by execDocker when the user detaches.
+var errDetached = errors.New("detached")
+
+const (
+	ctrlP = 0x10
+	ctrlQ = 0x11
+)
+
+// detachReader passes input through until the detach sequence, Ctrl-P
+// Ctrl-Q, and then calls onDetach and reports EOF. A Ctrl-P is held back
+// until the next key shows whether it starts the sequence.
+type detachReader struct {
+	r        io.Reader
+	onDetach func()
+	held     bool   // a Ctrl-P is waiting for the next key
+	carry    []byte // translated input that didn't fit the last read
+	done     bool
+}
+
+func (d *detachReader) Read(p []byte) (int, error) {
+	for len(d.carry) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		buf := make([]byte, len(p))
+		n, err := d.r.Read(buf)
+		for _, b := range buf[:n] {
+			if d.held {
+				d.held = false
+				if b == ctrlQ {
+					d.done = true
+					d.onDetach()
+					break
+				}
+				d.carry = append(d.carry, ctrlP)
+			}
+			if b == ctrlP {
+				d.held = true
+				continue
+			}
+			d.carry = append(d.carry, b)
+		}
+		if err != nil && len(d.carry) == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, d.carry)
+	d.carry = d.carry[n:]
+	return n, nil
+}
+
+// nudgeSize shrinks the PTY by a row and restores it, so full-screen
+// programs redraw.
+func nudgeSize(ptmx *os.File) {
+	ws, err := pty.GetsizeFull(os.Stdin)
+	if err != nil || ws.Rows <= 1 {
+		return
+	}
+	shrunk := *ws
+	shrunk.Rows--
+	_ = pty.Setsize(ptmx, &shrunk)
+	time.Sleep(100 * time.Millisecond)
+	_ = pty.Setsize(ptmx, ws)
+}
@@ -0,0 +1,111 @@
+package membrane
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// useFakeEngine makes a fakeEngine the engine for the test, with HOME in
+// a temp dir so what sessions write under ~/.membrane stays there.
+func useFakeEngine(t *testing.T) *fakeEngine {
+	t.Helper()
+	f := newFakeEngine()
+	saved := containers
+	containers = f
+	t.Cleanup(func() { containers = saved })
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("MEMBRANE_ENGINE", "")
+	return f
+}
+
+func TestStartSession(t *testing.T) {
+	f := useFakeEngine(t)
+	var execs []string
+	f.ExecHook = func(container string, cmd []string, stdin io.Reader, stdout, stderr io.Writer) int {
+		execs = append(execs, container+": "+strings.Join(cmd, " "))
+		return 0
+	}
+	s := sessionNamesFor("0123456789abcdef")
+	cfg := &config{
+		handlerImage: "membrane-handler:test",
+		Allow:        []AllowRule{{Type: "host", Host: "github.com"}},
+	}
+
+	cleanup, gatewayIP, err := startSession(s, cfg, t.TempDir())
+	if err != nil {
+		cleanup()
+		t.Fatalf("startSession: %v", err)
+	}
+
+	handler, ok := f.containers[s.handlerContainer]
+	if !ok || !handler.Running {
+		t.Fatalf("handler %s isn't running", s.handlerContainer)
+	}
+	if handler.spec.Image != cfg.handlerImage {
+		t.Errorf("handler image = %q, want %q", handler.spec.Image, cfg.handlerImage)
+	}
+	if handler.Labels[sessionLabel] != s.id || handler.Labels[ownerLabel] != resourceOwner() {
+		t.Errorf("handler labels = %v, want the session's", handler.Labels)
+	}
+	if want := handler.IPs[s.internalNetwork]; gatewayIP == "" || gatewayIP != want {
+		t.Errorf("gateway = %q, want the handler's internal address %q", gatewayIP, want)
+	}
+	if n := f.networks[s.internalNetwork]; n == nil || !n.internal {
+		t.Errorf("internal network %s missing or not internal", s.internalNetwork)
+	}
+	if n := f.networks[s.externalNetwork]; n == nil || n.internal {
+		t.Errorf("external network %s missing or internal", s.externalNetwork)
+	}
+	if _, ok := f.volumes[s.caVolume]; !ok {
+		t.Errorf("CA volume %s missing", s.caVolume)
+	}
+	if want := s.handlerContainer + ": test -f /tmp/handler-ready"; !slices.Contains(execs, want) {
+		t.Errorf("execs = %q, want the ready check %q", execs, want)
+	}
+
+	allowFile := handler.Mounts["/etc/membrane/allow.json"]
+	data, err := os.ReadFile(allowFile)
+	if err != nil {
+		t.Fatalf("read the handler's allow file: %v", err)
+	}
+	if !strings.Contains(string(data), `"host":"github.com"`) {
+		t.Errorf("allow file = %s, want the github.com rule", data)
+	}
+
+	cleanup()
+	if len(f.containers) != 0 || len(f.networks) != 0 || len(f.volumes) != 0 {
+		t.Errorf("cleanup left containers %d, networks %d, volumes %d", len(f.containers), len(f.networks), len(f.volumes))
+	}
+	if _, err := os.Stat(allowFile); !os.IsNotExist(err) {
+		t.Errorf("cleanup left the allow file: %v", err)
+	}
+	home, _ := os.UserHomeDir()
+	if _, err := os.Stat(filepath.Join(home, ".membrane", "logs", s.handlerContainer+".log.gz")); err != nil {
+		t.Errorf("handler log wasn't kept: %v", err)
+	}
+}
+
+func TestStartSessionCleansUpAfterFailure(t *testing.T) {
+	f := useFakeEngine(t)
+	s := sessionNamesFor("0123456789abcdef")
+	// A network by the same name makes the session's creation fail.
+	if _, err := f.CreateNetwork(s.externalNetwork, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cleanup, _, err := startSession(s, &config{handlerImage: "membrane-handler:test"}, t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), s.externalNetwork) {
+		t.Fatalf("startSession error = %v, want one naming %s", err, s.externalNetwork)
+	}
+	cleanup()
+	if _, ok := f.volumes[s.caVolume]; ok {
+		t.Errorf("cleanup left the CA volume")
+	}
+	if _, ok := f.containers[s.handlerContainer]; ok {
+		t.Errorf("the handler was started")
+	}
+}
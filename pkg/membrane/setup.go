@@ -3,6 +3,8 @@ package membrane
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,7 +13,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"runtime"
+	"sort"
 	"strings"
 	"time"
 )
@@ -28,8 +30,8 @@ const (
 // Empty string means all components.
 func Reset(components string) error {
 
-	if runtime.GOOS == "darwin" {
-		os.Setenv("DOCKER_CONTEXT", "colima-membrane")
+	if err := selectEngine(); err != nil {
+		return err
 	}
 
 	for _, r := range components {
@@ -45,7 +47,7 @@ func Reset(components string) error {
 
 	fmt.Fprintf(os.Stderr, "This will remove:\n")
 	if doC {
-		fmt.Fprintf(os.Stderr, "  c - all running membrane containers\n")
+		fmt.Fprintf(os.Stderr, "  c - all membrane containers, networks and volumes\n")
 	}
 	if doI {
 		fmt.Fprintf(os.Stderr, "  i - the membrane Docker images\n")
@@ -63,22 +65,44 @@ func Reset(components string) error {
 	}
 
 	if doC {
-		for _, img := range []string{agentImageName, handlerImageName} {
-			out, err := exec.Command("docker", "ps", "-q", "--filter", "ancestor="+img).Output()
+		running, err := containers.ListContainers("", false)
+		if err != nil {
+			return fmt.Errorf("list containers: %w", err)
+		}
+		for _, c := range running {
+			// Podman qualifies local images with localhost/.
+			img, _ := splitImageRef(strings.TrimPrefix(c.Image, "localhost/"))
+			if img != agentImageName && img != handlerImageName && img != builtImageName {
+				continue
+			}
+			if err := containers.RemoveContainer(c.ID); err != nil {
+				return fmt.Errorf("remove container %s: %w", c.Name, err)
+			}
+		}
+		// Then everything labelled as a session's, including tracee
+		// sidecars, networks and volumes.
+		for _, kind := range sessionResourceKinds() {
+			list, err := kind.list(sessionLabel)
 			if err != nil {
-				return fmt.Errorf("list containers: %w", err)
+				return fmt.Errorf("list %ss: %w", kind.name, err)
 			}
-			for _, id := range strings.Fields(string(out)) {
-				if err := exec.Command("docker", "rm", "-f", id).Run(); err != nil {
-					return fmt.Errorf("remove container %s: %w", id, err)
+			for _, r := range list {
+				if err := kind.remove(r.Name); err != nil && !isNotFound(err) {
+					return fmt.Errorf("remove %s %s: %w", kind.name, r.Name, err)
 				}
 			}
 		}
 	}
 
 	if doI {
-		_ = exec.Command("docker", "rmi", agentImageName).Run()   // ignore error — may not exist
-		_ = exec.Command("docker", "rmi", handlerImageName).Run() // ignore error — may not exist
+		for _, repo := range []string{agentImageName, handlerImageName, builtImageName} {
+			list, _ := containers.ListImages(repo)
+			for _, img := range list {
+				for _, t := range img.Tags {
+					_ = containers.RemoveImage(t) // ignore error — may not exist
+				}
+			}
+		}
 	}
 
 	if doD {
@@ -121,14 +145,36 @@ func ensureRepo() (string, error) {
 		return srcDir, nil // already cloned
 	}
 
+	if offline {
+		return "", fmt.Errorf("%s is missing, and membrane is offline; %s", srcDir, importHint)
+	}
+	lock, err := acquireLock(lockSrc, true, "Waiting for another membrane to finish cloning...")
+	if err != nil {
+		return "", err
+	}
+	defer lock.unlock()
+	if _, err := os.Stat(gitDir); err == nil {
+		return srcDir, nil // cloned while we waited
+	}
+
 	fmt.Fprintf(os.Stderr, "Cloning membrane repo to %s...\n", srcDir)
 
-	cmd := exec.Command("git", "clone", repoURL, srcDir)
+	// Cloned next to srcDir and moved into place, so an interrupted clone
+	// doesn't leave a broken ~/.membrane/src behind.
+	tmpDir, err := os.MkdirTemp(home, "src-clone-")
+	if err != nil {
+		return "", fmt.Errorf("create clone dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	cmd := exec.Command("git", "clone", repoURL, tmpDir)
 	cmd.Stdout = os.Stderr
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
 		return "", fmt.Errorf("git clone: %w", err)
 	}
+	if err := os.Rename(tmpDir, srcDir); err != nil {
+		return "", fmt.Errorf("move clone to %s: %w", srcDir, err)
+	}
 
 	fmt.Fprintf(os.Stderr, "Repo cloned to %s — edit %s to customize.\n",
 		srcDir, filepath.Join(home, "config.yaml"))
@@ -162,46 +208,147 @@ func remoteCommit() (string, error) {
 	return result.SHA, nil
 }
 
-// update does a git pull in repoDir.
-func update(repoDir string) error {
-	cmd := exec.Command("git", "-C", repoDir, "pull", "--ff-only")
-	cmd.Stdout = os.Stderr
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+// keepImageTags is how many superseded tags of each image are kept, so
+// rolling ~/.membrane/src back doesn't mean a rebuild.
+const keepImageTags = 3
+
+// sessionImages are the membrane images a session runs.
+type sessionImages struct {
+	agent, handler string
 }
 
-// ensureImages checks if both membrane Docker images exist locally.
-// Builds any that are missing from repoDir.
-func ensureImages(repoDir string) error {
-	candidates := []struct{ name, context string }{
-		{agentImageName, "docker/agent"},
-		{handlerImageName, "docker/handler"},
+// imageBuild is an image and its build context. tag is name:<hash of the
+// context>.
+type imageBuild struct {
+	name, context, tag string
+}
+
+// ensureImages returns the membrane images built from the source in
+// repoDir, building any that don't exist yet. Each is tagged with a hash
+// of its build context, so editing the source rebuilds it and a session
+// never runs an image that doesn't match. name:latest follows the current
+// tag, for Dockerfiles built FROM membrane-agent.
+func ensureImages(repoDir string) (sessionImages, error) {
+	// Shared, so the source doesn't change under a build; see
+	// checkAndUpdate.
+	srcLock, err := acquireLock(lockSrc, false, "Waiting for another membrane to finish updating...")
+	if err != nil {
+		return sessionImages{}, err
+	}
+	defer srcLock.unlock()
+	lock, err := acquireLock(lockImages, true, "Waiting for another membrane to finish building...")
+	if err != nil {
+		return sessionImages{}, err
+	}
+	defer lock.unlock()
+
+	builds := []imageBuild{
+		{name: agentImageName, context: filepath.Join(repoDir, "docker/agent")},
+		{name: handlerImageName, context: filepath.Join(repoDir, "docker/handler")},
 	}
-	var missing []struct{ name, context string }
-	for _, img := range candidates {
-		out, err := exec.Command("docker", "images", "-q", img.name).Output()
+	var missing []imageBuild
+	for i := range builds {
+		b := &builds[i]
+		hash, err := contextHash(b.context)
+		if err != nil {
+			return sessionImages{}, fmt.Errorf("hash %s: %w", b.context, err)
+		}
+		b.tag = b.name + ":" + hash
+		ok, err := containers.ImageExists(b.tag)
 		if err != nil {
-			return fmt.Errorf("check docker image %s: %w", img.name, err)
+			return sessionImages{}, fmt.Errorf("check docker image %s: %w", b.tag, err)
+		}
+		if !ok {
+			missing = append(missing, *b)
 		}
-		if strings.TrimSpace(string(out)) == "" {
-			missing = append(missing, struct{ name, context string }{img.name, filepath.Join(repoDir, img.context)})
+	}
+	if offline && len(missing) > 0 {
+		// The agent's Dockerfile downloads toolchains.
+		var tags []string
+		for _, b := range missing {
+			tags = append(tags, b.tag)
 		}
+		return sessionImages{}, fmt.Errorf("membrane is offline and can't build %s for the source in %s; %s",
+			strings.Join(tags, " and "), repoDir, importHint)
+	}
+	if err := buildImagesParallel(missing); err != nil {
+		return sessionImages{}, err
 	}
-	return buildImagesParallel(missing)
+	for _, b := range builds {
+		if err := containers.TagImage(b.tag, b.name); err != nil {
+			return sessionImages{}, fmt.Errorf("tag %s as %s: %w", b.tag, b.name, err)
+		}
+		pruneImageTags(b.name, b.tag)
+	}
+	return sessionImages{agent: builds[0].tag, handler: builds[1].tag}, nil
 }
 
-// buildImages builds both membrane Docker images from repoDir.
-func buildImages(repoDir string) error {
-	return buildImagesParallel([]struct{ name, context string }{
-		{agentImageName, filepath.Join(repoDir, "docker/agent")},
-		{handlerImageName, filepath.Join(repoDir, "docker/handler")},
+// contextHash hashes the files in a build context: their paths, whether
+// they're executable, and their contents.
+func contextHash(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%t\x00", filepath.ToSlash(rel), info.Mode()&0o111 != 0)
+		if d.Type()&fs.ModeSymlink != 0 {
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "link %s\x00", link)
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		return err
 	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12], nil
+}
+
+// pruneImageTags removes all but the newest keepImageTags tags of repo,
+// besides current and latest. Tags still in use by a container are left.
+func pruneImageTags(repo, current string) {
+	list, err := containers.ListImages(repo)
+	if err != nil {
+		return
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+	kept := 0
+	for _, img := range list {
+		for _, t := range img.Tags {
+			if t == current || t == repo+":latest" {
+				continue
+			}
+			if kept < keepImageTags {
+				kept++
+				continue
+			}
+			_ = containers.RemoveImage(t) // ignore error — may be in use
+		}
+	}
 }
 
 // buildImagesParallel runs docker build concurrently for each (name, context)
 // pair. Output from each build is line-prefixed with [name] so the logs
 // from interleaved builds can be distinguished.
-func buildImagesParallel(builds []struct{ name, context string }) error {
+func buildImagesParallel(builds []imageBuild) error {
 	if len(builds) == 0 {
 		return nil
 	}
@@ -209,7 +356,7 @@ func buildImagesParallel(builds []struct{ name, context string }) error {
 	for _, b := range builds {
 		b := b
 		go func() {
-			errs <- buildImageFromDir(b.name, b.context)
+			errs <- buildImageFromDir(b.tag, b.context)
 		}()
 	}
 	var firstErr error
@@ -222,8 +369,9 @@ func buildImagesParallel(builds []struct{ name, context string }) error {
 }
 
 // buildImageFromDir runs docker build, buffering output. On success it
-// prints a short summary; on failure it dumps the captured output.
-func buildImageFromDir(name, dir string) error {
+// prints a short summary; on failure it dumps the captured output. args
+// go before the context, e.g. -f Dockerfile.
+func buildImageFromDir(name, dir string, args ...string) error {
 	fmt.Fprintf(os.Stderr, "Building %s image...\n", name)
 
 	home, err := os.UserHomeDir()
@@ -235,7 +383,7 @@ func buildImageFromDir(name, dir string) error {
 		return fmt.Errorf("create log dir: %w", err)
 	}
 	ts := time.Now().Format("20060102-150405")
-	logPath := filepath.Join(logDir, fmt.Sprintf("build-%s-%s.log.gz", name, ts))
+	logPath := filepath.Join(logDir, fmt.Sprintf("build-%s-%s.log.gz", strings.ReplaceAll(name, ":", "-"), ts))
 	logFile, err := os.Create(logPath)
 	if err != nil {
 		return fmt.Errorf("create build log: %w", err)
@@ -246,7 +394,7 @@ func buildImageFromDir(name, dir string) error {
 	defer gzWriter.Close()
 
 	var buf bytes.Buffer
-	cmd := exec.Command("docker", "build", "-t", name, dir)
+	cmd := exec.Command(containerCLI, append(append([]string{"build", "-t", name}, args...), dir)...)
 	// BUILDKIT_PROGRESS=plain produces line-oriented output with explicit
 	// durations per step — readable from a file and greppable for later
 	// analysis. The ANSI-redraw default would render as garbage in a log.
@@ -258,7 +406,7 @@ func buildImageFromDir(name, dir string) error {
 	start := time.Now()
 	if err := cmd.Run(); err != nil {
 		fmt.Fprintf(os.Stderr, "--- %s build output ---\n%s--- end ---\n", name, buf.String())
-		return fmt.Errorf("docker build %s: %w", name, err)
+		return fmt.Errorf("%s build %s: %w", containerCLI, name, err)
 	}
 	fmt.Fprintf(os.Stderr, "Built %s in %s\n", name, time.Since(start).Round(time.Second))
 	return nil
@@ -271,6 +419,14 @@ func writeDefaultConfig(membraneHomeDir string) error {
 	if _, err := os.Stat(dest); err == nil {
 		return nil // already exists, never overwrite
 	}
+	lock, err := acquireLock(lockSrc, true, "Waiting for another membrane to finish setting up...")
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	if _, err := os.Stat(dest); err == nil {
+		return nil // written while we waited
+	}
 	src := filepath.Join(membraneHomeDir, "src", "config-default.yaml")
 	data, err := os.ReadFile(src)
 	if err != nil {
@@ -0,0 +1,139 @@
+package membrane
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// answer makes s what the test's prompts read from stdin.
+func answer(t *testing.T, s string) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteString(s); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	saved := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() {
+		os.Stdin = saved
+		r.Close()
+	})
+}
+
+// resetFixture fills f with a session's resources, an old agent, the
+// membrane images and things that aren't membrane's, and ~/.membrane
+// with a file.
+func resetFixture(t *testing.T, f *fakeEngine) string {
+	t.Helper()
+	labels := sessionNamesFor("0123456789abcdef").labels()
+	for _, spec := range []containerSpec{
+		{Name: "old-agent", Image: agentImageName + ":abc123def456"},
+		{Name: "tracee-agent-0123456789abcdef", Image: traceeImage, Labels: labels},
+		{Name: "web", Image: "nginx:latest"},
+	} {
+		if _, err := f.RunContainer(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, labels := range map[string]map[string]string{"membrane-internal-0123456789abcdef": labels, "other": nil} {
+		if _, err := f.CreateNetwork(name, false, labels); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.CreateVolume("membrane-ca-0123456789abcdef", labels, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, img := range []string{agentImageName + ":abc123def456", handlerImageName + ":latest", builtImageName + ":a1b2c3", "nginx:latest"} {
+		if err := f.PullImage(img, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	home, err := membraneHome()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(home, "config.yaml"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return home
+}
+
+func names[T any](m map[string]T) []string {
+	var list []string
+	for k := range m {
+		list = append(list, k)
+	}
+	slices.Sort(list)
+	return list
+}
+
+func TestResetContainersAndImages(t *testing.T) {
+	f := useFakeEngine(t)
+	home := resetFixture(t, f)
+	answer(t, "y\n")
+
+	if err := Reset("ci"); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	if got := names(f.containers); !slices.Equal(got, []string{"web"}) {
+		t.Errorf("containers left = %q, want only web", got)
+	}
+	if got := names(f.networks); !slices.Equal(got, []string{"other"}) {
+		t.Errorf("networks left = %q, want only other", got)
+	}
+	if got := names(f.volumes); len(got) != 0 {
+		t.Errorf("volumes left = %q, want none", got)
+	}
+	if got := names(f.images); !slices.Equal(got, []string{"nginx:latest"}) {
+		t.Errorf("images left = %q, want only nginx:latest", got)
+	}
+	if _, err := os.Stat(filepath.Join(home, "config.yaml")); err != nil {
+		t.Errorf("~/.membrane was touched: %v", err)
+	}
+}
+
+func TestResetDirectory(t *testing.T) {
+	f := useFakeEngine(t)
+	home := resetFixture(t, f)
+	answer(t, "y\n")
+
+	if err := Reset("d"); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	if _, err := os.Stat(home); !os.IsNotExist(err) {
+		t.Errorf("~/.membrane is still there: %v", err)
+	}
+	if len(f.containers) != 3 || len(f.images) != 4 {
+		t.Errorf("the engine was touched: %q", f.Calls)
+	}
+}
+
+func TestResetDeclined(t *testing.T) {
+	f := useFakeEngine(t)
+	home := resetFixture(t, f)
+	before := len(f.Calls)
+	answer(t, "n\n")
+
+	if err := Reset(""); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	if len(f.Calls) != before {
+		t.Errorf("declined reset changed the engine: %q", f.Calls[before:])
+	}
+	if _, err := os.Stat(home); err != nil {
+		t.Errorf("declined reset removed ~/.membrane: %v", err)
+	}
+}
+
+func TestResetUnknownComponent(t *testing.T) {
+	useFakeEngine(t)
+	if err := Reset("cx"); err == nil {
+		t.Fatal("Reset accepted an unknown component")
+	}
+}
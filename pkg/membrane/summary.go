@@ -0,0 +1,211 @@
+package membrane
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxTopBlocked is how many blocked destinations a summary lists.
+const maxTopBlocked = 10
+
+// sessionSummary is the --summary-json file: how a session went, for
+// scripts that shouldn't have to parse logs.
+type sessionSummary struct {
+	ID        string   `json:"id,omitempty"` // empty if membrane failed before the session was created
+	Name      string   `json:"name,omitempty"`
+	Workspace string   `json:"workspace"`
+	Command   []string `json:"command,omitempty"`
+
+	ExitCode int    `json:"exit_code"`           // membrane's own exit code
+	FailedBy string `json:"failed_by,omitempty"` // agent or membrane; empty on success
+	Reason   string `json:"reason,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	AgentOOMKilled   bool `json:"agent_oom_killed"`
+	HandlerOOMKilled bool `json:"handler_oom_killed"`
+	TimedOut         bool `json:"timed_out"`
+	IdleTimedOut     bool `json:"idle_timed_out"`
+
+	Started time.Time     `json:"started"`
+	Ended   time.Time     `json:"ended"`
+	Phases  summaryPhases `json:"phases"`
+
+	TraceLog   string `json:"trace_log,omitempty"`
+	HandlerLog string `json:"handler_log,omitempty"`
+
+	DNS        trafficCounts        `json:"dns"`
+	HTTP       trafficCounts        `json:"http"`
+	TopBlocked []blockedDestination `json:"top_blocked"`
+}
+
+// summaryPhases are the seconds spent setting the session up, running the
+// agent and tearing the session down.
+type summaryPhases struct {
+	Setup    float64 `json:"setup_seconds"`
+	Agent    float64 `json:"agent_seconds"`
+	Teardown float64 `json:"teardown_seconds"`
+}
+
+type trafficCounts struct {
+	Allowed int `json:"allowed"`
+	Blocked int `json:"blocked"`
+}
+
+type blockedDestination struct {
+	Destination string `json:"destination"`
+	Count       int    `json:"count"`
+}
+
+// writeSummary writes the summary of the session recorded in r to path,
+// with codes for membrane's own failure.
+func writeSummary(path string, codes ExitCodes, r *sessionRecord) error {
+	sum := sessionSummary{
+		ID:           r.ID,
+		Name:         r.Name,
+		Workspace:    r.Workspace,
+		Command:      r.Command,
+		Reason:       r.Reason,
+		Error:        r.Error,
+		TimedOut:     r.Timeout == "timeout",
+		IdleTimedOut: r.Timeout == "idle-timeout",
+		Started:      r.Started,
+		TraceLog:     r.TraceLog,
+		HandlerLog:   r.HandlerLog,
+		TopBlocked:   []blockedDestination{},
+	}
+	for _, c := range r.OOMKilled {
+		sum.AgentOOMKilled = sum.AgentOOMKilled || c == "agent"
+		sum.HandlerOOMKilled = sum.HandlerOOMKilled || c == "handler"
+	}
+	switch {
+	case r.Status == statusFailed || r.ExitCode == nil:
+		sum.ExitCode, sum.FailedBy = codes.Failed, "membrane"
+	case r.Timeout != "":
+		// membrane stopped the agent; the exit code is the timeout's.
+		sum.ExitCode, sum.FailedBy = *r.ExitCode, "membrane"
+	case *r.ExitCode != 0:
+		sum.ExitCode, sum.FailedBy = *r.ExitCode, "agent"
+	}
+	if r.Ended != nil {
+		sum.Ended = *r.Ended
+	}
+	sum.Phases = phasesOf(r)
+
+	if r.HandlerLog != "" {
+		var blocked map[string]int
+		var err error
+		sum.DNS, sum.HTTP, blocked, err = countTraffic(r.HandlerLog)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Warning: summary: read handler log: %v\n", err)
+		}
+		for dest, n := range blocked {
+			sum.TopBlocked = append(sum.TopBlocked, blockedDestination{dest, n})
+		}
+		sort.Slice(sum.TopBlocked, func(i, j int) bool {
+			a, b := sum.TopBlocked[i], sum.TopBlocked[j]
+			if a.Count != b.Count {
+				return a.Count > b.Count
+			}
+			return a.Destination < b.Destination
+		})
+		if len(sum.TopBlocked) > maxTopBlocked {
+			sum.TopBlocked = sum.TopBlocked[:maxTopBlocked]
+		}
+	}
+
+	data, err := json.MarshalIndent(sum, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode summary: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write summary: %w", err)
+	}
+	return nil
+}
+
+// phasesOf splits the session's time around the agent's run. A session
+// whose agent never started was all setup.
+func phasesOf(r *sessionRecord) summaryPhases {
+	var p summaryPhases
+	if r.Ended == nil {
+		return p
+	}
+	if r.AgentStarted == nil {
+		p.Setup = r.Ended.Sub(r.Started).Seconds()
+		return p
+	}
+	agentEnded := *r.Ended
+	if r.AgentEnded != nil {
+		agentEnded = *r.AgentEnded
+	}
+	p.Setup = r.AgentStarted.Sub(r.Started).Seconds()
+	p.Agent = agentEnded.Sub(*r.AgentStarted).Seconds()
+	p.Teardown = r.Ended.Sub(agentEnded).Seconds()
+	return p
+}
+
+// countTraffic counts the DNS and L7 decisions in a handler log, which
+// dns-proxy and the mitmproxy addon log one line each, and how often
+// each destination was blocked.
+func countTraffic(path string) (dns, http trafficCounts, blocked map[string]int, err error) {
+	blocked = map[string]int{}
+	f, err := os.Open(path)
+	if err != nil {
+		return dns, http, blocked, err
+	}
+	defer f.Close()
+	var rd io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return dns, http, blocked, err
+		}
+		defer gz.Close()
+		rd = gz
+	}
+
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "dns-proxy: "); i >= 0 {
+			// allowed <name> <qtype>, blocked <name> (...), refused <name> <qtype> (...)
+			verdict, rest, _ := strings.Cut(line[i+len("dns-proxy: "):], " ")
+			name, _, _ := strings.Cut(rest, " ")
+			switch verdict {
+			case "allowed":
+				dns.Allowed++
+			case "blocked", "refused":
+				dns.Blocked++
+				if name != "multi-question" {
+					blocked[name]++
+				}
+			}
+		} else if i := strings.Index(line, "l7-filter: "); i >= 0 {
+			// allowed|blocked <method> <host><path>, or blocked <host>:<port> non-HTTP
+			fields := strings.Fields(line[i+len("l7-filter: "):])
+			if len(fields) < 2 {
+				continue
+			}
+			switch fields[0] {
+			case "allowed":
+				http.Allowed++
+			case "blocked":
+				http.Blocked++
+				dest := fields[1]
+				if len(fields) > 2 && fields[2] != "non-HTTP" {
+					dest, _, _ = strings.Cut(fields[2], "/")
+				}
+				blocked[dest]++
+			}
+		}
+	}
+	return dns, http, blocked, scanner.Err()
+}
@@ -0,0 +1,151 @@
+package membrane
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// timeoutGrace is how long a timed-out agent has to exit after SIGTERM
+// before it is killed.
+const timeoutGrace = 10 * time.Second
+
+// watchdog stops the agent once it has run for longer than timeout, or
+// has been idle for longer than idle. The agent is idle while it writes
+// nothing to its terminal, the handler logs no DNS or HTTP traffic, and
+// the tracer sees no events.
+type watchdog struct {
+	s       sessionNames
+	timeout time.Duration
+	idle    time.Duration
+	last    atomic.Int64 // UnixNano of the latest activity
+
+	stop   chan struct{}
+	done   chan struct{}
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	flag   string // the flag that stopped the agent
+	reason string
+}
+
+// startWatchdog starts a watchdog for the session's agent; the clocks
+// start now. Zero durations are off.
+func startWatchdog(s sessionNames, timeout, idle time.Duration, tracer *Tracer) *watchdog {
+	w := &watchdog{s: s, timeout: timeout, idle: idle, stop: make(chan struct{}), done: make(chan struct{}), cancel: func() {}}
+	if timeout == 0 && idle == 0 {
+		close(w.done)
+		return w
+	}
+	start := time.Now()
+	w.touch()
+	if idle > 0 {
+		var ctx context.Context
+		ctx, w.cancel = context.WithCancel(context.Background())
+		go w.follow(ctx, s.agentContainer)
+		go w.follow(ctx, s.handlerContainer)
+		if tracer != nil {
+			tracer.activity = w.touch
+		}
+	}
+	go func() {
+		defer close(w.done)
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-t.C:
+			}
+			var flag, reason string
+			switch {
+			case timeout > 0 && time.Since(start) >= timeout:
+				flag, reason = "--timeout", fmt.Sprintf("the agent was stopped after running for %s (--timeout)", timeout)
+			case idle > 0 && time.Since(time.Unix(0, w.last.Load())) >= idle:
+				flag, reason = "--idle-timeout", fmt.Sprintf("the agent was stopped after %s without activity (--idle-timeout)", idle)
+			default:
+				continue
+			}
+			w.mu.Lock()
+			w.flag, w.reason = flag, reason
+			w.mu.Unlock()
+			fmt.Fprintf(os.Stderr, "\r\nmembrane: %s reached; stopping the agent...\n", flag)
+			// SIGTERM, then SIGKILL once the grace period is up.
+			_ = containers.StopContainer(s.agentContainer, timeoutGrace)
+			return
+		}
+	}()
+	return w
+}
+
+func (w *watchdog) touch() { w.last.Store(time.Now().UnixNano()) }
+
+// follow counts new output of container as activity. The stream is
+// reopened until the watchdog stops, since the agent may not exist yet;
+// output seen before a reopen isn't counted again.
+func (w *watchdog) follow(ctx context.Context, container string) {
+	a := &activityWriter{w: w}
+	for ctx.Err() == nil {
+		a.n = 0
+		_ = containers.Logs(ctx, container, true, a)
+		select {
+		case <-ctx.Done():
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// activityWriter touches the watchdog when it's written more than it has
+// before.
+type activityWriter struct {
+	w       *watchdog
+	n, seen int
+}
+
+func (a *activityWriter) Write(p []byte) (int, error) {
+	a.n += len(p)
+	if a.n > a.seen {
+		a.seen = a.n
+		a.w.touch()
+	}
+	return len(p), nil
+}
+
+// expired stops the watchdog and returns the flag that made it stop the
+// agent and why, or "" if it didn't.
+func (w *watchdog) expired() (flag, reason string) {
+	select {
+	case <-w.stop:
+	default:
+		close(w.stop)
+	}
+	w.cancel()
+	<-w.done
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flag, w.reason
+}
+
+// withTimeoutReason replaces the agent's exit with code, membrane's
+// timeout exit code, if the watchdog stopped it.
+func withTimeoutReason(err error, w *watchdog, code int) error {
+	flag, reason := w.expired()
+	if reason == "" {
+		return err
+	}
+	timedOut := &ExitError{Code: code, Reason: reason, Timeout: strings.TrimPrefix(flag, "--")}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		if exitErr.Reason != "" {
+			timedOut.Reason += "; " + exitErr.Reason
+		}
+		timedOut.OOMKilled = exitErr.OOMKilled
+	}
+	return timedOut
+}
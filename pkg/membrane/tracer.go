@@ -6,11 +6,11 @@ package membrane
 import (
 	"bufio"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"strings"
 	"time"
 
@@ -21,16 +21,21 @@ import (
 // container and writes matching events to a JSONL file.
 type Tracer struct {
 	containerName string // tracee-<suffix>
+	sessionID     string
 	traceFile     string // path to output JSONL file
-	cmd           *exec.Cmd
 	stdout        io.ReadCloser
 	containerID   string        // agent container ID for filtering; set once before streaming starts
 	buffered      <-chan string // lines read between ready signal and StartStreaming
 	done          chan struct{} // closed when the streaming goroutine exits
+	activity      func()        // called for each agent event, if set before StartStreaming
 }
 
 const traceeImage = "aquasec/tracee:0.24.1"
 
+// execProcessName is the process name of docker/agent/membrane-exec, which
+// starts every `membrane exec` command.
+const execProcessName = "membrane-exec"
+
 // traceeEvents is the default set of events to trace.
 var traceeEvents = []string{
 	"security_file_open",
@@ -47,6 +52,7 @@ func NewTracer(agentContainerName, traceFile string) *Tracer {
 	suffix := strings.TrimPrefix(agentContainerName, "membrane-")
 	return &Tracer{
 		containerName: "tracee-" + suffix,
+		sessionID:     strings.TrimPrefix(agentContainerName, "membrane-agent-"),
 		traceFile:     traceFile,
 		done:          make(chan struct{}),
 	}
@@ -55,50 +61,48 @@ func NewTracer(agentContainerName, traceFile string) *Tracer {
 // Start launches the Tracee container and blocks until Tracee signals ready
 // or the 30-second timeout expires.
 func (t *Tracer) Start() error {
-	if err := exec.Command("docker", "image", "inspect", traceeImage).Run(); err != nil {
-		cmd := exec.Command("docker", "pull", traceeImage)
-		cmd.Stdout = os.Stderr
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
+	if ok, _ := containers.ImageExists(traceeImage); !ok {
+		if offline {
+			return fmt.Errorf("the tracee image %s is missing, and membrane is offline; %s", traceeImage, importHint)
+		}
+		if err := containers.PullImage(traceeImage, os.Stderr); err != nil {
 			return fmt.Errorf("pull tracee image: %w", err)
 		}
 	}
 
-	args := []string{
-		"run", "--rm",
-		"--name", t.containerName,
-		"--privileged",
-		"--pid=host",
+	_, err := containers.RunContainer(containerSpec{
+		Name:       t.containerName,
+		Image:      traceeImage,
+		Labels:     sessionNamesFor(t.sessionID).labels(),
+		Privileged: true,
+		PidMode:    "host",
 		// "--cgroupns=host",
-		"-v", "/sys/fs/cgroup/system.slice:/sys/fs/cgroup/system.slice:ro",
-		"-v", "/etc/os-release:/etc/os-release-host:ro",
-		"-e", "LIBBPFGO_OSRELEASE_FILE=/etc/os-release-host",
-		"--entrypoint", "/tracee/tracee",
-		traceeImage,
-		"--output", "json",
-		"--log", "debug",
-		"--scope", "container=new",
-		"--events", strings.Join(traceeEvents, ","),
+		Binds: []string{
+			"/sys/fs/cgroup/system.slice:/sys/fs/cgroup/system.slice:ro",
+			"/etc/os-release:/etc/os-release-host:ro",
+		},
+		Env:        []string{"LIBBPFGO_OSRELEASE_FILE=/etc/os-release-host"},
+		Entrypoint: []string{"/tracee/tracee"},
+		Cmd: []string{
+			"--output", "json",
+			"--log", "debug",
+			"--scope", "container=new",
+			"--events", strings.Join(traceeEvents, ","),
+		},
+		AutoRemove: true,
+	})
+	if err != nil {
+		return fmt.Errorf("start tracee: %w", err)
 	}
 
-	t.cmd = exec.Command("docker", args...)
-
 	// Merge stdout and stderr into a single reader via an io.Pipe.
 	// Tracee writes the ready signal and log lines to stderr, and JSON
-	// events to stdout. We need both in one stream.
+	// events to stdout. We need both in one stream. The pipe writer is
+	// closed when the container exits so the reader gets EOF.
 	pr, pw := io.Pipe()
-	t.cmd.Stdout = pw
-	t.cmd.Stderr = pw
 	t.stdout = pr
-
-	if err := t.cmd.Start(); err != nil {
-		return fmt.Errorf("start tracee: %w", err)
-	}
-
-	// Close the pipe writer when the process exits so the reader gets EOF.
 	go func() {
-		_ = t.cmd.Wait()
-		pw.Close()
+		pw.CloseWithError(containers.Logs(context.Background(), t.containerName, true, pw))
 	}()
 
 	// Wait for the "is ready callback" line or an error/timeout.
@@ -146,14 +150,14 @@ func (t *Tracer) Start() error {
 			s.Stop()
 		}
 		if err != nil {
-			_ = t.cmd.Process.Kill()
+			_ = containers.RemoveContainer(t.containerName)
 			return err
 		}
 	case <-time.After(30 * time.Second):
 		if s != nil {
 			s.Stop()
 		}
-		_ = t.cmd.Process.Kill()
+		_ = containers.RemoveContainer(t.containerName)
 		return fmt.Errorf("tracee did not become ready within 30 seconds")
 	}
 
@@ -187,6 +191,7 @@ func (t *Tracer) streamEvents() {
 	}
 
 	agentStarted := false
+	execRoots := map[int]int{} // host PID → host PID of its membrane exec
 
 	process := func(line string) {
 		if !strings.HasPrefix(line, "{") {
@@ -208,6 +213,10 @@ func (t *Tracer) streamEvents() {
 
 		var ev struct {
 			ContainerID string `json:"containerId"`
+			EventName   string `json:"eventName"`
+			ProcessName string `json:"processName"`
+			HostPID     int    `json:"hostProcessId"`
+			HostPPID    int    `json:"hostParentProcessId"`
 		}
 		if json.Unmarshal([]byte(line), &ev) != nil {
 			return
@@ -215,8 +224,23 @@ func (t *Tracer) streamEvents() {
 		if ev.ContainerID != t.containerID {
 			return
 		}
+		// Tag events from `membrane exec` sessions, and their descendants,
+		// with the host PID of the session's membrane-exec process.
+		if ev.EventName == "sched_process_exec" && ev.ProcessName == execProcessName {
+			execRoots[ev.HostPID] = ev.HostPID
+		} else if root, ok := execRoots[ev.HostPPID]; ok {
+			if _, seen := execRoots[ev.HostPID]; !seen {
+				execRoots[ev.HostPID] = root
+			}
+		}
+		if root, ok := execRoots[ev.HostPID]; ok && strings.HasSuffix(line, "}") {
+			line = fmt.Sprintf(`%s,"membraneExec":%d}`, strings.TrimSuffix(line, "}"), root)
+		}
 		// TODO: this is where you would add hooks to act on events in real time,
 		// e.g. killing the agent container if a suspicious event is detected.
+		if t.activity != nil {
+			t.activity()
+		}
 		if f != nil {
 			fmt.Fprintln(f, line)
 		}
@@ -235,7 +259,7 @@ func (t *Tracer) streamEvents() {
 	}
 }
 
-// Stop sends docker stop to the Tracee container and waits for the
+// Stop stops the Tracee container and waits for the
 // streaming goroutine to finish.
 // NOTE: SIGKILL cannot be caught; the tracee container may need manual
 // cleanup via: docker stop tracee-<id>
@@ -246,7 +270,7 @@ func (t *Tracer) Stop() {
 		s.Start("Tearing down sandbox...")
 	}
 
-	_ = exec.Command("docker", "stop", "-t", "2", t.containerName).Run()
+	_ = containers.StopContainer(t.containerName, 2*time.Second)
 	if t.containerID != "" {
 		<-t.done
 	}
@@ -0,0 +1,103 @@
+package membrane
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTracer(t *testing.T) {
+	f := useFakeEngine(t)
+	const agentID = "0a0a0a0a0a0a"
+	s := sessionNamesFor("0123456789abcdef")
+	events := []string{
+		// Before gosu starts the agent: the entrypoint's setup.
+		`{"eventName":"sched_process_exec","processName":"ip","containerId":"0a0a0a0a0a0a","hostProcessId":5}`,
+		`{"eventName":"sched_process_exec","processName":"gosu","containerId":"0a0a0a0a0a0a","hostProcessId":6}`,
+		`{"eventName":"security_file_open","processName":"bash","containerId":"0a0a0a0a0a0a","hostProcessId":10,"hostParentProcessId":6}`,
+		`{"eventName":"security_file_open","processName":"nginx","containerId":"0b0b0b0b0b0b","hostProcessId":11}`,
+		`{"eventName":"sched_process_exec","processName":"membrane-exec","containerId":"0a0a0a0a0a0a","hostProcessId":20,"hostParentProcessId":1}`,
+		`{"eventName":"sched_process_exec","processName":"ls","containerId":"0a0a0a0a0a0a","hostProcessId":21,"hostParentProcessId":20}`,
+	}
+	f.LogsHook = func(container string, w io.Writer) {
+		fmt.Fprintln(w, `{"L":"INFO","M":"starting tracee"}`)
+		fmt.Fprintln(w, `{"L":"INFO","M":"is ready callback"}`)
+		for _, e := range events {
+			fmt.Fprintln(w, e)
+		}
+	}
+	traceFile := filepath.Join(t.TempDir(), "trace.jsonl.gz")
+
+	tr := NewTracer(s.agentContainer, traceFile)
+	if err := tr.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	tracee, ok := f.containers["tracee-agent-"+s.id]
+	if !ok || !tracee.Running {
+		t.Fatalf("tracee isn't running: %q", f.Calls)
+	}
+	if !slices.Contains(f.Calls, "pull "+traceeImage) {
+		t.Errorf("the missing tracee image wasn't pulled: %q", f.Calls)
+	}
+	if tracee.Labels[sessionLabel] != s.id {
+		t.Errorf("tracee labels = %v, want the session's", tracee.Labels)
+	}
+	var activity int
+	tr.activity = func() { activity++ }
+	tr.StartStreaming(agentID)
+	tr.Stop()
+
+	if _, ok := f.containers[tracee.Name]; ok {
+		t.Errorf("tracee wasn't removed")
+	}
+	in, err := os.Open(traceFile)
+	if err != nil {
+		t.Fatalf("open trace: %v", err)
+	}
+	defer in.Close()
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		t.Fatalf("read trace: %v", err)
+	}
+	var got []string
+	sc := bufio.NewScanner(gz)
+	for sc.Scan() {
+		got = append(got, sc.Text())
+	}
+	want := []string{
+		events[2],
+		strings.TrimSuffix(events[4], "}") + `,"membraneExec":20}`,
+		strings.TrimSuffix(events[5], "}") + `,"membraneExec":20}`,
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("trace =\n%s\nwant the agent's events after gosu, exec-tagged:\n%s",
+			strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if activity != len(want) {
+		t.Errorf("activity = %d, want %d", activity, len(want))
+	}
+	if _, err := os.Stat(strings.TrimSuffix(traceFile, ".gz")); !os.IsNotExist(err) {
+		t.Errorf("the uncompressed trace was left: %v", err)
+	}
+}
+
+func TestTracerNotReady(t *testing.T) {
+	f := useFakeEngine(t)
+	f.LogsHook = func(container string, w io.Writer) {
+		fmt.Fprintln(w, `{"L":"FATAL","M":"can't load eBPF"}`)
+	}
+	tr := NewTracer(sessionNamesFor("0123456789abcdef").agentContainer, "")
+	err := tr.Start()
+	if err == nil || !strings.Contains(err.Error(), "eBPF") {
+		t.Fatalf("Start error = %v, want tracee's", err)
+	}
+	if len(f.containers) != 0 {
+		t.Errorf("tracee wasn't removed: %q", f.Calls)
+	}
+}
@@ -0,0 +1,416 @@
+package membrane
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Updates (`update:` and `membrane update`). ~/.membrane/src follows a
+// channel:
+//
+//	main     the latest commit on main (the default)
+//	release  the latest release tag, v<version> without a pre-release suffix
+//	<ref>    an exact tag or commit, which pins membrane
+//
+// Sessions update to the channel's target as they start, unless `auto`
+// is off; `membrane update` shows the commits between ~/.membrane/src and
+// the target, and applies them with --apply. ensureImages rebuilds what
+// changed. With `verify`, the target must be a tag with a good signature
+// (git verify-tag), so only signed releases are built.
+//
+// The update config is read from ~/.membrane/config.yaml only, even with
+// --no-global-config, so a workspace can't change which membrane runs it.
+
+// Update channels; anything else is a tag or commit.
+const (
+	channelMain    = "main"
+	channelRelease = "release"
+)
+
+type updateConfig struct {
+	Channel string `yaml:"channel"`
+	Verify  bool   `yaml:"verify"` // only check out tags with a good signature
+	Auto    *bool  `yaml:"auto"`   // update as sessions start; default true
+}
+
+// UnmarshalYAML accepts the channel alone, as in `update: release`, as
+// well as the full mapping.
+func (u *updateConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		u.Channel = value.Value
+		return nil
+	}
+	type plain updateConfig
+	return value.Decode((*plain)(u))
+}
+
+// validate fills in defaults and checks u.
+func (u *updateConfig) validate() error {
+	if u.Channel == "" {
+		u.Channel = channelMain
+	}
+	if u.Verify && u.Channel == channelMain {
+		return fmt.Errorf("update: verify checks tag signatures, so it needs the release channel or a tag")
+	}
+	return nil
+}
+
+func (u *updateConfig) auto() bool {
+	return u.Auto == nil || *u.Auto
+}
+
+// loadUpdateConfig reads the update config from ~/.membrane/config.yaml.
+func loadUpdateConfig() (updateConfig, error) {
+	home, err := membraneHome()
+	if err != nil {
+		return updateConfig{}, err
+	}
+	var u updateConfig
+	cfg, err := loadConfigFile(filepath.Join(home, "config.yaml"))
+	if err != nil && !os.IsNotExist(err) {
+		return updateConfig{}, fmt.Errorf("load local config: %w", err)
+	}
+	if cfg != nil {
+		u = cfg.Update
+	}
+	return u, u.validate()
+}
+
+// srcGit runs git in repoDir and returns its trimmed output.
+func srcGit(repoDir string, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", append([]string{"-C", repoDir}, args...)...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s: %w", args[0], msg, err)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// checkManagedSrc returns an error unless membrane manages the checkout in
+// repoDir: a clone on main or detached at an update's target. A link to a
+// working copy (see run-dev.sh) or a checkout on another branch is left
+// alone.
+func checkManagedSrc(repoDir string) error {
+	if info, err := os.Lstat(repoDir); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		target, _ := os.Readlink(repoDir)
+		return fmt.Errorf("%s is a link to %s; update that yourself", repoDir, target)
+	}
+	branch, err := srcGit(repoDir, "rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return err
+	}
+	if branch != "main" && branch != "HEAD" {
+		return fmt.Errorf("%s is on branch %s; update it yourself, or check out main", repoDir, branch)
+	}
+	return nil
+}
+
+// updatePlan is where an update would move ~/.membrane/src.
+type updatePlan struct {
+	channel string
+	ref     string // the tag, commit or branch updated to
+	local   string // commits
+	target  string
+}
+
+func (p *updatePlan) current() bool {
+	return p.local == p.target
+}
+
+// String describes the target, as in "the latest release, v1.4.0
+// (1a2b3c4)".
+func (p *updatePlan) String() string {
+	switch p.channel {
+	case channelMain:
+		return fmt.Sprintf("the latest commit on main (%s)", p.target[:7])
+	case channelRelease:
+		return fmt.Sprintf("the latest release, %s (%s)", p.ref, p.target[:7])
+	}
+	return fmt.Sprintf("the pinned %s (%s)", p.ref, p.target[:7])
+}
+
+// planUpdate fetches what the channel needs and resolves its target,
+// checking the target's signature if u.Verify. The caller holds the src
+// lock.
+func planUpdate(repoDir string, u updateConfig) (*updatePlan, error) {
+	local, err := srcGit(repoDir, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("get local commit: %w", err)
+	}
+	p := &updatePlan{channel: u.Channel, local: local}
+
+	switch u.Channel {
+	case channelMain:
+		if _, err := srcGit(repoDir, "fetch", "--quiet", "origin", "main"); err != nil {
+			return nil, err
+		}
+		p.ref = "main"
+		if p.target, err = srcGit(repoDir, "rev-parse", "FETCH_HEAD"); err != nil {
+			return nil, err
+		}
+		return p, nil
+	case channelRelease:
+		if _, err := srcGit(repoDir, "fetch", "--quiet", "--tags", "origin"); err != nil {
+			return nil, err
+		}
+		tags, err := srcGit(repoDir, "tag", "--list", "v*", "--sort=-v:refname")
+		if err != nil {
+			return nil, err
+		}
+		if p.ref = latestRelease(strings.Fields(tags)); p.ref == "" {
+			return nil, fmt.Errorf("no release tags in %s", repoDir)
+		}
+	default:
+		// A pinned tag or commit that's already here needs no fetch.
+		if _, err := srcGit(repoDir, "rev-parse", "--verify", "--quiet", u.Channel+"^{commit}"); err != nil {
+			if _, err := srcGit(repoDir, "fetch", "--quiet", "--tags", "origin"); err != nil {
+				return nil, err
+			}
+		}
+		p.ref = u.Channel
+	}
+
+	if p.target, err = srcGit(repoDir, "rev-parse", "--verify", "--quiet", p.ref+"^{commit}"); err != nil {
+		return nil, fmt.Errorf("update channel %s: no such tag or commit in %s", p.ref, repoDir)
+	}
+	if u.Verify {
+		if _, err := srcGit(repoDir, "rev-parse", "--verify", "--quiet", "refs/tags/"+p.ref); err != nil {
+			return nil, fmt.Errorf("update: verify is set, but %s is not a tag", p.ref)
+		}
+		if _, err := srcGit(repoDir, "verify-tag", p.ref); err != nil {
+			return nil, fmt.Errorf("tag %s has no good signature, so membrane won't update to it: %w", p.ref, err)
+		}
+	}
+	return p, nil
+}
+
+// latestRelease returns the first of tags, sorted newest first, that
+// isn't a pre-release, or "" if there's none.
+func latestRelease(tags []string) string {
+	for _, t := range tags {
+		if !strings.Contains(t, "-") { // v1.2.0-rc1 and the like are pre-releases
+			return t
+		}
+	}
+	return ""
+}
+
+// releaseCurrent reports whether ~/.membrane/src is already at origin's
+// latest release, asking origin with ls-remote rather than fetching, so
+// it needs no lock. Any doubt, as when the tag moved or isn't here yet,
+// reports false and leaves it to planUpdate.
+func releaseCurrent(repoDir string) (bool, error) {
+	out, err := srcGit(repoDir, "ls-remote", "--tags", "--refs", "--sort=-v:refname", "origin", "v*")
+	if err != nil {
+		return false, err
+	}
+	var tags []string
+	remote := map[string]string{} // tag → object
+	for _, line := range strings.Split(out, "\n") {
+		obj, ref, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		tag := strings.TrimPrefix(ref, "refs/tags/")
+		tags = append(tags, tag)
+		remote[tag] = obj
+	}
+	tag := latestRelease(tags)
+	if tag == "" {
+		return false, nil
+	}
+	local, err := srcGit(repoDir, "rev-parse", "--verify", "--quiet", "refs/tags/"+tag)
+	if err != nil || local != remote[tag] {
+		return false, nil
+	}
+	head, err := srcGit(repoDir, "rev-parse", "HEAD")
+	if err != nil {
+		return false, nil
+	}
+	target, err := srcGit(repoDir, "rev-parse", "--verify", "--quiet", tag+"^{commit}")
+	return err == nil && head == target, nil
+}
+
+// changelog lists the commits the update brings in, and those it takes
+// out, as when a pin moves to an older release, one per line.
+func (p *updatePlan) changelog(repoDir string) (in, out []string, err error) {
+	log := func(rng string) ([]string, error) {
+		s, err := srcGit(repoDir, "log", "--oneline", "--no-decorate", rng)
+		if err != nil || s == "" {
+			return nil, err
+		}
+		return strings.Split(s, "\n"), nil
+	}
+	if in, err = log(p.local + ".." + p.target); err != nil {
+		return nil, nil, err
+	}
+	if out, err = log(p.target + ".." + p.local); err != nil {
+		return nil, nil, err
+	}
+	return in, out, nil
+}
+
+// applyUpdate moves ~/.membrane/src to the plan's target, backing up
+// local edits first. main is fast-forwarded; anything else is checked out
+// detached. The caller holds the src lock.
+func applyUpdate(repoDir string, p *updatePlan) error {
+	dirty, err := isDirty(repoDir)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		if err := backupSrc(repoDir); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Updating to %s (%s)...\n", p.ref, p.target[:7])
+	steps := [][]string{{"checkout", "--quiet", "--detach", p.target}}
+	if p.channel == channelMain {
+		steps = [][]string{
+			{"checkout", "--quiet", "main"},
+			{"merge", "--quiet", "--ff-only", p.target},
+		}
+	}
+	for _, args := range steps {
+		if _, err := srcGit(repoDir, args...); err != nil {
+			return fmt.Errorf("update %s: %w", repoDir, err)
+		}
+	}
+	// The next ensureImages rebuilds what changed.
+	return nil
+}
+
+// checkAndUpdate updates ~/.membrane/src to its channel's target as a
+// session starts.
+func checkAndUpdate(repoDir string) error {
+	u, err := loadUpdateConfig()
+	if err != nil {
+		return err
+	}
+	if !u.auto() || checkManagedSrc(repoDir) != nil {
+		return nil
+	}
+	switch u.Channel {
+	case channelMain:
+		// Asking GitHub is quicker than a fetch, and most sessions find
+		// nothing new.
+		remote, err := remoteCommit()
+		if err != nil {
+			return err
+		}
+		if local, err := srcGit(repoDir, "rev-parse", "HEAD"); err == nil && local == remote {
+			return nil
+		}
+	case channelRelease:
+		// Likewise, listing origin's tags spares the fetch, and the src
+		// lock, while the latest release stays the same.
+		if current, err := releaseCurrent(repoDir); err != nil || current {
+			return err
+		}
+	default:
+		// A pin that's already checked out has nothing to fetch.
+		target, err := srcGit(repoDir, "rev-parse", "--verify", "--quiet", u.Channel+"^{commit}")
+		if local, lerr := srcGit(repoDir, "rev-parse", "HEAD"); err == nil && lerr == nil && local == target {
+			return nil
+		}
+	}
+
+	// Another membrane may be updating, or building from, the same source.
+	lock, err := acquireLock(lockSrc, true, "Waiting for another membrane to finish updating...")
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	p, err := planUpdate(repoDir, u)
+	if err != nil {
+		return err
+	}
+	if p.current() {
+		return nil
+	}
+	return applyUpdate(repoDir, p)
+}
+
+// Update shows the commits between ~/.membrane/src and its channel's
+// target, and with apply, updates to the target and rebuilds the images.
+func Update(apply bool) error {
+	repoDir, err := ensureRepo()
+	if err != nil {
+		return err
+	}
+	u, err := loadUpdateConfig()
+	if err != nil {
+		return err
+	}
+	if err := checkManagedSrc(repoDir); err != nil {
+		return err
+	}
+	updated, err := updateSrc(repoDir, u, apply)
+	if err != nil || !updated {
+		return err
+	}
+	if err := selectEngine(); err != nil {
+		return err
+	}
+	if _, err := ensureImages(repoDir); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "membrane: updated %s; new sessions run it\n", repoDir)
+	return nil
+}
+
+// updateSrc is Update's part under the src lock, which ensureImages
+// can't be called under. It reports whether it updated.
+func updateSrc(repoDir string, u updateConfig, apply bool) (bool, error) {
+	lock, err := acquireLock(lockSrc, true, "Waiting for another membrane to finish updating...")
+	if err != nil {
+		return false, err
+	}
+	defer lock.unlock()
+	p, err := planUpdate(repoDir, u)
+	if err != nil {
+		return false, err
+	}
+	if p.current() {
+		fmt.Fprintf(os.Stderr, "membrane: %s is up to date, at %s\n", repoDir, p)
+		return false, nil
+	}
+	in, out, err := p.changelog(repoDir)
+	if err != nil {
+		return false, err
+	}
+	fmt.Fprintf(os.Stderr, "membrane: %s is at %s; updating goes to %s\n", repoDir, p.local[:7], p)
+	for _, c := range []struct {
+		what    string
+		commits []string
+	}{{"to bring in", in}, {"to take out", out}} {
+		if len(c.commits) == 0 {
+			continue
+		}
+		noun := "commits"
+		if len(c.commits) == 1 {
+			noun = "commit"
+		}
+		fmt.Printf("%d %s %s:\n", len(c.commits), noun, c.what)
+		for _, line := range c.commits {
+			fmt.Printf("  %s\n", line)
+		}
+	}
+	if !apply {
+		fmt.Fprintf(os.Stderr, "membrane: apply it with: membrane update --apply\n")
+		return false, nil
+	}
+	return true, applyUpdate(repoDir, p)
+}
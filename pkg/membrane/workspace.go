@@ -39,21 +39,21 @@ type mounts struct {
 
 // scan walks workspaceDir and applies ignore/readonly patterns from cfg.
 // Returns the full set of overlay mounts to pass to docker run.
-func scan(workspaceDir string, cfg *config) (*mounts, error) {
+// The shadow placeholders go in a temp dir named for sessionID, removed
+// with the rest of the session's temp files at cleanup or by gc.
+func scan(workspaceDir string, cfg *config, sessionID string) (*mounts, error) {
 	if err := validateConfig(cfg); err != nil {
 		return nil, err
 	}
 
 	// Create temp empty file and dir for shadowing ignored paths.
-	// Not cleaned up: syscall.Exec replaces this process so defers won't
-	// run, and the OS handles /tmp cleanup.
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return nil, err
 	}
 	tmpBase := filepath.Join(home, ".membrane", "tmp")
 	_ = os.MkdirAll(tmpBase, 0755)
-	tmpDir, err := os.MkdirTemp(tmpBase, "membrane-")
+	tmpDir, err := os.MkdirTemp(tmpBase, "membrane-"+sessionID+"-")
 
 	if err != nil {
 		return nil, err
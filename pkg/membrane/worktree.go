@@ -0,0 +1,227 @@
+package membrane
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Worktree sessions (--worktree). Agents that share a repository each get
+// their own git worktree under ~/.membrane/worktrees/<id>, on their own
+// branch, so they don't trample each other's working tree. The worktree is
+// mounted at /workspace and scanned for ignore and readonly paths like any
+// workspace. The repository's .git directory isn't mounted: as with
+// mediate_git, the agent commits to a private git directory that borrows
+// the repository's objects read-only (see commits.go), and when the
+// session ends its commits are checked and imported onto the worktree's
+// branch. Other branches, tags, hooks and config are out of its reach.
+
+// WorktreeDefaultBranch is the --worktree branch when none is given;
+// <session> becomes the session ID.
+const WorktreeDefaultBranch = "membrane/<session>"
+
+type worktree struct {
+	id      string
+	repo    string // the repository's top level
+	dir     string // the worktree
+	sub     string // the workspace's path inside the repository
+	branch  string
+	base    string       // the commit the branch was at when the session started
+	created bool         // membrane created the branch
+	git     *mediatedGit // where the agent commits; nil if the workspace is below the top level
+}
+
+// workspace is the directory in the worktree that stands in for the
+// workspace, which may be below the repository's top level.
+func (w *worktree) workspace() string {
+	return filepath.Join(w.dir, w.sub)
+}
+
+// createWorktree checks out branch for session id in a new worktree of the
+// repository containing workspaceDir. A branch that doesn't exist yet is
+// created at HEAD.
+func createWorktree(workspaceDir, id, branch string) (*worktree, error) {
+	top, err := gitOutput(workspaceDir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, fmt.Errorf("--worktree needs a git repository: %w", err)
+	}
+	top, err = filepath.EvalSymlinks(top)
+	if err != nil {
+		return nil, fmt.Errorf("resolve repository path: %w", err)
+	}
+	sub, err := filepath.Rel(top, workspaceDir)
+	if err != nil {
+		return nil, fmt.Errorf("find workspace in repository: %w", err)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("get home dir: %w", err)
+	}
+
+	w := &worktree{
+		id:     id,
+		repo:   top,
+		dir:    filepath.Join(home, ".membrane", "worktrees", id),
+		sub:    sub,
+		branch: strings.ReplaceAll(branch, "<session>", id),
+	}
+	if _, err := gitOutput(top, "check-ref-format", "--branch", w.branch); err != nil {
+		return nil, fmt.Errorf("--worktree: %q is not a valid branch name", w.branch)
+	}
+	if err := os.MkdirAll(filepath.Dir(w.dir), 0o755); err != nil {
+		return nil, fmt.Errorf("create worktrees dir: %w", err)
+	}
+	// Locked, so that git worktree prune in the agent, where the worktree's
+	// path doesn't exist, leaves it alone.
+	args := []string{"worktree", "add", "--quiet", "--lock"}
+	if w.base, err = gitOutput(top, "rev-parse", "--verify", "--quiet", "refs/heads/"+w.branch); err == nil {
+		args = append(args, w.dir, w.branch)
+	} else {
+		if w.base, err = gitOutput(top, "rev-parse", "--verify", "HEAD"); err != nil {
+			return nil, fmt.Errorf("--worktree needs a commit to branch from: %w", err)
+		}
+		args = append(args, "-b", w.branch, w.dir, w.base)
+		w.created = true
+	}
+	if _, err := gitOutput(top, args...); err != nil {
+		return nil, fmt.Errorf("create worktree: %w", err)
+	}
+	// The private git directory's work tree is /workspace, so it can only
+	// stand in for the worktree's top level.
+	if sub == "." {
+		dir, err := filepath.EvalSymlinks(w.dir)
+		if err == nil {
+			w.git, err = createMediatedGit(dir, id, nil)
+		}
+		if err != nil {
+			w.finish()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// mountArgs gives the agent the private git directory, if any.
+func (w *worktree) mountArgs() []string {
+	if w.git == nil {
+		return nil
+	}
+	return w.git.args()
+}
+
+// record is a sessionRecord for the private git directory, as
+// sessionCommits and importCommits take.
+func (w *worktree) record() *sessionRecord {
+	return &sessionRecord{
+		ID:           w.id,
+		Workspace:    w.repo,
+		GitDir:       w.git.dir,
+		GitObjects:   w.git.objects,
+		GitBase:      w.git.base,
+		GitProtected: w.git.protected,
+	}
+}
+
+// importCommits imports the agent's commits onto the worktree's branch
+// and brings the worktree's index up to date with them, leaving the
+// agent's uncommitted changes as they are. Commits that can't be imported
+// are kept for `membrane import`.
+func (w *worktree) importCommits() {
+	if w.git == nil {
+		return
+	}
+	if _, err := os.Stat(w.git.dir); err != nil {
+		return
+	}
+	r := w.record()
+	head, commits, err := sessionCommits(r)
+	if err == nil && len(commits) > 0 {
+		err = importCommits(r, head, w.branch)
+	}
+	if err == nil && len(commits) > 0 {
+		_, err = gitOutput(w.dir, "reset", "--quiet")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: import the agent's commits onto %s: %v\n", w.branch, err)
+		return
+	}
+	_ = os.RemoveAll(w.git.dir)
+}
+
+// finish imports the agent's commits, then removes the worktree, and the
+// branch if membrane created it, if the agent left no commits or changes
+// behind. Otherwise it's kept for the user; see reportWorktree.
+func (w *worktree) finish() {
+	if w == nil {
+		return
+	}
+	w.importCommits()
+	status, err := gitOutput(w.dir, "status", "--porcelain")
+	if err != nil || status != "" {
+		return
+	}
+	head, err := gitOutput(w.dir, "rev-parse", "HEAD")
+	if err != nil || head != w.base {
+		return
+	}
+	if _, err := gitOutput(w.repo, "worktree", "unlock", w.dir); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: remove worktree: %v\n", err)
+		return
+	}
+	if _, err := gitOutput(w.repo, "worktree", "remove", w.dir); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: remove worktree: %v\n", err)
+		return
+	}
+	if w.created {
+		if _, err := gitOutput(w.repo, "branch", "--quiet", "-D", w.branch); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: remove worktree branch: %v\n", err)
+		}
+	}
+}
+
+// reportWorktree tells the user where a session's work is, if its
+// worktree was kept.
+func reportWorktree(r *sessionRecord) {
+	if r == nil || r.Worktree == "" {
+		return
+	}
+	if _, err := os.Stat(r.Worktree); err != nil {
+		return
+	}
+	what := "uncommitted changes"
+	if n, err := gitOutput(r.Worktree, "rev-list", "--count", r.WorktreeBase+"..HEAD"); err == nil && n != "0" {
+		what = n + " new commit(s)"
+		if status, _ := gitOutput(r.Worktree, "status", "--porcelain"); status != "" {
+			what += " and uncommitted changes"
+		}
+	}
+	fmt.Fprintf(os.Stderr, "membrane: the agent left %s on branch %s in %s\n", what, r.WorktreeBranch, r.Worktree)
+	fmt.Fprintf(os.Stderr, "membrane: when you're done with it: git worktree remove -f -f %s\n", r.Worktree)
+}
+
+// gitOutput runs git in dir and returns its trimmed output.
+func gitOutput(dir string, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// agentWorkspace is the directory mounted at /workspace: workspaceDir, or
+// its counterpart in the session's worktree.
+func (c *config) agentWorkspace(workspaceDir string) string {
+	if c.worktree != nil {
+		return c.worktree.workspace()
+	}
+	return workspaceDir
+}
@@ -0,0 +1,36 @@
+#!/usr/bin/env bash
+set -euo pipefail
+
+# Generate pkg/membrane/qtypes.go, the query types config may name, from
+# qtypeCodes in dns-proxy, so the two can't drift. Writes to the given
+# file, or stdout. Run by go generate in pkg/membrane.
+
+REPO_ROOT=$(cd "$(dirname "$0")/.." && pwd)
+SRC="$REPO_ROOT/docker/handler/dns-proxy/main.go"
+
+names=$(sed -n '/^var qtypeCodes = map\[string\]uint16{$/,/^}$/p' "$SRC" |
+    sed -n 's/^[[:space:]]*"\([A-Z0-9]*\)":.*/\1/p')
+if [ -z "$names" ]; then
+    echo "gen-qtypes: no qtypeCodes in $SRC" >&2
+    exit 1
+fi
+
+generate() {
+    echo '// Code generated by scripts/gen-qtypes.sh from qtypeCodes in'
+    echo '// docker/handler/dns-proxy/main.go. DO NOT EDIT.'
+    echo
+    echo 'package membrane'
+    echo
+    echo '// dnsQTypeNames lists the query types the dns-proxy understands.'
+    echo 'var dnsQTypeNames = []string{'
+    for n in $names; do
+        printf '\t"%s",\n' "$n"
+    done
+    echo '}'
+}
+
+if [ $# -gt 0 ]; then
+    generate >"$1"
+else
+    generate
+fi
@@ -13,12 +13,6 @@ fi
 echo "Linking ~/.membrane/src -> ${REPO_ROOT}"
 ln -sfn "$REPO_ROOT" "$MEMBRANE_SRC"
 
-echo "Building membrane-agent..."
-docker build -t membrane-agent "${REPO_ROOT}/docker/agent/"
-
-echo "Building membrane-handler..."
-docker build -t membrane-handler "${REPO_ROOT}/docker/handler/"
-
 echo "Building membrane binary..."
 go build -o "${REPO_ROOT}/membrane" "${REPO_ROOT}/cmd/membrane"
 
@@ -4,9 +4,9 @@ set -euo pipefail
 REPO_ROOT=$(git rev-parse --show-toplevel)
 MEMBRANE_CMD="$REPO_ROOT/membrane"
 
-# Warm-up: build images and membrane binary once, so parallel test runs
-# don't race on docker build.
-"$REPO_ROOT/scripts/run-dev.sh" -- echo ok
+# Link ~/.membrane/src to this checkout and build the membrane binary.
+# The first sessions build the images; the rest wait for them.
+"$REPO_ROOT/scripts/run-dev.sh" ls >/dev/null
 
 # -------------------------------------------------------
 # Helpers
@@ -93,8 +93,21 @@ in_tmpdir() {
     cd "$tmpdir"
 }
 
+# wait_session prints the ID of the session named $1 once it's running.
+wait_session() {
+    local id
+    for _ in $(seq 1 60); do
+        id=$("$MEMBRANE_CMD" ls 2>/dev/null | awk -v n="$1" '$0 ~ n && /running/ {print $1; exit}')
+        if [ -n "$id" ]; then
+            echo "$id"
+            return
+        fi
+        sleep 1
+    done
+}
+
 export MEMBRANE_CMD
-export -f run run_exit run_dns in_tmpdir dump_log
+export -f run run_exit run_dns in_tmpdir dump_log wait_session
 
 # -------------------------------------------------------
 # Test groups (each runs in its own temp dir)
@@ -327,7 +340,7 @@ readonly:
 ignore:
   - config/secrets.txt
 EOF
-    run_exit "14C ignore nested inside readonly errors at startup" "1" \
+    run_exit "14C ignore nested inside readonly errors at startup" "125" \
         "$MEMBRANE_CMD --no-trace --no-global-config -- bash -c 'echo should not run'"
 }
 
@@ -587,9 +600,647 @@ EOF
         "$MEMBRANE_CMD --no-trace --no-global-config -- bash -c \"curl -svL -m 5 https://httpbin.org/anything/root 2>&1\""
 }
 
+group_25() {
+    in_tmpdir
+    cat >.membrane.yaml <<'EOF'
+allow:
+  - github.com
+  - dest: gmail.com
+    qtypes: [MX]
+EOF
+    run_dns "25A DNS default qtype A allowed" "NOERROR" \
+        "dig github.com A"
+    run_dns "25B DNS TXT refused by default qtype policy" "REFUSED" \
+        "dig github.com TXT"
+    run_dns "25C DNS per-rule qtypes permit MX" "NOERROR" \
+        "dig gmail.com MX"
+    run_dns "25D DNS per-rule qtypes replace global list" "REFUSED" \
+        "dig gmail.com A"
+    run_exit "25E config's qtype list is generated from dns-proxy's" "0" \
+        "$REPO_ROOT/scripts/gen-qtypes.sh | cmp -s - $REPO_ROOT/pkg/membrane/qtypes.go"
+}
+
+group_26() {
+    in_tmpdir
+    IP=$(dig +short httpbin.org | head -1)
+    cat >.membrane.yaml <<EOF
+allow:
+  - dest: mock.membrane.test
+    ports: [443]
+hosts:
+  mock.membrane.test: ${IP}
+  other.membrane.test: ${IP}
+EOF
+    run_dns "26A static host answered authoritatively" "NOERROR" \
+        "dig mock.membrane.test"
+    run_exit "26B static host IP added to firewall with rule ports" "0" \
+        "$MEMBRANE_CMD --no-trace --no-global-config -- bash -c 'sleep 3 | ncat -w3 mock.membrane.test 443 </dev/null'"
+    run_exit "26C static host IP blocked on ports outside rule" "1" \
+        "$MEMBRANE_CMD --no-trace --no-global-config -- bash -c 'ncat -w3 mock.membrane.test 80 </dev/null'"
+    run_dns "26D static host without allow rule gets NXDOMAIN" "NXDOMAIN" \
+        "dig other.membrane.test"
+}
+
+group_27() {
+    in_tmpdir
+    # 192.0.2.1 (TEST-NET-1) never answers, so lookups must fail over.
+    cat >.membrane.yaml <<'EOF'
+allow:
+  - github.com
+  - example.com
+dns_routes:
+  - suffix: example.com
+    resolver:
+      - address: 192.0.2.1
+        timeout: 1s
+      - 8.8.8.8
+EOF
+    run_dns "27A DNS default resolver answers unrouted name" "NOERROR" \
+        "dig github.com"
+    run_dns "27B DNS split-horizon route fails over to next resolver" "NOERROR" \
+        "dig example.com"
+}
+
+group_28() {
+    in_tmpdir
+    : >.membrane.yaml
+    local idfile
+    idfile=$(mktemp)
+    # Add httpbin.org to the running session as soon as its handler is up.
+    (
+        for _ in $(seq 1 60); do
+            id=$(cat "$idfile" 2>/dev/null || true)
+            [ -n "$id" ] && "$MEMBRANE_CMD" allow --session "$id" httpbin.org >/dev/null 2>&1 && break
+            sleep 1
+        done
+    ) &
+    result=$("$MEMBRANE_CMD" --no-trace --no-global-config --session-id-file="$idfile" -- bash -c '
+curl -sf -m 5 https://httpbin.org/anything >/dev/null; echo "before=$?"
+for _ in $(seq 1 30); do
+    curl -sf -m 5 https://httpbin.org/anything >/dev/null && { echo after=0; exit; }
+    sleep 1
+done
+echo after=fail' 2>/dev/null | tr -d '\r' | tr '\n' ' ')
+    wait
+    rm -f "$idfile"
+    if echo "$result" | grep -q "before=6 after=0"; then
+        echo "PASS 28A allow rule added to running session ($result)"
+    else
+        echo "FAIL 28A allow rule added to running session — got: $result"
+    fi
+
+    # Concurrent changes each land: dns-proxy applies them in turn.
+    local id pids=() n
+    id=$("$MEMBRANE_CMD" -d --no-trace --no-global-config -- sleep 300 2>/dev/null)
+    "$MEMBRANE_CMD" allow --session "$id" gone.example.com >/dev/null 2>&1
+    for n in 1 2 3 4 5; do
+        "$MEMBRANE_CMD" allow --session "$id" "h$n.example.com" >/dev/null 2>&1 &
+        pids+=($!)
+    done
+    "$MEMBRANE_CMD" revoke --session "$id" gone.example.com >/dev/null 2>&1 &
+    pids+=($!)
+    wait "${pids[@]}"
+    n=$(docker exec "membrane-handler-$id" cat /run/membrane/allow.json 2>/dev/null |
+        python3 -c 'import json, sys; hosts = [r.get("host") for r in json.load(sys.stdin)]; print(sum(h.endswith(".example.com") and h != "gone.example.com" for h in hosts if h), "gone.example.com" in hosts)')
+    if [ "$n" = "5 False" ]; then
+        echo "PASS 28B concurrent allow and revoke don't lose each other's changes"
+    else
+        echo "FAIL 28B concurrent allow and revoke don't lose each other's changes — got: $n"
+        dump_log "$id"
+    fi
+    "$MEMBRANE_CMD" stop "$id" >/dev/null 2>&1
+}
+
+group_29() {
+    in_tmpdir
+    : >.membrane.yaml
+    # Approval mode needs a terminal; without one it falls back to denying.
+    result=$("$MEMBRANE_CMD" --no-trace --no-global-config --approve -- bash -c '
+curl -sf -m 5 https://httpbin.org/anything >/dev/null; echo "rc=$?"' 2>&1 | tr -d '\r' | tr '\n' ' ')
+    if echo "$result" | grep -q "approval mode needs an interactive terminal" &&
+        echo "$result" | grep -q "rc=6"; then
+        echo "PASS 29A --approve without a terminal denies as usual"
+    else
+        echo "FAIL 29A --approve without a terminal denies as usual — got: $result"
+    fi
+}
+
+group_30() {
+    in_tmpdir
+    printf 'allow:\n  - example.com\n' >.membrane.yaml
+    result=$("$MEMBRANE_CMD" learn --no-trace --no-global-config -- bash -c '
+curl -sf -m 10 -o /dev/null https://httpbin.org/anything/a/1
+curl -sf -m 10 -o /dev/null https://httpbin.org/anything/a/2
+curl -sf -m 10 -o /dev/null https://example.com/' 2>/dev/null | tr -d '\r')
+    if echo "$result" | grep -q "^+  - dest: httpbin.org" &&
+        echo "$result" | grep -q "paths: \[/anything/a\]" &&
+        ! echo "$result" | grep -q "^+.*example.com"; then
+        echo "PASS 30A learn proposes rules for new traffic only"
+    else
+        echo "FAIL 30A learn proposes rules for new traffic only — got: $result"
+    fi
+
+    "$MEMBRANE_CMD" learn --apply --no-trace --no-global-config -- \
+        curl -sf -m 10 -o /dev/null https://httpbin.org/get >/dev/null 2>&1
+    if grep -q "dest: httpbin.org" .membrane.yaml && grep -q "^  - example.com" .membrane.yaml; then
+        echo "PASS 30B learn --apply writes rules to .membrane.yaml"
+    else
+        echo "FAIL 30B learn --apply writes rules to .membrane.yaml — got: $(cat .membrane.yaml)"
+    fi
+
+    echo secret >ro.txt
+    if "$MEMBRANE_CMD" learn --no-trace --no-global-config --readonly ro.txt --arg=--env=LEARN_ARG=1 -- \
+        bash -c '[ "$LEARN_ARG" = 1 ] && ! echo x >ro.txt' >/dev/null 2>&1; then
+        echo "PASS 30C learn takes a session's --readonly and --arg"
+    else
+        echo "FAIL 30C learn takes a session's --readonly and --arg"
+    fi
+}
+
+group_31() {
+    in_tmpdir
+    id=$("$MEMBRANE_CMD" -d --no-trace --no-global-config -- sleep 300 2>/dev/null)
+    if [ -n "$id" ] && [ "$(docker inspect -f '{{.State.Running}}' "membrane-agent-$id" 2>/dev/null)" = "true" ]; then
+        echo "PASS 31A run -d leaves the agent running in the background"
+    else
+        echo "FAIL 31A run -d leaves the agent running in the background — got id: $id"
+    fi
+
+    docker stop -t 2 "membrane-agent-$id" >/dev/null 2>&1
+    for _ in $(seq 1 30); do
+        docker inspect "membrane-handler-$id" >/dev/null 2>&1 || break
+        sleep 1
+    done
+    if ! docker inspect "membrane-handler-$id" >/dev/null 2>&1 &&
+        ! docker network inspect "membrane-internal-$id" >/dev/null 2>&1; then
+        echo "PASS 31B supervisor cleans up a detached session when its agent exits"
+    else
+        echo "FAIL 31B supervisor cleans up a detached session when its agent exits"
+        dump_log "$id"
+    fi
+
+    # An interactive session, given a terminal by script(1), outlives it.
+    name="t31c-$$"
+    script -qfec "$MEMBRANE_CMD --name $name --no-trace --no-global-config -- sleep 300" /dev/null >/dev/null 2>&1 &
+    term=$!
+    id=$(wait_session "$name")
+    kill -HUP "$term" 2>/dev/null
+    sleep 3
+    if [ -n "$id" ] && [ "$(docker inspect -f '{{.State.Running}}' "membrane-agent-$id" 2>/dev/null)" = "true" ]; then
+        echo "PASS 31C an interactive session survives its terminal hanging up"
+    else
+        echo "FAIL 31C an interactive session survives its terminal hanging up — got id: $id"
+    fi
+    "$MEMBRANE_CMD" stop "$id" >/dev/null 2>&1
+
+    # SIGTERM to the foreground membrane stops the session, as it always has.
+    name="t31d-$$"
+    script -qfec "$MEMBRANE_CMD --name $name --no-trace --no-global-config -- sleep 300" /dev/null >/dev/null 2>&1 &
+    term=$!
+    id=$(wait_session "$name")
+    pkill -TERM -f "^$MEMBRANE_CMD --name $name " 2>/dev/null
+    wait "$term" 2>/dev/null
+    if [ -n "$id" ] && ! docker inspect "membrane-handler-$id" >/dev/null 2>&1; then
+        echo "PASS 31D SIGTERM to an interactive membrane stops its session"
+    else
+        echo "FAIL 31D SIGTERM to an interactive membrane stops its session — got id: $id"
+        "$MEMBRANE_CMD" stop "$id" >/dev/null 2>&1
+    fi
+}
+
+group_32() {
+    in_tmpdir
+    name="t32-$$"
+    id=$("$MEMBRANE_CMD" -d --name "$name" --no-trace --no-global-config -- sleep 300 2>/dev/null)
+    if "$MEMBRANE_CMD" ls | grep "^$id " | grep -q "$name.*running"; then
+        echo "PASS 32A ls lists a running session by ID and name"
+    else
+        echo "FAIL 32A ls lists a running session by ID and name — got: $("$MEMBRANE_CMD" ls)"
+    fi
+
+    if "$MEMBRANE_CMD" inspect "$name" | grep -q "\"agent\": \"membrane-agent-$id\""; then
+        echo "PASS 32B inspect resolves a session name to its record"
+    else
+        echo "FAIL 32B inspect resolves a session name to its record"
+    fi
+
+    "$MEMBRANE_CMD" stop "$name" 2>/dev/null
+    if ! docker inspect "membrane-handler-$id" >/dev/null 2>&1 &&
+        "$MEMBRANE_CMD" ls -a | grep "^$id " | grep -q "exited"; then
+        echo "PASS 32C stop ends the session and records it as exited"
+    else
+        echo "FAIL 32C stop ends the session and records it as exited — got: $("$MEMBRANE_CMD" ls -a | grep "^$id ")"
+        dump_log "$id"
+    fi
+}
+
+group_33() {
+    in_tmpdir
+    id=$("$MEMBRANE_CMD" -d --no-trace --no-global-config -- sleep 300 2>/dev/null)
+    result=$("$MEMBRANE_CMD" exec "$id" -- bash -c 'echo "$(id -un) $(pwd)"; capsh --has-p=cap_net_admin 2>/dev/null && echo net_admin' </dev/null | tr -d '\r')
+    if [ "$result" = "agent /workspace" ]; then
+        echo "PASS 33A exec runs as agent in /workspace without NET_ADMIN"
+    else
+        echo "FAIL 33A exec runs as agent in /workspace without NET_ADMIN — got: $result"
+    fi
+
+    "$MEMBRANE_CMD" exec "$id" -- bash -c 'exit 7' </dev/null
+    rc=$?
+    if [ "$rc" -eq 7 ]; then
+        echo "PASS 33B exec passes through the command's exit code"
+    else
+        echo "FAIL 33B exec passes through the command's exit code — got: $rc"
+    fi
+    "$MEMBRANE_CMD" stop "$id" 2>/dev/null
+}
+
+group_34() {
+    in_tmpdir
+    dead=$(openssl rand -hex 8)
+    docker network create --label "membrane.session=$dead" "membrane-internal-$dead" >/dev/null
+    docker volume create --label "membrane.session=$dead" "membrane-ca-$dead" >/dev/null
+    id=$("$MEMBRANE_CMD" -d --no-trace --no-global-config -- sleep 300 2>/dev/null)
+
+    "$MEMBRANE_CMD" gc 2>/dev/null
+    if ! docker network inspect "membrane-internal-$dead" >/dev/null 2>&1 &&
+        ! docker volume inspect "membrane-ca-$dead" >/dev/null 2>&1; then
+        echo "PASS 34A gc removes resources of sessions that are gone"
+    else
+        echo "FAIL 34A gc removes resources of sessions that are gone"
+    fi
+    if docker network inspect "membrane-internal-$id" >/dev/null 2>&1 &&
+        [ "$(docker inspect -f '{{.State.Running}}' "membrane-agent-$id" 2>/dev/null)" = "true" ]; then
+        echo "PASS 34B gc leaves running sessions alone"
+    else
+        echo "FAIL 34B gc leaves running sessions alone"
+    fi
+    "$MEMBRANE_CMD" stop "$id" 2>/dev/null
+}
+
+group_35() {
+    in_tmpdir
+    if ! command -v podman >/dev/null 2>&1; then
+        echo "SKIP 35 podman not installed"
+        return
+    fi
+    export MEMBRANE_ENGINE=podman
+    cat >.membrane.yaml <<'EOF'
+allow:
+  - httpbin.org
+EOF
+    run "35A podman: allowed host passthrough" "200" \
+        "$MEMBRANE_CMD --no-trace --no-global-config -- bash -c \"curl -svL -m 5 https://httpbin.org/anything/root 2>&1\""
+    run_exit "35B podman: host not in allow list fails" "6" \
+        "$MEMBRANE_CMD --no-trace --no-global-config -- bash -c \"curl -sf -m 5 https://example.com\""
+    run_exit "35C podman: agent can write the workspace" "0" \
+        "$MEMBRANE_CMD --no-trace --no-global-config -- touch written"
+    if podman network ls --format '{{.Name}}' | grep -q '^membrane-'; then
+        echo "FAIL 35D podman: session networks removed"
+    else
+        echo "PASS 35D podman: session networks removed"
+    fi
+}
+
+group_36() {
+    in_tmpdir
+    cat >.membrane.yaml <<'EOF'
+limits:
+  memory: 64m
+  memory_swap: 64m
+  pids: 64
+EOF
+    run_exit "36A memory limit kills the agent" "137" \
+        "$MEMBRANE_CMD --no-trace --no-global-config -- bash -c \"head -c 512m /dev/zero | tail\""
+    if "$MEMBRANE_CMD" --no-trace --no-global-config -- bash -c "head -c 512m /dev/zero | tail" 2>&1 |
+        grep -q "ran out of memory"; then
+        echo "PASS 36B out-of-memory exit is explained"
+    else
+        echo "FAIL 36B out-of-memory exit is explained"
+    fi
+    run_exit "36C pid limit applied" "0" \
+        "$MEMBRANE_CMD --no-trace --no-global-config -- bash -c \"[ \\\$(cat /sys/fs/cgroup/pids.max) = 64 ]\""
+}
+
+group_37() {
+    in_tmpdir
+    run_exit "37A --timeout stops the agent" "124" \
+        "$MEMBRANE_CMD --no-trace --timeout 5s -- sleep 60"
+    run_exit "37B --idle-timeout stops a silent agent" "124" \
+        "$MEMBRANE_CMD --no-trace --idle-timeout 5s -- sleep 60"
+    run_exit "37C output keeps the agent active" "0" \
+        "$MEMBRANE_CMD --no-trace --idle-timeout 5s -- bash -c \"for i in 1 2 3 4 5 6 7 8; do echo \\\$i; sleep 2; done\""
+    if "$MEMBRANE_CMD" --no-trace --idle-timeout 5s -- sleep 60 2>&1 | grep -q "without activity (--idle-timeout)"; then
+        echo "PASS 37D idle timeout is explained"
+    else
+        echo "FAIL 37D idle timeout is explained"
+    fi
+    run_exit "37E traced run times out too" "124" \
+        "$MEMBRANE_CMD --timeout 5s -- sleep 60"
+    run_exit "37F --timeout-exit-code moves the timeout code" "200" \
+        "$MEMBRANE_CMD --no-trace --timeout 5s --timeout-exit-code 200 -- sleep 60"
+}
+
+group_38() {
+    in_tmpdir
+    local summary
+    summary=$(mktemp)
+    "$MEMBRANE_CMD" --no-trace --no-global-config --summary-json "$summary" \
+        -- bash -c "curl -s -m 5 https://example.com; exit 3" >/dev/null 2>&1
+    if python3 -c 'import json,sys; s=json.load(open(sys.argv[1])); sys.exit(not (s["exit_code"] == 3 and s["failed_by"] == "agent" and s["dns"]["blocked"] > 0))' "$summary"; then
+        echo "PASS 38A summary records the agent's exit and blocked DNS"
+    else
+        echo "FAIL 38A summary records the agent's exit and blocked DNS"
+    fi
+    if python3 -c 'import json,sys; s=json.load(open(sys.argv[1])); sys.exit(not (s["top_blocked"][0]["destination"] == "example.com" and s["phases"]["agent_seconds"] > 0))' "$summary"; then
+        echo "PASS 38B summary lists blocked destinations and phases"
+    else
+        echo "FAIL 38B summary lists blocked destinations and phases"
+    fi
+    echo 'readonly: [' >.membrane.yaml
+    run_exit "38C membrane failures exit 125" "125" \
+        "$MEMBRANE_CMD --no-trace --no-global-config --summary-json $summary -- true"
+    if python3 -c 'import json,sys; s=json.load(open(sys.argv[1])); sys.exit(not (s["failed_by"] == "membrane" and s["exit_code"] == 125))' "$summary"; then
+        echo "PASS 38D summary records membrane failures"
+    else
+        echo "FAIL 38D summary records membrane failures"
+    fi
+    run_exit "38E --failure-exit-code moves the failure code" "3" \
+        "$MEMBRANE_CMD --no-trace --no-global-config --failure-exit-code 3 --summary-json $summary -- true"
+    if python3 -c 'import json,sys; s=json.load(open(sys.argv[1])); sys.exit(not (s["failed_by"] == "membrane" and s["exit_code"] == 3))' "$summary"; then
+        echo "PASS 38F summary records the moved failure code"
+    else
+        echo "FAIL 38F summary records the moved failure code"
+    fi
+    rm -f .membrane.yaml
+    if "$MEMBRANE_CMD" --no-trace --no-global-config -- bash -c "exit 125" 2>&1 | grep -q "the agent itself exited with code 125"; then
+        echo "PASS 38G an agent exiting with membrane's code is warned about"
+    else
+        echo "FAIL 38G an agent exiting with membrane's code is warned about"
+    fi
+    "$MEMBRANE_CMD" --no-trace --no-global-config --timeout 5s --summary-json "$summary" -- sleep 60 >/dev/null 2>&1
+    if python3 -c 'import json,sys; s=json.load(open(sys.argv[1])); sys.exit(not (s["failed_by"] == "membrane" and s["exit_code"] == 124 and s["timed_out"]))' "$summary"; then
+        echo "PASS 38H summary attributes a timeout to membrane"
+    else
+        echo "FAIL 38H summary attributes a timeout to membrane"
+    fi
+    rm -f "$summary"
+    local id
+    id=$("$MEMBRANE_CMD" -d --no-trace --no-global-config --idle-timeout 5s --summary-json "$summary" -- sleep 300 2>/dev/null)
+    for _ in $(seq 1 60); do
+        [ -s "$summary" ] && break
+        sleep 1
+    done
+    sleep 1
+    if python3 -c 'import json,sys; s=json.load(open(sys.argv[1])); sys.exit(not (s["failed_by"] == "membrane" and s["exit_code"] == 124 and s["idle_timed_out"]))' "$summary" 2>/dev/null; then
+        echo "PASS 38I summary records a detached session's idle timeout"
+    else
+        echo "FAIL 38I summary records a detached session's idle timeout"
+        dump_log "$id"
+    fi
+    rm -f "$summary"
+}
+
+group_39() {
+    in_tmpdir
+    echo 'home: workspace' >.membrane.yaml
+    run_exit "39A workspace home keeps files between sessions" "0" \
+        "$MEMBRANE_CMD --no-trace --no-global-config -- bash -c 'echo \$PWD >~/.membrane-test-39'"
+    run_exit "39B workspace home sees the earlier session's file" "0" \
+        "$MEMBRANE_CMD --no-trace --no-global-config -- bash -c '[ -f ~/.membrane-test-39 ]'"
+    mkdir other && cd other
+    echo 'home: workspace' >.membrane.yaml
+    run_exit "39C workspace homes aren't shared between workspaces" "1" \
+        "$MEMBRANE_CMD --no-trace --no-global-config -- bash -c '[ -f ~/.membrane-test-39 ]'"
+    echo 'home: ephemeral' >.membrane.yaml
+    run_exit "39D ephemeral home is writable" "0" \
+        "$MEMBRANE_CMD --no-trace --no-global-config -- bash -c 'touch ~/.membrane-test-39'"
+    run_exit "39E ephemeral homes are discarded" "1" \
+        "$MEMBRANE_CMD --no-trace --no-global-config -- bash -c '[ -f ~/.membrane-test-39 ]'"
+    local tmpl
+    tmpl=$(mktemp -d)
+    mkdir -p "$tmpl/.config/gh"
+    echo old >"$tmpl/.config/gh/hosts.yml"
+    printf 'home:\n  mode: ephemeral\n  persist: true\n  template: %s\n  seed: [.config/gh]\n' "$tmpl" >.membrane.yaml
+    if "$MEMBRANE_CMD" --no-trace --no-global-config -- bash -c 'mkdir -p /tmp/elsewhere/gh && echo new >/tmp/elsewhere/gh/hosts.yml && rm -rf ~/.config && ln -s /tmp/elsewhere ~/.config' 2>&1 | grep -q "is a symlink" &&
+        [ "$(cat "$tmpl/.config/gh/hosts.yml")" = old ]; then
+        echo "PASS 39F persist won't copy through a symlink the agent made"
+    else
+        echo "FAIL 39F persist won't copy through a symlink the agent made"
+    fi
+    rm -rf "$tmpl"
+}
+
+group_40() {
+    in_tmpdir
+    echo old >file.txt
+    echo secret >.env
+    printf 'ignore: [.env]\n' >.membrane.yaml
+    local idfile id
+    idfile=$(mktemp)
+    if "$MEMBRANE_CMD" --no-trace --no-global-config --cow --session-id-file="$idfile" \
+        -- bash -c 'echo new >file.txt && touch added.txt' >/dev/null 2>&1; then
+        echo "PASS 40A agent can change a copy-on-write workspace"
+    else
+        echo "FAIL 40A agent can change a copy-on-write workspace"
+    fi
+    id=$(cat "$idfile")
+    rm -f "$idfile"
+    run_exit "40B the workspace is unchanged until review" "0" \
+        "[ \"\$(cat file.txt)\" = old ] && [ ! -e added.txt ]"
+    run_exit "40C ignored paths stay hidden in the overlay" "1" \
+        "$MEMBRANE_CMD --no-trace --no-global-config --cow -- bash -c '[ -s .env ]'"
+    run_exit "40D review without a terminal keeps the changes" "0" \
+        "$MEMBRANE_CMD review $id </dev/null && [ -d ~/.membrane/overlays/$id/upper ]"
+    mkdir sub && touch sub/a sub/b
+    if "$MEMBRANE_CMD" --no-trace --no-global-config --cow \
+        -- bash -c 'rm -rf sub && mkdir sub && touch sub/c' </dev/null 2>&1 | grep -q "agent's 3 workspace changes"; then
+        echo "PASS 40E a replaced directory's old entries count as deleted"
+    else
+        echo "FAIL 40E a replaced directory's old entries count as deleted"
+    fi
+}
+
+group_41() {
+    in_tmpdir
+    git init -q
+    git -c user.email=test@example.com -c user.name=test commit -q --allow-empty -m init
+    echo secret >.env
+    run_exit "41A agent works in its own worktree" "0" \
+        "$MEMBRANE_CMD --no-trace --no-global-config --worktree=test-41 -- bash -c 'touch new.txt && git add new.txt && git -c user.email=agent@example.com -c user.name=agent commit -q -m new'"
+    run_exit "41B the agent's commit is on its branch" "0" \
+        "git cat-file -e test-41:new.txt && [ ! -e new.txt ]"
+    local gitdir
+    gitdir=$(git rev-parse --path-format=absolute --git-common-dir)
+    run_exit "41C the repository's .git isn't mounted" "1" \
+        "$MEMBRANE_CMD --no-trace --no-global-config --worktree -- bash -c '[ -e $gitdir/hooks ]'"
+    run_exit "41D untouched worktree branches are removed" "1" \
+        "git branch --list 'membrane/*' | grep -q ."
+    local main branch
+    main=$(git rev-parse HEAD)
+    branch=$(git symbolic-ref --short HEAD)
+    run_exit "41E the agent can't move other branches" "0" \
+        "$MEMBRANE_CMD --no-trace --no-global-config --worktree=test-41e -- bash -c 'git -c user.email=agent@example.com -c user.name=agent commit -q --allow-empty -m x && git update-ref refs/heads/$branch HEAD' && [ \"\$(git rev-parse $branch)\" = $main ] && [ \"\$(git rev-parse test-41e)\" != $main ]"
+    run_exit "41F --worktree takes its branch after =" "125" \
+        "$MEMBRANE_CMD --no-trace --no-global-config --worktree test-41f -- true"
+    git worktree list --porcelain | awk '/^worktree /{print $2}' | tail -n +2 | xargs -r -n1 git worktree remove -f -f
+}
+
+group_42() {
+    in_tmpdir
+    git init -q
+    git -c user.email=test@example.com -c user.name=test commit -q --allow-empty -m init
+    local idfile id
+    idfile=$(mktemp)
+    if "$MEMBRANE_CMD" --no-trace --no-global-config --mediate-git --session-id-file="$idfile" \
+        -- bash -c 'touch new.txt && git add new.txt && git -c user.email=agent@example.com -c user.name=agent commit -q -m new' >/dev/null 2>&1; then
+        echo "PASS 42A agent can commit with mediate_git"
+    else
+        echo "FAIL 42A agent can commit with mediate_git"
+    fi
+    id=$(cat "$idfile")
+    rm -f "$idfile"
+    run_exit "42B the repository is unchanged until import" "0" \
+        "[ \"\$(git rev-list --count --all)\" = 1 ]"
+    run_exit "42C import puts the commit on a branch" "0" \
+        "$MEMBRANE_CMD import $id test-42 && git cat-file -e test-42:new.txt"
+    idfile=$(mktemp)
+    "$MEMBRANE_CMD" --no-trace --no-global-config --mediate-git --readonly .env --session-id-file="$idfile" \
+        -- bash -c 'git update-index --add --cacheinfo "100644,$(echo x | git hash-object -w --stdin),.env" && git -c user.email=agent@example.com -c user.name=agent commit -q -m env' >/dev/null 2>&1
+    id=$(cat "$idfile")
+    rm -f "$idfile"
+    run_exit "42D commits to readonly paths aren't imported" "125" \
+        "$MEMBRANE_CMD import $id test-42d"
+}
+
+group_43() {
+    in_tmpdir
+    local id resumed result
+    id=$("$MEMBRANE_CMD" -d --no-trace --no-global-config --allow example.org -- sleep 300 2>/dev/null)
+    "$MEMBRANE_CMD" exec "$id" -- bash -c 'echo kept >/tmp/marker' </dev/null
+    run_exit "43A checkpoint a running session" "0" \
+        "$MEMBRANE_CMD checkpoint $id"
+    "$MEMBRANE_CMD" stop "$id" >/dev/null 2>&1
+    resumed=$("$MEMBRANE_CMD" resume -d "$id" 2>/dev/null)
+    result=$("$MEMBRANE_CMD" exec "$resumed" -- cat /tmp/marker </dev/null | tr -d '\r')
+    if [ "$result" = "kept" ]; then
+        echo "PASS 43B resume restores the agent's filesystem"
+    else
+        echo "FAIL 43B resume restores the agent's filesystem — got: $result"
+    fi
+    if "$MEMBRANE_CMD" exec "$resumed" -- curl -sf -m 10 -o /dev/null https://example.org/ </dev/null; then
+        echo "PASS 43C resume restores the session's allow rules"
+    else
+        echo "FAIL 43C resume restores the session's allow rules"
+    fi
+    "$MEMBRANE_CMD" stop "$resumed" >/dev/null 2>&1
+    run_exit "43D checkpoint --rm removes the checkpoint" "0" \
+        "$MEMBRANE_CMD checkpoint --rm $id && [ ! -d ~/.membrane/checkpoints/$id ]"
+    printf 'args: [-e, MEMBRANE_TEST_43=started]\n' >.membrane.yaml
+    id=$("$MEMBRANE_CMD" -d --no-trace --no-global-config -- sleep 300 2>/dev/null)
+    printf 'args: [-e, MEMBRANE_TEST_43=edited]\n' >.membrane.yaml
+    "$MEMBRANE_CMD" checkpoint "$id" >/dev/null 2>&1
+    "$MEMBRANE_CMD" stop "$id" >/dev/null 2>&1
+    resumed=$("$MEMBRANE_CMD" resume -d "$id" 2>/dev/null)
+    result=$("$MEMBRANE_CMD" exec "$resumed" -- printenv MEMBRANE_TEST_43 </dev/null | tr -d '\r')
+    if [ "$result" = "started" ]; then
+        echo "PASS 43E resume uses the config the session started with"
+    else
+        echo "FAIL 43E resume uses the config the session started with — got: $result"
+    fi
+    "$MEMBRANE_CMD" stop "$resumed" >/dev/null 2>&1
+    "$MEMBRANE_CMD" checkpoint --rm "$id" >/dev/null 2>&1
+}
+
+group_44() {
+    in_tmpdir
+    printf 'FROM membrane-agent\nRUN touch /opt/custom\n' >Dockerfile
+    echo 'build: Dockerfile' >.membrane.yaml
+    run_exit "44A build: runs the agent in the built image" "0" \
+        "$MEMBRANE_CMD --no-trace --no-global-config -- test -f /opt/custom"
+    echo 'image: ubuntu:22.04' >.membrane.yaml
+    run_exit "44B an image without membrane's entrypoint is refused" "125" \
+        "$MEMBRANE_CMD --no-trace --no-global-config -- true"
+    printf 'FROM membrane-agent\nRUN rm "$(command -v capsh)"\n' >Dockerfile
+    echo 'build: Dockerfile' >.membrane.yaml
+    run_exit "44C an image missing capsh is refused" "125" \
+        "$MEMBRANE_CMD --no-trace --no-global-config -- true"
+}
+
+group_45() {
+    in_tmpdir
+    local tags
+    "$MEMBRANE_CMD" --no-trace --no-global-config -- true >/dev/null 2>&1
+    tags=$(docker image ls --format '{{.Tag}}' membrane-handler | grep -cE '^[0-9a-f]{12}$')
+    if [ "$tags" -ge 1 ] && [ "$tags" -le 4 ]; then
+        echo "PASS 45A images are tagged by content hash, with bounded old tags ($tags)"
+    else
+        echo "FAIL 45A images are tagged by content hash, with bounded old tags — got $tags tags"
+    fi
+    run_exit "45B latest follows a content-hash tag" "0" \
+        "docker image ls --format '{{.Tag}} {{.ID}}' membrane-handler | grep -E '^[0-9a-f]{12} ' | grep -q \"\$(docker image ls --format '{{.ID}}' membrane-handler:latest)\""
+}
+
+group_46() {
+    in_tmpdir
+    local a b
+    "$MEMBRANE_CMD" --no-trace --no-global-config -- true >/dev/null 2>&1 &
+    a=$!
+    "$MEMBRANE_CMD" --no-trace --no-global-config -- true >/dev/null 2>&1 &
+    b=$!
+    if wait "$a" && wait "$b"; then
+        echo "PASS 46A concurrent sessions share setup without racing"
+    else
+        echo "FAIL 46A concurrent sessions share setup without racing"
+    fi
+}
+
+group_47() {
+    in_tmpdir
+    run_exit "47A images export bundles the images and source" "0" \
+        "$MEMBRANE_CMD images export images.tar.gz && tar -tzf images.tar.gz | grep -qx images.tar"
+    run_exit "47B images import loads an export" "0" \
+        "$MEMBRANE_CMD images import images.tar.gz"
+    run_exit "47C a session starts offline" "0" \
+        "$MEMBRANE_CMD --offline --no-trace --no-global-config -- true"
+}
+
+group_48() {
+    in_tmpdir
+    # run-dev.sh links ~/.membrane/src to this working copy.
+    run_exit "48A update leaves a linked working copy alone" "125" \
+        "$MEMBRANE_CMD update --check"
+
+    # A membrane-managed clone, under a HOME of its own, whose origin is
+    # a copy of this repo with release tags.
+    local home="$PWD/home" src="$PWD/home/.membrane/src"
+    git clone --quiet --bare "$REPO_ROOT" origin.git
+    git -C origin.git tag v0.0.1 HEAD~3
+    git -C origin.git tag v0.0.2 HEAD~2
+    git -C origin.git tag v0.0.3 HEAD~1
+    git -C origin.git tag v0.0.4-rc1 HEAD
+    mkdir -p "$home/.membrane"
+    git clone --quiet origin.git "$src"
+    git -C "$src" checkout --quiet --detach v0.0.1
+    at() { [ "$(git -C "$src" rev-parse HEAD)" = "$(git -C "$src" rev-parse "$1^{commit}")" ]; }
+
+    echo 'update: v0.0.2' >"$home/.membrane/config.yaml"
+    run_exit "48B update lists what a pin brings in without moving" "0" \
+        "HOME=$home $MEMBRANE_CMD update --check | grep -qx '1 commit to bring in:' && at v0.0.1"
+    run_exit "48C --check and --apply can't be combined" "125" \
+        "HOME=$home $MEMBRANE_CMD update --check --apply"
+    run_exit "48D update --apply checks out the pin" "0" \
+        "HOME=$home $MEMBRANE_CMD update --apply && at v0.0.2"
+    echo 'update: release' >"$home/.membrane/config.yaml"
+    run_exit "48E the release channel skips pre-releases" "0" \
+        "HOME=$home $MEMBRANE_CMD update --apply && at v0.0.3"
+    echo 'update: v0.0.1' >"$home/.membrane/config.yaml"
+    run_exit "48F update lists what pinning an older release takes out" "0" \
+        "HOME=$home $MEMBRANE_CMD update | grep -qx '2 commits to take out:' && at v0.0.3"
+}
+
 export -f group_1 group_2 group_3 group_4 group_5 group_6 group_7 group_8 \
     group_9 group_10 group_11 group_12 group_13 group_14 group_15 group_16 group_17 \
-    group_18 group_19 group_20 group_21 group_22 group_23 group_24
+    group_18 group_19 group_20 group_21 group_22 group_23 group_24 group_25 group_26 group_27 group_28 group_29 group_30 group_31 group_32 group_33 group_34 group_35 group_36 group_37 group_38 group_39 group_40 group_41 group_42 group_43 group_44 group_45 group_46 group_47 group_48
 
 # -------------------------------------------------------
 # Run specified groups, or all if none given
@@ -598,7 +1249,7 @@ if [ $# -eq 0 ]; then
     groups=(group_1 group_2 group_3 group_4 group_5 group_6 group_7 group_8
         group_9 group_10 group_11 group_12 group_13 group_14 group_15 group_16
         group_17 group_18 group_19 group_20 group_21 group_22 group_23
-        group_24)
+        group_24 group_25 group_26 group_27 group_28 group_29 group_30 group_31 group_32 group_33 group_34 group_35 group_36 group_37 group_38 group_39 group_40 group_41 group_42 group_43 group_44 group_45 group_46 group_47 group_48)
 else
     groups=()
     for n in "$@"; do